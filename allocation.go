@@ -0,0 +1,656 @@
+package stunner
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/l7mp/stunner/internal/telemetry"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// Allocation describes an active TURN allocation.
+type Allocation struct {
+	// Listener is the name of the listener the allocation was created at.
+	Listener string
+	// Protocol is the transport protocol between the client and the listener.
+	Protocol string
+	// Transport is the transport protocol of the relay, either "udp" or "tcp".
+	Transport string
+	// Username is the username the allocation was authenticated with.
+	Username string
+	// ClientAddr is the transport address of the client.
+	ClientAddr net.Addr
+	// ServerAddr is the transport address of the listener.
+	ServerAddr net.Addr
+	// RelayAddr is the relayed transport address of the allocation.
+	RelayAddr net.Addr
+	// Created is the creation time of the allocation.
+	Created time.Time
+
+	trace       trace.SpanContext
+	stats       *allocationStats
+	permissions map[string]time.Time // peer IP -> expiry
+	channels    map[uint16]channelBinding
+}
+
+// channelBinding is a channel bound to a peer.
+type channelBinding struct {
+	peer    string
+	expires time.Time
+}
+
+// allocationStats counts the traffic relayed by an allocation.
+type allocationStats struct {
+	rxBytes, rxPackets, txBytes, txPackets atomic.Uint64
+}
+
+// rx counts n bytes received from a peer.
+func (s *allocationStats) rx(n int) {
+	if s == nil {
+		return
+	}
+	s.rxBytes.Add(uint64(n))
+	s.rxPackets.Add(1)
+}
+
+// tx counts n bytes sent to a peer.
+func (s *allocationStats) tx(n int) {
+	if s == nil {
+		return
+	}
+	s.txBytes.Add(uint64(n))
+	s.txPackets.Add(1)
+}
+
+// status returns the status of the allocation.
+func (a *Allocation) status(now time.Time) *stnrv1.AllocationStatus {
+	s := &stnrv1.AllocationStatus{
+		Listener:      a.Listener,
+		Protocol:      a.Protocol,
+		ClientAddr:    addrString(a.ClientAddr),
+		ServerAddr:    addrString(a.ServerAddr),
+		RelayProtocol: a.Transport,
+		RelayAddr:     addrString(a.RelayAddr),
+		Username:      a.Username,
+		Permissions:   []string{},
+		Channels:      []stnrv1.ChannelStatus{},
+		Created:       a.Created,
+		Age:           int64(now.Sub(a.Created) / time.Second),
+	}
+
+	for peer, exp := range a.permissions {
+		if now.Before(exp) {
+			s.Permissions = append(s.Permissions, peer)
+		}
+	}
+	sort.Strings(s.Permissions)
+
+	for n, c := range a.channels {
+		if now.Before(c.expires) {
+			s.Channels = append(s.Channels, stnrv1.ChannelStatus{Number: n, Peer: c.peer})
+		}
+	}
+	sort.Slice(s.Channels, func(i, j int) bool { return s.Channels[i].Number < s.Channels[j].Number })
+
+	if a.stats != nil {
+		s.RxBytes, s.RxPackets = a.stats.rxBytes.Load(), a.stats.rxPackets.Load()
+		s.TxBytes, s.TxPackets = a.stats.txBytes.Load(), a.stats.txPackets.Load()
+	}
+
+	return s
+}
+
+// Access log events.
+const (
+	accessLogEventCreate = "create"
+	accessLogEventDelete = "delete"
+)
+
+// accessLogRecord is the access log record of an allocation event.
+type accessLogRecord struct {
+	Time          time.Time              `json:"time"`
+	Event         string                 `json:"event"`
+	Listener      string                 `json:"listener"`
+	Protocol      string                 `json:"protocol"`
+	ClientAddr    string                 `json:"client_address"`
+	ServerAddr    string                 `json:"server_address"`
+	RelayProtocol string                 `json:"relay_protocol"`
+	RelayAddr     string                 `json:"relay_address"`
+	Username      string                 `json:"username"`
+	Created       time.Time              `json:"created"`
+	Duration      float64                `json:"duration,omitempty"`
+	Peers         []string               `json:"peers,omitempty"`
+	Channels      []stnrv1.ChannelStatus `json:"channels,omitempty"`
+	RxBytes       uint64                 `json:"rx_bytes"`
+	RxPackets     uint64                 `json:"rx_packets"`
+	TxBytes       uint64                 `json:"tx_bytes"`
+	TxPackets     uint64                 `json:"tx_packets"`
+}
+
+// accessLogRecord returns the access log record of an allocation event. Unlike the status, the
+// record lists all the peers the client has ever installed a permission for and all the channels
+// ever bound by the client.
+func (a *Allocation) accessLogRecord(event string, now time.Time) *accessLogRecord {
+	r := &accessLogRecord{
+		Time:          now,
+		Event:         event,
+		Listener:      a.Listener,
+		Protocol:      a.Protocol,
+		ClientAddr:    addrString(a.ClientAddr),
+		ServerAddr:    addrString(a.ServerAddr),
+		RelayProtocol: a.Transport,
+		RelayAddr:     addrString(a.RelayAddr),
+		Username:      a.Username,
+		Created:       a.Created,
+	}
+
+	if event == accessLogEventDelete {
+		r.Duration = now.Sub(a.Created).Seconds()
+	}
+
+	for peer := range a.permissions {
+		r.Peers = append(r.Peers, peer)
+	}
+	sort.Strings(r.Peers)
+
+	for n, c := range a.channels {
+		r.Channels = append(r.Channels, stnrv1.ChannelStatus{Number: n, Peer: c.peer})
+	}
+	sort.Slice(r.Channels, func(i, j int) bool { return r.Channels[i].Number < r.Channels[j].Number })
+
+	if a.stats != nil {
+		r.RxBytes, r.RxPackets = a.stats.rxBytes.Load(), a.stats.rxPackets.Load()
+		r.TxBytes, r.TxPackets = a.stats.txBytes.Load(), a.stats.txPackets.Load()
+	}
+
+	return r
+}
+
+// relayKey identifies an allocation by the relay port of the listener.
+type relayKey struct {
+	listener, transport string
+	port                int
+}
+
+// allocationTable tracks the active allocations of all listeners and keeps per-user, per-client
+// and per-listener allocation counts for enforcing allocation quotas. The TURN server does not
+// report allocation events, so allocations are added when the success response to the Allocate
+// request is sent to the client and removed when the relay port is closed. The quotas are checked
+// when the allocation is added, allocations exceeding a quota are rejected by closing the relay.
+// The table also holds the administrative blocks on new allocations and writes the allocation
+// events into the access log.
+type allocationTable struct {
+	allocs    map[relayKey]*Allocation
+	stats     map[relayKey]*allocationStats
+	closers   map[relayKey]func()
+	blocks    []allocationBlock
+	byClient  map[string]relayKey
+	users     map[string]int
+	clients   map[string]int
+	listeners map[string]int
+	quota     func() (user, client int)
+	accessLog func() *telemetry.AccessLog
+	lock      sync.RWMutex
+}
+
+func newAllocationTable(quota func() (user, client int), accessLog func() *telemetry.AccessLog) *allocationTable {
+	return &allocationTable{
+		allocs:    map[relayKey]*Allocation{},
+		stats:     map[relayKey]*allocationStats{},
+		closers:   map[relayKey]func(){},
+		byClient:  map[string]relayKey{},
+		users:     map[string]int{},
+		clients:   map[string]int{},
+		listeners: map[string]int{},
+		quota:     quota,
+		accessLog: accessLog,
+	}
+}
+
+// audit writes an allocation event into the access log, if enabled.
+func (t *allocationTable) audit(event string, a *Allocation) {
+	if t == nil || t.accessLog == nil {
+		return
+	}
+
+	l := t.accessLog()
+	if l == nil {
+		return
+	}
+
+	t.lock.RLock()
+	r := a.accessLogRecord(event, time.Now())
+	t.lock.RUnlock()
+
+	l.Write(r)
+}
+
+// add registers a new allocation unless the allocation would exceed any of the allocation quotas.
+// The quotas are checked and the allocation counts are updated atomically so that concurrent
+// allocations cannot exceed the quotas. Returns true if the allocation was added, otherwise the
+// name of the quota ("user", "client" or "listener") that would be exceeded, or an empty string if
+// the allocation is already registered.
+func (t *allocationTable) add(a *Allocation, port, listenerQuota int) (bool, string) {
+	if t == nil {
+		return false, ""
+	}
+
+	key := relayKey{listener: a.Listener, transport: a.Transport, port: port}
+
+	userQuota, clientQuota := 0, 0
+	if t.quota != nil {
+		userQuota, clientQuota = t.quota()
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.allocs[key]; ok {
+		return false, ""
+	}
+
+	switch {
+	case userQuota > 0 && t.users[a.Username] >= userQuota:
+		return false, "user"
+	case clientQuota > 0 && t.clients[getIPString(a.ClientAddr)] >= clientQuota:
+		return false, "client"
+	case listenerQuota > 0 && t.listeners[a.Listener] >= listenerQuota:
+		return false, "listener"
+	}
+
+	a.stats = t.getStats(key)
+	a.permissions = map[string]time.Time{}
+	a.channels = map[uint16]channelBinding{}
+	t.allocs[key] = a
+	t.byClient[clientKey(a.Listener, a.ClientAddr)] = key
+	t.users[a.Username]++
+	t.clients[getIPString(a.ClientAddr)]++
+	t.listeners[a.Listener]++
+
+	return true, ""
+}
+
+// remove deletes the allocation registered for a relay port and returns the deleted allocation,
+// or nil if no allocation was registered for the relay port.
+func (t *allocationTable) remove(listener, transport string, port int) *Allocation {
+	if t == nil {
+		return nil
+	}
+
+	key := relayKey{listener: listener, transport: transport, port: port}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.stats, key)
+	delete(t.closers, key)
+
+	a, ok := t.allocs[key]
+	if !ok {
+		return nil
+	}
+
+	delete(t.allocs, key)
+	ck := clientKey(a.Listener, a.ClientAddr)
+	if t.byClient[ck] == key {
+		delete(t.byClient, ck)
+	}
+	decrement(t.users, a.Username)
+	decrement(t.clients, getIPString(a.ClientAddr))
+	decrement(t.listeners, a.Listener)
+
+	return a
+}
+
+// addRelay registers a new relay port with a callback that closes the relay, and returns the
+// traffic counters of the allocation using the relay port. The relay is registered before the
+// allocation is added to the table.
+func (t *allocationTable) addRelay(listener, transport string, port int, close func()) *allocationStats {
+	if t == nil {
+		return nil
+	}
+
+	key := relayKey{listener: listener, transport: transport, port: port}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.closers[key] = close
+	return t.getStats(key)
+}
+
+// closeRelay closes a relay registered with addRelay.
+func (t *allocationTable) closeRelay(listener, transport string, port int) {
+	if t == nil {
+		return
+	}
+
+	t.lock.RLock()
+	close, ok := t.closers[relayKey{listener: listener, transport: transport, port: port}]
+	t.lock.RUnlock()
+
+	if ok {
+		close()
+	}
+}
+
+// closeAll closes all the relays registered with addRelay, deleting all the allocations.
+func (t *allocationTable) closeAll() {
+	if t == nil {
+		return
+	}
+
+	t.lock.RLock()
+	closers := make([]func(), 0, len(t.closers))
+	for _, close := range t.closers {
+		closers = append(closers, close)
+	}
+	t.lock.RUnlock()
+
+	for _, close := range closers {
+		close()
+	}
+}
+
+// setTrace sets the trace of the allocation registered for a relay port.
+func (t *allocationTable) setTrace(listener, transport string, port int, sc trace.SpanContext) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if a, ok := t.allocs[relayKey{listener: listener, transport: transport, port: port}]; ok {
+		a.trace = sc
+	}
+}
+
+func (t *allocationTable) getStats(key relayKey) *allocationStats {
+	s, ok := t.stats[key]
+	if !ok {
+		s = &allocationStats{}
+		t.stats[key] = s
+	}
+	return s
+}
+
+// addPermission registers a permission installed by a client for a peer IP.
+func (t *allocationTable) addPermission(listener string, client net.Addr, peer net.IP) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if a := t.getByClient(listener, client); a != nil {
+		a.permissions[peer.String()] = time.Now().Add(permissionLifetime)
+	}
+}
+
+// bindChannel registers a channel bound by a client to a peer.
+func (t *allocationTable) bindChannel(listener string, client net.Addr, number uint16, peer net.Addr) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if a := t.getByClient(listener, client); a != nil {
+		a.channels[number] = channelBinding{peer: peer.String(),
+			expires: time.Now().Add(channelBindingLifetime)}
+	}
+}
+
+// traceContext returns the trace of the allocation of a client, or an invalid span context if the
+// client has no allocation.
+func (t *allocationTable) traceContext(listener string, client net.Addr) trace.SpanContext {
+	if t == nil {
+		return trace.SpanContext{}
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if a := t.getByClient(listener, client); a != nil {
+		return a.trace
+	}
+	return trace.SpanContext{}
+}
+
+// getUsername returns the username of the allocation of a client. Returns false if the client has
+// no allocation.
+func (t *allocationTable) getUsername(listener string, client net.Addr) (string, bool) {
+	if t == nil {
+		return "", false
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if a := t.getByClient(listener, client); a != nil {
+		return a.Username, true
+	}
+	return "", false
+}
+
+func (t *allocationTable) getByClient(listener string, client net.Addr) *Allocation {
+	key, ok := t.byClient[clientKey(listener, client)]
+	if !ok {
+		return nil
+	}
+	return t.allocs[key]
+}
+
+// list returns the status of the allocations matching a filter, ordered by creation time.
+func (t *allocationTable) list(filter stnrv1.AllocationFilter) []*stnrv1.AllocationStatus {
+	ret := []*stnrv1.AllocationStatus{}
+	if t == nil {
+		return ret
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	now := time.Now()
+	for _, a := range t.allocs {
+		if s := a.status(now); filter.Match(s) {
+			ret = append(ret, s)
+		}
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if !ret[i].Created.Equal(ret[j].Created) {
+			return ret[i].Created.Before(ret[j].Created)
+		}
+		return ret[i].ClientAddr < ret[j].ClientAddr
+	})
+
+	return ret
+}
+
+// terminate closes the allocations matching a filter and returns the status of the closed
+// allocations.
+func (t *allocationTable) terminate(filter stnrv1.AllocationFilter) []*stnrv1.AllocationStatus {
+	return t.terminateIf(filter.Match)
+}
+
+// terminateIf closes the allocations for which a predicate holds and returns the status of the
+// closed allocations.
+func (t *allocationTable) terminateIf(match func(*stnrv1.AllocationStatus) bool) []*stnrv1.AllocationStatus {
+	ret := []*stnrv1.AllocationStatus{}
+	if t == nil {
+		return ret
+	}
+
+	closers := []func(){}
+	t.lock.RLock()
+	now := time.Now()
+	for key, a := range t.allocs {
+		if s := a.status(now); match(s) {
+			ret = append(ret, s)
+			if close, ok := t.closers[key]; ok {
+				closers = append(closers, close)
+			}
+		}
+	}
+	t.lock.RUnlock()
+
+	// closing the relay removes the allocation from the table
+	for _, close := range closers {
+		close()
+	}
+
+	return ret
+}
+
+// allocationBlock is an administrative block on new allocations matching a filter.
+type allocationBlock struct {
+	filter  stnrv1.AllocationFilter
+	expires time.Time
+}
+
+// block rejects new allocations matching a filter for the given period.
+func (t *allocationTable) block(filter stnrv1.AllocationFilter, d time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.blocks = append(t.blocks, allocationBlock{filter: filter, expires: time.Now().Add(d)})
+}
+
+// blocked returns true if a new allocation is blocked for a user and client at a listener.
+// Expired blocks are removed.
+func (t *allocationTable) blocked(listener, username string, client net.Addr) bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.blocks) == 0 {
+		return false
+	}
+
+	now := time.Now()
+	s := &stnrv1.AllocationStatus{Listener: listener, Username: username,
+		ClientAddr: addrString(client)}
+	ret := false
+	blocks := t.blocks[:0]
+	for _, b := range t.blocks {
+		if !now.Before(b.expires) {
+			continue
+		}
+		blocks = append(blocks, b)
+		if b.filter.Match(s) {
+			ret = true
+		}
+	}
+	t.blocks = blocks
+
+	return ret
+}
+
+// hasClient returns true if the client already holds an allocation at the listener.
+func (t *allocationTable) hasClient(listener string, client net.Addr) bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	_, ok := t.byClient[clientKey(listener, client)]
+	return ok
+}
+
+// hasRelay returns true if the client holds an allocation at the listener with the given relay
+// port.
+func (t *allocationTable) hasRelay(listener string, client net.Addr, port int) bool {
+	if t == nil {
+		return false
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	key, ok := t.byClient[clientKey(listener, client)]
+	return ok && key.port == port
+}
+
+// count returns the number of allocations at a listener.
+func (t *allocationTable) count(listener string) int {
+	if t == nil {
+		return 0
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.listeners[listener]
+}
+
+// usage returns the number of allocations per username and per client IP address.
+func (t *allocationTable) usage() (map[string]int, map[string]int) {
+	users, clients := map[string]int{}, map[string]int{}
+	if t == nil {
+		return users, clients
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for u, n := range t.users {
+		users[u] = n
+	}
+	for c, n := range t.clients {
+		clients[c] = n
+	}
+
+	return users, clients
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func decrement(m map[string]int, key string) {
+	m[key]--
+	if m[key] <= 0 {
+		delete(m, key)
+	}
+}
+
+func clientKey(listener string, client net.Addr) string {
+	return listener + "/" + client.String()
+}
+
+// getIPString returns the IP address of a transport address as a string.
+func getIPString(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
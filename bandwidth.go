@@ -0,0 +1,183 @@
+package stunner
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/l7mp/stunner/internal/object"
+)
+
+// minBandwidthBurst is the smallest token bucket size used for bandwidth limiting, large enough
+// for a maximum-size UDP datagram.
+const minBandwidthBurst = 65535
+
+// bandwidthLimiter is a token bucket limiting relayed traffic to a given number of bytes per
+// second. The limit is passed on each call so that configuration changes take effect immediately.
+// Bursts of up to one second worth of traffic are admitted.
+type bandwidthLimiter struct {
+	limiter *rate.Limiter
+	limit   int
+	lock    sync.Mutex
+}
+
+// get returns the token bucket for the given limit, or nil if there is no limit.
+func (b *bandwidthLimiter) get(limit int) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.limiter == nil || b.limit != limit {
+		burst := max(limit, minBandwidthBurst)
+		if b.limiter == nil {
+			b.limiter = rate.NewLimiter(rate.Limit(limit), burst)
+		} else {
+			b.limiter.SetLimit(rate.Limit(limit))
+			b.limiter.SetBurst(burst)
+		}
+		b.limit = limit
+	}
+
+	return b.limiter
+}
+
+// reserve takes n bytes from the token bucket if they are available at the given time. The
+// returned reservation can be cancelled to give back the tokens, and is nil if there is no limit.
+func (b *bandwidthLimiter) reserve(limit, n int, now time.Time) (*rate.Reservation, bool) {
+	l := b.get(limit)
+	if l == nil {
+		return nil, true
+	}
+
+	res := l.ReserveN(now, n)
+	if !res.OK() {
+		return nil, false
+	}
+	if res.DelayFrom(now) > 0 {
+		res.CancelAt(now)
+		return nil, false
+	}
+
+	return res, true
+}
+
+// wait blocks until n bytes can be sent without exceeding the limit.
+func (b *bandwidthLimiter) wait(ctx context.Context, limit, n int) error {
+	l := b.get(limit)
+	if l == nil {
+		return nil
+	}
+
+	for n > 0 {
+		chunk := min(n, l.Burst())
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+
+	return nil
+}
+
+// relayLimiter implements bandwidth limiting in one direction for a single allocation: traffic is
+// subject to the per-allocation limit of the listener, or the limit of the peer's cluster if the
+// cluster overrides it, plus the aggregate limit of the listener.
+type relayLimiter struct {
+	listener  *object.Listener
+	aggregate *bandwidthLimiter
+	alloc     bandwidthLimiter
+	clusters  map[string]*bandwidthLimiter
+	lock      sync.Mutex
+}
+
+func newRelayLimiter(l *object.Listener, aggregate *bandwidthLimiter) *relayLimiter {
+	return &relayLimiter{
+		listener:  l,
+		aggregate: aggregate,
+		clusters:  map[string]*bandwidthLimiter{},
+	}
+}
+
+// getLimiter returns the per-allocation token bucket and the limit for a cluster.
+func (r *relayLimiter) getLimiter(cluster *object.Cluster) (*bandwidthLimiter, int) {
+	limit := 0
+	if cluster != nil {
+		limit = cluster.GetBandwidthLimit()
+	}
+	if limit <= 0 {
+		_, allocLimit := r.listener.GetBandwidthLimits()
+		return &r.alloc, allocLimit
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	b, ok := r.clusters[cluster.Name]
+	if !ok {
+		b = &bandwidthLimiter{}
+		r.clusters[cluster.Name] = b
+	}
+
+	return b, limit
+}
+
+// allow reports whether n bytes can be exchanged with a peer in the given cluster. Tokens are
+// only spent if both the per-allocation and the aggregate limit admit the traffic.
+func (r *relayLimiter) allow(cluster *object.Cluster, n int) bool {
+	now := time.Now()
+	b, limit := r.getLimiter(cluster)
+	res, ok := b.reserve(limit, n, now)
+	if !ok {
+		return false
+	}
+
+	limit, _ = r.listener.GetBandwidthLimits()
+	if _, ok := r.aggregate.reserve(limit, n, now); !ok {
+		if res != nil {
+			res.CancelAt(now)
+		}
+		return false
+	}
+
+	return true
+}
+
+// wait blocks until n bytes can be exchanged with a peer in the given cluster.
+func (r *relayLimiter) wait(ctx context.Context, cluster *object.Cluster, n int) error {
+	b, limit := r.getLimiter(cluster)
+	if err := b.wait(ctx, limit, n); err != nil {
+		return err
+	}
+
+	limit, _ = r.listener.GetBandwidthLimits()
+	return r.aggregate.wait(ctx, limit, n)
+}
+
+// limitedReader is an io.Reader that delays reads to keep within the bandwidth limits of a TCP
+// relay and counts the bytes read.
+type limitedReader struct {
+	r       io.Reader
+	limiter *relayLimiter
+	cluster *object.Cluster
+	ctx     context.Context
+	count   func(n int)
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if l.count != nil {
+			l.count(n)
+		}
+		if werr := l.limiter.wait(l.ctx, l.cluster, n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,216 @@
+package stunner
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v3"
+	"github.com/pion/logging"
+
+	"github.com/l7mp/stunner/internal/object"
+	"github.com/l7mp/stunner/internal/telemetry"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// clientCertHandshakeTimeout is the time limit for a client to complete the TLS/DTLS handshake on a
+// listener with client cert authentication.
+var clientCertHandshakeTimeout = 10 * time.Second
+
+// clientCertEnabled returns true if a listener requests TLS client certs.
+func clientCertEnabled(l *object.Listener) bool {
+	return l.ClientAuth == stnrv1.ClientAuthRequest || l.ClientAuth == stnrv1.ClientAuthRequire
+}
+
+// verifyClientCert verifies the client cert chain presented at a listener against the client CA
+// bundle of the listener. Rejections are logged and counted.
+func verifyClientCert(l *object.Listener, certs []*x509.Certificate, log logging.LeveledLogger) error {
+	if len(certs) == 0 {
+		if l.ClientAuth != stnrv1.ClientAuthRequire {
+			return nil
+		}
+		log.Infof("listener %s: rejecting client: no client certificate", l.Name)
+		telemetry.IncrementClientCertRejected(l.Name, "missing")
+		return errors.New("client certificate required")
+	}
+
+	pool, err := l.GetClientCAs()
+	if err != nil {
+		log.Errorf("listener %s: cannot load client CA: %s", l.Name, err)
+		telemetry.IncrementClientCertRejected(l.Name, "invalid")
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		log.Infof("listener %s: rejecting client certificate %q: %s", l.Name,
+			certs[0].Subject.CommonName, err)
+		telemetry.IncrementClientCertRejected(l.Name, "invalid")
+		return err
+	}
+
+	return nil
+}
+
+// verifyDTLSClientCert verifies the raw client cert chain presented at a DTLS listener.
+func verifyDTLSClientCert(l *object.Listener, rawCerts [][]byte, log logging.LeveledLogger) error {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			log.Infof("listener %s: rejecting client certificate: %s", l.Name, err)
+			telemetry.IncrementClientCertRejected(l.Name, "invalid")
+			return err
+		}
+		certs = append(certs, c)
+	}
+
+	return verifyClientCert(l, certs, log)
+}
+
+// clientIdentity is the identity of a client verified by the TLS client cert.
+type clientIdentity struct {
+	listener *object.Listener
+	// subject is the subject common name of the client cert, empty if the client did not
+	// present a cert.
+	subject string
+}
+
+// clientCertTable maps the transport address of clients connected to listeners with client
+// cert authentication to the identity of the client, for the auth handler to map the client cert
+// subject to the TURN username. Identities are keyed by the listener that performed the handshake
+// so that they are never applied to clients of other listeners.
+type clientCertTable struct {
+	conns map[string]*clientIdentity
+	lock  sync.RWMutex
+}
+
+func newClientCertTable() *clientCertTable {
+	return &clientCertTable{conns: map[string]*clientIdentity{}}
+}
+
+func clientCertKey(listener string, addr net.Addr) string {
+	return listener + "/" + addr.Network() + "/" + addr.String()
+}
+
+func (t *clientCertTable) add(listener string, addr net.Addr, id *clientIdentity) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.conns[clientCertKey(listener, addr)] = id
+}
+
+func (t *clientCertTable) remove(listener string, addr net.Addr) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.conns, clientCertKey(listener, addr))
+}
+
+// get returns the identity of a client connected to a listener, or nil if the client is not
+// connected to the listener or the listener does not use client cert authentication.
+func (t *clientCertTable) get(listener string, addr net.Addr) *clientIdentity {
+	if addr == nil {
+		return nil
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.conns[clientCertKey(listener, addr)]
+}
+
+// clientCertListener is a TLS/DTLS listener that registers the identity of each client in the
+// client cert table.
+type clientCertListener struct {
+	net.Listener
+	listener *object.Listener
+	table    *clientCertTable
+	log      logging.LeveledLogger
+}
+
+func newClientCertListener(l net.Listener, listener *object.Listener, table *clientCertTable, log logging.LeveledLogger) net.Listener {
+	return &clientCertListener{Listener: l, listener: listener, table: table, log: log}
+}
+
+// Accept accepts a new connection.
+func (l *clientCertListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &clientCertConn{Conn: conn, listener: l}, nil
+}
+
+// clientCertConn is a TLS/DTLS connection that completes the handshake before the first read and
+// registers the identity of the client until the connection is closed.
+type clientCertConn struct {
+	net.Conn
+	listener *clientCertListener
+	once     sync.Once
+	err      error
+}
+
+// Read reads from the connection, completing the handshake on the first read.
+func (c *clientCertConn) Read(p []byte) (int, error) {
+	c.once.Do(func() { c.err = c.handshake() })
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.Conn.Read(p)
+}
+
+// Close closes the connection and removes the client from the client cert table.
+func (c *clientCertConn) Close() error {
+	c.listener.table.remove(c.listener.listener.Name, c.RemoteAddr())
+	return c.Conn.Close()
+}
+
+func (c *clientCertConn) handshake() error {
+	id := &clientIdentity{listener: c.listener.listener}
+
+	// stalled clients must not hold the connection forever
+	ctx, cancel := context.WithTimeout(context.Background(), clientCertHandshakeTimeout)
+	defer cancel()
+
+	switch conn := c.Conn.(type) {
+	case *tls.Conn:
+		if err := conn.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			id.subject = certs[0].Subject.CommonName
+		}
+	case *dtls.Conn:
+		if err := conn.HandshakeContext(ctx); err != nil {
+			return fmt.Errorf("DTLS handshake failed: %w", err)
+		}
+		if state, ok := conn.ConnectionState(); ok && len(state.PeerCertificates) > 0 {
+			cert, err := x509.ParseCertificate(state.PeerCertificates[0])
+			if err != nil {
+				return err
+			}
+			id.subject = cert.Subject.CommonName
+		}
+	default:
+		return fmt.Errorf("internal error: unknown connection type %T", c.Conn)
+	}
+
+	c.listener.log.Debugf("listener %s: client %s connected with client certificate %q",
+		id.listener.Name, c.RemoteAddr(), id.subject)
+	c.listener.table.add(id.listener.Name, c.RemoteAddr(), id)
+
+	return nil
+}
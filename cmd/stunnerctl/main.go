@@ -21,6 +21,7 @@ import (
 	"sigs.k8s.io/yaml"
 
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
 	cdsclient "github.com/l7mp/stunner/pkg/config/client"
 	"github.com/l7mp/stunner/pkg/logger"
 )
@@ -33,6 +34,8 @@ import (
 var (
 	output              string
 	watch, all, verbose bool
+	local               bool
+	ttl                 time.Duration
 	k8sConfigFlags      *cliopt.ConfigFlags
 	cdsConfigFlags      *cdsclient.CDSConfigFlags
 	authConfigFlags     *cdsclient.AuthConfigFlags
@@ -114,6 +117,11 @@ func init() {
 	authConfigFlags = cdsclient.NewAuthConfigFlags()
 	authConfigFlags.AddFlags(authCmd.Flags())
 
+	// local credential generation flags: only for "auth" command
+	authCmd.Flags().BoolVar(&local, "local", false, "Generate the TURN credential locally from the gateway config loaded from the CDS server (disables the auth service)")
+	authCmd.Flags().DurationVar(&ttl, "ttl", 24*time.Hour, "Lifetime of the locally generated ephemeral TURN credential")
+	cdsConfigFlags.AddFlags(authCmd.Flags())
+
 	// Add commands
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(statusCmd)
@@ -362,6 +370,10 @@ func runAuth(cmd *cobra.Command, args []string) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if local {
+		return runAuthLocal(ctx, args)
+	}
+
 	log.Debug("Searching for authentication server")
 	pod, err := cdsclient.DiscoverK8sAuthServer(ctx, k8sConfigFlags, authConfigFlags,
 		loggerFactory.NewLogger("auth-fwd"))
@@ -412,6 +424,98 @@ func runAuth(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// runAuthLocal generates a TURN credential for a gateway from the config of the gateway, without
+// querying the authentication service. Ephemeral credentials are generated with the active shared
+// secret and the credential algorithm of the gateway.
+func runAuthLocal(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("gateway name required for generating local credentials")
+	}
+
+	gwNs := "default"
+	if k8sConfigFlags.Namespace != nil && *k8sConfigFlags.Namespace != "" {
+		gwNs = *k8sConfigFlags.Namespace
+	}
+
+	log.Debug("Searching for CDS server")
+	pod, err := cdsclient.DiscoverK8sCDSServer(ctx, k8sConfigFlags, cdsConfigFlags,
+		loggerFactory.NewLogger("cds-fwd"))
+	if err != nil {
+		return fmt.Errorf("error searching for CDS server: %w", err)
+	}
+
+	cds, err := cdsclient.NewConfigNamespaceNameAPI(pod.Addr, gwNs, args[0],
+		loggerFactory.NewLogger("cds-client"))
+	if err != nil {
+		return fmt.Errorf("error creating CDS client: %w", err)
+	}
+
+	confs, err := cds.Get(ctx)
+	if err != nil {
+		return err
+	}
+	if len(confs) == 0 || cdsclient.IsConfigDeleted(confs[0]) {
+		return fmt.Errorf("no config found for gateway %s/%s", gwNs, args[0])
+	}
+	conf := confs[0]
+
+	atype, err := stnrv1.NewAuthType(conf.Auth.Type)
+	if err != nil {
+		return err
+	}
+
+	var username, password string
+	credTTL := ttl
+	switch atype {
+	case stnrv1.AuthTypeStatic:
+		u, userFound := conf.Auth.Credentials["username"]
+		p, passFound := conf.Auth.Credentials["password"]
+		if !userFound || !passFound {
+			return fmt.Errorf("cannot find username/password for %s authentication",
+				conf.Auth.Type)
+		}
+		username, password = u, p
+		credTTL = 24 * time.Hour
+
+	case stnrv1.AuthTypeEphemeral:
+		secrets := conf.Auth.GetSharedSecrets()
+		if len(secrets) == 0 {
+			return fmt.Errorf("cannot find shared secret for %s authentication",
+				conf.Auth.Type)
+		}
+		username, password, err = a12n.GenerateEphemeralCredential(secrets[0].Secret,
+			secrets[0].Algorithm, ttl)
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("cannot generate credentials locally for %s authentication",
+			conf.Auth.Type)
+	}
+
+	uris := []string{}
+	for _, l := range conf.Listeners {
+		if uri, err := l.GetListenerURI(true); err == nil {
+			uris = append(uris, uri)
+		}
+	}
+
+	out, err := json.Marshal(map[string]any{
+		"username": username,
+		"password": password,
+		"ttl":      int(credTTL.Seconds()),
+		"uris":     uris,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(out))
+
+	return nil
+}
+
 // ////////////////////////
 var jsonRegexp = regexp.MustCompile(`^\{\.?([^{}]+)\}$|^\.?([^{}]+)$`)
 
@@ -27,6 +27,7 @@ func main() {
 	os.Args[0] = "stunnerd"
 	var config = flag.StringP("config", "c", "", "Config origin, either a valid address in the format IP:port, or HTTP URL to the CDS server, or literal \"k8s\" to discover the CDS server from Kubernetes, or a proper file name URI in the format file://<path-to-config-file> (overrides: STUNNER_CONFIG_ORIGIN)")
 	var level = flag.StringP("log", "l", "", "Log level (format: <scope>:<level>, overrides: PION_LOG_*, default: all:INFO)")
+	var logFormat = flag.String("log-format", "", "Log output format, either \"text\", \"json\" or \"logfmt\" (overrides the admin config, default: text)")
 	var id = flag.StringP("id", "i", "", "Id for identifying with the CDS server (format: <namespace>/<name>, overrides: STUNNER_NAMESPACE/STUNNER_NAME, default: <default/stunnerd-hostname>)")
 	var watch = flag.BoolP("watch", "w", false, "Watch config file for updates (default: false)")
 	var udpThreadNum = flag.IntP("udp-thread-num", "u", 0,
@@ -72,6 +73,7 @@ func main() {
 	st := stunner.NewStunner(stunner.Options{
 		Name:                 *id,
 		LogLevel:             logLevel,
+		LogFormat:            *logFormat,
 		DryRun:               *dryRun,
 		UDPListenerThreadNum: *udpThreadNum,
 	})
@@ -178,8 +180,13 @@ func main() {
 
 			go func() {
 				for {
-					// check if we can exit
-					if st.AllocationCount() == 0 {
+					// check if we can exit: either all allocations are gone or the
+					// drain timeout has expired
+					if st.IsDrained() {
+						if n := st.AllocationCount(); n > 0 {
+							log.Infof("Drain timeout expired with %d active "+
+								"connection(s)", n)
+						}
 						exit <- true
 						return
 					}
@@ -194,6 +201,9 @@ func main() {
 			if *verbose || *level != "" {
 				c.Admin.LogLevel = logLevel
 			}
+			if *logFormat != "" {
+				c.Admin.LogFormat = *logFormat
+			}
 
 			// we have working stunnerd: reconcile
 			log.Debug("Initiating reconciliation")
@@ -10,13 +10,13 @@ import (
 	"time"
 
 	"github.com/pion/logging"
-	"github.com/pion/turn/v4"
 	flag "github.com/spf13/pflag"
 
 	cliopt "k8s.io/cli-runtime/pkg/genericclioptions"
 
 	"github.com/l7mp/stunner"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
 	"github.com/l7mp/stunner/pkg/buildinfo"
 	cdsclient "github.com/l7mp/stunner/pkg/config/client"
 	"github.com/l7mp/stunner/pkg/logger"
@@ -259,13 +259,15 @@ func getAuth(config *stnrv1.StunnerConfig) (stunner.AuthGen, error) {
 
 	switch atype {
 	case stnrv1.AuthTypeEphemeral:
-		s, found := auth.Credentials["secret"]
-		if !found {
+		// use the active secret
+		secrets := auth.GetSharedSecrets()
+		if len(secrets) == 0 {
 			return nil, fmt.Errorf("cannot find shared secret for %s authentication",
 				auth.Type)
 		}
 		return func() (string, string, error) {
-			return turn.GenerateLongTermCredentials(s, defaultDuration)
+			return a12n.GenerateEphemeralCredential(secrets[0].Secret, secrets[0].Algorithm,
+				defaultDuration)
 		}, nil
 
 	case stnrv1.AuthTypeStatic:
@@ -29,6 +29,9 @@ type Options struct {
 	// will suppress all logs except in the authentication subsystem and the TURN protocol
 	// logic.
 	LogLevel string
+	// LogFormat specifies the output format of the logs, either "text" (the default), "json" or
+	// "logfmt". Used unless the log format is explicitly set in the admin config.
+	LogFormat string
 	// Resolver swaps the internal DNS resolver with a custom implementation. Intended for
 	// testing.
 	Resolver resolver.DnsResolver
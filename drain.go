@@ -0,0 +1,122 @@
+package stunner
+
+import (
+	"sync"
+	"time"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// drainState tracks the progress of a graceful shutdown. While draining, new allocations are
+// rejected and the lifetime of existing allocations is capped at the time left until the drain
+// timeout expires.
+type drainState struct {
+	active            bool
+	started, deadline time.Time
+	initialAllocs     int
+	lock              sync.RWMutex
+}
+
+// start starts draining with the given timeout. Restarting an ongoing drain is a no-op.
+func (d *drainState) start(timeout time.Duration, allocs int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.active {
+		return
+	}
+
+	d.active = true
+	d.started = time.Now()
+	d.deadline = d.started.Add(timeout)
+	d.initialAllocs = allocs
+}
+
+// draining returns true if a graceful shutdown is in progress.
+func (d *drainState) draining() bool {
+	if d == nil {
+		return false
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return d.active
+}
+
+// expired returns true if the drain timeout has expired.
+func (d *drainState) expired() bool {
+	if d == nil {
+		return false
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return d.active && !time.Now().Before(d.deadline)
+}
+
+// remaining returns the time left until the drain timeout expires, or zero if not draining.
+func (d *drainState) remaining() time.Duration {
+	if d == nil {
+		return 0
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if !d.active {
+		return 0
+	}
+
+	return max(time.Until(d.deadline), 0)
+}
+
+// capLifetime caps an allocation lifetime at the time left until the drain timeout expires,
+// rounded up to whole seconds.
+func (d *drainState) capLifetime(lt time.Duration) time.Duration {
+	if !d.draining() {
+		return lt
+	}
+
+	capped := (d.remaining() + time.Second - 1).Truncate(time.Second)
+	capped = max(capped, time.Second)
+
+	return min(lt, capped)
+}
+
+// progress returns the ratio of the allocations terminated since draining has started.
+func (d *drainState) progress(allocs int) float64 {
+	if d == nil {
+		return 0
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	switch {
+	case !d.active:
+		return 0
+	case d.initialAllocs == 0 || allocs == 0:
+		return 1
+	case allocs >= d.initialAllocs:
+		return 0
+	}
+
+	return 1 - float64(allocs)/float64(d.initialAllocs)
+}
+
+// status returns the drain status.
+func (d *drainState) status(allocs int) *stnrv1.DrainStatus {
+	progress := d.progress(allocs)
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return &stnrv1.DrainStatus{
+		Started:            d.started,
+		Deadline:           d.deadline,
+		InitialAllocations: d.initialAllocs,
+		Progress:           progress,
+	}
+}
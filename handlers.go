@@ -3,66 +3,240 @@ package stunner
 import (
 	"errors"
 	"net"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/l7mp/stunner/internal/object"
+	"github.com/l7mp/stunner/internal/telemetry"
 	"github.com/l7mp/stunner/internal/util"
 
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 	a12n "github.com/l7mp/stunner/pkg/authentication"
+	"github.com/l7mp/stunner/pkg/logger"
 )
 
 // NewAuthHandler returns an authentication handler callback to be used with a TURN server for
 // authenticating clients.
 func (s *Stunner) NewAuthHandler() a12n.AuthHandler {
+	return s.newAuthHandler(nil)
+}
+
+// newAuthHandler returns an authentication handler for a listener. The listener may be nil. The
+// MESSAGE-INTEGRITY of the request is checked against the key so that failed attempts can be
+// recorded for the brute-force protection.
+func (s *Stunner) newAuthHandler(l *object.Listener) a12n.AuthHandler {
 	s.log.Trace("NewAuthHandler")
 
+	h := s.newKeyHandler(l)
+	return func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+		key, ok := h(username, realm, srcAddr)
+		if ok {
+			s.authLockout.verify(srcAddr, username, key)
+		}
+		return key, ok
+	}
+}
+
+// newKeyHandler returns a handler that looks up the key of a user.
+func (s *Stunner) newKeyHandler(l *object.Listener) a12n.AuthHandler {
 	return func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
 		// dynamic: auth mode might have changed behind ur back
 		auth := s.GetAuth()
 
+		fields := []any{"client", addrString(srcAddr), "username", username}
+		if l != nil {
+			fields = append([]any{"listener", l.Name}, fields...)
+		}
+		log := logger.WithFields(auth.Log, fields...)
+
+		// reject locked out clients and usernames before looking up the key
+		owner := false
+		if l != nil && srcAddr != nil {
+			u, ok := s.allocs.getUsername(l.Name, srcAddr)
+			owner = ok && u == username
+		}
+		if s.authLockout.locked(srcAddr, username, owner) {
+			log.Info("auth request: failed: locked out after too many failed attempts")
+			return nil, false
+		}
+
+		// map the subject of the verified client cert to the username: only the listener that
+		// performed the handshake may accept the client cert identity
+		var id *clientIdentity
+		if l != nil {
+			id = s.clientCerts.get(l.Name, srcAddr)
+		}
+		if id != nil {
+			switch id.listener.ClientCertUsername {
+			case stnrv1.ClientCertUsernameVerify, stnrv1.ClientCertUsernameMap:
+				if id.subject == "" || username != id.subject {
+					log.Infof("client cert auth request: failed: username does not "+
+						"match client cert subject %q", id.subject)
+					telemetry.IncrementClientCertRejected(id.listener.Name, "username")
+					s.authLockout.reject(srcAddr, username, authFailureClientCert)
+					return nil, false
+				}
+
+				if id.listener.ClientCertUsername == stnrv1.ClientCertUsernameMap {
+					log.Info("client cert auth request: success")
+					return a12n.GenerateAuthKey(username, auth.Realm, ""), true
+				}
+			}
+		}
+
 		switch auth.Type {
 		case stnrv1.AuthTypeStatic:
-			auth.Log.Infof("static auth request: username=%q realm=%q srcAddr=%v\n",
-				username, realm, srcAddr)
+			log.Infof("static auth request: realm=%q", realm)
 
-			key := a12n.GenerateAuthKey(auth.Username, auth.Realm, auth.Password)
-			if username == auth.Username {
-				auth.Log.Debug("static auth request: valid username")
-				return key, true
+			password, err := auth.GetStaticPassword(username)
+			if err != nil {
+				log.Infof("static auth request: failed: %s", err)
+				reason := authFailureInvalidUsername
+				switch {
+				case errors.Is(err, object.ErrUserDisabled):
+					reason = authFailureDisabled
+				case errors.Is(err, object.ErrUserExpired):
+					reason = authFailureExpired
+				}
+				s.authLockout.reject(srcAddr, username, reason)
+				return nil, false
 			}
 
-			auth.Log.Info("static auth request: failed: invalid username")
-			return nil, false
+			log.Debug("static auth request: valid username")
+			return a12n.GenerateAuthKey(username, auth.Realm, password), true
 
 		case stnrv1.AuthTypeEphemeral:
-			auth.Log.Infof("ephemeral auth request: username=%q realm=%q srcAddr=%v",
-				username, realm, srcAddr)
+			log.Infof("ephemeral auth request: realm=%q", realm)
 
 			if err := a12n.CheckTimeWindowedUsername(username); err != nil {
-				auth.Log.Infof("ephemeral auth request: failed: %s", err)
+				log.Infof("ephemeral auth request: failed: %s", err)
+				reason := authFailureInvalidUsername
+				if _, ok := a12n.GetExpiry(username); ok {
+					reason = authFailureExpired
+				}
+				s.authLockout.reject(srcAddr, username, reason)
+				return nil, false
+			}
+
+			if reason, revoked := auth.IsRevoked(username); revoked {
+				log.Infof("ephemeral auth request: failed: credential revoked (%s)", reason)
+				s.authLockout.reject(srcAddr, username, authFailureRevoked)
+				return nil, false
+			}
+
+			secret, ok := s.sharedSecrets.get(srcAddr, username)
+			if !ok {
+				log.Info("ephemeral auth request: failed: no valid shared secret")
+				s.authLockout.reject(srcAddr, username, authFailureUnavailable)
 				return nil, false
 			}
 
-			password, err := a12n.GetLongTermCredential(username, auth.Secret)
+			password, err := a12n.GetLongTermCredentialWithAlgorithm(username, secret.Secret,
+				secret.Algorithm)
 			if err != nil {
-				auth.Log.Infof("ephemeral auth request: error generating password: %s",
-					err)
+				log.Infof("ephemeral auth request: error generating password: %s", err)
+				s.authLockout.reject(srcAddr, username, authFailureUnavailable)
 				return nil, false
 			}
 
-			auth.Log.Info("ephemeral auth request: success")
+			log.Infof("ephemeral auth request: success (secret version %q)", secret.Version)
+			telemetry.IncrementSharedSecretRequests(secret.Version)
 			return a12n.GenerateAuthKey(username, auth.Realm, password), true
 
+		case stnrv1.AuthTypeWebhook:
+			log.Infof("webhook auth request: realm=%q", realm)
+
+			// the client-supplied realm is not trusted: use the configured realm for the
+			// request and the cache key alike
+			req := stnrv1.WebhookRequest{Username: username, Realm: auth.Realm,
+				Client: addrString(srcAddr)}
+			if l != nil {
+				req.Listener = l.Name
+			}
+			key, err := auth.CallWebhook(req)
+			if err != nil {
+				log.Infof("webhook auth request: failed: %s", err)
+				reason := authFailureUnavailable
+				if errors.Is(err, object.ErrWebhookRejected) {
+					reason = authFailureRejected
+				}
+				s.authLockout.reject(srcAddr, username, reason)
+				return nil, false
+			}
+
+			log.Info("webhook auth request: success")
+			return key, true
+
+		case stnrv1.AuthTypeOAuth:
+			log.Infof("oauth auth request: realm=%q", realm)
+
+			token, err := s.accessTokens.get(srcAddr, username)
+			if err != nil {
+				log.Infof("oauth auth request: failed: %s", err)
+				s.authLockout.reject(srcAddr, username, authFailureInvalidToken)
+				return nil, false
+			}
+
+			log.Info("oauth auth request: success")
+			return token.MACKey, true
+
 		default:
-			auth.Log.Errorf("internal error: unknown authentication mode %q",
-				auth.Type.String())
+			log.Errorf("internal error: unknown authentication mode %q", auth.Type.String())
 			return nil, false
 		}
 	}
 }
 
-// NewPermissionHandler returns a callback to handle client permission requests to access peers.
+var (
+	errAuthFailed   = errors.New("authentication failed")
+	errNoRoute      = errors.New("no route to peer")
+	errTenantDenied = errors.New("cluster not allowed for tenant")
+)
+
+// newTracedAuthHandler wraps an authentication handler to record the authentication requests at a
+// listener as trace spans.
+func (s *Stunner) newTracedAuthHandler(l *object.Listener, h a12n.AuthHandler) a12n.AuthHandler {
+	return func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+		key, ok := h(username, realm, srcAddr)
+		traceAuth(l.Name, username, srcAddr, ok)
+		return key, ok
+	}
+}
+
+// traceAuth records an authentication request at a listener as a trace span.
+func traceAuth(listener, username string, srcAddr net.Addr, ok bool) {
+	var err error
+	if !ok {
+		err = errAuthFailed
+	}
+	telemetry.TraceEvent(trace.SpanContext{}, "auth", err,
+		telemetry.AttrListener.String(listener),
+		telemetry.AttrUsername.String(username),
+		telemetry.AttrClient.String(addrString(srcAddr)))
+}
+
+// NewSTUNAuthHandler returns an authentication handler for STUN-only listeners that rejects all
+// authenticated (i.e., TURN) requests.
+func (s *Stunner) NewSTUNAuthHandler(l *object.Listener) a12n.AuthHandler {
+	s.log.Trace("NewSTUNAuthHandler")
+
+	return func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+		s.log.Debugf("STUN listener %q: rejecting TURN request: username=%q srcAddr=%v",
+			l.Name, username, srcAddr)
+		return nil, false
+	}
+}
+
+// NewPermissionHandler returns a callback to handle client permission requests to access peers
+// over UDP allocations.
 func (s *Stunner) NewPermissionHandler(l *object.Listener) a12n.PermissionHandler {
+	return s.newPermissionHandler(l, stnrv1.ClusterProtocolUDP)
+}
+
+// newPermissionHandler returns a permission handler that admits peers only via clusters of the
+// given protocol.
+func (s *Stunner) newPermissionHandler(l *object.Listener, proto stnrv1.ClusterProtocol) a12n.PermissionHandler {
 	s.log.Trace("NewPermissionHandler")
 
 	return func(src net.Addr, peer net.IP) bool {
@@ -71,8 +245,20 @@ func (s *Stunner) NewPermissionHandler(l *object.Listener) a12n.PermissionHandle
 		auth := s.GetAuth()
 
 		peerIP := peer.String()
-		auth.Log.Debugf("permission handler for listener %q: client %q, peer %q", l.Name,
-			src.String(), peerIP)
+		auth.Log.Debugf("permission handler for listener %q: client %q, peer %q, protocol %s",
+			l.Name, src.String(), peerIP, proto.String())
+
+		// identity-scoped routing: the tenant of the user restricts the clusters, so fail
+		// closed for allocations that were not registered with a username if tenants are
+		// configured
+		username, ok := s.allocs.getUsername(l.Name, src)
+		if !ok && auth.HasTenants() {
+			auth.Log.Infof("permission denied on listener %q for client %q to peer %s: "+
+				"unknown allocation", l.Name, src.String(), peerIP)
+			return false
+		}
+		tenant, allowed, restricted := auth.GetTenant(username)
+		denied := ""
 
 		clusters := s.clusterManager.Keys()
 		for _, r := range l.Routes {
@@ -80,16 +266,41 @@ func (s *Stunner) NewPermissionHandler(l *object.Listener) a12n.PermissionHandle
 			if util.Member(clusters, r) {
 				auth.Log.Tracef("considering cluster %q", r)
 				c := s.GetCluster(r)
-				if c.Route(peer) {
+				if c.Protocol == proto && c.Route(peer) {
+					if restricted && !util.Member(allowed, c.Name) {
+						denied = c.Name
+						continue
+					}
+
 					auth.Log.Infof("permission granted on listener %q for client "+
 						"%q to peer %s via cluster %q", l.Name, src.String(),
 						peerIP, c.Name)
+					s.allocs.addPermission(l.Name, src, peer)
+					telemetry.TraceEvent(s.allocs.traceContext(l.Name, src),
+						"permission", nil,
+						telemetry.AttrListener.String(l.Name),
+						telemetry.AttrCluster.String(c.Name),
+						telemetry.AttrClient.String(src.String()),
+						telemetry.AttrPeer.String(peerIP))
 					return true
 				}
 			}
 		}
-		auth.Log.Debugf("permission denied on listener %q for client %q to peer %s: "+
-			"no route to endpoint", l.Name, src.String(), peerIP)
+
+		err := errNoRoute
+		if denied != "" {
+			auth.Log.Infof("permission denied on listener %q for client %q (user %q, "+
+				"tenant %q) to peer %s: cluster %q not allowed for tenant", l.Name,
+				src.String(), username, tenant, peerIP, denied)
+			err = errTenantDenied
+		} else {
+			auth.Log.Debugf("permission denied on listener %q for client %q to peer %s: "+
+				"no route to endpoint", l.Name, src.String(), peerIP)
+		}
+		telemetry.TraceEvent(s.allocs.traceContext(l.Name, src), "permission", err,
+			telemetry.AttrListener.String(l.Name),
+			telemetry.AttrClient.String(src.String()),
+			telemetry.AttrPeer.String(peerIP))
 		return false
 	}
 }
@@ -115,6 +326,52 @@ func (s *Stunner) NewRealmHandler() object.RealmHandler {
 	}
 }
 
+// NewAllocationHandler creates a helper function for listing the active allocations.
+func (s *Stunner) NewAllocationHandler() object.AllocationHandler {
+	return func(filter stnrv1.AllocationFilter) []*stnrv1.AllocationStatus {
+		return s.GetAllocations(filter)
+	}
+}
+
+// NewTerminationHandler creates a helper function for terminating allocations.
+func (s *Stunner) NewTerminationHandler() object.TerminationHandler {
+	return func(filter stnrv1.AllocationFilter, block time.Duration) ([]*stnrv1.AllocationStatus, error) {
+		return s.TerminateAllocations(filter, block)
+	}
+}
+
+// NewRevocationHandler creates a helper function for managing the revoked ephemeral credentials.
+func (s *Stunner) NewRevocationHandler() object.RevocationHandler {
+	return func(req *stnrv1.RevocationConfig, remove bool) (*stnrv1.RevocationStatus, error) {
+		return s.RevokeCredentials(req, remove)
+	}
+}
+
+// NewLockoutHandler creates a helper function for listing and resetting the failed authentication
+// attempts.
+func (s *Stunner) NewLockoutHandler() object.LockoutHandler {
+	return func(clientIP, username string, unlock bool) []*stnrv1.LockoutStatus {
+		if unlock {
+			return s.ResetLockouts(clientIP, username)
+		}
+		return s.GetLockouts(clientIP, username)
+	}
+}
+
+// NewLogLevelHandler creates a helper function for querying and overriding the loglevels at
+// runtime.
+func (s *Stunner) NewLogLevelHandler() object.LogLevelHandler {
+	return func(levelSpec string, revert time.Duration) (*stnrv1.LogLevelStatus, error) {
+		if levelSpec != "" {
+			if err := s.logLevels.set(levelSpec, revert); err != nil {
+				return nil, err
+			}
+			s.log.Infof("Loglevel overridden to %q (revert: %s)", levelSpec, revert)
+		}
+		return s.logLevels.status(), nil
+	}
+}
+
 // NewStatusHandler creates a helper function for printing the status of STUNner.
 func (s *Stunner) NewStatusHandler() object.StatusHandler {
 	return func() stnrv1.Status { return s.Status() }
@@ -0,0 +1,535 @@
+package stunner
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun/v3"
+
+	a12n "github.com/l7mp/stunner/pkg/authentication"
+)
+
+// allocTransactionTimeout is the time we remember an Allocate request while waiting for the
+// response of the TURN server.
+const allocTransactionTimeout = 30 * time.Second
+
+// allocInterceptor inspects the Allocate transactions handled by the TURN server in order to
+// implement features the pion/turn server does not support:
+//   - RFC 6156 address family selection: the TURN server always allocates an IPv4 relay, so the
+//     interceptor rejects Allocate requests for address families the listener cannot relay with a
+//     440 (Address Family not Supported) error and rewrites the XOR-RELAYED-ADDRESS in the
+//     responses to IPv6 allocations,
+//   - allocation quotas: allocations exceeding the per-user, per-client or per-listener
+//     allocation quota are deleted and the success response is replaced with a 486 (Allocation
+//     Quota Reached) error,
+//   - administrative blocks: allocations blocked after an administrative termination are deleted
+//     and the success response is replaced with a 403 (Forbidden) error,
+//   - draining: Allocate requests are rejected with a 508 (Insufficient Capacity) error during a
+//     graceful shutdown and the LIFETIME of Refresh requests is capped at the drain timeout,
+//   - allocation tracking: successful allocations and the channels bound by clients are
+//     registered with the relay address generator of the listener, and allocations whose Allocate
+//     transaction is unknown are deleted and the success response is replaced with a 500 (Server
+//     Error) error,
+//   - third-party authorization (RFC 7635): the access tokens presented by clients in Allocate
+//     and Refresh requests are registered for the auth handler and 401 (Unauthorized) responses
+//     to Allocate requests are extended with the THIRD-PARTY-AUTHORIZATION attribute,
+//   - shared secret rotation: authenticated requests are matched against the shared secrets
+//     accepted by the ephemeral authentication mode so that the auth handler can find the secret
+//     that was used to issue the credential of the client,
+//   - brute-force protection: authenticated requests are tracked until the TURN server responds
+//     in order to count the failed authentication attempts per client and per username.
+type allocInterceptor struct {
+	relay       *RelayGen
+	authHandler a12n.AuthHandler
+	pending     map[allocTransaction]allocRequest
+	lastGC      time.Time
+	lock        sync.Mutex
+	log         logging.LeveledLogger
+}
+
+// allocTransaction identifies an Allocate or ChannelBind transaction.
+type allocTransaction struct {
+	client string
+	id     [stun.TransactionIDSize]byte
+}
+
+// allocRequest stores the data needed to process the response to an Allocate or a ChannelBind
+// request.
+type allocRequest struct {
+	username, realm string
+	family          addrFamily
+	rewrite         bool
+	channel         uint16
+	peer            net.Addr // nil for Allocate requests
+	created         time.Time
+}
+
+func newAllocInterceptor(relay *RelayGen, authHandler a12n.AuthHandler, log logging.LeveledLogger) *allocInterceptor {
+	return &allocInterceptor{
+		relay:       relay,
+		authHandler: authHandler,
+		pending:     map[allocTransaction]allocRequest{},
+		lastGC:      time.Now(),
+		log:         log,
+	}
+}
+
+// request inspects a message received from a client and returns a response to be sent back to the
+// client if the message must not be passed to the TURN server, or nil otherwise.
+func (i *allocInterceptor) request(p []byte, src net.Addr) []byte {
+	if isMessage(p, stun.MethodChannelBind, stun.ClassRequest) {
+		i.channelBind(p, src)
+		return nil
+	}
+
+	if !isMessage(p, stun.MethodAllocate, stun.ClassRequest) {
+		return nil
+	}
+
+	m := &stun.Message{Raw: p}
+	if err := m.Decode(); err != nil {
+		return nil
+	}
+
+	// unauthenticated requests will be challenged by the TURN server
+	username, errUser := m.Get(stun.AttrUsername)
+	realm, errRealm := m.Get(stun.AttrRealm)
+
+	// retransmitted requests and requests for an existing allocation are handled by the TURN
+	// server
+	exists := i.relay.allocs.hasClient(i.relay.Listener.Name, src)
+
+	if i.relay.drain.draining() && !exists {
+		i.log.Debugf("rejecting allocation request from client %s: draining", src)
+		return allocErrorResponse(m, stun.CodeInsufficientCapacity, nil)
+	}
+
+	family, err := getRequestedAddressFamily(m, src)
+	if err != nil {
+		return allocErrorResponse(m, stun.CodeBadRequest, nil)
+	}
+
+	ip := i.relay.relayIP(family)
+	if ip == nil {
+		i.log.Debugf("rejecting allocation request from client %s: address family %s not "+
+			"supported", src, family)
+		return allocErrorResponse(m, stun.CodeAddrFamilyNotSupported, nil)
+	}
+
+	if errUser != nil || errRealm != nil {
+		return nil
+	}
+
+	i.addPending(allocTransaction{client: src.String(), id: m.TransactionID}, allocRequest{
+		username: string(username),
+		realm:    string(realm),
+		family:   family,
+		rewrite:  !ip.Equal(i.relay.defaultRelayIP()),
+	})
+
+	return nil
+}
+
+// accessToken registers the access token presented in the ACCESS-TOKEN attribute of an Allocate or
+// a Refresh request. Invalid tokens are ignored: the request will then fail authentication.
+func (i *allocInterceptor) accessToken(p []byte, src net.Addr) {
+	if i.relay.tokens == nil || (!isMessage(p, stun.MethodAllocate, stun.ClassRequest) &&
+		!isMessage(p, stun.MethodRefresh, stun.ClassRequest)) {
+		return
+	}
+
+	m := &stun.Message{Raw: p}
+	if err := m.Decode(); err != nil {
+		return
+	}
+
+	token, err := m.Get(a12n.AttrAccessToken)
+	if err != nil {
+		return
+	}
+
+	kid, err := m.Get(stun.AttrUsername)
+	if err != nil {
+		return
+	}
+
+	if err := i.relay.tokens.add(src, string(kid), token); err != nil {
+		i.log.Infof("rejecting access token from client %s (key id %q): %s", src, kid,
+			err.Error())
+	}
+}
+
+// sharedSecret registers the shared secret that verifies an authenticated request.
+func (i *allocInterceptor) sharedSecret(p []byte, src net.Addr) {
+	if i.relay.secrets != nil {
+		i.relay.secrets.match(p, src)
+	}
+}
+
+// authRequest registers an authenticated request so that a failed authentication attempt can be
+// recorded when the TURN server rejects the request.
+func (i *allocInterceptor) authRequest(p []byte, src net.Addr) {
+	i.relay.lockout.request(p, src)
+}
+
+// channelBind remembers a ChannelBind request so that the channel can be registered with the
+// allocation when the TURN server accepts the request.
+func (i *allocInterceptor) channelBind(p []byte, src net.Addr) {
+	m := &stun.Message{Raw: p}
+	if err := m.Decode(); err != nil {
+		return
+	}
+
+	channel, err := m.Get(stun.AttrChannelNumber)
+	if err != nil || len(channel) < 2 {
+		return
+	}
+
+	var peer stun.XORMappedAddress
+	if err := peer.GetFromAs(m, stun.AttrXORPeerAddress); err != nil {
+		return
+	}
+
+	i.addPending(allocTransaction{client: src.String(), id: m.TransactionID}, allocRequest{
+		channel: binary.BigEndian.Uint16(channel[0:2]),
+		peer:    &net.UDPAddr{IP: peer.IP, Port: peer.Port},
+	})
+}
+
+// addPending remembers a request until the response is sent by the TURN server.
+func (i *allocInterceptor) addPending(tx allocTransaction, req allocRequest) {
+	now := time.Now()
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	if now.Sub(i.lastGC) > allocTransactionTimeout {
+		for tx, req := range i.pending {
+			if now.Sub(req.created) > allocTransactionTimeout {
+				delete(i.pending, tx)
+			}
+		}
+		i.lastGC = now
+	}
+
+	req.created = now
+	i.pending[tx] = req
+}
+
+// getPending returns and forgets the request a response sent by the TURN server belongs to.
+func (i *allocInterceptor) getPending(p []byte, dst net.Addr) (allocRequest, bool) {
+	tx := allocTransaction{client: dst.String()}
+	copy(tx.id[:], p[8:stunHeaderSize])
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+
+	req, ok := i.pending[tx]
+	delete(i.pending, tx)
+
+	return req, ok
+}
+
+// refresh caps the LIFETIME of a Refresh request received from a client at the time left until the
+// drain timeout expires during a graceful shutdown. Requests failing the integrity check are
+// passed on untouched for the TURN server to reject. Returns the rewritten request and true if the
+// request was modified.
+func (i *allocInterceptor) refresh(p []byte, src net.Addr) ([]byte, bool) {
+	if !isMessage(p, stun.MethodRefresh, stun.ClassRequest) || !i.relay.drain.draining() {
+		return p, false
+	}
+
+	m := &stun.Message{Raw: p}
+	if err := m.Decode(); err != nil {
+		return p, false
+	}
+
+	username, errUser := m.Get(stun.AttrUsername)
+	realm, errRealm := m.Get(stun.AttrRealm)
+	if errUser != nil || errRealm != nil {
+		return p, false
+	}
+
+	lt := defaultAllocationLifetime
+	if m.Contains(stun.AttrLifetime) {
+		lt = requestedLifetime(m)
+	}
+	if lt == 0 {
+		return p, false
+	}
+
+	capped := i.relay.drain.capLifetime(lt)
+	if capped == lt {
+		return p, false
+	}
+
+	// only re-sign requests that were signed with the right key in the first place, otherwise
+	// the rewrite would turn an unauthenticated request into a valid one
+	key, ok := i.authHandler(string(username), string(realm), src)
+	if !ok {
+		return p, false
+	}
+	if err := stun.MessageIntegrity(key).Check(m); err != nil {
+		return p, false
+	}
+
+	raw, err := rewriteLifetime(m, capped, key)
+	if err != nil {
+		i.log.Warnf("cannot rewrite refresh request from client %s: %s", src, err.Error())
+		return p, false
+	}
+
+	i.log.Debugf("capping allocation lifetime for client %s at %s: draining", src, capped)
+
+	return raw, true
+}
+
+// response processes a message sent by the TURN server to a client and returns the message to be
+// sent to the client.
+func (i *allocInterceptor) response(p []byte, dst net.Addr) []byte {
+	i.relay.lockout.response(p, dst, i.relay.Listener.Name)
+
+	if isMessage(p, stun.MethodChannelBind, stun.ClassSuccessResponse) {
+		if req, ok := i.getPending(p, dst); ok && req.peer != nil {
+			i.relay.allocs.bindChannel(i.relay.Listener.Name, dst, req.channel, req.peer)
+		}
+		return p
+	}
+
+	if isMessage(p, stun.MethodRefresh, stun.ClassSuccessResponse) {
+		// a zero lifetime deletes the allocation, which is traced separately
+		m := &stun.Message{Raw: p}
+		if m.Decode() == nil {
+			if lt, err := getLifetime(m); err == nil && lt > 0 {
+				i.relay.traceRefresh(dst, lt)
+			}
+		}
+		return p
+	}
+
+	if isMessage(p, stun.MethodAllocate, stun.ClassErrorResponse) {
+		return i.thirdPartyAuthorization(p)
+	}
+
+	if !isMessage(p, stun.MethodAllocate, stun.ClassSuccessResponse) {
+		return p
+	}
+
+	req, ok := i.getPending(p, dst)
+	if ok && req.peer != nil {
+		return p
+	}
+
+	m := &stun.Message{Raw: p}
+	if err := m.Decode(); err != nil {
+		return p
+	}
+
+	var relayed stun.XORMappedAddress
+	if err := relayed.GetFromAs(m, stun.AttrXORRelayedAddress); err != nil {
+		return p
+	}
+
+	// the request is unknown if the pending transaction has expired or was already answered:
+	// allocations that are not registered by now cannot be attributed to a user, so the quotas
+	// cannot be enforced on them
+	if !ok {
+		if i.relay.allocs.hasRelay(i.relay.Listener.Name, dst, relayed.Port) {
+			return p
+		}
+		i.log.Infof("rejecting allocation request from client %s: unknown transaction", dst)
+		i.relay.allocs.closeRelay(i.relay.Listener.Name, "udp", relayed.Port)
+		return allocErrorResponse(m, stun.CodeServerError, nil)
+	}
+
+	// the quotas are enforced once the TURN server has authenticated the request and created the
+	// relay: closing the relay deletes the allocation
+	code, admitted := i.relay.addAllocation("udp", req.username, dst,
+		&net.UDPAddr{IP: i.relay.relayIP(req.family), Port: relayed.Port})
+	if !admitted {
+		i.relay.allocs.closeRelay(i.relay.Listener.Name, "udp", relayed.Port)
+		key, _ := i.authHandler(req.username, req.realm, dst)
+		return allocErrorResponse(m, code, key)
+	}
+
+	if !req.rewrite {
+		return p
+	}
+
+	key, ok := i.authHandler(req.username, req.realm, dst)
+	if !ok {
+		return p
+	}
+
+	raw, err := rewriteRelayedAddress(m, i.relay.relayIP(req.family), key)
+	if err != nil {
+		i.log.Warnf("cannot rewrite relayed address for client %s: %s", dst, err.Error())
+		return p
+	}
+
+	return raw
+}
+
+// thirdPartyAuthorization adds the THIRD-PARTY-AUTHORIZATION attribute with the STUN server name to
+// the 401 (Unauthorized) responses to Allocate requests when third-party authorization is enabled,
+// see RFC 7635, Section 6.1.
+func (i *allocInterceptor) thirdPartyAuthorization(p []byte) []byte {
+	if i.relay.tokens == nil {
+		return p
+	}
+
+	serverName := i.relay.tokens.serverName()
+	if serverName == "" {
+		return p
+	}
+
+	m := &stun.Message{Raw: p}
+	if err := m.Decode(); err != nil {
+		return p
+	}
+
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(m); err != nil || code.Code != stun.CodeUnauthorized ||
+		m.Contains(stun.AttrMessageIntegrity) || m.Contains(a12n.AttrThirdPartyAuthorization) {
+		return p
+	}
+
+	raw, err := resignMessage(m, nil, a12n.AttrThirdPartyAuthorization, stun.RawAttribute{
+		Type:  a12n.AttrThirdPartyAuthorization,
+		Value: []byte(serverName),
+	})
+	if err != nil {
+		return p
+	}
+
+	return raw
+}
+
+// isMessage checks whether a buffer contains a STUN message of the given method and class without
+// decoding the whole message.
+func isMessage(p []byte, method stun.Method, class stun.MessageClass) bool {
+	if len(p) < stunHeaderSize || !stun.IsMessage(p) {
+		return false
+	}
+
+	var t stun.MessageType
+	t.ReadValue(binary.BigEndian.Uint16(p[0:2]))
+
+	return t.Method == method && t.Class == class
+}
+
+// allocErrorResponse builds an error response to an Allocate request. The response is signed with
+// the long-term credential key unless key is nil.
+func allocErrorResponse(m *stun.Message, code stun.ErrorCode, key []byte) []byte {
+	setters := []stun.Setter{stun.NewTransactionIDSetter(m.TransactionID),
+		stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse),
+		&stun.ErrorCodeAttribute{Code: code}}
+	if key != nil {
+		setters = append(setters, stun.MessageIntegrity(key))
+	}
+	setters = append(setters, stun.Fingerprint)
+
+	res, err := stun.Build(setters...)
+	if err != nil {
+		return nil
+	}
+
+	return res.Raw
+}
+
+// interceptPacketConn is a net.PacketConn that passes Allocate transactions through an
+// allocInterceptor.
+type interceptPacketConn struct {
+	net.PacketConn
+	interceptor *allocInterceptor
+}
+
+// ReadFrom reads the next packet that is to be handled by the TURN server.
+func (c *interceptPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		c.interceptor.accessToken(p[:n], addr)
+		c.interceptor.sharedSecret(p[:n], addr)
+		c.interceptor.authRequest(p[:n], addr)
+		if res := c.interceptor.request(p[:n], addr); res != nil {
+			c.PacketConn.WriteTo(res, addr) //nolint:errcheck
+			continue
+		}
+
+		if req, ok := c.interceptor.refresh(p[:n], addr); ok && len(req) <= len(p) {
+			n = copy(p, req)
+		}
+
+		return n, addr, nil
+	}
+}
+
+// WriteTo writes a packet to a client.
+func (c *interceptPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if _, err := c.PacketConn.WriteTo(c.interceptor.response(p, addr), addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// interceptListener is a net.Listener for datagram-oriented connections (e.g., DTLS) that passes
+// Allocate transactions through an allocInterceptor.
+type interceptListener struct {
+	net.Listener
+	interceptor *allocInterceptor
+}
+
+// Accept accepts a new connection.
+func (l *interceptListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &interceptConn{Conn: conn, interceptor: l.interceptor}, nil
+}
+
+// interceptConn is a datagram-oriented net.Conn that passes Allocate transactions through an
+// allocInterceptor. Each Read must return a single message.
+type interceptConn struct {
+	net.Conn
+	interceptor *allocInterceptor
+}
+
+// Read reads the next message that is to be handled by the TURN server.
+func (c *interceptConn) Read(p []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(p)
+		if err != nil {
+			return n, err
+		}
+
+		c.interceptor.accessToken(p[:n], c.RemoteAddr())
+		c.interceptor.sharedSecret(p[:n], c.RemoteAddr())
+		c.interceptor.authRequest(p[:n], c.RemoteAddr())
+		if res := c.interceptor.request(p[:n], c.RemoteAddr()); res != nil {
+			c.Conn.Write(res) //nolint:errcheck
+			continue
+		}
+
+		if req, ok := c.interceptor.refresh(p[:n], c.RemoteAddr()); ok && len(req) <= len(p) {
+			n = copy(p, req)
+		}
+
+		return n, nil
+	}
+}
+
+// Write writes a message to the client.
+func (c *interceptConn) Write(p []byte) (int, error) {
+	if _, err := c.Conn.Write(c.interceptor.response(p, c.RemoteAddr())); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -2,43 +2,65 @@ package object
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/url"
+	"os"
+	"reflect"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/pion/logging"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/l7mp/stunner/internal/telemetry"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 )
 
 const DefaultAdminObjectName = "DefaultAdmin"
 
+// debugServerShutdownTimeout bounds the time a reconciliation waits for the in-flight requests of
+// the debug server to finish.
+const debugServerShutdownTimeout = 5 * time.Second
+
 // Admin is the main object holding STUNner administration info.
 type Admin struct {
-	Name, LogLevel                       string
+	Name, LogLevel, LogFormat            string
 	DryRun                               bool
 	MetricsEndpoint, HealthCheckEndpoint string
+	DrainTimeout                         int
+	OTLP                                 *stnrv1.OTLPConfig
+	AccessLog                            *stnrv1.AccessLogConfig
+	Debug                                *stnrv1.DebugConfig
+	AdminToken                           string
 	metricsServer, healthCheckServer     *http.Server
+	debugServer                          *http.Server
+	otlp                                 *telemetry.OTLPExporter
+	accessLog                            atomic.Pointer[telemetry.AccessLog]
+	token                                atomic.Pointer[[]byte]
 	health                               *http.ServeMux
+	logLevel                             LogLevelHandler
 	log                                  logging.LeveledLogger
 }
 
 // NewAdmin creates a new Admin object.
-func NewAdmin(conf stnrv1.Config, dryRun bool, rc ReadinessHandler, status StatusHandler, logger logging.LoggerFactory) (Object, error) {
+func NewAdmin(conf stnrv1.Config, dryRun bool, handlers AdminHandlers, logger logging.LoggerFactory) (Object, error) {
 	req, ok := conf.(*stnrv1.AdminConfig)
 	if !ok {
 		return nil, stnrv1.ErrInvalidConf
 	}
 
 	admin := Admin{
-		DryRun: dryRun,
-		health: http.NewServeMux(),
-		log:    logger.NewLogger("stunner-admin"),
+		DryRun:   dryRun,
+		health:   http.NewServeMux(),
+		logLevel: handlers.LogLevel,
+		log:      logger.NewLogger("stunner-admin"),
 	}
 	admin.log.Tracef("NewAdmin: %s", req.String())
 
@@ -52,7 +74,7 @@ func NewAdmin(conf stnrv1.Config, dryRun bool, rc ReadinessHandler, status Statu
 	// readniness checker calls the checker from the factory
 	admin.health.HandleFunc("/ready", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		if err := rc(); err != nil {
+		if err := handlers.Readiness(); err != nil {
 			w.WriteHeader(http.StatusServiceUnavailable)
 
 			w.Write([]byte(fmt.Sprintf("{\"status\":%d,\"message\":\"%s\"}\n", //nolint:errcheck
@@ -66,7 +88,7 @@ func NewAdmin(conf stnrv1.Config, dryRun bool, rc ReadinessHandler, status Statu
 	// status handler returns the status
 	admin.health.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		if js, err := json.Marshal(status()); err != nil {
+		if js, err := json.Marshal(handlers.Status()); err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(fmt.Sprintf("{\"status\":%d,\"message\":\"%s\"}\n", //nolint:errcheck
 				http.StatusInternalServerError, err.Error())))
@@ -75,6 +97,141 @@ func NewAdmin(conf stnrv1.Config, dryRun bool, rc ReadinessHandler, status Statu
 			w.Write(js) //nolint:errcheck
 		}
 	})
+	// allocation handler lists the active allocations (GET), optionally filtered by listener,
+	// username and client IP, or terminates the matching allocations (DELETE) and optionally
+	// blocks new matching allocations for the number of seconds given in the "block" parameter;
+	// requires the admin token
+	admin.health.HandleFunc("/allocations", func(w http.ResponseWriter, req *http.Request) {
+		if !admin.authorize(w, req) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := req.URL.Query()
+		filter := stnrv1.AllocationFilter{
+			Listener: q.Get("listener"),
+			Username: q.Get("username"),
+			ClientIP: q.Get("client_ip"),
+		}
+
+		var list []*stnrv1.AllocationStatus
+		switch req.Method {
+		case http.MethodGet:
+			list = handlers.Allocations(filter)
+		case http.MethodDelete:
+			block := 0
+			if b := q.Get("block"); b != "" {
+				n, err := strconv.Atoi(b)
+				if err != nil || n < 0 {
+					writeError(w, http.StatusBadRequest, "invalid block period")
+					return
+				}
+				block = n
+			}
+			l, err := handlers.Termination(filter, time.Duration(block)*time.Second)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			list = l
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		if js, err := json.Marshal(list); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+		} else {
+			w.WriteHeader(http.StatusOK)
+			w.Write(js) //nolint:errcheck
+		}
+	})
+
+	// revocation handler lists the revoked ephemeral credentials (GET), revokes the credentials
+	// given by the "username", "user_id" and "issued_before" parameters (POST) and optionally
+	// terminates their allocations if "terminate" is set, or removes credentials from the
+	// revocation list (DELETE, no parameters clear all the runtime revocations); requires the
+	// admin token
+	admin.health.HandleFunc("/revocations", func(w http.ResponseWriter, req *http.Request) {
+		if !admin.authorize(w, req) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := req.URL.Query()
+		r := &stnrv1.RevocationConfig{
+			Usernames:    q["username"],
+			UserIDs:      q["user_id"],
+			IssuedBefore: q.Get("issued_before"),
+		}
+		if t := q.Get("terminate"); t != "" {
+			b, err := strconv.ParseBool(t)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "invalid terminate flag")
+				return
+			}
+			r.Terminate = b
+		}
+
+		var status *stnrv1.RevocationStatus
+		var err error
+		switch req.Method {
+		case http.MethodGet:
+			status, err = handlers.Revocation(nil, false)
+		case http.MethodPost:
+			if r.IsEmpty() {
+				writeError(w, http.StatusBadRequest, "empty revocation")
+				return
+			}
+			status, err = handlers.Revocation(r, false)
+		case http.MethodDelete:
+			status, err = handlers.Revocation(r, true)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if js, err := json.Marshal(status); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+		} else {
+			w.WriteHeader(http.StatusOK)
+			w.Write(js) //nolint:errcheck
+		}
+	})
+
+	// lockout handler lists the source IP addresses and the usernames with failed authentication
+	// attempts or recent lockouts (GET), optionally filtered by client IP and username, or
+	// unlocks them (DELETE); requires the admin token
+	admin.health.HandleFunc("/lockouts", func(w http.ResponseWriter, req *http.Request) {
+		if !admin.authorize(w, req) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := req.URL.Query()
+
+		var list []*stnrv1.LockoutStatus
+		switch req.Method {
+		case http.MethodGet:
+			list = handlers.Lockout(q.Get("client_ip"), q.Get("username"), false)
+		case http.MethodDelete:
+			list = handlers.Lockout(q.Get("client_ip"), q.Get("username"), true)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		if js, err := json.Marshal(list); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+		} else {
+			w.WriteHeader(http.StatusOK)
+			w.Write(js) //nolint:errcheck
+		}
+	})
 
 	if err := admin.Reconcile(req); err != nil && !errors.Is(err, ErrRestartRequired) {
 		return nil, err
@@ -105,6 +262,15 @@ func (a *Admin) Reconcile(conf stnrv1.Config) error {
 
 	a.Name = req.Name
 	a.LogLevel = req.LogLevel
+	a.LogFormat = req.LogFormat
+	a.DrainTimeout = req.DrainTimeout
+	a.AdminToken = req.AdminToken
+
+	a.token.Store(nil)
+	if req.AdminToken != "" {
+		token := []byte("Bearer " + req.AdminToken)
+		a.token.Store(&token)
+	}
 
 	// metrics server reconciliation errors are NOT FATAL: just warn if something goes wrong
 	// but otherwise go on with reconciliation
@@ -112,6 +278,22 @@ func (a *Admin) Reconcile(conf stnrv1.Config) error {
 		a.log.Warnf("error reconciling metrics server:", err.Error())
 	}
 
+	// OTLP exporter reconciliation errors are NOT FATAL either
+	if err := a.reconcileOTLP(req); err != nil {
+		a.log.Warnf("error reconciling OTLP exporter: %s", err.Error())
+	}
+
+	// debug server reconciliation errors are NOT FATAL
+	if err := a.reconcileDebug(req); err != nil {
+		a.log.Warnf("error reconciling debug server: %s", err.Error())
+	}
+
+	// access log reconciliation errors are FATAL: we do not want to silently lose the audit
+	// trail
+	if err := a.reconcileAccessLog(req); err != nil {
+		return err
+	}
+
 	// health-check server reconciliation errors are FATAL (may break Kubernetes
 	// liveness/readiness checks): return any error encountered
 	if err := a.reconcileHealthCheck(req); err != nil {
@@ -139,12 +321,28 @@ func (a *Admin) GetConfig() stnrv1.Config {
 	// copies
 	h := a.HealthCheckEndpoint
 
-	return &stnrv1.AdminConfig{
+	c := &stnrv1.AdminConfig{
 		Name:                a.Name,
 		LogLevel:            a.LogLevel,
+		LogFormat:           a.LogFormat,
 		MetricsEndpoint:     a.MetricsEndpoint,
 		HealthCheckEndpoint: &h,
+		DrainTimeout:        a.DrainTimeout,
+		AdminToken:          a.AdminToken,
+	}
+	if a.OTLP != nil {
+		c.OTLP = a.OTLP.DeepCopy()
 	}
+	if a.AccessLog != nil {
+		l := *a.AccessLog
+		c.AccessLog = &l
+	}
+	if a.Debug != nil {
+		d := *a.Debug
+		c.Debug = &d
+	}
+
+	return c
 }
 
 // Close closes the Admin object.
@@ -167,6 +365,27 @@ func (a *Admin) Close() error {
 		}
 	}
 
+	if a.otlp != nil {
+		if err := a.otlp.Close(); err != nil {
+			a.log.Debugf("error closing OTLP exporter: %s", err.Error())
+		}
+		a.otlp = nil
+	}
+
+	if a.debugServer != nil {
+		if err := a.debugServer.Close(); err != nil {
+			a.log.Debugf("error closing debug server %s: %s", a.Debug.Endpoint,
+				err.Error())
+		}
+		a.debugServer = nil
+	}
+
+	if l := a.accessLog.Swap(nil); l != nil {
+		if err := l.Close(); err != nil {
+			a.log.Debugf("error closing access log: %s", err.Error())
+		}
+	}
+
 	return nil
 }
 
@@ -175,9 +394,19 @@ func (a *Admin) Status() stnrv1.Status {
 	s := stnrv1.AdminStatus{
 		Name:                a.Name,
 		LogLevel:            a.LogLevel,
+		LogFormat:           a.LogFormat,
 		MetricsEndpoint:     a.MetricsEndpoint,
 		HealthCheckEndpoint: a.HealthCheckEndpoint,
 	}
+	if a.OTLP != nil {
+		s.OTLPEndpoint = a.OTLP.Endpoint
+	}
+	if a.AccessLog != nil {
+		s.AccessLog = a.AccessLog.Path
+	}
+	if a.Debug != nil {
+		s.DebugEndpoint = a.Debug.Endpoint
+	}
 
 	// add licensing status here
 	return &s
@@ -244,6 +473,248 @@ end:
 	return nil
 }
 
+// req MUST be validated!
+func (a *Admin) reconcileOTLP(req *stnrv1.AdminConfig) error {
+	a.log.Trace("reconcileOTLP")
+
+	// restart if: the config has changed
+	if !a.DryRun && !reflect.DeepEqual(req.OTLP, a.OTLP) {
+		if a.otlp != nil {
+			a.log.Tracef("stopping OTLP exporter: %s", a.OTLP.String())
+			if err := a.otlp.Close(); err != nil {
+				a.log.Debugf("error stopping OTLP exporter: %s", err.Error())
+			}
+			a.otlp = nil
+		}
+
+		if req.OTLP != nil {
+			a.log.Tracef("starting OTLP exporter: %s", req.OTLP.String())
+			e, err := telemetry.NewOTLPExporter(telemetry.OTLPOptions{
+				Endpoint:        req.OTLP.Endpoint,
+				Headers:         req.OTLP.Headers,
+				MetricsInterval: time.Duration(req.OTLP.MetricsInterval) * time.Second,
+				Metrics:         !req.OTLP.DisableMetrics,
+				Traces:          !req.OTLP.DisableTraces,
+				Instance:        a.Name,
+			}, a.log)
+			if err != nil {
+				// leave the config unset so that the next reconciliation retries
+				a.OTLP = nil
+				return fmt.Errorf("cannot start OTLP exporter at %s: %w",
+					req.OTLP.Endpoint, err)
+			}
+			a.otlp = e
+		}
+	}
+
+	a.OTLP = nil
+	if req.OTLP != nil {
+		a.OTLP = req.OTLP.DeepCopy()
+	}
+
+	return nil
+}
+
+// req MUST be validated!
+func (a *Admin) reconcileDebug(req *stnrv1.AdminConfig) error {
+	a.log.Trace("reconcileDebug")
+
+	// restart if: the config has changed
+	if !a.DryRun && !reflect.DeepEqual(req.Debug, a.Debug) {
+		if a.debugServer != nil {
+			a.log.Tracef("closing debug server: %s", a.Debug.String())
+			ctx, cancel := context.WithTimeout(context.Background(), debugServerShutdownTimeout)
+			if err := a.debugServer.Shutdown(ctx); err != nil {
+				a.log.Debugf("error stopping debug server: %s", err.Error())
+			}
+			cancel()
+			a.debugServer = nil
+		}
+
+		if req.Debug != nil {
+			a.log.Tracef("starting debug server: %s", req.Debug.String())
+			if err := a.startDebugServer(req.Debug); err != nil {
+				// leave the config unset so that the next reconciliation retries
+				a.Debug = nil
+				return err
+			}
+		}
+	}
+
+	a.Debug = nil
+	if req.Debug != nil {
+		d := *req.Debug
+		a.Debug = &d
+	}
+
+	return nil
+}
+
+// authorize checks whether an administrative request received on the health-check server presents
+// the admin token and writes an error response if not. Administrative requests are rejected if no
+// admin token is configured.
+func (a *Admin) authorize(w http.ResponseWriter, req *http.Request) bool {
+	token := a.token.Load()
+	if token == nil || !checkBearerToken(req, *token) {
+		writeUnauthorized(w)
+		return false
+	}
+	return true
+}
+
+func (a *Admin) startDebugServer(conf *stnrv1.DebugConfig) error {
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid debug server endpoint URL %s: %w", conf.Endpoint, err)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), strconv.Itoa(stnrv1.DefaultDebugPort))
+	}
+
+	mux := http.NewServeMux()
+	// loglevel handler returns the loglevels (GET) or overrides the loglevels with the level
+	// spec in the "level" parameter (PUT or POST), optionally reverting the loglevels after the
+	// number of seconds given in the "revert" parameter
+	mux.HandleFunc("/loglevel", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		q := req.URL.Query()
+
+		var status *stnrv1.LogLevelStatus
+		switch req.Method {
+		case http.MethodGet:
+			s, err := a.logLevel("", 0)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			status = s
+		case http.MethodPut, http.MethodPost:
+			level := q.Get("level")
+			if level == "" {
+				writeError(w, http.StatusBadRequest, "no loglevel")
+				return
+			}
+			revert := 0
+			if r := q.Get("revert"); r != "" {
+				n, err := strconv.Atoi(r)
+				if err != nil || n < 0 {
+					writeError(w, http.StatusBadRequest, "invalid revert timeout")
+					return
+				}
+				revert = n
+			}
+			s, err := a.logLevel(level, time.Duration(revert)*time.Second)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			status = s
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		if js, err := json.Marshal(status); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+		} else {
+			w.WriteHeader(http.StatusOK)
+			w.Write(js) //nolint:errcheck
+		}
+	})
+
+	if conf.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	// all requests must present the bearer token
+	token := []byte("Bearer " + conf.Token)
+	server := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !checkBearerToken(req, token) {
+				writeUnauthorized(w)
+				return
+			}
+			mux.ServeHTTP(w, req)
+		}),
+	}
+
+	// we separate Listen() and Serve(), so that we can return errors from the listener
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot start debug server at %s: %w", conf.Endpoint, err)
+	}
+	a.debugServer = server
+
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			if errors.Is(err, http.ErrServerClosed) {
+				a.log.Tracef("debug server: normal shutdown")
+			} else {
+				a.log.Warnf("debug server error at %s: %s", conf.Endpoint, err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// req MUST be validated!
+func (a *Admin) reconcileAccessLog(req *stnrv1.AdminConfig) error {
+	a.log.Trace("reconcileAccessLog")
+
+	// reopen if: the config has changed
+	if !a.DryRun && !reflect.DeepEqual(req.AccessLog, a.AccessLog) {
+		var l *telemetry.AccessLog
+		if req.AccessLog != nil {
+			a.log.Tracef("opening access log: %s", req.AccessLog.String())
+			opts := telemetry.AccessLogOptions{
+				MaxSize:    int64(req.AccessLog.MaxSize) << 20,
+				MaxBackups: req.AccessLog.MaxBackups,
+			}
+			switch req.AccessLog.Path {
+			case stnrv1.AccessLogStdout:
+				opts.Writer = os.Stdout
+			case stnrv1.AccessLogStderr:
+				opts.Writer = os.Stderr
+			default:
+				opts.Path = req.AccessLog.Path
+			}
+
+			var err error
+			if l, err = telemetry.NewAccessLog(opts, a.log); err != nil {
+				return err
+			}
+		}
+
+		// swap the new access log in before closing the old one
+		if old := a.accessLog.Swap(l); old != nil {
+			a.log.Tracef("closing access log: %s", a.AccessLog.String())
+			if err := old.Close(); err != nil {
+				a.log.Debugf("error closing access log: %s", err.Error())
+			}
+		}
+	}
+
+	a.AccessLog = nil
+	if req.AccessLog != nil {
+		l := *req.AccessLog
+		a.AccessLog = &l
+	}
+
+	return nil
+}
+
+// GetAccessLog returns the allocation access log, or nil if the access log is disabled.
+func (a *Admin) GetAccessLog() *telemetry.AccessLog {
+	return a.accessLog.Load()
+}
+
 // req MUST be validated!
 func (a *Admin) reconcileHealthCheck(req *stnrv1.AdminConfig) error {
 	a.log.Trace("reconcileHealthCheck")
@@ -315,15 +786,14 @@ end:
 
 // AdminFactory can create now Admin objects
 type AdminFactory struct {
-	dry    bool
-	rc     ReadinessHandler
-	status StatusHandler
-	logger logging.LoggerFactory
+	dry      bool
+	handlers AdminHandlers
+	logger   logging.LoggerFactory
 }
 
 // NewAdminFactory creates a new factory for Admin objects
-func NewAdminFactory(dryRun bool, rc ReadinessHandler, status StatusHandler, logger logging.LoggerFactory) Factory {
-	return &AdminFactory{dry: dryRun, rc: rc, status: status, logger: logger}
+func NewAdminFactory(dryRun bool, handlers AdminHandlers, logger logging.LoggerFactory) Factory {
+	return &AdminFactory{dry: dryRun, handlers: handlers, logger: logger}
 }
 
 // New can produce a new Admin object from the given configuration. A nil config will create an
@@ -333,7 +803,31 @@ func (f *AdminFactory) New(conf stnrv1.Config) (Object, error) {
 		return &Admin{}, nil
 	}
 
-	return NewAdmin(conf, f.dry, f.rc, f.status, f.logger)
+	return NewAdmin(conf, f.dry, f.handlers, f.logger)
+}
+
+// writeError writes an error response on the health-check or the debug server.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	js, _ := json.Marshal(struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	}{Status: code, Message: msg})
+	w.WriteHeader(code)
+	w.Write(append(js, '\n')) //nolint:errcheck
+}
+
+// checkBearerToken returns true if a request presents the given bearer token in the Authorization
+// header.
+func checkBearerToken(req *http.Request, token []byte) bool {
+	auth := []byte(req.Header.Get("Authorization"))
+	return subtle.ConstantTimeCompare(auth, token) == 1
+}
+
+// writeUnauthorized writes a 401 (Unauthorized) error response asking for a bearer token.
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeError(w, http.StatusUnauthorized, "unauthorized")
 }
 
 func getHealthAddr(e string) string {
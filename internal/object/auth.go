@@ -3,17 +3,53 @@ package object
 import (
 	// "fmt"
 	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pion/logging"
 
+	"github.com/l7mp/stunner/internal/telemetry"
 	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
 )
 
 // Auth is the STUNner authenticator
 type Auth struct {
 	Type                              stnrv1.AuthType
 	Realm, Username, Password, Secret string
-	Log                               logging.LeveledLogger
+	UserQuota, ClientQuota            int
+	quotas                            atomic.Pointer[[2]int] // user and client quota
+	// Tenants maps tenant names to the clusters the users of the tenant may reach.
+	Tenants map[string][]string
+	tenants atomic.Pointer[tenantPolicy]
+	// Secrets are the shared secrets of the ephemeral mode in addition to Secret.
+	Secrets []stnrv1.SharedSecret
+	secrets atomic.Pointer[[]SharedSecret]
+	// CredentialAlgorithm is the credential algorithm of the ephemeral mode.
+	CredentialAlgorithm string
+	// Revocations is the revocation list of the ephemeral mode from the config. Revocations
+	// added at runtime are kept in revoked across reconciliations.
+	Revocations *stnrv1.RevocationConfig
+	revoked     stnrv1.RevocationConfig
+	revokedLock sync.Mutex
+	revocations atomic.Pointer[revocationList]
+	// Lockout is the brute-force protection config, nil if disabled.
+	Lockout *stnrv1.LockoutConfig
+	lockout atomic.Pointer[LockoutPolicy]
+	// Users and UsersFile specify the static user table.
+	Users     []stnrv1.StaticUser
+	UsersFile string
+	users     atomic.Pointer[staticUserTable]
+	// OAuth is the RFC 7635 third-party authorization config, nil unless the type is "oauth".
+	OAuth     *stnrv1.OAuthConfig
+	oauthKeys atomic.Pointer[map[string][]byte]
+	// Webhook is the authentication webhook config, nil unless the type is "webhook".
+	Webhook *stnrv1.WebhookConfig
+	webhook atomic.Pointer[webhookClient]
+	Log     logging.LeveledLogger
 }
 
 // NewAuth creates a new authenticator.
@@ -53,22 +89,306 @@ func (auth *Auth) Reconcile(conf stnrv1.Config) error {
 	// type already validated
 	atype, _ := stnrv1.NewAuthType(req.Type)
 
+	var users *staticUserTable
+	if atype == stnrv1.AuthTypeStatic {
+		list := []stnrv1.StaticUser{}
+		if u, ok := req.Credentials["username"]; ok {
+			list = append(list, stnrv1.StaticUser{Username: u, Password: req.Credentials["password"]})
+		}
+		list = append(list, req.Users...)
+
+		var err error
+		if users, err = newStaticUserTable(list, req.UsersFile, auth.Log); err != nil {
+			return err
+		}
+	}
+
 	auth.Log.Debugf("using authentication: %s", atype.String())
 
 	// no error: update
 	auth.Type = atype
 	auth.Realm = req.Realm
+	auth.UserQuota = req.UserQuota
+	auth.ClientQuota = req.ClientQuota
+	auth.quotas.Store(&[2]int{req.UserQuota, req.ClientQuota})
+	auth.Tenants = nil
+	tenants := map[string][]string{}
+	if req.Tenants != nil {
+		auth.Tenants = make(map[string][]string, len(req.Tenants))
+		for k, v := range req.Tenants {
+			auth.Tenants[k] = append([]string{}, v...)
+			tenants[k] = append([]string{}, v...)
+		}
+	}
+	auth.tenants.Store(&tenantPolicy{authType: atype, tenants: tenants})
+	auth.Lockout = nil
+	auth.lockout.Store(nil)
+	if req.Lockout != nil {
+		auth.Lockout = req.Lockout.DeepCopy()
+		auth.lockout.Store(newLockoutPolicy(req.Lockout))
+	}
+	auth.OAuth = nil
+	auth.oauthKeys.Store(nil)
+	auth.Users, auth.UsersFile = nil, ""
+	auth.users.Store(users)
+	auth.Secret, auth.Secrets, auth.CredentialAlgorithm = "", nil, ""
+	auth.secrets.Store(nil)
+	telemetry.SetSharedSecrets(nil)
+	auth.Revocations = nil
+	if atype == stnrv1.AuthTypeEphemeral && req.Revocations != nil {
+		auth.Revocations = req.Revocations.DeepCopy()
+	}
+	auth.updateRevocations()
+	if atype != stnrv1.AuthTypeWebhook {
+		auth.Webhook = nil
+		if w := auth.webhook.Swap(nil); w != nil {
+			w.close()
+		}
+	}
 	switch atype {
 	case stnrv1.AuthTypeStatic:
 		auth.Username = req.Credentials["username"]
 		auth.Password = req.Credentials["password"]
+		if req.Users != nil {
+			auth.Users = make([]stnrv1.StaticUser, len(req.Users))
+			for i := range req.Users {
+				req.Users[i].DeepCopyInto(&auth.Users[i])
+			}
+		}
+		auth.UsersFile = req.UsersFile
 	case stnrv1.AuthTypeEphemeral:
 		auth.Secret = req.Credentials["secret"]
+		auth.CredentialAlgorithm = req.CredentialAlgorithm
+		if req.Secrets != nil {
+			auth.Secrets = make([]stnrv1.SharedSecret, len(req.Secrets))
+			copy(auth.Secrets, req.Secrets)
+		}
+		secrets := newSharedSecrets(req.GetSharedSecrets())
+		auth.secrets.Store(&secrets)
+
+		versions := make([]string, len(secrets))
+		for i, s := range secrets {
+			versions[i] = s.Version
+		}
+		telemetry.SetSharedSecrets(versions)
+	case stnrv1.AuthTypeOAuth:
+		// keys already validated
+		keys := make(map[string][]byte, len(req.OAuth.Keys))
+		for _, k := range req.OAuth.Keys {
+			keys[k.ID], _ = k.Decode()
+		}
+		auth.OAuth = req.OAuth.DeepCopy()
+		auth.oauthKeys.Store(&keys)
+	case stnrv1.AuthTypeWebhook:
+		// keep the response cache and the circuit breaker state unless the webhook changes
+		if auth.webhook.Load() == nil || !reflect.DeepEqual(auth.Webhook, req.Webhook) {
+			auth.Webhook = req.Webhook.DeepCopy()
+			if w := auth.webhook.Swap(newWebhookClient(req.Webhook, auth.Log)); w != nil {
+				w.close()
+			}
+		}
 	}
 
 	return nil
 }
 
+// GetStaticPassword returns the password of a user of the static user table. Returns an error if
+// the user does not exist, is disabled or has expired.
+func (auth *Auth) GetStaticPassword(username string) (string, error) {
+	users := auth.users.Load()
+	if users == nil {
+		return "", ErrInvalidUsername
+	}
+	return users.lookup(username)
+}
+
+// GetQuotas returns the per-user and the per-client allocation quota. Safe to call concurrently
+// with reconciliation.
+func (auth *Auth) GetQuotas() (int, int) {
+	quotas := auth.quotas.Load()
+	if quotas == nil {
+		return 0, 0
+	}
+	return quotas[0], quotas[1]
+}
+
+// GetSharedSecrets returns the shared secrets of the ephemeral mode accepted at the given time, the
+// active secret first.
+func (auth *Auth) GetSharedSecrets(now time.Time) []SharedSecret {
+	secrets := auth.secrets.Load()
+	if secrets == nil {
+		return nil
+	}
+
+	ret := make([]SharedSecret, 0, len(*secrets))
+	for _, s := range *secrets {
+		if s.IsValid(now) {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+// IsRevoked checks whether an ephemeral credential is revoked and returns the reason ("username",
+// "user-id" or "issued-before").
+func (auth *Auth) IsRevoked(username string) (string, bool) {
+	l := auth.revocations.Load()
+	if l == nil {
+		return "", false
+	}
+	return l.match(username)
+}
+
+// Revoke adds ephemeral credentials to the runtime revocation list, or removes them from it if
+// remove is set. Removing an empty revocation list clears the runtime revocation list. The
+// revocations in the config cannot be removed.
+func (auth *Auth) Revoke(req *stnrv1.RevocationConfig, remove bool) error {
+	if auth.Type != stnrv1.AuthTypeEphemeral {
+		return fmt.Errorf("revocation is not supported for auth type %s", auth.Type.String())
+	}
+
+	if err := req.Validate(); err != nil {
+		return err
+	}
+
+	auth.revokedLock.Lock()
+	switch {
+	case remove && req.IsEmpty():
+		auth.revoked = stnrv1.RevocationConfig{}
+	case remove:
+		removeRevocations(&auth.revoked, req)
+	default:
+		mergeRevocations(&auth.revoked, req)
+	}
+	auth.revokedLock.Unlock()
+
+	auth.updateRevocations()
+
+	return nil
+}
+
+// RevocationMatcher returns a function that checks whether a username is revoked by a validated
+// revocation list, using the credential TTL of the config.
+func (auth *Auth) RevocationMatcher(req *stnrv1.RevocationConfig) func(username string) bool {
+	ttl := &stnrv1.RevocationConfig{}
+	if auth.Revocations != nil {
+		ttl.CredentialTTL = auth.Revocations.CredentialTTL
+	}
+	l := newRevocationList(ttl, req)
+	return func(username string) bool {
+		_, revoked := l.match(username)
+		return revoked
+	}
+}
+
+// GetRevocations returns the revocation list of the ephemeral mode, including the revocations in
+// the config and the revocations added at runtime.
+func (auth *Auth) GetRevocations() stnrv1.RevocationConfig {
+	ret := stnrv1.RevocationConfig{CredentialTTL: stnrv1.DefaultCredentialTTL}
+	if auth.Revocations != nil {
+		ret = *auth.Revocations.DeepCopy()
+	}
+
+	auth.revokedLock.Lock()
+	mergeRevocations(&ret, &auth.revoked)
+	auth.revokedLock.Unlock()
+
+	return ret
+}
+
+// updateRevocations recompiles the revocation list.
+func (auth *Auth) updateRevocations() {
+	auth.revokedLock.Lock()
+	defer auth.revokedLock.Unlock()
+
+	if auth.Type != stnrv1.AuthTypeEphemeral ||
+		((auth.Revocations == nil || auth.Revocations.IsEmpty()) && auth.revoked.IsEmpty()) {
+		auth.revocations.Store(nil)
+		return
+	}
+
+	auth.revocations.Store(newRevocationList(auth.Revocations, &auth.revoked))
+}
+
+// GetLockoutPolicy returns the brute-force protection policy, or nil if lockout is disabled.
+func (auth *Auth) GetLockoutPolicy() *LockoutPolicy {
+	return auth.lockout.Load()
+}
+
+// tenantPolicy is a snapshot of the tenant config taken at reconciliation.
+type tenantPolicy struct {
+	authType stnrv1.AuthType
+	tenants  map[string][]string
+}
+
+// GetTenant returns the tenant of a user and the clusters the user may reach. The last return
+// value is false if the user has no tenant and may reach all clusters. Users of an unknown tenant
+// cannot reach any cluster.
+func (auth *Auth) GetTenant(username string) (string, []string, bool) {
+	tenant := auth.GetTenantName(username)
+	if tenant == "" {
+		return "", nil, false
+	}
+
+	return tenant, auth.GetTenantClusters(tenant), true
+}
+
+// HasTenants returns true if tenants are configured. Safe to call concurrently with
+// reconciliation.
+func (auth *Auth) HasTenants() bool {
+	p := auth.tenants.Load()
+	return p != nil && len(p.tenants) > 0
+}
+
+// GetTenantName returns the tenant of a user, or an empty string if the user has no tenant.
+func (auth *Auth) GetTenantName(username string) string {
+	p := auth.tenants.Load()
+	if p == nil {
+		return ""
+	}
+
+	switch p.authType {
+	case stnrv1.AuthTypeStatic:
+		if users := auth.users.Load(); users != nil {
+			return users.getTenant(username)
+		}
+	case stnrv1.AuthTypeEphemeral:
+		return a12n.GetTenant(username)
+	}
+	return ""
+}
+
+// GetTenantClusters returns the clusters the users of a tenant may reach, none if the tenant is
+// unknown.
+func (auth *Auth) GetTenantClusters(tenant string) []string {
+	p := auth.tenants.Load()
+	if p == nil {
+		return nil
+	}
+	return p.tenants[tenant]
+}
+
+// CallWebhook returns the TURN long-term credential key for a request from the authentication
+// webhook. Returns an error if the webhook rejects the request or fails.
+func (auth *Auth) CallWebhook(req stnrv1.WebhookRequest) ([]byte, error) {
+	w := auth.webhook.Load()
+	if w == nil {
+		return nil, errors.New("no authentication webhook")
+	}
+	return w.authenticate(req)
+}
+
+// GetOAuthKey returns the token encryption key for a key id. Safe to call concurrently with
+// reconciliation.
+func (auth *Auth) GetOAuthKey(kid string) ([]byte, bool) {
+	keys := auth.oauthKeys.Load()
+	if keys == nil {
+		return nil, false
+	}
+	key, ok := (*keys)[kid]
+	return key, ok
+}
+
 // ObjectName returns the name of the object
 func (auth *Auth) ObjectName() string {
 	// singleton!
@@ -87,13 +407,51 @@ func (auth *Auth) GetConfig() stnrv1.Config {
 		Type:        auth.Type.String(),
 		Realm:       auth.Realm,
 		Credentials: make(map[string]string),
+		UserQuota:   auth.UserQuota,
+		ClientQuota: auth.ClientQuota,
+	}
+	if auth.Lockout != nil {
+		r.Lockout = auth.Lockout.DeepCopy()
+	}
+	if auth.Tenants != nil {
+		r.Tenants = make(map[string][]string, len(auth.Tenants))
+		for k, v := range auth.Tenants {
+			r.Tenants[k] = append([]string{}, v...)
+		}
 	}
 	switch auth.Type {
 	case stnrv1.AuthTypeStatic:
-		r.Credentials["username"] = auth.Username
-		r.Credentials["password"] = auth.Password
+		if auth.Username != "" || auth.Password != "" {
+			r.Credentials["username"] = auth.Username
+			r.Credentials["password"] = auth.Password
+		}
+		if auth.Users != nil {
+			r.Users = make([]stnrv1.StaticUser, len(auth.Users))
+			for i := range auth.Users {
+				auth.Users[i].DeepCopyInto(&r.Users[i])
+			}
+		}
+		r.UsersFile = auth.UsersFile
 	case stnrv1.AuthTypeEphemeral:
-		r.Credentials["secret"] = auth.Secret
+		if auth.Secret != "" || auth.Secrets == nil {
+			r.Credentials["secret"] = auth.Secret
+		}
+		if auth.Secrets != nil {
+			r.Secrets = make([]stnrv1.SharedSecret, len(auth.Secrets))
+			copy(r.Secrets, auth.Secrets)
+		}
+		r.CredentialAlgorithm = auth.CredentialAlgorithm
+		if auth.Revocations != nil {
+			r.Revocations = auth.Revocations.DeepCopy()
+		}
+	case stnrv1.AuthTypeOAuth:
+		if auth.OAuth != nil {
+			r.OAuth = auth.OAuth.DeepCopy()
+		}
+	case stnrv1.AuthTypeWebhook:
+		if auth.Webhook != nil {
+			r.Webhook = auth.Webhook.DeepCopy()
+		}
 	}
 
 	return &r
@@ -102,12 +460,32 @@ func (auth *Auth) GetConfig() stnrv1.Config {
 // Close closes the authenticator
 func (auth *Auth) Close() error {
 	auth.Log.Tracef("Close")
+	if w := auth.webhook.Swap(nil); w != nil {
+		w.close()
+	}
 	return nil
 }
 
-// Status returns the status of the object.
+// Status returns the status of the object. The status is served on the health-check endpoint, so
+// the keys, the webhook headers, the passwords of the static users and the rotated shared secrets
+// are redacted: use GetConfig to obtain the full configuration.
 func (auth *Auth) Status() stnrv1.Status {
-	return auth.GetConfig()
+	status := auth.GetConfig().(*stnrv1.AuthConfig)
+	for i := range status.Users {
+		status.Users[i].Password = ""
+	}
+	for i := range status.Secrets {
+		status.Secrets[i].Secret = ""
+	}
+	if status.OAuth != nil {
+		for i := range status.OAuth.Keys {
+			status.OAuth.Keys[i].Key = ""
+		}
+	}
+	if status.Webhook != nil {
+		status.Webhook.Headers = nil
+	}
+	return status
 }
 
 // AuthFactory can create now Auth objects
@@ -0,0 +1,146 @@
+package object
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// Certificate is a TLS cert/key pair served for a set of server names.
+type Certificate struct {
+	Hostnames []string
+	Cert, Key []byte
+}
+
+// decodeCertificates decodes the TLS certs of a listener config.
+func decodeCertificates(req *stnrv1.ListenerConfig) ([]byte, []byte, []Certificate, error) {
+	cert, err := base64.StdEncoding.DecodeString(req.Cert)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid TLS certificate: base64-decode error: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(req.Key)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid TLS key: base64-decode error: %w", err)
+	}
+
+	var certs []Certificate
+	for i, c := range req.Certificates {
+		cert, err := base64.StdEncoding.DecodeString(c.Cert)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid TLS certificate #%d: base64-decode "+
+				"error: %w", i, err)
+		}
+		key, err := base64.StdEncoding.DecodeString(c.Key)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid TLS key #%d: base64-decode error: %w",
+				i, err)
+		}
+		hostnames := make([]string, len(c.Hostnames))
+		copy(hostnames, c.Hostnames)
+		certs = append(certs, Certificate{Hostnames: hostnames, Cert: cert, Key: key})
+	}
+
+	return cert, key, certs, nil
+}
+
+// certStore selects the TLS cert to serve based on the server name requested by the client.
+type certStore struct {
+	def    *tls.Certificate
+	byName map[string]*tls.Certificate
+}
+
+// newCertStore parses the default cert/key pair and the SNI certs. If there is no default cert
+// then the first SNI cert is used as a default.
+func newCertStore(cert, key []byte, certs []Certificate) (*certStore, error) {
+	s := &certStore{byName: map[string]*tls.Certificate{}}
+
+	if len(cert) > 0 || len(key) > 0 {
+		c, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		s.def = &c
+	}
+
+	for i := range certs {
+		c, err := tls.X509KeyPair(certs[i].Cert, certs[i].Key)
+		if err != nil {
+			return nil, fmt.Errorf("cert #%d: %w", i, err)
+		}
+
+		hostnames := certs[i].Hostnames
+		if len(hostnames) == 0 {
+			leaf, err := x509.ParseCertificate(c.Certificate[0])
+			if err != nil {
+				return nil, fmt.Errorf("cert #%d: %w", i, err)
+			}
+			hostnames = leaf.DNSNames
+			if len(hostnames) == 0 && leaf.Subject.CommonName != "" {
+				hostnames = []string{leaf.Subject.CommonName}
+			}
+		}
+
+		// the first cert wins
+		for _, h := range hostnames {
+			h = normalizeServerName(h)
+			if _, ok := s.byName[h]; !ok {
+				s.byName[h] = &c
+			}
+		}
+
+		if s.def == nil {
+			s.def = &c
+		}
+	}
+
+	if s.def == nil {
+		return nil, errors.New("no TLS certificate")
+	}
+
+	return s, nil
+}
+
+// get returns the cert for a server name: an exact match is preferred over a wildcard match and
+// the default cert is returned if there is no match.
+func (s *certStore) get(serverName string) *tls.Certificate {
+	name := normalizeServerName(serverName)
+	if name == "" {
+		return s.def
+	}
+
+	if c, ok := s.byName[name]; ok {
+		return c
+	}
+
+	if labels := strings.Split(name, "."); len(labels) > 1 {
+		labels[0] = "*"
+		if c, ok := s.byName[strings.Join(labels, ".")]; ok {
+			return c
+		}
+	}
+
+	return s.def
+}
+
+func normalizeServerName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// newCertPool parses a PEM bundle of CA certs.
+func newCertPool(bundle []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no valid CA certificate in PEM bundle")
+	}
+	return pool, nil
+}
+
+// clientAuthEnabled returns true if a client auth mode requests client certs.
+func clientAuthEnabled(mode string) bool {
+	return mode != "" && mode != stnrv1.ClientAuthNone
+}
@@ -0,0 +1,113 @@
+package object
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert generates a self-signed PEM cert/key pair with the given common name and DNS names.
+func testCert(t *testing.T, cn string, dnsNames ...string) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err, "generate key")
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err, "create cert")
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err, "marshal key")
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// commonName returns the common name of the leaf of a TLS cert.
+func commonName(t *testing.T, c *tls.Certificate) string {
+	t.Helper()
+
+	if !assert.NotNil(t, c, "cert") {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	assert.NoError(t, err, "parse cert")
+	return leaf.Subject.CommonName
+}
+
+func TestCertStore(t *testing.T) {
+	defCert, defKey := testCert(t, "default")
+	exactCert, exactKey := testCert(t, "exact", "turn.example.com")
+	wildcardCert, wildcardKey := testCert(t, "wildcard", "*.example.com")
+	otherCert, otherKey := testCert(t, "other", "turn.example.com", "other.example.org")
+	cnCert, cnKey := testCert(t, "cn.example.net")
+	explicitCert, explicitKey := testCert(t, "explicit", "ignored.example.org")
+
+	certs := []Certificate{
+		{Cert: wildcardCert, Key: wildcardKey},
+		{Cert: exactCert, Key: exactKey},
+		{Cert: otherCert, Key: otherKey},
+		{Cert: cnCert, Key: cnKey},
+		{Hostnames: []string{"Explicit.Example.Org"}, Cert: explicitCert, Key: explicitKey},
+	}
+
+	store, err := newCertStore(defCert, defKey, certs)
+	assert.NoError(t, err, "cert store")
+
+	for _, c := range []struct {
+		name, serverName, cert string
+	}{
+		{"no server name", "", "default"},
+		{"exact match preferred over wildcard", "turn.example.com", "exact"},
+		{"wildcard match", "media.example.com", "wildcard"},
+		{"wildcard matches a single label", "a.b.example.com", "default"},
+		{"wildcard does not match the apex", "example.com", "default"},
+		{"all DNS names of a cert", "other.example.org", "other"},
+		{"first cert wins over a later exact match", "turn.example.com", "exact"},
+		{"case insensitive", "TURN.Example.COM", "exact"},
+		{"trailing dot", "turn.example.com.", "exact"},
+		{"common name without DNS names", "cn.example.net", "cn.example.net"},
+		{"explicit hostnames", "explicit.example.org", "explicit"},
+		{"explicit hostnames override the DNS names", "ignored.example.org", "default"},
+		{"no match", "turn.example.net", "default"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.cert, commonName(t, store.get(c.serverName)), "cert")
+		})
+	}
+}
+
+func TestCertStoreDefault(t *testing.T) {
+	exactCert, exactKey := testCert(t, "exact", "turn.example.com")
+	wildcardCert, wildcardKey := testCert(t, "wildcard", "*.example.com")
+
+	store, err := newCertStore(nil, nil, []Certificate{
+		{Cert: exactCert, Key: exactKey},
+		{Cert: wildcardCert, Key: wildcardKey},
+	})
+	assert.NoError(t, err, "cert store")
+	assert.Equal(t, "exact", commonName(t, store.get("")), "first cert is the default")
+	assert.Equal(t, "exact", commonName(t, store.get("turn.example.org")), "no match")
+	assert.Equal(t, "wildcard", commonName(t, store.get("media.example.com")), "wildcard")
+
+	_, err = newCertStore(nil, nil, nil)
+	assert.Error(t, err, "no cert")
+	_, err = newCertStore(exactCert, wildcardKey, nil)
+	assert.Error(t, err, "key mismatch")
+	_, err = newCertStore(nil, nil, []Certificate{{Cert: exactCert, Key: wildcardKey}})
+	assert.Error(t, err, "SNI key mismatch")
+}
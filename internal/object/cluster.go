@@ -5,6 +5,7 @@ import (
 	"net"
 	"sort"
 	"strings"
+	"sync/atomic"
 
 	"github.com/pion/logging"
 
@@ -22,6 +23,9 @@ type Cluster struct {
 	Domains   []string
 	Resolver  resolver.DnsResolver // for strict DNS
 
+	BandwidthLimit int
+	bandwidthLimit atomic.Int64 // BandwidthLimit, safe for concurrent use
+
 	logger logging.LoggerFactory
 	log    logging.LeveledLogger
 }
@@ -76,6 +80,8 @@ func (c *Cluster) Reconcile(conf stnrv1.Config) error {
 	c.log.Tracef("Reconcile: %s", req.String())
 	c.Type, _ = stnrv1.NewClusterType(req.Type)
 	c.Protocol, _ = stnrv1.NewClusterProtocol(req.Protocol)
+	c.BandwidthLimit = req.BandwidthLimit
+	c.bandwidthLimit.Store(int64(req.BandwidthLimit))
 
 	switch c.Type {
 	case stnrv1.ClusterTypeStatic:
@@ -114,6 +120,12 @@ func (c *Cluster) Reconcile(conf stnrv1.Config) error {
 	return nil
 }
 
+// GetBandwidthLimit returns the per-allocation bandwidth limit of the cluster. Safe to call
+// concurrently with reconciliation.
+func (c *Cluster) GetBandwidthLimit() int {
+	return int(c.bandwidthLimit.Load())
+}
+
 // ObjectName returns the name of the object.
 func (c *Cluster) ObjectName() string {
 	// singleton!
@@ -128,9 +140,10 @@ func (c *Cluster) ObjectType() string {
 // GetConfig returns the configuration of the running cluster.
 func (c *Cluster) GetConfig() stnrv1.Config {
 	conf := stnrv1.ClusterConfig{
-		Name:     c.Name,
-		Protocol: c.Protocol.String(),
-		Type:     c.Type.String(),
+		Name:           c.Name,
+		Protocol:       c.Protocol.String(),
+		Type:           c.Type.String(),
+		BandwidthLimit: c.BandwidthLimit,
 	}
 
 	switch c.Type {
@@ -2,11 +2,17 @@ package object
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"fmt"
 	"net"
+	"reflect"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pion/logging"
 	"github.com/pion/transport/v3"
@@ -22,10 +28,23 @@ type Listener struct {
 	Proto                  stnrv1.ListenerProtocol
 	Addr                   net.IP
 	Port, MinPort, MaxPort int
-	PublicAddr             string // for GetConfig()
-	PublicPort             int    // for GetConfig()
-	rawAddr                string // net.IP.String() may rewrite the string representation
+	Quota                  int
+	quota                  atomic.Int64 // Quota, safe for concurrent use
+	BandwidthLimit         int
+	bandwidthLimit         atomic.Int64 // BandwidthLimit, safe for concurrent use
+	AllocBandwidthLimit    int
+	allocBandwidthLimit    atomic.Int64 // AllocBandwidthLimit, safe for concurrent use
+	PublicAddr             string       // for GetConfig()
+	PublicPort             int          // for GetConfig()
+	rawAddr                string       // net.IP.String() may rewrite the string representation
 	Cert, Key              []byte
+	Certificates           []Certificate // SNI certs
+	certs                  *certStore    // parsed from the TLS creds on the first handshake
+	ClientAuth             string
+	ClientCA               []byte
+	ClientCertUsername     string
+	clientCAs              *x509.CertPool // parsed from ClientCA on the first handshake
+	certLock               sync.RWMutex
 	Conns                  []any // either a set of turn.ListenerConfigs or turn.PacketConnConfigs
 	Server                 *turn.Server
 	Routes                 []string
@@ -83,26 +102,43 @@ func (l *Listener) Inspect(old, new, full stnrv1.Config) (bool, error) {
 	changed := !old.DeepEqual(req)
 
 	proto, _ := stnrv1.NewListenerProtocol(req.Protocol)
-	cert, err := base64.StdEncoding.DecodeString(req.Cert)
+	cert, key, certs, err := decodeCertificates(req)
 	if err != nil {
-		return false, fmt.Errorf("invalid TLS certificate: base64-decode error: %w", err)
+		return false, err
 	}
-	key, err := base64.StdEncoding.DecodeString(req.Key)
+	clientCA, err := base64.StdEncoding.DecodeString(req.ClientCA)
 	if err != nil {
-		return false, fmt.Errorf("invalid TLS key: base64-decode error: %w", err)
+		return false, fmt.Errorf("invalid client CA: base64-decode error: %w", err)
 	}
 
-	// the only chance we don't need a restart if only the Routes and/or PublicIP/PublicPort change
+	// the only chance we don't need a restart if only the Routes, PublicIP/PublicPort and/or
+	// the TLS creds change
 	restart := ErrRestartRequired
 	if l.Name == req.Name && // name unchanged (should always be true)
 		l.Proto == proto && // protocol unchanged
 		l.rawAddr == req.Addr && // address unchanged
 		l.Port == req.Port && // ports unchanged
-		bytes.Equal(l.Cert, cert) && // TLS creds unchanged
-		bytes.Equal(l.Key, key) {
+		l.MinPort == req.MinRelayPort && // relay port range unchanged
+		l.MaxPort == req.MaxRelayPort &&
+		clientAuthEnabled(l.ClientAuth) == clientAuthEnabled(req.ClientAuth) { // client auth unchanged
 		restart = nil
 	}
 
+	// TLS creds are swapped in place, unless they are invalid: then we restart so that the error
+	// surfaces when the listener is restarted
+	if restart == nil && !l.certificatesEqual(cert, key, certs) {
+		if _, err := newCertStore(cert, key, certs); err != nil {
+			l.log.Tracef("listener %s restarts due to invalid TLS cert/key: %s", l.Name, err)
+			restart = ErrRestartRequired
+		}
+	}
+	if restart == nil && clientAuthEnabled(req.ClientAuth) && !l.clientCAEqual(clientCA) {
+		if _, err := newCertPool(clientCA); err != nil {
+			l.log.Tracef("listener %s restarts due to invalid client CA: %s", l.Name, err)
+			restart = ErrRestartRequired
+		}
+	}
+
 	// if the realm changes then we have to restart
 	if l.Realm != stunnerConf.Auth.Realm {
 		l.log.Tracef("listener %s restarts due to changing auth realm", l.Name)
@@ -140,18 +176,30 @@ func (l *Listener) Reconcile(conf stnrv1.Config) error {
 	l.Addr = ipAddr
 	l.rawAddr = req.Addr
 	l.Port = req.Port
-	if proto == stnrv1.ListenerProtocolTURNTLS || proto == stnrv1.ListenerProtocolTURNDTLS {
-		cert, err := base64.StdEncoding.DecodeString(req.Cert)
+	l.MinPort = req.MinRelayPort
+	l.MaxPort = req.MaxRelayPort
+	l.Quota = req.Quota
+	l.quota.Store(int64(req.Quota))
+	l.BandwidthLimit = req.BandwidthLimit
+	l.bandwidthLimit.Store(int64(req.BandwidthLimit))
+	l.AllocBandwidthLimit = req.AllocationBandwidthLimit
+	l.allocBandwidthLimit.Store(int64(req.AllocationBandwidthLimit))
+	if proto == stnrv1.ListenerProtocolTURNTLS || proto == stnrv1.ListenerProtocolTURNDTLS ||
+		proto == stnrv1.ListenerProtocolTLS || proto == stnrv1.ListenerProtocolDTLS {
+		cert, key, certs, err := decodeCertificates(req)
 		if err != nil {
-			return fmt.Errorf("invalid TLS certificate: base64-decode error: %w", err)
+			return err
 		}
-		key, err := base64.StdEncoding.DecodeString(req.Key)
+		l.setCertificates(cert, key, certs)
+
+		clientCA, err := base64.StdEncoding.DecodeString(req.ClientCA)
 		if err != nil {
-			return fmt.Errorf("invalid TLS key: base64-decode error: %w", err)
+			return fmt.Errorf("invalid client CA: base64-decode error: %w", err)
 		}
-		l.Cert = cert
-		l.Key = key
+		l.setClientCA(clientCA)
 	}
+	l.ClientAuth = req.ClientAuth
+	l.ClientCertUsername = req.ClientCertUsername
 	l.Realm = l.getRealm()
 
 	l.PublicAddr = req.PublicAddr
@@ -163,10 +211,114 @@ func (l *Listener) Reconcile(conf stnrv1.Config) error {
 	return nil
 }
 
+// certificatesEqual returns true if the TLS creds of the listener are unchanged.
+func (l *Listener) certificatesEqual(cert, key []byte, certs []Certificate) bool {
+	l.certLock.RLock()
+	defer l.certLock.RUnlock()
+
+	return bytes.Equal(l.Cert, cert) && bytes.Equal(l.Key, key) &&
+		reflect.DeepEqual(l.Certificates, certs)
+}
+
+// setCertificates updates the TLS creds. New TLS/DTLS handshakes will pick up the new
+// certificates, existing sessions are not affected.
+func (l *Listener) setCertificates(cert, key []byte, certs []Certificate) {
+	if l.certificatesEqual(cert, key, certs) {
+		return
+	}
+
+	l.certLock.Lock()
+	defer l.certLock.Unlock()
+
+	if l.Cert != nil || l.Key != nil || l.Certificates != nil {
+		l.log.Infof("updating TLS certificates for listener %s", l.Name)
+	}
+
+	l.Cert = cert
+	l.Key = key
+	l.Certificates = certs
+	l.certs = nil
+}
+
+// GetCertificate returns the TLS certificate of the listener for the server name requested by
+// the client, or the default certificate if no certificate matches. This can be used in the
+// GetCertificate callback of the TLS/DTLS listener config to swap certificates without
+// restarting the listener.
+func (l *Listener) GetCertificate(serverName string) (*tls.Certificate, error) {
+	l.certLock.RLock()
+	certs := l.certs
+	l.certLock.RUnlock()
+	if certs != nil {
+		return certs.get(serverName), nil
+	}
+
+	l.certLock.Lock()
+	defer l.certLock.Unlock()
+
+	if l.certs == nil {
+		certs, err := newCertStore(l.Cert, l.Key, l.Certificates)
+		if err != nil {
+			return nil, err
+		}
+		l.certs = certs
+	}
+
+	return l.certs.get(serverName), nil
+}
+
+// clientCAEqual returns true if the client CA bundle of the listener is unchanged.
+func (l *Listener) clientCAEqual(clientCA []byte) bool {
+	l.certLock.RLock()
+	defer l.certLock.RUnlock()
+
+	return bytes.Equal(l.ClientCA, clientCA)
+}
+
+// setClientCA updates the client CA bundle. New TLS/DTLS handshakes will verify client certs
+// using the new CA bundle, existing sessions are not affected.
+func (l *Listener) setClientCA(clientCA []byte) {
+	if l.clientCAEqual(clientCA) {
+		return
+	}
+
+	l.certLock.Lock()
+	defer l.certLock.Unlock()
+
+	if l.ClientCA != nil {
+		l.log.Infof("updating client CA for listener %s", l.Name)
+	}
+
+	l.ClientCA = clientCA
+	l.clientCAs = nil
+}
+
+// GetClientCAs returns the pool of CA certs used to verify client certs at the listener.
+func (l *Listener) GetClientCAs() (*x509.CertPool, error) {
+	l.certLock.RLock()
+	pool := l.clientCAs
+	l.certLock.RUnlock()
+	if pool != nil {
+		return pool, nil
+	}
+
+	l.certLock.Lock()
+	defer l.certLock.Unlock()
+
+	if l.clientCAs == nil {
+		pool, err := newCertPool(l.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		l.clientCAs = pool
+	}
+
+	return l.clientCAs, nil
+}
+
 // String returns a short stable string representation of the listener, safe for applying as a key in a map.
 func (l *Listener) String() string {
-	uri := fmt.Sprintf("%s: [%s://%s:%d<%d:%d>]", l.Name, strings.ToLower(l.Proto.String()),
-		l.Addr, l.Port, l.MinPort, l.MaxPort)
+	uri := fmt.Sprintf("%s: [%s://%s<%d:%d>]", l.Name, strings.ToLower(l.Proto.String()),
+		net.JoinHostPort(l.Addr.String(), strconv.Itoa(l.Port)), l.MinPort, l.MaxPort)
 	return uri
 }
 
@@ -186,16 +338,33 @@ func (l *Listener) GetConfig() stnrv1.Config {
 	sort.Strings(l.Routes)
 
 	c := &stnrv1.ListenerConfig{
-		Name:       l.Name,
-		Protocol:   l.Proto.String(),
-		Addr:       l.rawAddr,
-		Port:       l.Port,
-		PublicAddr: l.PublicAddr,
-		PublicPort: l.PublicPort,
+		Name:         l.Name,
+		Protocol:     l.Proto.String(),
+		Addr:         l.rawAddr,
+		Port:         l.Port,
+		MinRelayPort: l.MinPort,
+		MaxRelayPort: l.MaxPort,
+		Quota:        l.Quota,
+		PublicAddr:   l.PublicAddr,
+		PublicPort:   l.PublicPort,
 	}
+	c.BandwidthLimit = l.BandwidthLimit
+	c.AllocationBandwidthLimit = l.AllocBandwidthLimit
+	c.ClientAuth = l.ClientAuth
+	c.ClientCertUsername = l.ClientCertUsername
 
 	c.Cert = string(l.Cert)
 	c.Key = string(l.Key)
+	c.ClientCA = string(l.ClientCA)
+	for _, cert := range l.Certificates {
+		hostnames := make([]string, len(cert.Hostnames))
+		copy(hostnames, cert.Hostnames)
+		c.Certificates = append(c.Certificates, stnrv1.CertificateConfig{
+			Hostnames: hostnames,
+			Cert:      string(cert.Cert),
+			Key:       string(cert.Key),
+		})
+	}
 
 	c.Routes = make([]string, len(l.Routes))
 	copy(c.Routes, l.Routes)
@@ -209,7 +378,7 @@ func (l *Listener) Close() error {
 
 	for _, c := range l.Conns {
 		switch l.Proto {
-		case stnrv1.ListenerProtocolTURNUDP:
+		case stnrv1.ListenerProtocolTURNUDP, stnrv1.ListenerProtocolUDP:
 			l.log.Tracef("closing %s packet socket at %s", l.Proto.String(), l.Addr)
 
 			conn, ok := c.(turn.PacketConnConfig)
@@ -221,7 +390,8 @@ func (l *Listener) Close() error {
 			if err := conn.PacketConn.Close(); err != nil && !util.IsClosedErr(err) {
 				return err
 			}
-		case stnrv1.ListenerProtocolTURNTCP, stnrv1.ListenerProtocolTURNTLS, stnrv1.ListenerProtocolTURNDTLS:
+		case stnrv1.ListenerProtocolTURNTCP, stnrv1.ListenerProtocolTURNTLS, stnrv1.ListenerProtocolTURNDTLS,
+			stnrv1.ListenerProtocolTCP, stnrv1.ListenerProtocolTLS, stnrv1.ListenerProtocolDTLS:
 			l.log.Tracef("closing %s listener socket at %s", l.Proto.String(), l.Addr)
 
 			conn, ok := c.(turn.ListenerConfig)
@@ -249,6 +419,24 @@ func (l *Listener) Close() error {
 	return nil
 }
 
+// GetQuota returns the allocation quota of the listener. Safe to call concurrently with
+// reconciliation.
+func (l *Listener) GetQuota() int {
+	return int(l.quota.Load())
+}
+
+// GetBandwidthLimits returns the aggregate and the per-allocation bandwidth limit of the listener.
+// Safe to call concurrently with reconciliation.
+func (l *Listener) GetBandwidthLimits() (int, int) {
+	return int(l.bandwidthLimit.Load()), int(l.allocBandwidthLimit.Load())
+}
+
+// GetRelayPortRange returns the relay port range of the listener.
+func (l *Listener) GetRelayPortRange() (int, int) {
+	c := stnrv1.ListenerConfig{MinRelayPort: l.MinPort, MaxRelayPort: l.MaxPort}
+	return c.GetRelayPortRange()
+}
+
 // Status returns the status of the object.
 func (l *Listener) Status() stnrv1.Status {
 	return l.GetConfig()
@@ -0,0 +1,58 @@
+package object
+
+import (
+	"net"
+	"time"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// LockoutPolicy is the brute-force protection policy.
+type LockoutPolicy struct {
+	// ClientThreshold and UserThreshold are the number of failed attempts that lock out a
+	// source IP address and a username, respectively. The username lockout is disabled if
+	// UserThreshold is not positive.
+	ClientThreshold, UserThreshold int
+	// Window is the time failed attempts are remembered.
+	Window time.Duration
+	// Duration and MaxDuration are the first and the maximum lockout period.
+	Duration, MaxDuration time.Duration
+	allowlist             []*net.IPNet
+}
+
+// newLockoutPolicy converts a validated lockout config.
+func newLockoutPolicy(req *stnrv1.LockoutConfig) *LockoutPolicy {
+	p := &LockoutPolicy{
+		ClientThreshold: req.ClientThreshold,
+		UserThreshold:   req.UserThreshold,
+		Window:          time.Duration(req.Window) * time.Second,
+		Duration:        time.Duration(req.Duration) * time.Second,
+		MaxDuration:     time.Duration(req.MaxDuration) * time.Second,
+	}
+
+	for _, a := range req.Allowlist {
+		if ip := net.ParseIP(a); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			p.allowlist = append(p.allowlist, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if _, n, err := net.ParseCIDR(a); err == nil { // already validated
+			p.allowlist = append(p.allowlist, n)
+		}
+	}
+
+	return p
+}
+
+// IsAllowed returns true if an IP address is on the allowlist.
+func (p *LockoutPolicy) IsAllowed(ip net.IP) bool {
+	for _, n := range p.allowlist {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,10 @@
 package object
 
-import stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+import (
+	"time"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
 
 // Object is the high-level interface for all STUNner objects like listeners, clusters, etc.
 type Object interface {
@@ -34,3 +38,37 @@ type RealmHandler = func() string
 
 // StatusHandler is a callback that allows an object to obtain the status of STUNNer.
 type StatusHandler = func() stnrv1.Status
+
+// AllocationHandler is a callback that allows an object to list the active allocations.
+type AllocationHandler = func(filter stnrv1.AllocationFilter) []*stnrv1.AllocationStatus
+
+// TerminationHandler is a callback that allows an object to terminate the active allocations
+// matching a filter and block new matching allocations for a cool-down period.
+type TerminationHandler = func(filter stnrv1.AllocationFilter, block time.Duration) ([]*stnrv1.AllocationStatus, error)
+
+// RevocationHandler is a callback that allows an object to add revoked ephemeral credentials to
+// the revocation list or remove them from the list at runtime. A nil request returns the
+// revocation list.
+type RevocationHandler = func(req *stnrv1.RevocationConfig, remove bool) (*stnrv1.RevocationStatus, error)
+
+// LockoutHandler is a callback that allows an object to list the source IP addresses and the
+// usernames with failed authentication attempts matching a client IP and a username, or to reset
+// them if unlock is set.
+type LockoutHandler = func(clientIP, username string, unlock bool) []*stnrv1.LockoutStatus
+
+// LogLevelHandler is a callback that allows an object to query the loglevels and, if the level
+// spec is not empty, to override the loglevels, restoring the previous loglevels after the revert
+// timeout if positive.
+type LogLevelHandler = func(levelSpec string, revert time.Duration) (*stnrv1.LogLevelStatus, error)
+
+// AdminHandlers holds the callbacks the Admin object uses to serve the health-check, the
+// administrative and the debug endpoints.
+type AdminHandlers struct {
+	Readiness   ReadinessHandler
+	Status      StatusHandler
+	Allocations AllocationHandler
+	Termination TerminationHandler
+	Revocation  RevocationHandler
+	Lockout     LockoutHandler
+	LogLevel    LogLevelHandler
+}
@@ -0,0 +1,101 @@
+package object
+
+import (
+	"time"
+
+	"github.com/l7mp/stunner/internal/util"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
+)
+
+// revocationList is a compiled list of revoked ephemeral credentials.
+type revocationList struct {
+	usernames    map[string]bool
+	userIDs      map[string]bool
+	issuedBefore time.Time
+	ttl          time.Duration
+}
+
+// newRevocationList merges validated revocation lists. The credential TTL is taken from the first
+// list, the latest cutoff wins.
+func newRevocationList(lists ...*stnrv1.RevocationConfig) *revocationList {
+	l := &revocationList{
+		usernames: map[string]bool{},
+		userIDs:   map[string]bool{},
+		ttl:       time.Duration(stnrv1.DefaultCredentialTTL) * time.Second,
+	}
+
+	for i, r := range lists {
+		if r == nil {
+			continue
+		}
+		if i == 0 && r.CredentialTTL > 0 {
+			l.ttl = time.Duration(r.CredentialTTL) * time.Second
+		}
+		for _, u := range r.Usernames {
+			l.usernames[u] = true
+		}
+		for _, id := range r.UserIDs {
+			l.userIDs[id] = true
+		}
+		if t, _ := r.GetIssuedBefore(); t.After(l.issuedBefore) { // already validated
+			l.issuedBefore = t
+		}
+	}
+
+	return l
+}
+
+// match returns the reason why a username is revoked ("username", "user-id" or "issued-before").
+// Returns false if the username is not revoked.
+func (l *revocationList) match(username string) (string, bool) {
+	if l.usernames[username] {
+		return "username", true
+	}
+
+	if len(l.userIDs) > 0 && l.userIDs[a12n.GetUserID(username)] {
+		return "user-id", true
+	}
+
+	if !l.issuedBefore.IsZero() {
+		if expiry, ok := a12n.GetExpiry(username); ok && expiry.Add(-l.ttl).Before(l.issuedBefore) {
+			return "issued-before", true
+		}
+	}
+
+	return "", false
+}
+
+// mergeRevocations adds the revocations of a validated revocation list to another list.
+func mergeRevocations(dst *stnrv1.RevocationConfig, src *stnrv1.RevocationConfig) {
+	for _, u := range src.Usernames {
+		if !util.Member(dst.Usernames, u) {
+			dst.Usernames = append(dst.Usernames, u)
+		}
+	}
+	for _, id := range src.UserIDs {
+		if !util.Member(dst.UserIDs, id) {
+			dst.UserIDs = append(dst.UserIDs, id)
+		}
+	}
+	if src.IssuedBefore != "" {
+		s, _ := src.GetIssuedBefore() // already validated
+		if d, _ := dst.GetIssuedBefore(); s.After(d) {
+			dst.IssuedBefore = src.IssuedBefore
+		}
+	}
+}
+
+// removeRevocations removes the usernames and user-ids of a revocation list from another list,
+// and the cutoff if the list contains a cutoff.
+func removeRevocations(dst *stnrv1.RevocationConfig, src *stnrv1.RevocationConfig) {
+	for _, u := range src.Usernames {
+		dst.Usernames = util.Remove(dst.Usernames, u)
+	}
+	for _, id := range src.UserIDs {
+		dst.UserIDs = util.Remove(dst.UserIDs, id)
+	}
+	if src.IssuedBefore != "" {
+		dst.IssuedBefore = ""
+	}
+}
@@ -0,0 +1,36 @@
+package object
+
+import (
+	"time"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// SharedSecret is a shared secret of the ephemeral authentication mode.
+type SharedSecret struct {
+	// Version identifies the secret.
+	Version string
+	// Secret is the shared authentication secret.
+	Secret string
+	// Algorithm is the credential algorithm used with the secret.
+	Algorithm string
+	// Expiry is the time after which the secret is no longer accepted, zero if the secret
+	// never expires.
+	Expiry time.Time
+}
+
+// IsValid returns true if the secret is accepted at the given time.
+func (s *SharedSecret) IsValid(now time.Time) bool {
+	return s.Expiry.IsZero() || now.Before(s.Expiry)
+}
+
+// newSharedSecrets converts a validated list of shared secrets.
+func newSharedSecrets(list []stnrv1.SharedSecret) []SharedSecret {
+	ret := make([]SharedSecret, 0, len(list))
+	for _, s := range list {
+		expiry, _ := s.GetExpiry() // already validated
+		ret = append(ret, SharedSecret{Version: s.Version, Secret: s.Secret,
+			Algorithm: s.Algorithm, Expiry: expiry})
+	}
+	return ret
+}
@@ -0,0 +1,178 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"sigs.k8s.io/yaml"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// staticUsersFileCheckInterval is the minimum time between two checks of the static users file for
+// changes.
+const staticUsersFileCheckInterval = time.Second
+
+var (
+	// ErrInvalidUsername is returned when a user does not exist.
+	ErrInvalidUsername = errors.New("invalid username")
+	// ErrUserDisabled is returned when a user is disabled.
+	ErrUserDisabled = errors.New("user disabled")
+	// ErrUserExpired is returned when a user has expired.
+	ErrUserExpired = errors.New("user expired")
+)
+
+type staticUser struct {
+	password string
+	expiry   time.Time
+	enabled  bool
+	tenant   string
+}
+
+// staticUserTable is the user table of the static authentication mode. The users specified in the
+// auth config take precedence over the users loaded from the users file. The users file is
+// reloaded on the first lookup after the file changes, at most once per second.
+type staticUserTable struct {
+	users     map[string]staticUser
+	file      string
+	fileUsers map[string]staticUser
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+	lock      sync.Mutex
+	log       logging.LeveledLogger
+}
+
+func newStaticUserTable(users []stnrv1.StaticUser, file string, log logging.LeveledLogger) (*staticUserTable, error) {
+	t := &staticUserTable{
+		users:     make(map[string]staticUser, len(users)),
+		file:      file,
+		fileUsers: map[string]staticUser{},
+		lastCheck: time.Now(),
+		log:       log,
+	}
+
+	for _, u := range users {
+		expiry, err := u.GetExpiry()
+		if err != nil {
+			return nil, err
+		}
+		t.users[u.Username] = staticUser{password: u.Password, expiry: expiry, enabled: u.IsEnabled(),
+			tenant: u.Tenant}
+	}
+
+	if file != "" {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load static users file: %w", err)
+		}
+		if err := t.load(info); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// lookup returns the password of a user. Returns an error if the user does not exist, is disabled or
+// has expired.
+func (t *staticUserTable) lookup(username string) (string, error) {
+	now := time.Now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.check(now)
+
+	u, ok := t.users[username]
+	if !ok {
+		u, ok = t.fileUsers[username]
+	}
+	if !ok {
+		return "", ErrInvalidUsername
+	}
+	if !u.enabled {
+		return "", ErrUserDisabled
+	}
+	if !u.expiry.IsZero() && !now.Before(u.expiry) {
+		return "", ErrUserExpired
+	}
+
+	return u.password, nil
+}
+
+// getTenant returns the tenant of a user, or an empty string if the user does not exist or has no
+// tenant.
+func (t *staticUserTable) getTenant(username string) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	u, ok := t.users[username]
+	if !ok {
+		u = t.fileUsers[username]
+	}
+
+	return u.tenant
+}
+
+// check reloads the users file if it has changed since the last load. Errors are logged and the
+// previous users are kept. Must be called with the lock held.
+func (t *staticUserTable) check(now time.Time) {
+	if t.file == "" || now.Sub(t.lastCheck) < staticUsersFileCheckInterval {
+		return
+	}
+	t.lastCheck = now
+
+	info, err := os.Stat(t.file)
+	if err != nil {
+		t.log.Warnf("cannot check static users file: %s", err.Error())
+		return
+	}
+
+	if info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return
+	}
+
+	if err := t.load(info); err != nil {
+		t.log.Errorf("cannot reload static users file, keeping %d users: %s",
+			len(t.fileUsers), err.Error())
+		return
+	}
+
+	t.log.Infof("static users file %s reloaded: %d users", t.file, len(t.fileUsers))
+}
+
+// load loads the users file. Must be called with the lock held.
+func (t *staticUserTable) load(info os.FileInfo) error {
+	buf, err := os.ReadFile(t.file)
+	if err != nil {
+		return fmt.Errorf("cannot load static users file: %w", err)
+	}
+
+	list := []stnrv1.StaticUser{}
+	if err := yaml.Unmarshal(buf, &list); err != nil {
+		return fmt.Errorf("cannot parse static users file %s: %w", t.file, err)
+	}
+
+	users := make(map[string]staticUser, len(list))
+	for _, u := range list {
+		if err := u.Validate(); err != nil {
+			return fmt.Errorf("invalid static users file %s: %w", t.file, err)
+		}
+		if _, ok := users[u.Username]; ok {
+			return fmt.Errorf("invalid static users file %s: duplicate username %q", t.file,
+				u.Username)
+		}
+		expiry, _ := u.GetExpiry() // already validated
+		users[u.Username] = staticUser{password: u.Password, expiry: expiry, enabled: u.IsEnabled(),
+			tenant: u.Tenant}
+	}
+
+	t.fileUsers, t.modTime, t.size = users, info.ModTime(), info.Size()
+
+	return nil
+}
@@ -0,0 +1,315 @@
+package object
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/l7mp/stunner/internal/telemetry"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
+)
+
+const (
+	// webhookMaxResponseSize is the maximum size of a webhook response body.
+	webhookMaxResponseSize = 64 * 1024
+	// webhookCacheGCInterval is the interval at which expired cache entries are removed.
+	webhookCacheGCInterval = time.Minute
+	// webhookCacheSize is the maximum number of cached webhook responses.
+	webhookCacheSize = 10000
+)
+
+var (
+	// ErrWebhookRejected is returned when the authentication webhook rejects a request.
+	ErrWebhookRejected = errors.New("rejected by the authentication webhook")
+	// ErrWebhookUnavailable is returned when the circuit breaker of the authentication webhook
+	// is open.
+	ErrWebhookUnavailable = errors.New("authentication webhook unavailable: circuit breaker open")
+)
+
+// webhookCacheKey identifies a cached webhook response. The client port is omitted so that the
+// clients cannot evade the cache by connecting from new ports.
+type webhookCacheKey struct {
+	username, realm, clientIP string
+}
+
+func newWebhookCacheKey(req stnrv1.WebhookRequest) webhookCacheKey {
+	ip := req.Client
+	if host, _, err := net.SplitHostPort(req.Client); err == nil {
+		ip = host
+	}
+	return webhookCacheKey{username: req.Username, realm: req.Realm, clientIP: ip}
+}
+
+// String returns the key of the in-flight webhook call for the cache key.
+func (k webhookCacheKey) String() string {
+	return k.username + "\x00" + k.realm + "\x00" + k.clientIP
+}
+
+// webhookCacheEntry is a cached webhook response: a nil key is a cached rejection.
+type webhookCacheEntry struct {
+	key     []byte
+	reason  string
+	expires time.Time
+}
+
+// webhookClient calls the authentication webhook, caches the responses and implements a circuit
+// breaker: after FailureThreshold consecutive failures the breaker opens and requests are failed
+// without calling the webhook until the breaker timeout expires, after which a single probe
+// request is let through. A successful probe closes the breaker, a failed one reopens it. The
+// cache holds at most webhookCacheSize entries and expired entries are removed periodically.
+// Concurrent uncached requests with the same cache key share a single webhook call.
+type webhookClient struct {
+	conf      stnrv1.WebhookConfig
+	client    *http.Client
+	cache     map[webhookCacheKey]webhookCacheEntry
+	inflight  singleflight.Group
+	done      chan struct{}
+	failures  int
+	openUntil time.Time
+	probing   bool
+	lock      sync.Mutex
+	log       logging.LeveledLogger
+}
+
+func newWebhookClient(conf *stnrv1.WebhookConfig, log logging.LeveledLogger) *webhookClient {
+	w := &webhookClient{
+		conf: *conf.DeepCopy(),
+		client: &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+			Timeout:   time.Duration(conf.Timeout) * time.Millisecond,
+		},
+		cache: map[webhookCacheKey]webhookCacheEntry{},
+		done:  make(chan struct{}),
+		log:   log,
+	}
+
+	go w.runGC()
+
+	return w
+}
+
+// runGC removes the expired cache entries periodically until the client is closed.
+func (w *webhookClient) runGC() {
+	ticker := time.NewTicker(webhookCacheGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case now := <-ticker.C:
+			w.lock.Lock()
+			w.gc(now)
+			w.lock.Unlock()
+		}
+	}
+}
+
+// gc removes the expired cache entries. Must be called with the lock held.
+func (w *webhookClient) gc(now time.Time) {
+	for k, e := range w.cache {
+		if !now.Before(e.expires) {
+			delete(w.cache, k)
+		}
+	}
+}
+
+// store caches a webhook response. If the cache is full then the expired entries are removed,
+// and if this does not make room then the entry closest to expiry is evicted. Must be called with
+// the lock held.
+func (w *webhookClient) store(k webhookCacheKey, e webhookCacheEntry, now time.Time) {
+	if _, ok := w.cache[k]; !ok && len(w.cache) >= webhookCacheSize {
+		w.gc(now)
+	}
+
+	if _, ok := w.cache[k]; !ok && len(w.cache) >= webhookCacheSize {
+		var victim webhookCacheKey
+		var expires time.Time
+		for k, e := range w.cache {
+			if expires.IsZero() || e.expires.Before(expires) {
+				victim, expires = k, e.expires
+			}
+		}
+		delete(w.cache, victim)
+	}
+
+	w.cache[k] = e
+}
+
+// authenticate returns the TURN long-term credential key for a request.
+func (w *webhookClient) authenticate(req stnrv1.WebhookRequest) ([]byte, error) {
+	k := newWebhookCacheKey(req)
+	key, err, _ := w.inflight.Do(k.String(), func() (any, error) {
+		return w.fetch(req, k)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key.([]byte), nil
+}
+
+// fetch returns the key for a request from the cache or, on a cache miss, from the webhook.
+func (w *webhookClient) fetch(req stnrv1.WebhookRequest, k webhookCacheKey) ([]byte, error) {
+	now := time.Now()
+
+	w.lock.Lock()
+	if e, ok := w.cache[k]; ok && now.Before(e.expires) {
+		w.lock.Unlock()
+		if e.key == nil {
+			return nil, fmt.Errorf("%w (cached): %s", ErrWebhookRejected, e.reason)
+		}
+		return e.key, nil
+	}
+
+	if now.Before(w.openUntil) || w.probing {
+		w.lock.Unlock()
+		telemetry.IncrementWebhookFailures("circuit_open")
+		return nil, ErrWebhookUnavailable
+	}
+	if w.failures >= w.conf.FailureThreshold {
+		// breaker timeout expired: let a single probe request through
+		w.probing = true
+	}
+	w.lock.Unlock()
+
+	key, reason, err := w.call(req)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.probing = false
+	if err != nil {
+		w.failures++
+		if w.failures >= w.conf.FailureThreshold {
+			w.log.Warnf("authentication webhook failed %d times: opening circuit breaker for "+
+				"%d seconds", w.failures, w.conf.BreakerTimeout)
+			w.openUntil = time.Now().Add(time.Duration(w.conf.BreakerTimeout) * time.Second)
+		}
+		return nil, err
+	}
+
+	if w.failures >= w.conf.FailureThreshold {
+		w.log.Info("authentication webhook recovered: closing circuit breaker")
+	}
+	w.failures, w.openUntil = 0, time.Time{}
+
+	ttl := time.Duration(w.conf.CacheTTL) * time.Second
+	if key == nil {
+		ttl = time.Duration(w.conf.NegativeCacheTTL) * time.Second
+	}
+	w.store(k, webhookCacheEntry{key: key, reason: reason, expires: now.Add(ttl)}, now)
+
+	if key == nil {
+		return nil, fmt.Errorf("%w: %s", ErrWebhookRejected, reason)
+	}
+
+	return key, nil
+}
+
+// call sends a request to the webhook. Returns the key, or a nil key and the reason if the webhook
+// rejected the request, or an error if the webhook failed.
+func (w *webhookClient) call(req stnrv1.WebhookRequest) ([]byte, string, error) {
+	start := time.Now()
+
+	key, reason, err := w.do(req)
+
+	result := "allow"
+	switch {
+	case err != nil:
+		result = "error"
+	case key == nil:
+		result = "deny"
+	}
+	telemetry.ObserveWebhook(result, time.Since(start))
+
+	return key, reason, err
+}
+
+func (w *webhookClient) do(req stnrv1.WebhookRequest) ([]byte, string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		telemetry.IncrementWebhookFailures("error")
+		return nil, "", err
+	}
+
+	r, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.conf.URL,
+		bytes.NewReader(body))
+	if err != nil {
+		telemetry.IncrementWebhookFailures("error")
+		return nil, "", err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range w.conf.Headers {
+		r.Header.Set(k, v)
+	}
+
+	res, err := w.client.Do(r)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			telemetry.IncrementWebhookFailures("timeout")
+			return nil, "", fmt.Errorf("authentication webhook timed out: %w", err)
+		}
+		telemetry.IncrementWebhookFailures("error")
+		return nil, "", fmt.Errorf("authentication webhook failed: %w", err)
+	}
+	defer res.Body.Close() //nolint:errcheck
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		io.Copy(io.Discard, io.LimitReader(res.Body, webhookMaxResponseSize)) //nolint:errcheck
+		return nil, res.Status, nil
+	default:
+		io.Copy(io.Discard, io.LimitReader(res.Body, webhookMaxResponseSize)) //nolint:errcheck
+		telemetry.IncrementWebhookFailures("status")
+		return nil, "", fmt.Errorf("authentication webhook failed: unexpected status %s",
+			res.Status)
+	}
+
+	resp := stnrv1.WebhookResponse{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, webhookMaxResponseSize)).Decode(&resp); err != nil {
+		telemetry.IncrementWebhookFailures("response")
+		return nil, "", fmt.Errorf("authentication webhook failed: invalid response: %w", err)
+	}
+
+	if !resp.Allow {
+		if resp.Reason == "" {
+			resp.Reason = "no reason given"
+		}
+		return nil, resp.Reason, nil
+	}
+
+	switch {
+	case resp.Key != "":
+		key, err := hex.DecodeString(resp.Key)
+		if err != nil || len(key) == 0 {
+			telemetry.IncrementWebhookFailures("response")
+			return nil, "", fmt.Errorf("authentication webhook failed: invalid key")
+		}
+		return key, "", nil
+	case resp.Password != "":
+		return a12n.GenerateAuthKey(req.Username, req.Realm, resp.Password), "", nil
+	default:
+		telemetry.IncrementWebhookFailures("response")
+		return nil, "", fmt.Errorf("authentication webhook failed: no key or password in response")
+	}
+}
+
+// close stops the cache garbage collector and releases the idle connections to the webhook.
+func (w *webhookClient) close() {
+	close(w.done)
+	w.client.CloseIdleConnections()
+}
@@ -0,0 +1,304 @@
+package object
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
+	"github.com/l7mp/stunner/pkg/logger"
+)
+
+// testWebhook is a webhook server that answers based on the username and counts the calls.
+type testWebhook struct {
+	*httptest.Server
+	calls int
+	fail  bool
+	lock  sync.Mutex
+}
+
+func newTestWebhook() *testWebhook {
+	h := &testWebhook{}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := stnrv1.WebhookRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		h.lock.Lock()
+		h.calls++
+		fail := h.fail
+		h.lock.Unlock()
+
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		res := stnrv1.WebhookResponse{}
+		switch req.Username {
+		case "password":
+			res = stnrv1.WebhookResponse{Allow: true, Password: "passwd"}
+		case "key":
+			res = stnrv1.WebhookResponse{Allow: true, Key: hex.EncodeToString([]byte("key"))}
+		case "denied":
+			res = stnrv1.WebhookResponse{Allow: false, Reason: "denied"}
+		case "forbidden":
+			w.WriteHeader(http.StatusForbidden)
+			return
+		case "invalid-key":
+			res = stnrv1.WebhookResponse{Allow: true, Key: "not-hex"}
+		case "no-key":
+			res = stnrv1.WebhookResponse{Allow: true}
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(res) //nolint:errcheck
+	}))
+	return h
+}
+
+func (h *testWebhook) numCalls() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.calls
+}
+
+func (h *testWebhook) setFail(fail bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.fail = fail
+}
+
+func newTestWebhookClient(t *testing.T, url string, threshold int) *webhookClient {
+	t.Helper()
+
+	conf := &stnrv1.WebhookConfig{URL: url, Timeout: stnrv1.MaxWebhookTimeout,
+		FailureThreshold: threshold}
+	assert.NoError(t, conf.Validate(), "validate")
+	log := logger.NewLoggerFactory("all:ERROR").NewLogger("webhook")
+	return newWebhookClient(conf, log)
+}
+
+func TestWebhookCache(t *testing.T) {
+	h := newTestWebhook()
+	defer h.Close()
+
+	for _, c := range []struct {
+		name, username string
+		key            []byte
+		err            error
+		cached         bool
+	}{
+		{"password", "password", a12n.GenerateAuthKey("password", "realm", "passwd"), nil, true},
+		{"key", "key", []byte("key"), nil, true},
+		{"denied", "denied", nil, ErrWebhookRejected, true},
+		{"forbidden", "forbidden", nil, ErrWebhookRejected, true},
+		{"invalid key", "invalid-key", nil, errors.New("failure"), false},
+		{"no key", "no-key", nil, errors.New("failure"), false},
+		{"server error", "error", nil, errors.New("failure"), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w := newTestWebhookClient(t, h.URL, 100)
+			defer w.close()
+
+			req := stnrv1.WebhookRequest{Username: c.username, Realm: "realm",
+				Client: "127.0.0.1:1234", Listener: "udp"}
+			calls := h.numCalls()
+			for i := 0; i < 2; i++ {
+				key, err := w.authenticate(req)
+				assert.Equal(t, c.key, key, "key")
+				if c.err == nil {
+					assert.NoError(t, err, "authenticate")
+				} else if assert.Error(t, err, "authenticate") && c.err == ErrWebhookRejected {
+					assert.ErrorIs(t, err, ErrWebhookRejected, "rejected")
+				}
+				// the client port is not part of the cache key
+				req.Client = "127.0.0.1:1235"
+			}
+
+			if c.cached {
+				assert.Equal(t, calls+1, h.numCalls(), "cached")
+			} else {
+				assert.Equal(t, calls+2, h.numCalls(), "not cached")
+			}
+
+			// the cache is keyed on the client IP
+			req.Client = "127.0.0.2:1234"
+			w.authenticate(req) //nolint:errcheck
+			if c.cached {
+				assert.Equal(t, calls+2, h.numCalls(), "new client IP")
+			}
+		})
+	}
+}
+
+func TestWebhookCacheExpiry(t *testing.T) {
+	h := newTestWebhook()
+	defer h.Close()
+
+	w := newTestWebhookClient(t, h.URL, 100)
+	defer w.close()
+
+	req := stnrv1.WebhookRequest{Username: "password", Realm: "realm", Client: "127.0.0.1"}
+	_, err := w.authenticate(req)
+	assert.NoError(t, err, "authenticate")
+	assert.Equal(t, 1, h.numCalls(), "webhook called")
+
+	k := newWebhookCacheKey(req)
+	w.lock.Lock()
+	e := w.cache[k]
+	assert.Equal(t, time.Duration(stnrv1.DefaultWebhookCacheTTL)*time.Second,
+		time.Until(e.expires).Round(time.Second), "cache TTL")
+	e.expires = time.Now()
+	w.cache[k] = e
+	w.lock.Unlock()
+
+	_, err = w.authenticate(req)
+	assert.NoError(t, err, "authenticate")
+	assert.Equal(t, 2, h.numCalls(), "expired entry refreshed")
+
+	w.lock.Lock()
+	w.gc(time.Now().Add(time.Duration(stnrv1.DefaultWebhookCacheTTL+1) * time.Second))
+	assert.Empty(t, w.cache, "expired entries removed")
+	w.lock.Unlock()
+}
+
+func TestWebhookCacheEviction(t *testing.T) {
+	w := &webhookClient{cache: map[webhookCacheKey]webhookCacheEntry{}}
+	now := time.Now()
+	key := func(i int) webhookCacheKey {
+		return webhookCacheKey{username: fmt.Sprintf("user%d", i)}
+	}
+	entry := func(ttl time.Duration) webhookCacheEntry {
+		return webhookCacheEntry{key: []byte("key"), expires: now.Add(ttl)}
+	}
+
+	for i := 0; i < webhookCacheSize; i++ {
+		w.store(key(i), entry(time.Hour+time.Duration(i)*time.Second), now)
+	}
+	assert.Len(t, w.cache, webhookCacheSize, "cache full")
+
+	w.store(key(0), entry(2*time.Hour), now)
+	assert.Len(t, w.cache, webhookCacheSize, "existing entries are updated in place")
+	assert.Contains(t, w.cache, key(1), "no eviction")
+
+	w.store(key(webhookCacheSize), entry(time.Hour), now)
+	assert.Len(t, w.cache, webhookCacheSize, "cache size bounded")
+	assert.NotContains(t, w.cache, key(1), "entry closest to expiry evicted")
+	assert.Contains(t, w.cache, key(0), "updated entry kept")
+
+	w.cache[key(2)] = entry(-time.Second)
+	w.cache[key(3)] = entry(-time.Second)
+	w.store(key(webhookCacheSize+1), entry(time.Hour), now)
+	assert.Len(t, w.cache, webhookCacheSize-1, "expired entries removed first")
+	assert.Contains(t, w.cache, key(4), "no eviction")
+}
+
+func TestWebhookCircuitBreaker(t *testing.T) {
+	h := newTestWebhook()
+	defer h.Close()
+
+	w := newTestWebhookClient(t, h.URL, 2)
+	defer w.close()
+
+	auth := func(username string) error {
+		_, err := w.authenticate(stnrv1.WebhookRequest{Username: username, Realm: "realm",
+			Client: "127.0.0.1"})
+		return err
+	}
+	// expire lets the breaker timeout expire
+	expire := func() {
+		w.lock.Lock()
+		w.openUntil = time.Now()
+		w.lock.Unlock()
+	}
+
+	assert.NoError(t, auth("password"), "cached")
+	assert.ErrorIs(t, auth("denied"), ErrWebhookRejected, "cached")
+
+	for _, c := range []struct {
+		name, username       string
+		fail, expire, called bool
+		err                  error
+	}{
+		{"first failure", "key", true, false, true, errors.New("failure")},
+		{"cached rejections do not count", "denied", true, false, false, ErrWebhookRejected},
+		{"threshold reached", "key", true, false, true, errors.New("failure")},
+		{"breaker open", "key", true, false, false, ErrWebhookUnavailable},
+		{"cached responses are served", "password", true, false, false, nil},
+		{"failed probe", "key", true, true, true, errors.New("failure")},
+		{"breaker reopened", "key", false, false, false, ErrWebhookUnavailable},
+		{"successful probe", "key", false, true, true, nil},
+		{"failures counted from zero", "no-key", false, false, true, errors.New("failure")},
+		{"breaker closed", "forbidden", false, false, true, ErrWebhookRejected},
+	} {
+		h.setFail(c.fail)
+		if c.expire {
+			expire()
+		}
+
+		calls := h.numCalls()
+		err := auth(c.username)
+		switch c.err {
+		case nil:
+			assert.NoError(t, err, c.name)
+		case ErrWebhookRejected, ErrWebhookUnavailable:
+			assert.ErrorIs(t, err, c.err, c.name)
+		default:
+			assert.Error(t, err, c.name)
+			assert.NotErrorIs(t, err, ErrWebhookUnavailable, c.name)
+		}
+		if c.called {
+			assert.Equal(t, calls+1, h.numCalls(), "%s: webhook called", c.name)
+		} else {
+			assert.Equal(t, calls, h.numCalls(), "%s: webhook not called", c.name)
+		}
+	}
+}
+
+func TestWebhookInflight(t *testing.T) {
+	block := make(chan struct{})
+	calls := 0
+	var lock sync.Mutex
+	h := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		<-block
+		json.NewEncoder(w).Encode(stnrv1.WebhookResponse{Allow: true, Password: "passwd"}) //nolint:errcheck
+	}))
+	defer h.Close()
+
+	w := newTestWebhookClient(t, h.URL, 100)
+	defer w.close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			_, err := w.authenticate(stnrv1.WebhookRequest{Username: "user", Realm: "realm",
+				Client: fmt.Sprintf("127.0.0.1:%d", port)})
+			assert.NoError(t, err, "authenticate")
+		}(1000 + i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(block)
+	wg.Wait()
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 1, calls, "concurrent requests share a webhook call")
+}
@@ -0,0 +1,171 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pion/logging"
+)
+
+const accessLogFileMode = 0o640
+
+// AccessLogOptions configures an access log.
+type AccessLogOptions struct {
+	// Path is the file the access log is written to. If empty, the records are written to
+	// Writer.
+	Path string
+	// Writer is the output of the access log if no Path is given, e.g., the standard output.
+	Writer io.Writer
+	// MaxSize is the size in bytes at which the access log file is rotated. Zero disables
+	// rotation.
+	MaxSize int64
+	// MaxBackups is the number of rotated access log files retained.
+	MaxBackups int
+}
+
+// AccessLog writes access log records as JSON objects, one record per line, to a file with
+// size-based rotation or to a writer. The rotated files are named <path>.1, <path>.2, etc., with
+// <path>.1 being the most recent.
+type AccessLog struct {
+	opts   AccessLogOptions
+	file   *os.File
+	out    io.Writer
+	size   int64
+	closed bool
+	lock   sync.Mutex
+	log    logging.LeveledLogger
+}
+
+// NewAccessLog opens a new access log.
+func NewAccessLog(opts AccessLogOptions, log logging.LeveledLogger) (*AccessLog, error) {
+	l := &AccessLog{opts: opts, out: opts.Writer, log: log}
+
+	if opts.Path != "" {
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.out == nil {
+		return nil, fmt.Errorf("no access log output")
+	}
+
+	return l, nil
+}
+
+// Write writes a record to the access log. Errors are logged but otherwise ignored.
+func (l *AccessLog) Write(record any) {
+	if l == nil {
+		return
+	}
+
+	buf, err := json.Marshal(record)
+	if err != nil {
+		l.log.Errorf("cannot encode access log record: %s", err.Error())
+		return
+	}
+	buf = append(buf, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	if l.opts.Path != "" {
+		switch {
+		case l.file == nil:
+			// a previous rotation failed to reopen the file: retry
+			if err := l.open(); err != nil {
+				l.log.Errorf("cannot write access log: %s", err.Error())
+				return
+			}
+		case l.opts.MaxSize > 0 && l.size > 0 && l.size+int64(len(buf)) > l.opts.MaxSize:
+			if err := l.rotate(); err != nil {
+				l.log.Errorf("cannot rotate access log %s: %s", l.opts.Path, err.Error())
+				if l.file == nil {
+					return
+				}
+			}
+		}
+	}
+
+	n, err := l.out.Write(buf)
+	l.size += int64(n)
+	if err != nil {
+		l.log.Errorf("cannot write access log: %s", err.Error())
+	}
+}
+
+// Close closes the access log. Records written after the access log is closed are dropped.
+func (l *AccessLog) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.closed = true
+	if l.file != nil {
+		err := l.file.Close()
+		l.file = nil
+		return err
+	}
+
+	return nil
+}
+
+// open opens the access log file for appending.
+func (l *AccessLog) open() error {
+	f, err := os.OpenFile(l.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, accessLogFileMode)
+	if err != nil {
+		return fmt.Errorf("cannot open access log: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close() //nolint:errcheck
+		return fmt.Errorf("cannot open access log: %w", err)
+	}
+
+	l.file, l.out, l.size = f, f, info.Size()
+
+	return nil
+}
+
+// rotate shifts the rotated files, renames the current file to <path>.1 and opens a new file.
+// Must be called with the lock held.
+func (l *AccessLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		l.log.Debugf("error closing access log %s: %s", l.opts.Path, err.Error())
+	}
+	l.file, l.out = nil, nil
+
+	if l.opts.MaxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", l.opts.Path, l.opts.MaxBackups)) //nolint:errcheck
+		for i := l.opts.MaxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.opts.Path, i), //nolint:errcheck
+				fmt.Sprintf("%s.%d", l.opts.Path, i+1))
+		}
+		if err := os.Rename(l.opts.Path, l.opts.Path+".1"); err != nil {
+			return l.reopen(err)
+		}
+	} else if err := os.Remove(l.opts.Path); err != nil {
+		return l.reopen(err)
+	}
+
+	return l.open()
+}
+
+// reopen reopens the access log file after a failed rotation and returns the error.
+func (l *AccessLog) reopen(err error) error {
+	if e := l.open(); e != nil {
+		return fmt.Errorf("%w (reopen: %s)", err, e.Error())
+	}
+	return err
+}
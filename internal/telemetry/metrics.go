@@ -1,6 +1,8 @@
 package telemetry
 
 import (
+	"time"
+
 	"github.com/pion/logging"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -10,17 +12,42 @@ const (
 )
 
 var (
-	ConnLabels           = []string{"name"}
-	CounterLabels        = []string{"name", "direction"}
-	AllocActiveGauge     prometheus.GaugeFunc
-	ListenerPacketsTotal *prometheus.CounterVec
-	ListenerBytesTotal   *prometheus.CounterVec
-	ListenerConnsTotal   *prometheus.CounterVec
-	ListenerConnsActive  *prometheus.GaugeVec
-	ClusterPacketsTotal  *prometheus.CounterVec
-	ClusterBytesTotal    *prometheus.CounterVec
-	// promClusterConnsTotal    *prometheus.CounterVec
-	// promClusterConnsActive   *prometheus.GaugeVec
+	ConnLabels                  = []string{"name"}
+	CounterLabels               = []string{"name", "direction"}
+	QuotaLabels                 = []string{"name", "quota"}
+	RejectLabels                = []string{"name", "reason"}
+	RouteLabels                 = []string{"listener", "cluster", "direction"}
+	WebhookResultLabels         = []string{"result"}
+	WebhookFailureLabels        = []string{"reason"}
+	SharedSecretLabels          = []string{"version"}
+	AuthFailureLabels           = []string{"listener", "reason"}
+	AllocActiveGauge            prometheus.GaugeFunc
+	DrainRemainingGauge         prometheus.GaugeFunc
+	DrainProgressGauge          prometheus.GaugeFunc
+	ListenerPacketsTotal        *prometheus.CounterVec
+	ListenerBytesTotal          *prometheus.CounterVec
+	ListenerConnsTotal          *prometheus.CounterVec
+	ListenerConnsActive         *prometheus.GaugeVec
+	ListenerRelayPortsActive    *prometheus.GaugeVec
+	ListenerRelayPortsCapacity  *prometheus.GaugeVec
+	ListenerRelayPortsExhausted *prometheus.CounterVec
+	ListenerAllocationsActive   *prometheus.GaugeVec
+	ListenerQuotaRejected       *prometheus.CounterVec
+	ListenerQuotaUsage          *prometheus.GaugeVec
+	ListenerShapedPackets       *prometheus.CounterVec
+	ListenerShapedBytes         *prometheus.CounterVec
+	ListenerClientCertRejected  *prometheus.CounterVec
+	ClusterPacketsTotal         *prometheus.CounterVec
+	ClusterBytesTotal           *prometheus.CounterVec
+	ClusterConnsTotal           *prometheus.CounterVec
+	ClusterConnsActive          *prometheus.GaugeVec
+	RoutePacketsTotal           *prometheus.CounterVec
+	RouteBytesTotal             *prometheus.CounterVec
+	AuthWebhookDuration         *prometheus.HistogramVec
+	AuthWebhookFailures         *prometheus.CounterVec
+	AuthSharedSecretActive      *prometheus.GaugeVec
+	AuthSharedSecretRequests    *prometheus.CounterVec
+	AuthFailures                *prometheus.CounterVec
 )
 
 func Init() {
@@ -50,24 +77,88 @@ func Init() {
 		Help:      "Number of bytes sent or received at a listener.",
 	}, CounterLabels)
 
+	ListenerRelayPortsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "listener",
+		Name:      "relay_ports",
+		Help:      "Number of relay ports in use at a listener.",
+	}, ConnLabels)
+	ListenerRelayPortsCapacity = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "listener",
+		Name:      "relay_ports_capacity",
+		Help:      "Size of the relay port range of a listener.",
+	}, ConnLabels)
+	ListenerRelayPortsExhausted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "listener",
+		Name:      "relay_port_exhausted_total",
+		Help:      "Number of relay allocations that failed because no relay port was available at a listener.",
+	}, ConnLabels)
+	ListenerAllocationsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "listener",
+		Name:      "allocations",
+		Help:      "Number of active allocations at a listener.",
+	}, ConnLabels)
+	ListenerQuotaRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "listener",
+		Name:      "allocation_quota_rejected_total",
+		Help:      "Number of allocation requests rejected at a listener because an allocation quota was reached.",
+	}, QuotaLabels)
+	ListenerQuotaUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "listener",
+		Name:      "allocation_quota_usage",
+		Help:      "Ratio of the allocation quota of a listener in use, zero if the listener has no allocation quota.",
+	}, ConnLabels)
+	ListenerShapedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "listener",
+		Name:      "bandwidth_dropped_packets_total",
+		Help:      "Number of relayed datagrams dropped at a listener because a bandwidth limit was exceeded.",
+	}, CounterLabels)
+	ListenerShapedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "listener",
+		Name:      "bandwidth_dropped_bytes_total",
+		Help:      "Number of relayed bytes dropped at a listener because a bandwidth limit was exceeded.",
+	}, CounterLabels)
+	ListenerClientCertRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "listener",
+		Name:      "client_cert_rejected_total",
+		Help:      "Number of clients rejected at a listener due to TLS client certificate authentication.",
+	}, RejectLabels)
+
 	prometheus.MustRegister(ListenerPacketsTotal)
 	prometheus.MustRegister(ListenerBytesTotal)
 	prometheus.MustRegister(ListenerConnsTotal)
 	prometheus.MustRegister(ListenerConnsActive)
+	prometheus.MustRegister(ListenerRelayPortsActive)
+	prometheus.MustRegister(ListenerRelayPortsCapacity)
+	prometheus.MustRegister(ListenerRelayPortsExhausted)
+	prometheus.MustRegister(ListenerAllocationsActive)
+	prometheus.MustRegister(ListenerQuotaRejected)
+	prometheus.MustRegister(ListenerQuotaUsage)
+	prometheus.MustRegister(ListenerShapedPackets)
+	prometheus.MustRegister(ListenerShapedBytes)
+	prometheus.MustRegister(ListenerClientCertRejected)
 
 	// cluster stats
-	// promClusterConnsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-	// 	Namespace: stunnerNamespace,
-	// 	Subsystem: "cluster",
-	// 	Name:      "connections",
-	// 	Help:      "Number of active upstream connections on behalf of a listener",
-	// }, promConnLabels)
-	// promClusterConnsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
-	// 	Namespace: stunnerNamespace,
-	// 	Subsystem: "cluster",
-	// 	Name:      "connections_total",
-	// 	Help:      "Number of upstream connections on behalf of a listener.",
-	// }, promConnLabels)
+	ClusterConnsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "cluster",
+		Name:      "connections",
+		Help:      "Number of active upstream relay connections to the backends of a cluster.",
+	}, ConnLabels)
+	ClusterConnsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "cluster",
+		Name:      "connections_total",
+		Help:      "Number of upstream relay connections to the backends of a cluster.",
+	}, ConnLabels)
 	ClusterPacketsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: stunnerNamespace,
 		Subsystem: "cluster",
@@ -83,8 +174,66 @@ func Init() {
 
 	prometheus.MustRegister(ClusterPacketsTotal)
 	prometheus.MustRegister(ClusterBytesTotal)
-	// prometheus.MustRegister(promClusterConnsTotal)
-	// prometheus.MustRegister(promClusterConnsActive)
+	prometheus.MustRegister(ClusterConnsTotal)
+	prometheus.MustRegister(ClusterConnsActive)
+
+	// route stats
+	RoutePacketsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "route",
+		Name:      "packets_total",
+		Help:      "Number of datagrams relayed between a listener and the backends of a cluster.",
+	}, RouteLabels)
+	RouteBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "route",
+		Name:      "bytes_total",
+		Help:      "Number of bytes relayed between a listener and the backends of a cluster.",
+	}, RouteLabels)
+
+	prometheus.MustRegister(RoutePacketsTotal)
+	prometheus.MustRegister(RouteBytesTotal)
+
+	// auth stats
+	AuthWebhookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "auth",
+		Name:      "webhook_duration_seconds",
+		Help:      "Latency of the requests to the authentication webhook.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, WebhookResultLabels)
+	AuthWebhookFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "auth",
+		Name:      "webhook_failures_total",
+		Help:      "Number of failed authentication webhook requests.",
+	}, WebhookFailureLabels)
+
+	AuthSharedSecretActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "auth",
+		Name:      "shared_secret_active",
+		Help:      "Shared secrets of the ephemeral authentication mode: 1 for the active secret, 0 for the secrets accepted for verification.",
+	}, SharedSecretLabels)
+	AuthSharedSecretRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "auth",
+		Name:      "shared_secret_requests_total",
+		Help:      "Number of ephemeral authentication requests per shared secret version.",
+	}, SharedSecretLabels)
+
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: stunnerNamespace,
+		Subsystem: "auth",
+		Name:      "failures_total",
+		Help:      "Number of failed authentication attempts per listener and reason.",
+	}, AuthFailureLabels)
+
+	prometheus.MustRegister(AuthWebhookDuration)
+	prometheus.MustRegister(AuthWebhookFailures)
+	prometheus.MustRegister(AuthSharedSecretActive)
+	prometheus.MustRegister(AuthSharedSecretRequests)
+	prometheus.MustRegister(AuthFailures)
 }
 
 func Close() {
@@ -92,10 +241,26 @@ func Close() {
 	_ = prometheus.Unregister(ListenerBytesTotal)
 	_ = prometheus.Unregister(ListenerConnsTotal)
 	_ = prometheus.Unregister(ListenerConnsActive)
+	_ = prometheus.Unregister(ListenerRelayPortsActive)
+	_ = prometheus.Unregister(ListenerRelayPortsCapacity)
+	_ = prometheus.Unregister(ListenerRelayPortsExhausted)
+	_ = prometheus.Unregister(ListenerAllocationsActive)
+	_ = prometheus.Unregister(ListenerQuotaRejected)
+	_ = prometheus.Unregister(ListenerQuotaUsage)
+	_ = prometheus.Unregister(ListenerShapedPackets)
+	_ = prometheus.Unregister(ListenerShapedBytes)
+	_ = prometheus.Unregister(ListenerClientCertRejected)
 	_ = prometheus.Unregister(ClusterPacketsTotal)
 	_ = prometheus.Unregister(ClusterBytesTotal)
-	// _ = prometheus.Unregister(promClusterConnsTotal)
-	// _ = prometheus.Unregister(promClusterConnsActive)
+	_ = prometheus.Unregister(ClusterConnsTotal)
+	_ = prometheus.Unregister(ClusterConnsActive)
+	_ = prometheus.Unregister(RoutePacketsTotal)
+	_ = prometheus.Unregister(RouteBytesTotal)
+	_ = prometheus.Unregister(AuthWebhookDuration)
+	_ = prometheus.Unregister(AuthWebhookFailures)
+	_ = prometheus.Unregister(AuthSharedSecretActive)
+	_ = prometheus.Unregister(AuthSharedSecretRequests)
+	_ = prometheus.Unregister(AuthFailures)
 }
 
 func IncrementPackets(n string, c ConnType, d Direction, count uint64) {
@@ -122,8 +287,8 @@ func AddConnection(n string, c ConnType) {
 		ListenerConnsActive.WithLabelValues(n).Add(1)
 		ListenerConnsTotal.WithLabelValues(n).Add(1)
 	case ClusterType:
-		// promClusterConnsActive.WithLabelValues(n).Add(1)
-		// promClusterConnsTotal.WithLabelValues(n).Add(1)
+		ClusterConnsActive.WithLabelValues(n).Add(1)
+		ClusterConnsTotal.WithLabelValues(n).Add(1)
 	}
 }
 
@@ -132,7 +297,143 @@ func SubConnection(n string, c ConnType) {
 	case ListenerType:
 		ListenerConnsActive.WithLabelValues(n).Sub(1)
 	case ClusterType:
-		// promClusterConnsActive.WithLabelValues(n).Sub(1)
+		ClusterConnsActive.WithLabelValues(n).Sub(1)
+	}
+}
+
+// IncrementRoute counts a datagram of the given size relayed between a listener and a cluster.
+func IncrementRoute(listener, cluster string, d Direction, bytes int) {
+	if RoutePacketsTotal != nil {
+		RoutePacketsTotal.WithLabelValues(listener, cluster, d.String()).Inc()
+		RouteBytesTotal.WithLabelValues(listener, cluster, d.String()).Add(float64(bytes))
+	}
+}
+
+// AddRelayPort increments the number of relay ports in use at a listener.
+func AddRelayPort(n string) {
+	if ListenerRelayPortsActive != nil {
+		ListenerRelayPortsActive.WithLabelValues(n).Add(1)
+	}
+}
+
+// SubRelayPort decrements the number of relay ports in use at a listener.
+func SubRelayPort(n string) {
+	if ListenerRelayPortsActive != nil {
+		ListenerRelayPortsActive.WithLabelValues(n).Sub(1)
+	}
+}
+
+// SetRelayPortCapacity sets the size of the relay port range of a listener.
+func SetRelayPortCapacity(n string, capacity int) {
+	if ListenerRelayPortsCapacity != nil {
+		ListenerRelayPortsCapacity.WithLabelValues(n).Set(float64(capacity))
+	}
+}
+
+// IncrementRelayPortExhausted counts a relay allocation failing due to port exhaustion.
+func IncrementRelayPortExhausted(n string) {
+	if ListenerRelayPortsExhausted != nil {
+		ListenerRelayPortsExhausted.WithLabelValues(n).Inc()
+	}
+}
+
+// AddAllocation increments the number of active allocations at a listener.
+func AddAllocation(n string) {
+	if ListenerAllocationsActive != nil {
+		ListenerAllocationsActive.WithLabelValues(n).Add(1)
+	}
+}
+
+// SubAllocation decrements the number of active allocations at a listener.
+func SubAllocation(n string) {
+	if ListenerAllocationsActive != nil {
+		ListenerAllocationsActive.WithLabelValues(n).Sub(1)
+	}
+}
+
+// IncrementQuotaRejected counts an allocation request rejected at a listener because the given
+// quota ("user", "client" or "listener") was reached.
+func IncrementQuotaRejected(n, quota string) {
+	if ListenerQuotaRejected != nil {
+		ListenerQuotaRejected.WithLabelValues(n, quota).Inc()
+	}
+}
+
+// SetQuotaUsage sets the ratio of the allocation quota of a listener in use given the number of
+// allocations at the listener and the quota, zero if the listener has no quota.
+func SetQuotaUsage(n string, allocations, quota int) {
+	if ListenerQuotaUsage == nil {
+		return
+	}
+	usage := 0.0
+	if quota > 0 {
+		usage = float64(allocations) / float64(quota)
+	}
+	ListenerQuotaUsage.WithLabelValues(n).Set(usage)
+}
+
+// IncrementShapedDrops counts a relayed datagram dropped at a listener because a bandwidth limit
+// was exceeded.
+func IncrementShapedDrops(n string, d Direction, bytes int) {
+	if ListenerShapedPackets != nil {
+		ListenerShapedPackets.WithLabelValues(n, d.String()).Inc()
+		ListenerShapedBytes.WithLabelValues(n, d.String()).Add(float64(bytes))
+	}
+}
+
+// IncrementClientCertRejected counts a client rejected at a listener due to TLS client
+// certificate authentication, for the given reason ("missing", "invalid" or "username").
+func IncrementClientCertRejected(n, reason string) {
+	if ListenerClientCertRejected != nil {
+		ListenerClientCertRejected.WithLabelValues(n, reason).Inc()
+	}
+}
+
+// ObserveWebhook records the latency of an authentication webhook request with the given result
+// ("allow", "deny" or "error").
+func ObserveWebhook(result string, d time.Duration) {
+	if AuthWebhookDuration != nil {
+		AuthWebhookDuration.WithLabelValues(result).Observe(d.Seconds())
+	}
+}
+
+// IncrementWebhookFailures counts a failed authentication webhook request, for the given reason
+// ("timeout", "error", "status", "response" or "circuit_open").
+func IncrementWebhookFailures(reason string) {
+	if AuthWebhookFailures != nil {
+		AuthWebhookFailures.WithLabelValues(reason).Inc()
+	}
+}
+
+// SetSharedSecrets sets the versions of the shared secrets of the ephemeral authentication mode,
+// the active secret first. An empty list clears the shared secrets.
+func SetSharedSecrets(versions []string) {
+	if AuthSharedSecretActive == nil {
+		return
+	}
+	AuthSharedSecretActive.Reset()
+	for i, v := range versions {
+		active := 0.0
+		if i == 0 {
+			active = 1.0
+		}
+		AuthSharedSecretActive.WithLabelValues(v).Set(active)
+	}
+}
+
+// IncrementSharedSecretRequests counts an ephemeral authentication request authenticated with the
+// shared secret of the given version.
+func IncrementSharedSecretRequests(version string) {
+	if AuthSharedSecretRequests != nil {
+		AuthSharedSecretRequests.WithLabelValues(version).Inc()
+	}
+}
+
+// IncrementAuthFailures counts a failed authentication attempt at a listener, for the given reason
+// (e.g., "invalid_credential" or "locked_out").
+func IncrementAuthFailures(listener, reason string) {
+	if AuthFailures != nil {
+		AuthFailures.WithLabelValues(listener, reason).Inc()
 	}
 }
 
@@ -162,6 +463,40 @@ func UnregisterAllocationMetric(log logging.LeveledLogger) {
 	log.Warn("GaugeFunc 'stunner_allocations_active' cannot be unregistered.")
 }
 
+// RegisterDrainMetrics registers the metrics reporting the progress of a graceful shutdown.
+func RegisterDrainMetrics(log logging.LeveledLogger, GetDrainRemaining, GetDrainProgress func() float64) {
+	DrainRemainingGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: stunnerNamespace,
+			Name:      "drain_remaining_seconds",
+			Help:      "Time left until the drain timeout expires during a graceful shutdown, zero if not draining.",
+		},
+		GetDrainRemaining,
+	)
+	DrainProgressGauge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: stunnerNamespace,
+			Name:      "drain_progress",
+			Help:      "Ratio of the allocations terminated since the start of a graceful shutdown, zero if not draining.",
+		},
+		GetDrainProgress,
+	)
+	for _, g := range []prometheus.GaugeFunc{DrainRemainingGauge, DrainProgressGauge} {
+		if err := prometheus.Register(g); err != nil {
+			log.Warnf("GaugeFunc %s cannot be registered.", g.Desc().String())
+		}
+	}
+}
+
+// UnregisterDrainMetrics unregisters the graceful shutdown metrics.
+func UnregisterDrainMetrics(log logging.LeveledLogger) {
+	for _, g := range []prometheus.GaugeFunc{DrainRemainingGauge, DrainProgressGauge} {
+		if g != nil && !prometheus.Unregister(g) {
+			log.Warnf("GaugeFunc %s cannot be unregistered.", g.Desc().String())
+		}
+	}
+}
+
 // func GetListenerPacketsTotal(ch chan prometheus.Metric) {
 // 	go func() {
 // 		defer close(ch)
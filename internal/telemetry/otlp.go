@@ -0,0 +1,155 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pion/logging"
+	"go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	defaultOTLPGRPCPort = "4317"
+	defaultOTLPHTTPPort = "4318"
+	otlpShutdownTimeout = 5 * time.Second
+)
+
+// OTLPOptions configures an OTLP exporter.
+type OTLPOptions struct {
+	// Endpoint is the URI of the collector, the scheme is one of grpc, grpcs, http or https.
+	Endpoint string
+	// Headers are sent with each export request.
+	Headers map[string]string
+	// MetricsInterval is the interval between metric exports.
+	MetricsInterval time.Duration
+	// Metrics and Traces enable exporting the metrics and the traces, respectively.
+	Metrics, Traces bool
+	// Instance is reported as the service instance id of the exported telemetry.
+	Instance string
+}
+
+// OTLPExporter pushes the Prometheus metrics and the allocation lifecycle traces to an
+// OpenTelemetry collector over OTLP/gRPC or OTLP/HTTP.
+type OTLPExporter struct {
+	meters *metric.MeterProvider
+	traces *sdktrace.TracerProvider
+}
+
+// NewOTLPExporter starts a new OTLP exporter.
+func NewOTLPExporter(conf OTLPOptions, log logging.LeveledLogger) (*OTLPExporter, error) {
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint URL %s: %w", conf.Endpoint, err)
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	grpc := scheme == "grpc" || scheme == "grpcs"
+	insecure := scheme == "grpc" || scheme == "http"
+	addr := u.Host
+	if u.Port() == "" {
+		port := defaultOTLPHTTPPort
+		if grpc {
+			port = defaultOTLPGRPCPort
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	res := resource.NewSchemaless(semconv.ServiceName("stunnerd"),
+		semconv.ServiceInstanceID(conf.Instance))
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warnf("OTLP exporter error: %s", err.Error())
+	}))
+
+	ctx := context.Background()
+	e := &OTLPExporter{}
+
+	if conf.Metrics {
+		var exp metric.Exporter
+		if grpc {
+			opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(addr),
+				otlpmetricgrpc.WithHeaders(conf.Headers)}
+			if insecure {
+				opts = append(opts, otlpmetricgrpc.WithInsecure())
+			}
+			exp, err = otlpmetricgrpc.New(ctx, opts...)
+		} else {
+			opts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(addr),
+				otlpmetrichttp.WithHeaders(conf.Headers)}
+			if insecure {
+				opts = append(opts, otlpmetrichttp.WithInsecure())
+			}
+			exp, err = otlpmetrichttp.New(ctx, opts...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot create OTLP metric exporter: %w", err)
+		}
+
+		// export the metrics registered with the default Prometheus registry
+		reader := metric.NewPeriodicReader(exp,
+			metric.WithInterval(conf.MetricsInterval),
+			metric.WithProducer(prometheus.NewMetricProducer()))
+		e.meters = metric.NewMeterProvider(metric.WithReader(reader), metric.WithResource(res))
+	}
+
+	if conf.Traces {
+		var exp sdktrace.SpanExporter
+		if grpc {
+			opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(addr),
+				otlptracegrpc.WithHeaders(conf.Headers)}
+			if insecure {
+				opts = append(opts, otlptracegrpc.WithInsecure())
+			}
+			exp, err = otlptracegrpc.New(ctx, opts...)
+		} else {
+			opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(addr),
+				otlptracehttp.WithHeaders(conf.Headers)}
+			if insecure {
+				opts = append(opts, otlptracehttp.WithInsecure())
+			}
+			exp, err = otlptracehttp.New(ctx, opts...)
+		}
+		if err != nil {
+			e.Close() //nolint:errcheck
+			return nil, fmt.Errorf("cannot create OTLP trace exporter: %w", err)
+		}
+
+		e.traces = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp),
+			sdktrace.WithResource(res))
+		otel.SetTracerProvider(e.traces)
+	}
+
+	return e, nil
+}
+
+// Close flushes the pending telemetry and stops the exporter.
+func (e *OTLPExporter) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), otlpShutdownTimeout)
+	defer cancel()
+
+	var errs []error
+	if e.traces != nil {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		errs = append(errs, e.traces.Shutdown(ctx))
+	}
+	if e.meters != nil {
+		errs = append(errs, e.meters.Shutdown(ctx))
+	}
+
+	return errors.Join(errs...)
+}
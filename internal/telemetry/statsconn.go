@@ -4,6 +4,7 @@ package telemetry
 
 import (
 	"net"
+	"sync/atomic"
 )
 
 // Listener is a net.Listener that knows how to report to Prometheus.
@@ -33,6 +34,7 @@ type Conn struct {
 	net.Conn
 	name     string
 	connType ConnType
+	closed   atomic.Bool
 }
 
 // NewConn allocates a stats conn that knows its name and type.
@@ -61,9 +63,12 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 	return
 }
 
-// Close closes the Conn.
+// Close closes the Conn. The connection is accounted for only once even if Close is called
+// multiple times.
 func (c *Conn) Close() error {
-	SubConnection(c.name, c.connType)
+	if !c.closed.Swap(true) {
+		SubConnection(c.name, c.connType)
+	}
 	return c.Conn.Close()
 }
 
@@ -72,6 +77,7 @@ type PacketConn struct {
 	net.PacketConn
 	name     string
 	connType ConnType
+	closed   atomic.Bool
 }
 
 // NewPacketConn decorates a PacketConnn with metric reporting.
@@ -104,6 +110,8 @@ func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 // WriteTo writes to the PacketConn.
 // Close closes the PacketConn.
 func (c *PacketConn) Close() error {
-	SubConnection(c.name, c.connType)
+	if !c.closed.Swap(true) {
+		SubConnection(c.name, c.connType)
+	}
 	return c.PacketConn.Close()
 }
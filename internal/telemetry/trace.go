@@ -0,0 +1,42 @@
+package telemetry
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/l7mp/stunner"
+
+// Span attributes of allocation lifecycle events.
+const (
+	AttrListener = attribute.Key("stunner.listener")
+	AttrCluster  = attribute.Key("stunner.cluster")
+	AttrUsername = attribute.Key("stunner.username")
+	AttrClient   = attribute.Key("stunner.client.address")
+	AttrRelay    = attribute.Key("stunner.relay.address")
+	AttrPeer     = attribute.Key("stunner.peer.address")
+	AttrLifetime = attribute.Key("stunner.lifetime")
+)
+
+// TraceEvent records an allocation lifecycle event ("auth", "allocate", "permission", "refresh"
+// or "delete") as a span and returns the context of the span. If parent is valid then the span is
+// added to the trace of the allocation. A non-nil error marks the span as failed. Spans are
+// dropped unless the OTLP exporter is running with traces enabled.
+func TraceEvent(parent trace.SpanContext, name string, err error, attrs ...attribute.KeyValue) trace.SpanContext {
+	ctx := context.Background()
+	if parent.IsValid() {
+		ctx = trace.ContextWithSpanContext(ctx, parent)
+	}
+
+	_, span := otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+
+	return span.SpanContext()
+}
@@ -0,0 +1,429 @@
+package stunner
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v3"
+
+	"github.com/l7mp/stunner/internal/object"
+	"github.com/l7mp/stunner/internal/telemetry"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+)
+
+// Reasons of failed authentication attempts, used as the "reason" label of the auth failure
+// metric.
+const (
+	authFailureLockedOut         = "locked_out"
+	authFailureInvalidUsername   = "invalid_username"
+	authFailureInvalidCredential = "invalid_credential"
+	authFailureExpired           = "expired"
+	authFailureDisabled          = "disabled"
+	authFailureRevoked           = "revoked"
+	authFailureClientCert        = "client_cert"
+	authFailureInvalidToken      = "invalid_token"
+	authFailureRejected          = "rejected"
+	authFailureUnavailable       = "unavailable"
+)
+
+// authFailureRecord holds the failed authentication attempts of a source IP address or a username.
+type authFailureRecord struct {
+	failures    []time.Time
+	lockouts    int
+	lockedUntil time.Time
+}
+
+// isLocked returns true if the record is locked out at the given time.
+func (r *authFailureRecord) isLocked(now time.Time) bool {
+	return now.Before(r.lockedUntil)
+}
+
+// prune forgets the failed attempts that fell out of the failure window.
+func (r *authFailureRecord) prune(now time.Time, window time.Duration) {
+	i := 0
+	for i < len(r.failures) && now.Sub(r.failures[i]) > window {
+		i++
+	}
+	r.failures = r.failures[i:]
+}
+
+// status returns the status of the record.
+func (r *authFailureRecord) status(now time.Time, window time.Duration) *stnrv1.LockoutStatus {
+	s := &stnrv1.LockoutStatus{Lockouts: r.lockouts}
+	for _, t := range r.failures {
+		if now.Sub(t) <= window {
+			s.Failures++
+		}
+	}
+	if r.isLocked(now) {
+		until := r.lockedUntil
+		s.LockedUntil = &until
+	}
+	return s
+}
+
+// pendingAuth is an authenticated request waiting for the response of the TURN server.
+type pendingAuth struct {
+	username string
+	created  time.Time
+}
+
+// authRejection is the reason why the auth handler rejected a client.
+type authRejection struct {
+	reason  string
+	created time.Time
+}
+
+// authRequest is the last authenticated request received from a client with a username.
+type authRequest struct {
+	raw     []byte
+	created time.Time
+}
+
+// authLockout tracks the failed authentication attempts per source IP address and per username and
+// locks out the addresses and usernames with too many failed attempts. The authenticated requests
+// received from the clients are registered and the auth handler records the reason why it rejects
+// a request, including a MESSAGE-INTEGRITY that does not match the key of the user. A failed
+// attempt is recorded only when the TURN server answers a request rejected by the auth handler
+// with an error: error responses to authenticated requests, e.g., to a ChannelBind request for an
+// invalid channel, are not failed attempts. The auth handler also rejects the clients that are
+// locked out before looking up the key.
+type authLockout struct {
+	auth     func() *object.Auth
+	clients  map[string]*authFailureRecord
+	users    map[string]*authFailureRecord
+	pending  map[allocTransaction]pendingAuth
+	requests map[string]authRequest
+	reasons  map[string]authRejection
+	lastGC   time.Time
+	lock     sync.Mutex
+}
+
+func newAuthLockout(auth func() *object.Auth) *authLockout {
+	return &authLockout{
+		auth:     auth,
+		clients:  map[string]*authFailureRecord{},
+		users:    map[string]*authFailureRecord{},
+		pending:  map[allocTransaction]pendingAuth{},
+		requests: map[string]authRequest{},
+		reasons:  map[string]authRejection{},
+		lastGC:   time.Now(),
+	}
+}
+
+func authRejectionKey(addr net.Addr, username string) string {
+	return addr.Network() + "/" + addr.String() + "/" + username
+}
+
+// policy returns the lockout policy for a client, or nil if lockout is disabled or the client is
+// on the allowlist.
+func (t *authLockout) policy(src net.Addr) *object.LockoutPolicy {
+	auth := t.auth()
+	if auth == nil {
+		return nil
+	}
+
+	p := auth.GetLockoutPolicy()
+	if p == nil || p.IsAllowed(net.ParseIP(getIPString(src))) {
+		return nil
+	}
+
+	return p
+}
+
+// locked checks whether a client or a username is locked out. The username lockout does not apply
+// to a client that already holds an allocation with the username, so that the lockout of a shared
+// username does not break the existing allocations.
+func (t *authLockout) locked(src net.Addr, username string, owner bool) bool {
+	if t == nil || src == nil || t.policy(src) == nil {
+		return false
+	}
+
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	c, okC := t.clients[getIPString(src)]
+	u, okU := t.users[username]
+	if (!okC || !c.isLocked(now)) && (owner || !okU || !u.isLocked(now)) {
+		return false
+	}
+
+	t.reasons[authRejectionKey(src, username)] = authRejection{reason: authFailureLockedOut,
+		created: now}
+	return true
+}
+
+// reject registers the reason why the auth handler rejected a client.
+func (t *authLockout) reject(src net.Addr, username, reason string) {
+	if t == nil || src == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	k := authRejectionKey(src, username)
+	if r, ok := t.reasons[k]; ok && r.reason == authFailureLockedOut {
+		return
+	}
+	t.reasons[k] = authRejection{reason: reason, created: time.Now()}
+}
+
+// verify checks the MESSAGE-INTEGRITY of the last authenticated request of a client against the key
+// returned by the auth handler and registers a rejection if the check fails.
+func (t *authLockout) verify(src net.Addr, username string, key []byte) {
+	if t == nil || src == nil {
+		return
+	}
+
+	t.lock.Lock()
+	req, ok := t.requests[authRejectionKey(src, username)]
+	t.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	m := &stun.Message{Raw: req.raw}
+	if err := m.Decode(); err != nil {
+		return
+	}
+	if err := stun.MessageIntegrity(key).Check(m); err != nil {
+		t.reject(src, username, authFailureInvalidCredential)
+	}
+}
+
+// request registers an authenticated request received from a client.
+func (t *authLockout) request(p []byte, src net.Addr) {
+	if t == nil || len(p) < stunHeaderSize || !stun.IsMessage(p) {
+		return
+	}
+
+	m := &stun.Message{Raw: p}
+	if err := m.Decode(); err != nil || m.Type.Class != stun.ClassRequest ||
+		!m.Contains(stun.AttrMessageIntegrity) {
+		return
+	}
+
+	username, err := m.Get(stun.AttrUsername)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.gc(now)
+
+	tx := allocTransaction{client: src.String(), id: m.TransactionID}
+	t.pending[tx] = pendingAuth{username: string(username), created: now}
+	k := authRejectionKey(src, string(username))
+	t.requests[k] = authRequest{raw: append([]byte(nil), p...), created: now}
+	delete(t.reasons, k)
+}
+
+// response checks a response sent by the TURN server to a client and records a failed attempt if
+// the response rejects an authenticated request that the auth handler rejected.
+func (t *authLockout) response(p []byte, dst net.Addr, listener string) {
+	if t == nil || len(p) < stunHeaderSize || !stun.IsMessage(p) {
+		return
+	}
+
+	var typ stun.MessageType
+	typ.ReadValue(binary.BigEndian.Uint16(p[0:2]))
+	if typ.Class != stun.ClassSuccessResponse && typ.Class != stun.ClassErrorResponse {
+		return
+	}
+
+	tx := allocTransaction{client: dst.String()}
+	copy(tx.id[:], p[8:stunHeaderSize])
+
+	t.lock.Lock()
+	req, ok := t.pending[tx]
+	delete(t.pending, tx)
+	rejected := false
+	if ok {
+		_, rejected = t.reasons[authRejectionKey(dst, req.username)]
+	}
+	t.lock.Unlock()
+
+	if !rejected || typ.Class != stun.ClassErrorResponse {
+		return
+	}
+
+	t.failure(listener, dst, req.username)
+}
+
+// failure records a failed attempt of a client and locks out the client and the username if the
+// number of failed attempts reaches the threshold.
+func (t *authLockout) failure(listener string, src net.Addr, username string) {
+	if t == nil {
+		return
+	}
+
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	reason := authFailureInvalidCredential
+	k := authRejectionKey(src, username)
+	if r, ok := t.reasons[k]; ok {
+		reason = r.reason
+		delete(t.reasons, k)
+	}
+	telemetry.IncrementAuthFailures(listener, reason)
+
+	// locked out clients are not counted again and backend failures are not the fault of the
+	// client
+	p := t.policy(src)
+	if p == nil || reason == authFailureLockedOut || reason == authFailureUnavailable {
+		return
+	}
+
+	ip := getIPString(src)
+	if d, ok := t.record(t.clients, ip, p.ClientThreshold, p, now); ok {
+		t.auth().Log.Infof("locking out client %s for %s: too many failed authentication "+
+			"attempts", ip, d)
+	}
+	if p.UserThreshold <= 0 {
+		return
+	}
+	if d, ok := t.record(t.users, username, p.UserThreshold, p, now); ok {
+		t.auth().Log.Infof("locking out user %q for %s: too many failed authentication "+
+			"attempts", username, d)
+	}
+}
+
+// record adds a failed attempt to the record of a source IP address or a username and locks out
+// the record if the number of failed attempts within the failure window reaches the threshold.
+// Returns the lockout period and true if the record was locked out.
+func (t *authLockout) record(records map[string]*authFailureRecord, key string, threshold int, p *object.LockoutPolicy, now time.Time) (time.Duration, bool) {
+	r, ok := records[key]
+	if !ok {
+		r = &authFailureRecord{}
+		records[key] = r
+	}
+
+	r.prune(now, p.Window)
+	r.failures = append(r.failures, now)
+	if len(r.failures) < threshold {
+		return 0, false
+	}
+
+	// the lockout period doubles for consecutive lockouts
+	if !r.lockedUntil.IsZero() && now.Sub(r.lockedUntil) > p.MaxDuration {
+		r.lockouts = 0
+	}
+	d := p.Duration
+	for i := 0; i < r.lockouts && d < p.MaxDuration; i++ {
+		d *= 2
+	}
+	if d > p.MaxDuration {
+		d = p.MaxDuration
+	}
+
+	r.lockouts++
+	r.lockedUntil = now.Add(d)
+	r.failures = nil
+
+	return d, true
+}
+
+// gc removes the expired transactions, rejections and records. Must be called with the lock held.
+func (t *authLockout) gc(now time.Time) {
+	if now.Sub(t.lastGC) <= allocTransactionTimeout {
+		return
+	}
+	t.lastGC = now
+
+	for tx, req := range t.pending {
+		if now.Sub(req.created) > allocTransactionTimeout {
+			delete(t.pending, tx)
+		}
+	}
+
+	for k, r := range t.reasons {
+		if now.Sub(r.created) > allocTransactionTimeout {
+			delete(t.reasons, k)
+		}
+	}
+
+	for k, r := range t.requests {
+		if now.Sub(r.created) > allocTransactionTimeout {
+			delete(t.requests, k)
+		}
+	}
+
+	// keep the records of recent lockouts to find consecutive lockouts
+	var window, memory time.Duration
+	if auth := t.auth(); auth != nil {
+		if p := auth.GetLockoutPolicy(); p != nil {
+			window, memory = p.Window, p.MaxDuration
+		}
+	}
+	for _, records := range []map[string]*authFailureRecord{t.clients, t.users} {
+		for k, r := range records {
+			r.prune(now, window)
+			if len(r.failures) == 0 && now.Sub(r.lockedUntil) > memory {
+				delete(records, k)
+			}
+		}
+	}
+}
+
+// status returns the status of the source IP addresses and the usernames with failed attempts or
+// recent lockouts matching a client IP address and a username (empty strings match all), and
+// removes the matching records if unlock is set.
+func (t *authLockout) status(clientIP, username string, unlock bool) []*stnrv1.LockoutStatus {
+	ret := []*stnrv1.LockoutStatus{}
+	if t == nil {
+		return ret
+	}
+
+	var window time.Duration
+	if auth := t.auth(); auth != nil {
+		if p := auth.GetLockoutPolicy(); p != nil {
+			window = p.Window
+		}
+	}
+
+	now := time.Now()
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	clients := []*stnrv1.LockoutStatus{}
+	if username == "" {
+		for ip, r := range t.clients {
+			if clientIP == "" || net.ParseIP(clientIP).Equal(net.ParseIP(ip)) {
+				s := r.status(now, window)
+				s.ClientIP = ip
+				clients = append(clients, s)
+				if unlock {
+					delete(t.clients, ip)
+				}
+			}
+		}
+		sort.Slice(clients, func(i, j int) bool { return clients[i].ClientIP < clients[j].ClientIP })
+	}
+
+	users := []*stnrv1.LockoutStatus{}
+	if clientIP == "" {
+		for u, r := range t.users {
+			if username == "" || username == u {
+				s := r.status(now, window)
+				s.Username = u
+				users = append(users, s)
+				if unlock {
+					delete(t.users, u)
+				}
+			}
+		}
+		sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	}
+
+	return append(append(ret, clients...), users...)
+}
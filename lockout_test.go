@@ -0,0 +1,193 @@
+package stunner
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/l7mp/stunner/internal/object"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	"github.com/l7mp/stunner/pkg/logger"
+)
+
+// newTestLockout creates a lockout tracker for a lockout config.
+func newTestLockout(t *testing.T, conf *stnrv1.LockoutConfig) *authLockout {
+	t.Helper()
+
+	req := &stnrv1.AuthConfig{
+		Type:        "static",
+		Credentials: map[string]string{"username": "user1", "password": "passwd1"},
+		Lockout:     conf,
+	}
+	assert.NoError(t, req.Validate(), "validate")
+	o, err := object.NewAuth(req, logger.NewLoggerFactory(stunnerTestLoglevel))
+	assert.NoError(t, err, "auth")
+	auth := o.(*object.Auth)
+
+	return newAuthLockout(func() *object.Auth { return auth })
+}
+
+func TestAuthLockoutRecord(t *testing.T) {
+	p := &object.LockoutPolicy{
+		Window:      10 * time.Second,
+		Duration:    time.Second,
+		MaxDuration: 5 * time.Second,
+	}
+	start := time.Now()
+	at := func(s float64) time.Time { return start.Add(time.Duration(s * float64(time.Second))) }
+
+	r := map[string]*authFailureRecord{}
+	for _, c := range []struct {
+		name     string
+		at       float64
+		locked   bool
+		duration time.Duration
+	}{
+		{"first failure", 0, false, 0},
+		{"second failure", 1, false, 0},
+		{"threshold reached", 2, true, time.Second},
+		{"failures are reset by a lockout", 3, false, 0},
+		{"failures are counted again", 4, false, 0},
+		{"consecutive lockout is doubled", 5, true, 2 * time.Second},
+		{"failure after the second lockout", 8, false, 0},
+		{"failure in a row", 9, false, 0},
+		{"third lockout is doubled", 10, true, 4 * time.Second},
+		{"failure after the third lockout", 14, false, 0},
+		{"another failure in a row", 15, false, 0},
+		{"fourth lockout is capped", 16, true, 5 * time.Second},
+		{"failure after the fourth lockout", 22, false, 0},
+		{"failures out of the window are forgotten", 33, false, 0},
+		{"failure within the window", 34, false, 0},
+		{"lockout after a quiet period starts over", 35, true, time.Second},
+	} {
+		d, locked := (&authLockout{}).record(r, "key", 3, p, at(c.at))
+		assert.Equal(t, c.locked, locked, c.name)
+		assert.Equal(t, c.duration, d, c.name)
+		if locked {
+			assert.True(t, r["key"].isLocked(at(c.at)), "%s: locked", c.name)
+			assert.False(t, r["key"].isLocked(at(c.at).Add(d)), "%s: lockout expires", c.name)
+		}
+	}
+}
+
+func TestAuthLockoutThresholds(t *testing.T) {
+	client1 := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	client2 := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}
+	allowed := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1234}
+
+	for _, c := range []struct {
+		name       string
+		conf       stnrv1.LockoutConfig
+		src        []*net.UDPAddr
+		reason     string
+		clientLock bool
+		userLock   bool
+	}{
+		{
+			name:       "client threshold",
+			conf:       stnrv1.LockoutConfig{ClientThreshold: 3},
+			src:        []*net.UDPAddr{client1, client1, client1},
+			reason:     authFailureInvalidCredential,
+			clientLock: true,
+		},
+		{
+			name:   "below the client threshold",
+			conf:   stnrv1.LockoutConfig{ClientThreshold: 4},
+			src:    []*net.UDPAddr{client1, client1, client1},
+			reason: authFailureInvalidCredential,
+		},
+		{
+			name:   "username lockout disabled by default",
+			conf:   stnrv1.LockoutConfig{ClientThreshold: 3},
+			src:    []*net.UDPAddr{client1, client2, client1, client2},
+			reason: authFailureInvalidCredential,
+		},
+		{
+			name:     "user threshold",
+			conf:     stnrv1.LockoutConfig{ClientThreshold: 3, UserThreshold: 3},
+			src:      []*net.UDPAddr{client1, client2, client1},
+			reason:   authFailureInvalidCredential,
+			userLock: true,
+		},
+		{
+			name:   "negative user threshold",
+			conf:   stnrv1.LockoutConfig{ClientThreshold: 3, UserThreshold: -1},
+			src:    []*net.UDPAddr{client1, client2, client1, client2},
+			reason: authFailureInvalidCredential,
+		},
+		{
+			name: "allowlist",
+			conf: stnrv1.LockoutConfig{ClientThreshold: 1, UserThreshold: 1,
+				Allowlist: []string{"192.168.0.0/16"}},
+			src:    []*net.UDPAddr{allowed, allowed},
+			reason: authFailureInvalidCredential,
+		},
+		{
+			name:   "backend failures are not counted",
+			conf:   stnrv1.LockoutConfig{ClientThreshold: 1, UserThreshold: 1},
+			src:    []*net.UDPAddr{client1, client1},
+			reason: authFailureUnavailable,
+		},
+		{
+			name:   "locked out attempts are not counted",
+			conf:   stnrv1.LockoutConfig{ClientThreshold: 1, UserThreshold: 1},
+			src:    []*net.UDPAddr{client1, client1},
+			reason: authFailureLockedOut,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			l := newTestLockout(t, &c.conf)
+			for _, src := range c.src {
+				l.reject(src, "user1", c.reason)
+				l.failure("udp", src, "user1")
+			}
+
+			other := &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 1234}
+			assert.Equal(t, c.clientLock, l.locked(client1, "user2", false), "client locked out")
+			assert.Equal(t, c.userLock, l.locked(other, "user1", false), "user locked out")
+			assert.False(t, l.locked(other, "user1", true), "owners are not locked out")
+			assert.False(t, l.locked(other, "user2", false), "others are not locked out")
+		})
+	}
+}
+
+func TestAuthLockoutExpiry(t *testing.T) {
+	l := newTestLockout(t, &stnrv1.LockoutConfig{ClientThreshold: 1, UserThreshold: 1,
+		Duration: 1, MaxDuration: 2})
+	src := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	l.failure("udp", src, "user1")
+	assert.True(t, l.locked(src, "user1", false), "locked out")
+	list := l.status("", "", false)
+	assert.Len(t, list, 2, "client and username")
+	for _, s := range list {
+		assert.Equal(t, 1, s.Lockouts, "lockouts")
+		assert.NotNil(t, s.LockedUntil, "locked out")
+	}
+
+	for _, r := range []*authFailureRecord{l.clients["10.0.0.1"], l.users["user1"]} {
+		r.lockedUntil = time.Now()
+	}
+	assert.False(t, l.locked(src, "user1", false), "lockout expired")
+	for _, s := range l.status("", "", false) {
+		assert.Nil(t, s.LockedUntil, "lockout expired")
+		assert.Equal(t, 1, s.Lockouts, "lockouts remembered")
+	}
+
+	l.lock.Lock()
+	l.lastGC = time.Time{}
+	l.gc(time.Now().Add(3 * time.Second))
+	l.lock.Unlock()
+	assert.Empty(t, l.status("", "", false), "records of old lockouts removed")
+
+	// the last request from the first port was rejected as locked out, which is not counted
+	src = &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1235}
+	l.failure("udp", src, "user1")
+	assert.True(t, l.locked(src, "user1", false), "locked out")
+	assert.Len(t, l.status("", "user1", true), 1, "username unlocked")
+	assert.True(t, l.locked(src, "user2", false), "client still locked out")
+	assert.Len(t, l.status("10.0.0.1", "", true), 1, "client unlocked")
+	assert.False(t, l.locked(src, "user1", false), "unlocked")
+}
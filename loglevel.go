@@ -0,0 +1,115 @@
+package stunner
+
+import (
+	"sync"
+	"time"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	"github.com/l7mp/stunner/pkg/logger"
+)
+
+// logLevelState tracks the loglevels set at runtime through the debug server. A runtime loglevel
+// overrides the configured loglevel until the configured loglevel changes, and a temporary
+// runtime loglevel is reverted to the previous loglevels when the revert timer expires.
+type logLevelState struct {
+	logger     *logger.LeveledLoggerFactory
+	configured string
+	overridden bool
+	revertSpec string
+	deadline   time.Time
+	timer      *time.Timer
+	lock       sync.Mutex
+}
+
+func newLogLevelState(logger *logger.LeveledLoggerFactory) *logLevelState {
+	return &logLevelState{logger: logger}
+}
+
+// configure applies the configured loglevel, unless the loglevel was overridden at runtime and
+// the configured loglevel has not changed since.
+func (l *logLevelState) configure(levelSpec string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.overridden && levelSpec == l.configured {
+		return
+	}
+
+	l.stop()
+	l.overridden = false
+	l.configured = levelSpec
+	l.logger.SetLevel(levelSpec)
+}
+
+// set overrides the loglevels. If revert is positive then the loglevels in effect before the
+// override are restored after the revert timeout expires. Overriding a temporary loglevel keeps
+// the original loglevels to be restored.
+func (l *logLevelState) set(levelSpec string, revert time.Duration) error {
+	if err := logger.ValidateLevelSpec(levelSpec); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	revertSpec := l.revertSpec
+	if l.timer == nil {
+		revertSpec = l.logger.GetLevelSpec()
+	}
+	l.stop()
+
+	l.overridden = true
+	l.logger.SetLevel(levelSpec)
+
+	if revert > 0 {
+		l.revertSpec = revertSpec
+		l.deadline = time.Now().Add(revert)
+		var timer *time.Timer
+		timer = time.AfterFunc(revert, func() { l.revert(timer) })
+		l.timer = timer
+	}
+
+	return nil
+}
+
+// revert restores the loglevels in effect before a temporary override.
+func (l *logLevelState) revert(timer *time.Timer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// the override was changed in the meantime
+	if l.timer != timer {
+		return
+	}
+
+	l.logger.SetLevel(l.revertSpec)
+	l.stop()
+}
+
+// status returns the current loglevels and the time remaining until the revert.
+func (l *logLevelState) status() *stnrv1.LogLevelStatus {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	s := &stnrv1.LogLevelStatus{Levels: l.logger.GetLevels()}
+	if l.timer != nil {
+		s.RevertIn = int64(time.Until(l.deadline).Round(time.Second) / time.Second)
+	}
+
+	return s
+}
+
+// close stops the revert timer.
+func (l *logLevelState) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.stop()
+}
+
+func (l *logLevelState) stop() {
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+	l.timer = nil
+	l.revertSpec = ""
+}
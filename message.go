@@ -0,0 +1,381 @@
+package stunner
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+// Helpers for handling TURN messages that are not processed by the pion/turn server.
+
+const (
+	// stunHeaderSize is the size of the STUN message header.
+	stunHeaderSize = 20
+	// channelDataHeaderSize is the size of the ChannelData message header.
+	channelDataHeaderSize = 4
+	// turnFrameReadSize is the buffer size used to read TURN frames from a stream.
+	turnFrameReadSize = 1600
+	// nonceLifetime is the lifetime of the nonces we generate, see RFC 5766, Section 4.
+	nonceLifetime = time.Hour
+	// nonceLength is the length of the raw nonce: 8 bytes timestamp plus a SHA256 HMAC.
+	nonceLength = 40
+	// nonceKeyLength is the length of the random key used to sign nonces.
+	nonceKeyLength = 64
+)
+
+var (
+	errInvalidTURNFrame = errors.New("invalid TURN frame")
+	errInvalidNonce     = errors.New("invalid nonce")
+	errInvalidLifetime  = errors.New("invalid LIFETIME attribute")
+	errInvalidConnID    = errors.New("invalid CONNECTION-ID attribute")
+	errInvalidFamily    = errors.New("invalid REQUESTED-ADDRESS-FAMILY attribute")
+)
+
+// addrFamily is an address family as encoded in the REQUESTED-ADDRESS-FAMILY attribute (RFC 6156).
+type addrFamily byte
+
+const (
+	addrFamilyIPv4 addrFamily = 0x01
+	addrFamilyIPv6 addrFamily = 0x02
+)
+
+func (f addrFamily) String() string {
+	switch f {
+	case addrFamilyIPv4:
+		return "IPv4"
+	case addrFamilyIPv6:
+		return "IPv6"
+	default:
+		return "<unknown>"
+	}
+}
+
+// getAddrFamily returns the address family of a transport address.
+func getAddrFamily(addr net.Addr) addrFamily {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	}
+
+	if ip != nil && ip.To4() == nil {
+		return addrFamilyIPv6
+	}
+	return addrFamilyIPv4
+}
+
+// getRequestedAddressFamily returns the address family requested in an Allocate request. If the
+// request contains no REQUESTED-ADDRESS-FAMILY attribute then the family of the client's source
+// address is used, see RFC 6156, Section 4.2.
+func getRequestedAddressFamily(m *stun.Message, src net.Addr) (addrFamily, error) {
+	v, err := m.Get(stun.AttrRequestedAddressFamily)
+	if err != nil {
+		return getAddrFamily(src), nil
+	}
+	if len(v) != 4 {
+		return 0, errInvalidFamily
+	}
+
+	return addrFamily(v[0]), nil
+}
+
+// turnFrameLen returns the length of the first TURN frame (a STUN message or a ChannelData
+// message) in a buffer, or zero if the buffer does not yet contain a full frame.
+func turnFrameLen(p []byte) (int, error) {
+	if len(p) < channelDataHeaderSize {
+		return 0, nil
+	}
+
+	size := 0
+	switch {
+	case p[0]>>6 == 0: // STUN message
+		if len(p) < stunHeaderSize {
+			return 0, nil
+		}
+		if !stun.IsMessage(p) {
+			return 0, errInvalidTURNFrame
+		}
+		size = int(binary.BigEndian.Uint16(p[2:4])) + stunHeaderSize
+	case p[0]>>6 == 1: // ChannelData, padded to 4 bytes on stream transports
+		size = int(binary.BigEndian.Uint16(p[2:4]))
+		size = (size+3)/4*4 + channelDataHeaderSize
+	default:
+		return 0, errInvalidTURNFrame
+	}
+
+	if len(p) < size {
+		return 0, nil
+	}
+
+	return size, nil
+}
+
+// turnFramer splits a TURN stream into frames.
+type turnFramer struct {
+	r   io.Reader
+	buf []byte
+}
+
+// peek returns the next TURN frame from the stream without consuming it.
+func (f *turnFramer) peek() ([]byte, error) {
+	for {
+		n, err := turnFrameLen(f.buf)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return f.buf[:n], nil
+		}
+
+		chunk := make([]byte, turnFrameReadSize)
+		m, err := f.r.Read(chunk)
+		f.buf = append(f.buf, chunk[:m]...)
+		if err != nil && m == 0 {
+			return nil, err
+		}
+	}
+}
+
+// next returns a copy of the next TURN frame from the stream.
+func (f *turnFramer) next() ([]byte, error) {
+	frame, err := f.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, len(frame))
+	copy(ret, frame)
+	f.consume(len(frame))
+
+	return ret, nil
+}
+
+// consume drops the first n bytes from the read buffer.
+func (f *turnFramer) consume(n int) {
+	f.buf = append(f.buf[:0], f.buf[n:]...)
+}
+
+// nonceHash creates and validates signed nonces, modeled after the nonce handling in pion/turn.
+type nonceHash struct {
+	key []byte
+}
+
+func newNonceHash() (*nonceHash, error) {
+	key := make([]byte, nonceKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &nonceHash{key: key}, nil
+}
+
+// generate creates a new nonce.
+func (n *nonceHash) generate() string {
+	nonce := make([]byte, 8, nonceLength)
+	binary.BigEndian.PutUint64(nonce, uint64(time.Now().UnixMilli()))
+
+	hash := hmac.New(sha256.New, n.key)
+	hash.Write(nonce[:8]) //nolint:errcheck
+	nonce = hash.Sum(nonce)
+
+	return hex.EncodeToString(nonce)
+}
+
+// validate checks that the nonce was signed by us and that it has not expired.
+func (n *nonceHash) validate(nonce string) error {
+	b, err := hex.DecodeString(nonce)
+	if err != nil || len(b) != nonceLength {
+		return errInvalidNonce
+	}
+
+	if ts := time.UnixMilli(int64(binary.BigEndian.Uint64(b))); time.Since(ts) > nonceLifetime {
+		return errInvalidNonce
+	}
+
+	hash := hmac.New(sha256.New, n.key)
+	hash.Write(b[:8]) //nolint:errcheck
+	if !hmac.Equal(b[8:], hash.Sum(nil)) {
+		return errInvalidNonce
+	}
+
+	return nil
+}
+
+// xorAddress is a stun.Setter for XOR-encoded address attributes.
+type xorAddress struct {
+	attr stun.AttrType
+	addr net.Addr
+}
+
+// AddTo adds the XOR-encoded address to a STUN message.
+func (a xorAddress) AddTo(m *stun.Message) error {
+	var xa stun.XORMappedAddress
+	switch addr := a.addr.(type) {
+	case *net.UDPAddr:
+		xa = stun.XORMappedAddress{IP: addr.IP, Port: addr.Port}
+	case *net.TCPAddr:
+		xa = stun.XORMappedAddress{IP: addr.IP, Port: addr.Port}
+	default:
+		return errNilConn
+	}
+
+	return xa.AddToAs(m, a.attr)
+}
+
+// getXORAddresses returns all XOR-encoded addresses of the given type from a STUN message.
+func getXORAddresses(m *stun.Message, t stun.AttrType) []stun.XORMappedAddress {
+	ret := []stun.XORMappedAddress{}
+	for _, attr := range m.Attributes {
+		if attr.Type != t {
+			continue
+		}
+
+		// XORMappedAddress can only decode the first attribute of a type, so decode
+		// each one in a throwaway message with the same transaction id
+		tmp := &stun.Message{TransactionID: m.TransactionID}
+		tmp.Add(t, attr.Value)
+		var a stun.XORMappedAddress
+		if err := a.GetFromAs(tmp, t); err == nil {
+			ret = append(ret, a)
+		}
+	}
+
+	return ret
+}
+
+// lifetime is a stun.Setter for the LIFETIME attribute.
+type lifetime time.Duration
+
+// AddTo adds the LIFETIME attribute to a STUN message.
+func (l lifetime) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(time.Duration(l)/time.Second))
+	m.Add(stun.AttrLifetime, v)
+	return nil
+}
+
+// getLifetime returns the LIFETIME attribute from a STUN message.
+func getLifetime(m *stun.Message) (time.Duration, error) {
+	v, err := m.Get(stun.AttrLifetime)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 4 {
+		return 0, errInvalidLifetime
+	}
+
+	return time.Duration(binary.BigEndian.Uint32(v)) * time.Second, nil
+}
+
+// connectionID is a stun.Setter for the CONNECTION-ID attribute (RFC 6062).
+type connectionID uint32
+
+// AddTo adds the CONNECTION-ID attribute to a STUN message.
+func (c connectionID) AddTo(m *stun.Message) error {
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(c))
+	m.Add(stun.AttrConnectionID, v)
+	return nil
+}
+
+// getConnectionID returns the CONNECTION-ID attribute from a STUN message.
+func getConnectionID(m *stun.Message) (connectionID, error) {
+	v, err := m.Get(stun.AttrConnectionID)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 4 {
+		return 0, errInvalidConnID
+	}
+
+	return connectionID(binary.BigEndian.Uint32(v)), nil
+}
+
+// rewriteRelayedAddress replaces the IP address in the XOR-RELAYED-ADDRESS attribute of a STUN
+// message and re-signs the message with the given long-term credential key.
+func rewriteRelayedAddress(m *stun.Message, ip net.IP, key []byte) ([]byte, error) {
+	var relayed stun.XORMappedAddress
+	if err := relayed.GetFromAs(m, stun.AttrXORRelayedAddress); err != nil {
+		return nil, err
+	}
+
+	return resignMessage(m, key, stun.AttrXORRelayedAddress, xorAddress{
+		attr: stun.AttrXORRelayedAddress,
+		addr: &net.UDPAddr{IP: ip, Port: relayed.Port},
+	})
+}
+
+// rewriteLifetime replaces the LIFETIME attribute of a STUN message (adding one if missing) and
+// re-signs the message with the given long-term credential key.
+func rewriteLifetime(m *stun.Message, lt time.Duration, key []byte) ([]byte, error) {
+	return resignMessage(m, key, stun.AttrLifetime, lifetime(lt))
+}
+
+// resignMessage rebuilds a STUN message with the attribute of the given type replaced by the
+// attribute added by the setter (the attribute is appended if the message does not contain one)
+// and re-signs the message with the given long-term credential key, unless the key is nil. The
+// FINGERPRINT is recomputed if the original message contained one.
+func resignMessage(m *stun.Message, key []byte, t stun.AttrType, setter stun.Setter) ([]byte, error) {
+	ret := &stun.Message{Type: m.Type, TransactionID: m.TransactionID}
+	ret.WriteHeader()
+	replaced, fingerprint := false, false
+	for _, attr := range m.Attributes {
+		switch attr.Type {
+		case stun.AttrMessageIntegrity:
+		case stun.AttrFingerprint:
+			fingerprint = true
+		case t:
+			if replaced {
+				continue
+			}
+			if err := setter.AddTo(ret); err != nil {
+				return nil, err
+			}
+			replaced = true
+		default:
+			ret.Add(attr.Type, attr.Value)
+		}
+	}
+
+	if !replaced {
+		if err := setter.AddTo(ret); err != nil {
+			return nil, err
+		}
+	}
+
+	if key != nil {
+		if err := stun.MessageIntegrity(key).AddTo(ret); err != nil {
+			return nil, err
+		}
+	}
+	if fingerprint {
+		if err := stun.Fingerprint.AddTo(ret); err != nil {
+			return nil, err
+		}
+	}
+
+	return ret.Raw, nil
+}
+
+// getRequestedTransport returns the protocol number from the REQUESTED-TRANSPORT attribute.
+func getRequestedTransport(m *stun.Message) (byte, error) {
+	v, err := m.Get(stun.AttrRequestedTransport)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) != 4 {
+		return 0, errInvalidTURNFrame
+	}
+
+	return v[0], nil
+}
@@ -0,0 +1,122 @@
+package stunner
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/l7mp/stunner/internal/object"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
+)
+
+// accessTokenGCInterval is the interval at which expired access tokens are removed.
+const accessTokenGCInterval = time.Minute
+
+var (
+	errOAuthDisabled  = errors.New("third-party authorization disabled")
+	errNoAccessToken  = errors.New("no access token")
+	errUnknownOAuthID = errors.New("unknown key id")
+)
+
+// accessTokenTable stores the access tokens presented by the clients in the ACCESS-TOKEN attribute
+// of Allocate and Refresh requests (RFC 7635 third-party authorization), for the auth handler to
+// find the MAC key the client uses to sign its requests. Tokens are indexed by the transport
+// address of the client and the key id (the USERNAME of the request) and kept until they expire.
+type accessTokenTable struct {
+	auth   func() *object.Auth
+	tokens map[string]*a12n.AccessToken
+	lastGC time.Time
+	lock   sync.Mutex
+}
+
+func newAccessTokenTable(auth func() *object.Auth) *accessTokenTable {
+	return &accessTokenTable{
+		auth:   auth,
+		tokens: map[string]*a12n.AccessToken{},
+		lastGC: time.Now(),
+	}
+}
+
+func accessTokenKey(addr net.Addr, kid string) string {
+	return addr.Network() + "/" + addr.String() + "/" + kid
+}
+
+// serverName returns the STUN server name if third-party authorization is enabled, or an empty
+// string otherwise.
+func (t *accessTokenTable) serverName() string {
+	auth := t.auth()
+	if auth.Type != stnrv1.AuthTypeOAuth || auth.OAuth == nil {
+		return ""
+	}
+	return auth.OAuth.ServerName
+}
+
+// add decrypts and checks an access token presented by a client and stores the token on success.
+func (t *accessTokenTable) add(src net.Addr, kid string, raw []byte) error {
+	auth := t.auth()
+	if auth.Type != stnrv1.AuthTypeOAuth || auth.OAuth == nil {
+		return errOAuthDisabled
+	}
+
+	key, ok := auth.GetOAuthKey(kid)
+	if !ok {
+		return fmt.Errorf("%w %q", errUnknownOAuthID, kid)
+	}
+
+	token, err := a12n.DecodeAccessToken(key, auth.OAuth.ServerName, raw)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err := token.Check(now); err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if now.Sub(t.lastGC) > accessTokenGCInterval {
+		for k, token := range t.tokens {
+			if !now.Before(token.Expiry()) {
+				delete(t.tokens, k)
+			}
+		}
+		t.lastGC = now
+	}
+
+	t.tokens[accessTokenKey(src, kid)] = token
+
+	return nil
+}
+
+// get returns the access token presented by a client for a key id. Returns an error if the client
+// has not presented a token, the token expired, or the key was removed from the configuration.
+func (t *accessTokenTable) get(src net.Addr, kid string) (*a12n.AccessToken, error) {
+	if src == nil {
+		return nil, errNoAccessToken
+	}
+
+	if _, ok := t.auth().GetOAuthKey(kid); !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownOAuthID, kid)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	k := accessTokenKey(src, kid)
+	token, ok := t.tokens[k]
+	if !ok {
+		return nil, errNoAccessToken
+	}
+
+	if err := token.Check(time.Now()); err != nil {
+		delete(t.tokens, k)
+		return nil, err
+	}
+
+	return token, nil
+}
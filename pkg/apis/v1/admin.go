@@ -4,9 +4,23 @@ import (
 	"fmt"
 	"net/url"
 	"reflect"
+	"sort"
 	"strings"
 )
 
+// Log formats.
+const (
+	LogFormatText   = "text"
+	LogFormatJSON   = "json"
+	LogFormatLogfmt = "logfmt"
+)
+
+// Special access log paths.
+const (
+	AccessLogStdout = "stdout"
+	AccessLogStderr = "stderr"
+)
+
 // AdminConfig holds the administrative configuration.
 type AdminConfig struct {
 	// Name of the server. Default is "default-stunnerd".
@@ -14,6 +28,10 @@ type AdminConfig struct {
 	// LogLevel is the desired log verbosity, e.g.: "stunner:TRACE,all:INFO". Default is
 	// "all:INFO".
 	LogLevel string `json:"loglevel,omitempty"`
+	// LogFormat is the output format of the logs, either "text" (free-form log lines), "json"
+	// (one JSON object per log record) or "logfmt" (one line of key=value pairs per log
+	// record). Default is "text".
+	LogFormat string `json:"log_format,omitempty"`
 	// MetricsEndpoint is the URI in the form `http://address:port/path` at which HTTP metric
 	// requests are served. The scheme (`http://`") is mandatory. Default is to expose no
 	// metric endpoints.
@@ -25,6 +43,203 @@ type AdminConfig struct {
 	// health-checking at `http://0.0.0.0:8086`. Set to a pointer to an empty string to disable
 	// health-checking.
 	HealthCheckEndpoint *string `json:"healthcheck_endpoint,omitempty"`
+	// DrainTimeout is the maximum time in seconds stunnerd waits for active allocations to
+	// terminate during a graceful shutdown before exiting. New allocations are rejected and
+	// allocation refreshes are capped at the remaining drain time while draining. Default is
+	// 3600 seconds.
+	DrainTimeout int `json:"drain_timeout,omitempty"`
+	// OTLP configures pushing metrics and allocation traces to an OpenTelemetry collector over
+	// OTLP. Default is not to export telemetry over OTLP.
+	OTLP *OTLPConfig `json:"otlp,omitempty"`
+	// AccessLog configures the allocation access log that records the lifecycle of each
+	// allocation for auditing. Default is not to write an access log.
+	AccessLog *AccessLogConfig `json:"access_log,omitempty"`
+	// Debug configures the debug server that exposes runtime loglevel control and, optionally,
+	// the Go profiler. Default is not to start a debug server.
+	Debug *DebugConfig `json:"debug,omitempty"`
+	// AdminToken is the bearer token the clients of the administrative endpoints of the
+	// health-check server (`/allocations`, `/revocations` and `/lockouts`) must present in the
+	// Authorization header. Default is to reject all administrative requests.
+	AdminToken string `json:"admin_token,omitempty"`
+}
+
+// OTLPConfig configures the OpenTelemetry OTLP exporter.
+type OTLPConfig struct {
+	// Endpoint is the URI of the OTLP collector of the form `scheme://address:port`. The scheme
+	// selects the protocol: `grpc://` or `grpcs://` (TLS) for OTLP/gRPC and `http://` or
+	// `https://` for OTLP/HTTP. If no port is specified then the default port is 4317 for
+	// OTLP/gRPC and 4318 for OTLP/HTTP.
+	Endpoint string `json:"endpoint"`
+	// Headers are additional headers sent with each export request, e.g., for authentication.
+	Headers map[string]string `json:"headers,omitempty"`
+	// MetricsInterval is the interval between metric exports in seconds. Default is 60
+	// seconds.
+	MetricsInterval int `json:"metrics_interval,omitempty"`
+	// DisableMetrics disables exporting metrics.
+	DisableMetrics bool `json:"disable_metrics,omitempty"`
+	// DisableTraces disables exporting allocation lifecycle traces.
+	DisableTraces bool `json:"disable_traces,omitempty"`
+}
+
+// Validate checks an OTLP exporter configuration and injects defaults.
+func (req *OTLPConfig) Validate() error {
+	u, err := url.Parse(req.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid OTLP endpoint URL %s: %s", req.Endpoint, err.Error())
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "grpc", "grpcs", "http", "https":
+	default:
+		return fmt.Errorf("invalid OTLP endpoint URL %s: scheme must be one of grpc, grpcs, "+
+			"http or https", req.Endpoint)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("invalid OTLP endpoint URL %s: no collector address",
+			req.Endpoint)
+	}
+
+	if req.MetricsInterval < 0 {
+		return fmt.Errorf("invalid OTLP metrics interval: %d", req.MetricsInterval)
+	}
+	if req.MetricsInterval == 0 {
+		req.MetricsInterval = DefaultOTLPMetricsInterval
+	}
+
+	return nil
+}
+
+// DeepCopy copies an OTLP exporter configuration.
+func (req *OTLPConfig) DeepCopy() *OTLPConfig {
+	ret := *req
+	if req.Headers != nil {
+		ret.Headers = make(map[string]string, len(req.Headers))
+		for k, v := range req.Headers {
+			ret.Headers[k] = v
+		}
+	}
+	return &ret
+}
+
+// String stringifies an OTLP exporter configuration. Header values are not shown.
+func (req *OTLPConfig) String() string {
+	status := []string{fmt.Sprintf("endpoint=%q", req.Endpoint)}
+	if len(req.Headers) > 0 {
+		hs := make([]string, 0, len(req.Headers))
+		for k := range req.Headers {
+			hs = append(hs, k)
+		}
+		sort.Strings(hs)
+		status = append(status, fmt.Sprintf("headers=[%s]", strings.Join(hs, ",")))
+	}
+	if !req.DisableMetrics {
+		status = append(status, fmt.Sprintf("metrics-interval=%d", req.MetricsInterval))
+	}
+	signals := []string{}
+	if !req.DisableMetrics {
+		signals = append(signals, "metrics")
+	}
+	if !req.DisableTraces {
+		signals = append(signals, "traces")
+	}
+	status = append(status, fmt.Sprintf("signals=[%s]", strings.Join(signals, ",")))
+	return fmt.Sprintf("otlp:{%s}", strings.Join(status, ","))
+}
+
+// AccessLogConfig configures the allocation access log. The access log contains a JSON record per
+// line for each created and each deleted allocation.
+type AccessLogConfig struct {
+	// Path is the file the access log is written to, or "stdout" or "stderr" to write the
+	// access log to the standard output or the standard error. Default is "stdout".
+	Path string `json:"path,omitempty"`
+	// MaxSize is the size in megabytes at which the access log file is rotated. Ignored when
+	// the access log is written to the standard output or error. Default is 100 megabytes.
+	MaxSize int `json:"max_size,omitempty"`
+	// MaxBackups is the number of rotated access log files retained. Default is 5.
+	MaxBackups int `json:"max_backups,omitempty"`
+}
+
+// Validate checks an access log configuration and injects defaults.
+func (req *AccessLogConfig) Validate() error {
+	if req.Path == "" {
+		req.Path = AccessLogStdout
+	}
+
+	if req.MaxSize < 0 {
+		return fmt.Errorf("invalid access log max size: %d", req.MaxSize)
+	}
+	if req.MaxSize == 0 {
+		req.MaxSize = DefaultAccessLogMaxSize
+	}
+
+	if req.MaxBackups < 0 {
+		return fmt.Errorf("invalid access log max backups: %d", req.MaxBackups)
+	}
+	if req.MaxBackups == 0 {
+		req.MaxBackups = DefaultAccessLogMaxBackups
+	}
+
+	return nil
+}
+
+// String stringifies an access log configuration.
+func (req *AccessLogConfig) String() string {
+	if req.Path == AccessLogStdout || req.Path == AccessLogStderr {
+		return fmt.Sprintf("access-log:{path=%q}", req.Path)
+	}
+	return fmt.Sprintf("access-log:{path=%q,max-size=%d,max-backups=%d}", req.Path, req.MaxSize,
+		req.MaxBackups)
+}
+
+// DebugConfig configures the debug server.
+type DebugConfig struct {
+	// Endpoint is the URI of the form `http://address:port` at which the debug server is
+	// exposed. The scheme (`http://`) is mandatory, and if no port is specified then the
+	// default port is 8089. Default is `http://127.0.0.1:8089`.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Token is the bearer token the clients of the debug server must present in the
+	// Authorization header. Mandatory.
+	Token string `json:"token"`
+	// EnablePprof exposes the Go profiler at the path `/debug/pprof/`. Default is false.
+	EnablePprof bool `json:"enable_pprof,omitempty"`
+}
+
+// Validate checks a debug server configuration and injects defaults.
+func (req *DebugConfig) Validate() error {
+	if req.Endpoint == "" {
+		req.Endpoint = fmt.Sprintf("http://127.0.0.1:%d", DefaultDebugPort)
+	}
+
+	u, err := url.Parse(req.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid debug server endpoint URL %s: %s", req.Endpoint,
+			err.Error())
+	}
+	if u.Scheme != "http" {
+		return fmt.Errorf("invalid debug server endpoint URL %s: scheme must be http",
+			req.Endpoint)
+	}
+
+	if req.Token == "" {
+		return fmt.Errorf("invalid debug server config: no token")
+	}
+
+	return nil
+}
+
+// String stringifies a debug server configuration. The token is not shown.
+func (req *DebugConfig) String() string {
+	return fmt.Sprintf("debug:{endpoint=%q,pprof=%t}", req.Endpoint, req.EnablePprof)
+}
+
+// LogLevelStatus is the response of the debug server to loglevel requests.
+type LogLevelStatus struct {
+	// Levels is the loglevel per scope, the scope "all" is the default loglevel.
+	Levels map[string]string `json:"levels"`
+	// RevertIn is the time in seconds until the loglevels are reverted, zero if no revert is
+	// pending.
+	RevertIn int64 `json:"revert_in,omitempty"`
 }
 
 // Validate checks a configuration and injects defaults.
@@ -37,6 +252,12 @@ func (req *AdminConfig) Validate() error {
 		req.Name = DefaultStunnerName
 	}
 
+	switch req.LogFormat {
+	case "", LogFormatText, LogFormatJSON, LogFormatLogfmt:
+	default:
+		return fmt.Errorf("invalid log format %q", req.LogFormat)
+	}
+
 	if req.MetricsEndpoint != "" {
 		//Metrics endpoint set: validate. The empty string is valid
 		if _, err := url.Parse(req.MetricsEndpoint); err != nil {
@@ -57,6 +278,28 @@ func (req *AdminConfig) Validate() error {
 		}
 	}
 
+	if req.DrainTimeout < 0 {
+		return fmt.Errorf("invalid drain timeout: %d", req.DrainTimeout)
+	}
+
+	if req.OTLP != nil {
+		if err := req.OTLP.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if req.AccessLog != nil {
+		if err := req.AccessLog.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if req.Debug != nil {
+		if err := req.Debug.Validate(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -75,6 +318,17 @@ func (req *AdminConfig) DeepEqual(other Config) bool {
 func (req *AdminConfig) DeepCopyInto(dst Config) {
 	ret := dst.(*AdminConfig)
 	*ret = *req
+	if req.OTLP != nil {
+		ret.OTLP = req.OTLP.DeepCopy()
+	}
+	if req.AccessLog != nil {
+		a := *req.AccessLog
+		ret.AccessLog = &a
+	}
+	if req.Debug != nil {
+		d := *req.Debug
+		ret.Debug = &d
+	}
 }
 
 // String stringifies the configuration.
@@ -86,12 +340,30 @@ func (req *AdminConfig) String() string {
 	if req.LogLevel != "" {
 		status = append(status, fmt.Sprintf("logLevel=%q", req.LogLevel))
 	}
+	if req.LogFormat != "" {
+		status = append(status, fmt.Sprintf("log-format=%q", req.LogFormat))
+	}
 	if req.MetricsEndpoint != "" {
 		status = append(status, fmt.Sprintf("metrics=%q", req.MetricsEndpoint))
 	}
 	if req.HealthCheckEndpoint != nil {
 		status = append(status, fmt.Sprintf("health-check=%q", *req.HealthCheckEndpoint))
 	}
+	if req.DrainTimeout > 0 {
+		status = append(status, fmt.Sprintf("drain-timeout=%d", req.DrainTimeout))
+	}
+	if req.OTLP != nil {
+		status = append(status, req.OTLP.String())
+	}
+	if req.AccessLog != nil {
+		status = append(status, req.AccessLog.String())
+	}
+	if req.Debug != nil {
+		status = append(status, req.Debug.String())
+	}
+	if req.AdminToken != "" {
+		status = append(status, "admin-token=<SECRET>")
+	}
 	return fmt.Sprintf("admin:{%s}", strings.Join(status, ","))
 }
 
@@ -99,8 +371,12 @@ func (req *AdminConfig) String() string {
 type AdminStatus struct {
 	Name                string `json:"name,omitempty"`
 	LogLevel            string `json:"loglevel,omitempty"`
+	LogFormat           string `json:"log_format,omitempty"`
 	MetricsEndpoint     string `json:"metrics_endpoint,omitempty"`
 	HealthCheckEndpoint string `json:"healthcheck_endpoint,omitempty"`
+	OTLPEndpoint        string `json:"otlp_endpoint,omitempty"`
+	AccessLog           string `json:"access_log,omitempty"`
+	DebugEndpoint       string `json:"debug_endpoint,omitempty"`
 	// licencing status comes here
 }
 
@@ -110,12 +386,24 @@ func (a *AdminStatus) String() string {
 	if a.LogLevel != "" {
 		status = append(status, fmt.Sprintf("logLevel=%q", a.LogLevel))
 	}
+	if a.LogFormat != "" {
+		status = append(status, fmt.Sprintf("log-format=%q", a.LogFormat))
+	}
 	if a.MetricsEndpoint != "" {
 		status = append(status, fmt.Sprintf("metrics=%q", a.MetricsEndpoint))
 	}
 	if a.HealthCheckEndpoint != "" {
 		status = append(status, fmt.Sprintf("health-check=%q", a.HealthCheckEndpoint))
 	}
+	if a.OTLPEndpoint != "" {
+		status = append(status, fmt.Sprintf("otlp=%q", a.OTLPEndpoint))
+	}
+	if a.AccessLog != "" {
+		status = append(status, fmt.Sprintf("access-log=%q", a.AccessLog))
+	}
+	if a.DebugEndpoint != "" {
+		status = append(status, fmt.Sprintf("debug=%q", a.DebugEndpoint))
+	}
 
 	// add licencing status here
 
@@ -0,0 +1,110 @@
+package v1
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// AllocationStatus represents an active TURN allocation.
+type AllocationStatus struct {
+	// Listener is the name of the listener the allocation was created at.
+	Listener string `json:"listener"`
+	// Protocol is the transport protocol between the client and the listener ("UDP", "TCP",
+	// "TLS" or "DTLS").
+	Protocol string `json:"protocol"`
+	// ClientAddr is the transport address of the client.
+	ClientAddr string `json:"client_address"`
+	// ServerAddr is the transport address of the listener.
+	ServerAddr string `json:"server_address"`
+	// RelayProtocol is the transport protocol of the relay, either "udp" or "tcp".
+	RelayProtocol string `json:"relay_protocol"`
+	// RelayAddr is the relayed transport address of the allocation.
+	RelayAddr string `json:"relay_address"`
+	// Username is the username the allocation was authenticated with.
+	Username string `json:"username"`
+	// Permissions is the list of peer IP addresses the client has installed a permission for.
+	Permissions []string `json:"permissions"`
+	// Channels is the list of channels bound by the client.
+	Channels []ChannelStatus `json:"channels"`
+	// Created is the creation time of the allocation.
+	Created time.Time `json:"created"`
+	// Age is the time elapsed since the allocation was created, in seconds.
+	Age int64 `json:"age"`
+	// RxBytes is the number of bytes received from the peers.
+	RxBytes uint64 `json:"rx_bytes"`
+	// RxPackets is the number of packets received from the peers.
+	RxPackets uint64 `json:"rx_packets"`
+	// TxBytes is the number of bytes sent to the peers.
+	TxBytes uint64 `json:"tx_bytes"`
+	// TxPackets is the number of packets sent to the peers.
+	TxPackets uint64 `json:"tx_packets"`
+}
+
+// ChannelStatus represents a channel bound to an allocation.
+type ChannelStatus struct {
+	// Number is the channel number.
+	Number uint16 `json:"number"`
+	// Peer is the transport address of the peer the channel is bound to.
+	Peer string `json:"peer"`
+}
+
+// String stringifies the allocation status.
+func (a *AllocationStatus) String() string {
+	chs := make([]string, len(a.Channels))
+	for i, c := range a.Channels {
+		chs[i] = fmt.Sprintf("0x%x:%s", c.Number, c.Peer)
+	}
+
+	return fmt.Sprintf("%q:{%s://%s->%s,relay=%s://%s,user=%q,permissions=[%s],channels=[%s],"+
+		"age=%s,rx=%d/%d,tx=%d/%d}", a.Listener, strings.ToLower(a.Protocol), a.ClientAddr,
+		a.ServerAddr, a.RelayProtocol, a.RelayAddr, a.Username,
+		strings.Join(a.Permissions, ","), strings.Join(chs, ","),
+		time.Duration(a.Age)*time.Second, a.RxPackets, a.RxBytes, a.TxPackets, a.TxBytes)
+}
+
+// AllocationFilter selects allocations by listener, username and client IP address. Empty fields
+// match all allocations.
+type AllocationFilter struct {
+	// Listener is the name of the listener.
+	Listener string `json:"listener,omitempty"`
+	// Username is the username the allocation was authenticated with.
+	Username string `json:"username,omitempty"`
+	// ClientIP is the IP address of the client.
+	ClientIP string `json:"client_ip,omitempty"`
+}
+
+// Match returns true if an allocation matches the filter.
+func (f *AllocationFilter) Match(a *AllocationStatus) bool {
+	if f.Listener != "" && f.Listener != a.Listener {
+		return false
+	}
+
+	if f.Username != "" && f.Username != a.Username {
+		return false
+	}
+
+	if f.ClientIP != "" {
+		host, _, err := net.SplitHostPort(a.ClientAddr)
+		if err != nil {
+			return false
+		}
+		if ip := net.ParseIP(f.ClientIP); ip == nil || !ip.Equal(net.ParseIP(host)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsEmpty returns true if the filter matches all allocations.
+func (f *AllocationFilter) IsEmpty() bool {
+	return f.Listener == "" && f.Username == "" && f.ClientIP == ""
+}
+
+// String stringifies the allocation filter.
+func (f *AllocationFilter) String() string {
+	return fmt.Sprintf("listener=%q,username=%q,client-ip=%q", f.Listener, f.Username,
+		f.ClientIP)
+}
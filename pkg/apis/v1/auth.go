@@ -1,23 +1,84 @@
 package v1
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net"
+	"net/url"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
+)
+
+const (
+	// OAuthAlgorithmA128GCM is the AEAD_AES_128_GCM token encryption algorithm.
+	OAuthAlgorithmA128GCM = "A128GCM"
+	// OAuthAlgorithmA256GCM is the AEAD_AES_256_GCM token encryption algorithm.
+	OAuthAlgorithmA256GCM = "A256GCM"
+
+	// CredentialAlgorithmHMACSHA1 derives ephemeral passwords with HMAC-SHA1.
+	CredentialAlgorithmHMACSHA1 = "HMAC-SHA1"
+	// CredentialAlgorithmHMACSHA256 derives ephemeral passwords with HMAC-SHA256.
+	CredentialAlgorithmHMACSHA256 = "HMAC-SHA256"
+	// CredentialAlgorithmHMACSHA512 derives ephemeral passwords with HMAC-SHA512.
+	CredentialAlgorithmHMACSHA512 = "HMAC-SHA512"
 )
 
 // Auth specifies the STUN/TURN authentication mechanism used by STUNner.
 type AuthConfig struct {
-	// Type of the STUN/TURN authentication mechanism ("static" or "ephemeral"). The deprecated
-	// type name "plaintext" is accepted for "static" and the deprecated type name "longterm"
-	// is accepted for "ephemeral" for compatibility with older versions.
+	// Type of the STUN/TURN authentication mechanism ("static", "ephemeral", "oauth" or
+	// "webhook"). The deprecated type name "plaintext" is accepted for "static" and the
+	// deprecated type name "longterm" is accepted for "ephemeral" for compatibility with older
+	// versions.
 	Type string `json:"type,omitempty"`
 	// Realm defines the STUN/TURN authentication realm.
 	Realm string `json:"realm,omitempty"`
-	// Credentials specifies the authententication credentials: for "static" at least the keys
-	// "username" and "password" must be set, for "ephemeral" the key "secret" specifying the
-	// shared authentication secret must be set.
+	// Credentials specifies the authententication credentials: for "static" the keys
+	// "username" and "password" must be set unless users are specified in Users or UsersFile,
+	// for "ephemeral" the key "secret" specifying the shared authentication secret must be
+	// set unless secrets are specified in Secrets.
 	Credentials map[string]string `json:"credentials"`
+	// Secrets is the ordered list of shared secrets for the "ephemeral" type, used to rotate
+	// the shared secret without invalidating the credentials issued with the previous
+	// secrets. The first secret is the active one that is used to issue new credentials, the
+	// rest are accepted for verifying credentials until their expiry. The secret specified in
+	// Credentials, if any, is the active secret and precedes the secrets in the list.
+	Secrets []SharedSecret `json:"secrets,omitempty"`
+	// CredentialAlgorithm is the HMAC algorithm used to derive the password from the username
+	// and the shared secret for the "ephemeral" type ("HMAC-SHA1", "HMAC-SHA256" or
+	// "HMAC-SHA512"). Default is "HMAC-SHA1".
+	CredentialAlgorithm string `json:"credential_algorithm,omitempty"`
+	// Users is the static user table for the "static" type. The user specified in Credentials,
+	// if any, is added to the table.
+	Users []StaticUser `json:"users,omitempty"`
+	// UsersFile is the path of a file containing a YAML or JSON list of static users for the
+	// "static" type, e.g., a mounted Kubernetes Secret. The file is reloaded when it changes.
+	// The users in the file are added to the users specified in Users.
+	UsersFile string `json:"users_file,omitempty"`
+	// OAuth specifies the keys used to decrypt the self-contained access tokens for the
+	// "oauth" type (RFC 7635 third-party authorization).
+	OAuth *OAuthConfig `json:"oauth,omitempty"`
+	// Webhook specifies the external authentication service for the "webhook" type.
+	Webhook *WebhookConfig `json:"webhook,omitempty"`
+	// Tenants maps tenant names to the clusters the users of the tenant may reach. The tenant
+	// of a static user is set in the user table, the tenant of an ephemeral credential is set
+	// in the username with a "tenant=<name>" component, e.g., "1681490135:user-id:tenant=acme".
+	// Users without a tenant may reach all the clusters of the listener, users of a tenant
+	// that is not listed here cannot reach any cluster.
+	Tenants map[string][]string `json:"tenants,omitempty"`
+	// Revocations lists the revoked credentials of the "ephemeral" type. Revoked credentials
+	// are rejected even before their expiry.
+	Revocations *RevocationConfig `json:"revocations,omitempty"`
+	// Lockout enables brute-force protection: source IP addresses and usernames with too many
+	// failed authentication attempts are locked out for a while. No lockout if unset.
+	Lockout *LockoutConfig `json:"lockout,omitempty"`
+	// UserQuota is the maximum number of concurrent allocations a single username can hold
+	// across all listeners. Zero means no limit.
+	UserQuota int `json:"user_quota,omitempty"`
+	// ClientQuota is the maximum number of concurrent allocations a single client IP address
+	// can hold across all listeners. Zero means no limit.
+	ClientQuota int `json:"client_quota,omitempty"`
 }
 
 // Validate checks a configuration and injects defaults.
@@ -37,16 +98,71 @@ func (req *AuthConfig) Validate() error {
 	case AuthTypeStatic:
 		_, userFound := req.Credentials["username"]
 		_, passFound := req.Credentials["password"]
-		if !userFound || !passFound {
+		if userFound != passFound || (!userFound && len(req.Users) == 0 && req.UsersFile == "") {
 			return fmt.Errorf("%s: empty username or password", atype.String())
 		}
 
+		users := map[string]bool{}
+		if userFound {
+			users[req.Credentials["username"]] = true
+		}
+		for i := range req.Users {
+			u := &req.Users[i]
+			if err := u.Validate(); err != nil {
+				return fmt.Errorf("%s: %w", atype.String(), err)
+			}
+			if users[u.Username] {
+				return fmt.Errorf("%s: duplicate username %q", atype.String(), u.Username)
+			}
+			users[u.Username] = true
+		}
+
 	case AuthTypeEphemeral:
 		_, secretFound := req.Credentials["secret"]
-		if !secretFound {
+		if !secretFound && len(req.Secrets) == 0 {
 			return fmt.Errorf("cannot handle auth config for type %s: invalid secret",
 				atype.String())
 		}
+
+		if req.CredentialAlgorithm != "" {
+			alg, err := normalizeCredentialAlgorithm(req.CredentialAlgorithm)
+			if err != nil {
+				return fmt.Errorf("%s: %w", atype.String(), err)
+			}
+			req.CredentialAlgorithm = alg
+		}
+
+		versions := map[string]bool{}
+		if secretFound {
+			versions[DefaultSharedSecretVersion] = true
+		}
+		for i := range req.Secrets {
+			s := &req.Secrets[i]
+			if err := s.Validate(); err != nil {
+				return fmt.Errorf("%s: %w", atype.String(), err)
+			}
+			if i == 0 && !secretFound && s.Expiry != "" {
+				return fmt.Errorf("%s: active secret %q cannot expire", atype.String(),
+					s.Version)
+			}
+			if versions[s.Version] {
+				return fmt.Errorf("%s: duplicate secret version %q", atype.String(),
+					s.Version)
+			}
+			versions[s.Version] = true
+		}
+
+	case AuthTypeOAuth:
+		if req.OAuth == nil {
+			return fmt.Errorf("cannot handle auth config for type %s: no oauth config",
+				atype.String())
+		}
+
+	case AuthTypeWebhook:
+		if req.Webhook == nil {
+			return fmt.Errorf("cannot handle auth config for type %s: no webhook config",
+				atype.String())
+		}
 	default:
 		return fmt.Errorf("invalid authentication type %q", req.Type)
 	}
@@ -55,6 +171,54 @@ func (req *AuthConfig) Validate() error {
 		req.Realm = DefaultRealm
 	}
 
+	if req.OAuth != nil {
+		if err := req.OAuth.Validate(req.Realm); err != nil {
+			return err
+		}
+	}
+
+	if req.Webhook != nil {
+		if err := req.Webhook.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for tenant, clusters := range req.Tenants {
+		if tenant == "" || strings.Contains(tenant, ":") {
+			return fmt.Errorf("invalid tenant name %q", tenant)
+		}
+		for _, c := range clusters {
+			if c == "" {
+				return fmt.Errorf("empty cluster name for tenant %q", tenant)
+			}
+		}
+	}
+
+	for _, u := range req.Users {
+		if _, ok := req.Tenants[u.Tenant]; u.Tenant != "" && !ok {
+			return fmt.Errorf("unknown tenant %q for user %q", u.Tenant, u.Username)
+		}
+	}
+
+	if req.Revocations != nil {
+		if err := req.Revocations.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if req.Lockout != nil {
+		if err := req.Lockout.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if req.UserQuota < 0 {
+		return fmt.Errorf("invalid user quota: %d", req.UserQuota)
+	}
+	if req.ClientQuota < 0 {
+		return fmt.Errorf("invalid client quota: %d", req.ClientQuota)
+	}
+
 	if req.Credentials == nil {
 		req.Credentials = map[string]string{}
 	}
@@ -81,6 +245,34 @@ func (req *AuthConfig) DeepCopyInto(dst Config) {
 	for k, v := range req.Credentials {
 		ret.Credentials[k] = v
 	}
+	if req.Users != nil {
+		ret.Users = make([]StaticUser, len(req.Users))
+		for i := range req.Users {
+			req.Users[i].DeepCopyInto(&ret.Users[i])
+		}
+	}
+	if req.Secrets != nil {
+		ret.Secrets = make([]SharedSecret, len(req.Secrets))
+		copy(ret.Secrets, req.Secrets)
+	}
+	if req.OAuth != nil {
+		ret.OAuth = req.OAuth.DeepCopy()
+	}
+	if req.Webhook != nil {
+		ret.Webhook = req.Webhook.DeepCopy()
+	}
+	if req.Tenants != nil {
+		ret.Tenants = make(map[string][]string, len(req.Tenants))
+		for k, v := range req.Tenants {
+			ret.Tenants[k] = append([]string{}, v...)
+		}
+	}
+	if req.Revocations != nil {
+		ret.Revocations = req.Revocations.DeepCopy()
+	}
+	if req.Lockout != nil {
+		ret.Lockout = req.Lockout.DeepCopy()
+	}
 }
 
 // String stringifies the configuration.
@@ -114,6 +306,12 @@ func (req *AuthConfig) String() string {
 				p = "-"
 			}
 			status = append(status, fmt.Sprintf("username=%q,password=%q", u, p))
+			if len(req.Users) > 0 {
+				status = append(status, fmt.Sprintf("users=%d", len(req.Users)))
+			}
+			if req.UsersFile != "" {
+				status = append(status, fmt.Sprintf("users-file=%q", req.UsersFile))
+			}
 
 		case AuthTypeEphemeral:
 			s, secretFound := req.Credentials["secret"]
@@ -128,11 +326,628 @@ func (req *AuthConfig) String() string {
 			}
 
 			status = append(status, fmt.Sprintf("secret=%q", s))
+			if req.CredentialAlgorithm != "" {
+				status = append(status, fmt.Sprintf("credential-algorithm=%s",
+					req.CredentialAlgorithm))
+			}
+			if len(req.Secrets) > 0 {
+				versions := []string{}
+				for _, s := range req.Secrets {
+					versions = append(versions, s.Version)
+				}
+				status = append(status, fmt.Sprintf("secrets=[%s]",
+					strings.Join(versions, ",")))
+			}
+
+		case AuthTypeOAuth:
+			if req.OAuth != nil {
+				status = append(status, req.OAuth.String())
+			}
+
+		case AuthTypeWebhook:
+			if req.Webhook != nil {
+				status = append(status, req.Webhook.String())
+			}
+		}
+	}
+
+	if len(req.Tenants) > 0 {
+		tenants := []string{}
+		for t := range req.Tenants {
+			tenants = append(tenants, t)
 		}
+		sort.Strings(tenants)
+		status = append(status, fmt.Sprintf("tenants=[%s]", strings.Join(tenants, ",")))
+	}
+	if req.Revocations != nil && !req.Revocations.IsEmpty() {
+		status = append(status, fmt.Sprintf("revocations={%s}", req.Revocations.String()))
+	}
+	if req.Lockout != nil {
+		status = append(status, fmt.Sprintf("lockout={%s}", req.Lockout.String()))
+	}
+	if req.UserQuota > 0 {
+		status = append(status, fmt.Sprintf("user-quota=%d", req.UserQuota))
+	}
+	if req.ClientQuota > 0 {
+		status = append(status, fmt.Sprintf("client-quota=%d", req.ClientQuota))
 	}
 
 	return fmt.Sprintf("%s-auth:{%s}", req.Type, strings.Join(status, ","))
 }
 
+// GetSharedSecrets returns the shared secrets of the ephemeral authentication mode, the active
+// secret first. The Algorithm of each secret is set to the credential algorithm used with the
+// secret.
+func (req *AuthConfig) GetSharedSecrets() []SharedSecret {
+	alg := req.CredentialAlgorithm
+	if alg == "" {
+		alg = CredentialAlgorithmHMACSHA1
+	}
+
+	ret := []SharedSecret{}
+	if s, ok := req.Credentials["secret"]; ok {
+		ret = append(ret, SharedSecret{Version: DefaultSharedSecretVersion, Secret: s,
+			Algorithm: alg})
+	}
+	for _, s := range req.Secrets {
+		if s.Algorithm == "" {
+			s.Algorithm = alg
+		}
+		ret = append(ret, s)
+	}
+
+	return ret
+}
+
+// SharedSecret is a shared secret of the ephemeral authentication mode.
+type SharedSecret struct {
+	// Version identifies the secret in the logs and the metrics.
+	Version string `json:"version"`
+	// Secret is the shared authentication secret.
+	Secret string `json:"secret"`
+	// Expiry is the time in RFC 3339 format after which the credentials issued with the secret
+	// are no longer accepted. Empty means the secret is accepted until it is removed. Must be
+	// empty for the active secret.
+	Expiry string `json:"expiry,omitempty"`
+	// Algorithm is the credential algorithm used with the secret, overrides the credential
+	// algorithm of the auth config. This allows to switch the credential algorithm with a
+	// secret rotation.
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+// Validate checks a shared secret.
+func (s *SharedSecret) Validate() error {
+	if s.Version == "" {
+		return fmt.Errorf("empty secret version")
+	}
+	if s.Secret == "" {
+		return fmt.Errorf("empty secret for version %q", s.Version)
+	}
+	if s.Algorithm != "" {
+		alg, err := normalizeCredentialAlgorithm(s.Algorithm)
+		if err != nil {
+			return fmt.Errorf("invalid algorithm for secret %q: %w", s.Version, err)
+		}
+		s.Algorithm = alg
+	}
+	if _, err := s.GetExpiry(); err != nil {
+		return fmt.Errorf("invalid expiry for secret %q: %w", s.Version, err)
+	}
+	return nil
+}
+
+// GetExpiry returns the expiry of the secret, or the zero time if the secret never expires.
+func (s *SharedSecret) GetExpiry() (time.Time, error) {
+	if s.Expiry == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s.Expiry)
+}
+
+// normalizeCredentialAlgorithm checks a credential algorithm and returns its canonical name.
+func normalizeCredentialAlgorithm(alg string) (string, error) {
+	switch a := strings.ToUpper(alg); a {
+	case CredentialAlgorithmHMACSHA1, CredentialAlgorithmHMACSHA256, CredentialAlgorithmHMACSHA512:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown credential algorithm %q", alg)
+	}
+}
+
+// StaticUser is a user of the static user table.
+type StaticUser struct {
+	// Username is the TURN username of the user.
+	Username string `json:"username"`
+	// Password is the TURN password of the user.
+	Password string `json:"password"`
+	// Expiry is the time in RFC 3339 format after which the user can no longer authenticate.
+	// Empty means the user never expires.
+	Expiry string `json:"expiry,omitempty"`
+	// Enabled can be set to false to disable the user without removing it from the table.
+	// Default is true.
+	Enabled *bool `json:"enabled,omitempty"`
+	// Tenant is the tenant of the user, which restricts the clusters the user may reach. Empty
+	// means the user may reach all clusters.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Validate checks a static user.
+func (u *StaticUser) Validate() error {
+	if u.Username == "" {
+		return fmt.Errorf("empty username")
+	}
+	if u.Password == "" {
+		return fmt.Errorf("empty password for user %q", u.Username)
+	}
+	if _, err := u.GetExpiry(); err != nil {
+		return fmt.Errorf("invalid expiry for user %q: %w", u.Username, err)
+	}
+	return nil
+}
+
+// GetExpiry returns the expiry of the user, or the zero time if the user never expires.
+func (u *StaticUser) GetExpiry() (time.Time, error) {
+	if u.Expiry == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, u.Expiry)
+}
+
+// IsEnabled returns true if the user is enabled.
+func (u *StaticUser) IsEnabled() bool {
+	return u.Enabled == nil || *u.Enabled
+}
+
+// DeepCopyInto copies a static user.
+func (u *StaticUser) DeepCopyInto(dst *StaticUser) {
+	*dst = *u
+	if u.Enabled != nil {
+		e := *u.Enabled
+		dst.Enabled = &e
+	}
+}
+
+// OAuthConfig configures RFC 7635 third-party authorization. Clients present a self-contained
+// access token issued by an authorization server in the ACCESS-TOKEN attribute of the Allocate
+// request and the key id of the token in the USERNAME attribute. The token is encrypted with the
+// key shared between the authorization server and STUNner.
+type OAuthConfig struct {
+	// ServerName is the name of the STUN server, used as the associated data of the token
+	// encryption and sent to the clients in the THIRD-PARTY-AUTHORIZATION attribute. Default
+	// is the realm.
+	ServerName string `json:"server_name,omitempty"`
+	// Keys is the list of the keys shared with the authorization server. At least one key must
+	// be specified.
+	Keys []OAuthKey `json:"keys"`
+}
+
+// OAuthKey is a token encryption key shared with the authorization server.
+type OAuthKey struct {
+	// ID is the key id the clients send in the USERNAME attribute.
+	ID string `json:"kid"`
+	// Key is the base64-encoded encryption key.
+	Key string `json:"key"`
+	// Algorithm is the token encryption algorithm, either "A128GCM" or "A256GCM". Default is
+	// set by the key length.
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+// Validate checks an OAuth configuration and injects defaults.
+func (req *OAuthConfig) Validate(realm string) error {
+	if req.ServerName == "" {
+		req.ServerName = realm
+	}
+
+	if len(req.Keys) == 0 {
+		return fmt.Errorf("oauth: no keys")
+	}
+
+	ids := map[string]bool{}
+	for i := range req.Keys {
+		k := &req.Keys[i]
+		if k.ID == "" {
+			return fmt.Errorf("oauth: empty key id")
+		}
+		if ids[k.ID] {
+			return fmt.Errorf("oauth: duplicate key id %q", k.ID)
+		}
+		ids[k.ID] = true
+
+		key, err := k.Decode()
+		if err != nil {
+			return fmt.Errorf("oauth: invalid key %q: %w", k.ID, err)
+		}
+
+		alg := OAuthAlgorithmA128GCM
+		if len(key) == 32 {
+			alg = OAuthAlgorithmA256GCM
+		} else if len(key) != 16 {
+			return fmt.Errorf("oauth: invalid key %q: invalid key length %d", k.ID, len(key))
+		}
+
+		if k.Algorithm == "" {
+			k.Algorithm = alg
+		}
+		if k.Algorithm != alg {
+			return fmt.Errorf("oauth: invalid key %q: key length %d does not match "+
+				"algorithm %q", k.ID, len(key), k.Algorithm)
+		}
+	}
+
+	return nil
+}
+
+// Decode returns the raw key.
+func (k *OAuthKey) Decode() ([]byte, error) {
+	return base64.StdEncoding.DecodeString(k.Key)
+}
+
+// DeepCopy copies an OAuth configuration.
+func (req *OAuthConfig) DeepCopy() *OAuthConfig {
+	ret := *req
+	ret.Keys = append([]OAuthKey(nil), req.Keys...)
+	return &ret
+}
+
+// String stringifies an OAuth configuration.
+func (req *OAuthConfig) String() string {
+	keys := make([]string, 0, len(req.Keys))
+	for _, k := range req.Keys {
+		keys = append(keys, fmt.Sprintf("%s/%s", k.ID, k.Algorithm))
+	}
+	return fmt.Sprintf("server-name=%q,keys=[%s]", req.ServerName, strings.Join(keys, ","))
+}
+
+// WebhookConfig configures the external authentication service of the "webhook" type. For each
+// authentication request STUNner sends a POST request with a JSON-encoded WebhookRequest to the
+// webhook and expects a JSON-encoded WebhookResponse. A 401 or 403 status code is interpreted as
+// a rejection, any other non-200 status code and unreachable or slow webhooks are considered
+// failures: the request is rejected and, after a number of consecutive failures, the circuit
+// breaker opens and authentication requests are rejected without calling the webhook until the
+// breaker timeout expires. Responses are cached.
+type WebhookConfig struct {
+	// URL is the HTTP or HTTPS URL of the webhook. Mandatory.
+	URL string `json:"url"`
+	// Headers are additional headers sent with each request, e.g., for authentication.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Timeout is the timeout of webhook requests in milliseconds. Webhook requests block the
+	// listener that received the authentication request, so the timeout must stay well below
+	// the retransmission timeout of the clients: the default is 50 ms and at most 100 ms is
+	// accepted.
+	Timeout int `json:"timeout,omitempty"`
+	// CacheTTL is the time in seconds an accepted request is cached. Default is 60 seconds.
+	CacheTTL int `json:"cache_ttl,omitempty"`
+	// NegativeCacheTTL is the time in seconds a rejected request is cached. Default is 5
+	// seconds.
+	NegativeCacheTTL int `json:"negative_cache_ttl,omitempty"`
+	// FailureThreshold is the number of consecutive webhook failures that opens the circuit
+	// breaker. Default is 5.
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+	// BreakerTimeout is the time in seconds the circuit breaker stays open before a single
+	// request is let through to probe the webhook. Default is 30 seconds.
+	BreakerTimeout int `json:"breaker_timeout,omitempty"`
+}
+
+// Validate checks a webhook configuration and injects defaults.
+func (req *WebhookConfig) Validate() error {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL %s: %s", req.URL, err.Error())
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+	default:
+		return fmt.Errorf("invalid webhook URL %s: scheme must be http or https", req.URL)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %s: no address", req.URL)
+	}
+
+	if req.Timeout < 0 {
+		return fmt.Errorf("invalid webhook timeout: %d", req.Timeout)
+	}
+	if req.Timeout == 0 {
+		req.Timeout = DefaultWebhookTimeout
+	}
+
+	if req.CacheTTL < 0 {
+		return fmt.Errorf("invalid webhook cache TTL: %d", req.CacheTTL)
+	}
+	if req.CacheTTL == 0 {
+		req.CacheTTL = DefaultWebhookCacheTTL
+	}
+
+	if req.NegativeCacheTTL < 0 {
+		return fmt.Errorf("invalid webhook negative cache TTL: %d", req.NegativeCacheTTL)
+	}
+	if req.NegativeCacheTTL == 0 {
+		req.NegativeCacheTTL = DefaultWebhookNegativeCacheTTL
+	}
+
+	if req.FailureThreshold < 0 {
+		return fmt.Errorf("invalid webhook failure threshold: %d", req.FailureThreshold)
+	}
+	if req.FailureThreshold == 0 {
+		req.FailureThreshold = DefaultWebhookFailureThreshold
+	}
+
+	if req.BreakerTimeout < 0 {
+		return fmt.Errorf("invalid webhook breaker timeout: %d", req.BreakerTimeout)
+	}
+	if req.BreakerTimeout == 0 {
+		req.BreakerTimeout = DefaultWebhookBreakerTimeout
+	}
+
+	if req.Timeout > MaxWebhookTimeout {
+		return fmt.Errorf("invalid webhook timeout: %d ms is more than the maximum %d ms",
+			req.Timeout, MaxWebhookTimeout)
+	}
+
+	return nil
+}
+
+// DeepCopy copies a webhook configuration.
+func (req *WebhookConfig) DeepCopy() *WebhookConfig {
+	ret := *req
+	if req.Headers != nil {
+		ret.Headers = make(map[string]string, len(req.Headers))
+		for k, v := range req.Headers {
+			ret.Headers[k] = v
+		}
+	}
+	return &ret
+}
+
+// String stringifies a webhook configuration. Header values and the userinfo and the query of
+// the URL are not shown.
+func (req *WebhookConfig) String() string {
+	return fmt.Sprintf("url=%q,timeout=%dms,cache-ttl=%ds/%ds,failure-threshold=%d,"+
+		"breaker-timeout=%ds", req.RedactedURL(), req.Timeout, req.CacheTTL,
+		req.NegativeCacheTTL, req.FailureThreshold, req.BreakerTimeout)
+}
+
+// RedactedURL returns the webhook URL with the userinfo and the query, which may hold
+// credentials, replaced with a placeholder.
+func (req *WebhookConfig) RedactedURL() string {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return "<SECRET>"
+	}
+
+	user, query := u.User != nil, u.RawQuery != ""
+	u.User, u.RawQuery = nil, ""
+	uri := u.String()
+	if user {
+		uri = strings.Replace(uri, "//", "//<SECRET>@", 1)
+	}
+	if query {
+		uri += "?<SECRET>"
+	}
+
+	return uri
+}
+
+// WebhookRequest is the request sent to the authentication webhook.
+type WebhookRequest struct {
+	// Username is the TURN username of the client.
+	Username string `json:"username"`
+	// Realm is the realm of the request.
+	Realm string `json:"realm"`
+	// Client is the source transport address of the client.
+	Client string `json:"client"`
+	// Listener is the name of the listener that received the request.
+	Listener string `json:"listener,omitempty"`
+}
+
+// WebhookResponse is the response of the authentication webhook.
+type WebhookResponse struct {
+	// Allow is true if the request is accepted.
+	Allow bool `json:"allow"`
+	// Key is the hex-encoded TURN long-term credential key MD5(username ":" realm ":"
+	// password). Either Key or Password must be set if the request is accepted.
+	Key string `json:"key,omitempty"`
+	// Password is the TURN password of the user, used to compute the key if no key is given.
+	Password string `json:"password,omitempty"`
+	// Reason is an optional human-readable reason for a rejection, used for logging.
+	Reason string `json:"reason,omitempty"`
+}
+
+// RevocationConfig is a list of revoked ephemeral credentials. A credential is revoked if its
+// username is listed in Usernames, its user-id is listed in UserIDs, or it was issued before
+// IssuedBefore. Ephemeral usernames carry only the expiry of the credential, so the issue time is
+// computed as the expiry minus CredentialTTL.
+type RevocationConfig struct {
+	// Usernames are the revoked TURN usernames, e.g., "1681490135:user-id".
+	Usernames []string `json:"usernames,omitempty"`
+	// UserIDs are the revoked user-ids: all credentials issued to a user-id are revoked,
+	// irrespective of the timestamp in the username.
+	UserIDs []string `json:"user_ids,omitempty"`
+	// IssuedBefore is a time in RFC 3339 format: credentials issued before this time are
+	// revoked.
+	IssuedBefore string `json:"issued_before,omitempty"`
+	// CredentialTTL is the lifetime of the credentials in seconds, used to compute the issue
+	// time of a credential from its expiry. Default is 86400 seconds (one day).
+	CredentialTTL int `json:"credential_ttl,omitempty"`
+	// Terminate requests the termination of the active allocations of the revoked credentials
+	// when a revocation is applied. Otherwise clients are rejected only when they next
+	// authenticate, e.g., when they refresh their allocation.
+	Terminate bool `json:"terminate,omitempty"`
+}
+
+// Validate checks a revocation list and injects defaults.
+func (req *RevocationConfig) Validate() error {
+	for _, u := range req.Usernames {
+		if u == "" {
+			return fmt.Errorf("empty revoked username")
+		}
+	}
+	for _, id := range req.UserIDs {
+		if id == "" {
+			return fmt.Errorf("empty revoked user-id")
+		}
+	}
+	if _, err := req.GetIssuedBefore(); err != nil {
+		return fmt.Errorf("invalid revocation cutoff %q: %w", req.IssuedBefore, err)
+	}
+	if req.CredentialTTL < 0 {
+		return fmt.Errorf("invalid credential TTL: %d", req.CredentialTTL)
+	}
+	if req.CredentialTTL == 0 {
+		req.CredentialTTL = DefaultCredentialTTL
+	}
+	return nil
+}
+
+// GetIssuedBefore returns the revocation cutoff, or the zero time if no cutoff is set.
+func (req *RevocationConfig) GetIssuedBefore() (time.Time, error) {
+	if req.IssuedBefore == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, req.IssuedBefore)
+}
+
+// IsEmpty returns true if the revocation list revokes no credentials.
+func (req *RevocationConfig) IsEmpty() bool {
+	return len(req.Usernames) == 0 && len(req.UserIDs) == 0 && req.IssuedBefore == ""
+}
+
+// DeepCopy copies a revocation list.
+func (req *RevocationConfig) DeepCopy() *RevocationConfig {
+	ret := *req
+	if req.Usernames != nil {
+		ret.Usernames = append([]string{}, req.Usernames...)
+	}
+	if req.UserIDs != nil {
+		ret.UserIDs = append([]string{}, req.UserIDs...)
+	}
+	return &ret
+}
+
+// String stringifies a revocation list.
+func (req *RevocationConfig) String() string {
+	status := []string{fmt.Sprintf("usernames=%d", len(req.Usernames)),
+		fmt.Sprintf("user-ids=%d", len(req.UserIDs))}
+	if req.IssuedBefore != "" {
+		status = append(status, fmt.Sprintf("issued-before=%s", req.IssuedBefore))
+	}
+	if req.Terminate {
+		status = append(status, "terminate")
+	}
+	return strings.Join(status, ",")
+}
+
+// RevocationStatus is the response of the revocation API of the health-check server.
+type RevocationStatus struct {
+	// Revocations is the revocation list, including the revocations in the config and the
+	// revocations added at runtime.
+	Revocations RevocationConfig `json:"revocations"`
+	// Terminated is the status of the allocations terminated by the request.
+	Terminated []*AllocationStatus `json:"terminated,omitempty"`
+}
+
+// LockoutConfig configures the brute-force protection. A source IP address or a username is
+// locked out when the number of failed authentication attempts within the failure window reaches
+// the threshold. Requests from a locked out source IP address or with a locked out username are
+// rejected without checking the credentials. The lockout period doubles with each consecutive
+// lockout, up to the maximum lockout period.
+type LockoutConfig struct {
+	// ClientThreshold is the number of failed attempts from a source IP address that locks out
+	// the address. Default is 10.
+	ClientThreshold int `json:"client_threshold,omitempty"`
+	// UserThreshold is the number of failed attempts with a username that locks out the
+	// username. Zero or a negative value disables the username lockout, which is the default:
+	// anyone can lock out a username that is shared by many clients.
+	UserThreshold int `json:"user_threshold,omitempty"`
+	// Window is the time in seconds failed attempts are remembered. Default is 60 seconds.
+	Window int `json:"window,omitempty"`
+	// Duration is the first lockout period in seconds. Default is 30 seconds.
+	Duration int `json:"duration,omitempty"`
+	// MaxDuration is the maximum lockout period in seconds. A lockout is consecutive if it
+	// starts within the maximum lockout period from the end of the previous lockout. Default
+	// is 3600 seconds.
+	MaxDuration int `json:"max_duration,omitempty"`
+	// Allowlist is a list of IP addresses and prefixes in CIDR notation that are never locked
+	// out. Failed attempts from these addresses are not counted for the username either.
+	Allowlist []string `json:"allowlist,omitempty"`
+}
+
+// Validate checks a lockout configuration and injects defaults.
+func (req *LockoutConfig) Validate() error {
+	if req.ClientThreshold < 0 {
+		return fmt.Errorf("invalid lockout client threshold: %d", req.ClientThreshold)
+	}
+	if req.ClientThreshold == 0 {
+		req.ClientThreshold = DefaultLockoutThreshold
+	}
+
+	if req.Window < 0 {
+		return fmt.Errorf("invalid lockout window: %d", req.Window)
+	}
+	if req.Window == 0 {
+		req.Window = DefaultLockoutWindow
+	}
+
+	if req.Duration < 0 {
+		return fmt.Errorf("invalid lockout duration: %d", req.Duration)
+	}
+	if req.Duration == 0 {
+		req.Duration = DefaultLockoutDuration
+	}
+
+	if req.MaxDuration < 0 {
+		return fmt.Errorf("invalid lockout max duration: %d", req.MaxDuration)
+	}
+	if req.MaxDuration == 0 {
+		req.MaxDuration = DefaultLockoutMaxDuration
+	}
+
+	if req.MaxDuration < req.Duration {
+		return fmt.Errorf("invalid lockout max duration: %d is shorter than the duration %d",
+			req.MaxDuration, req.Duration)
+	}
+
+	for _, a := range req.Allowlist {
+		if net.ParseIP(a) == nil {
+			if _, _, err := net.ParseCIDR(a); err != nil {
+				return fmt.Errorf("invalid lockout allowlist entry %q", a)
+			}
+		}
+	}
+
+	return nil
+}
+
+// DeepCopy copies a lockout configuration.
+func (req *LockoutConfig) DeepCopy() *LockoutConfig {
+	ret := *req
+	if req.Allowlist != nil {
+		ret.Allowlist = append([]string{}, req.Allowlist...)
+	}
+	return &ret
+}
+
+// String stringifies a lockout configuration.
+func (req *LockoutConfig) String() string {
+	return fmt.Sprintf("client-threshold=%d,user-threshold=%d,window=%ds,duration=%ds/%ds,"+
+		"allowlist=%d", req.ClientThreshold, req.UserThreshold, req.Window, req.Duration,
+		req.MaxDuration, len(req.Allowlist))
+}
+
+// LockoutStatus is the failed authentication state of a source IP address or a username.
+type LockoutStatus struct {
+	// ClientIP is the source IP address, empty for usernames.
+	ClientIP string `json:"client_ip,omitempty"`
+	// Username is the username, empty for source IP addresses.
+	Username string `json:"username,omitempty"`
+	// Failures is the number of failed attempts within the failure window.
+	Failures int `json:"failures"`
+	// Lockouts is the number of consecutive lockouts.
+	Lockouts int `json:"lockouts"`
+	// LockedUntil is the end of the current lockout, nil if not locked out.
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
 // AuthStatus represents the authentication status.
 type AuthStatus = AuthConfig
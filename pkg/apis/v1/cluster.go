@@ -22,11 +22,16 @@ type ClusterConfig struct {
 	// Type specifies the cluster address resolution policy, either STATIC or
 	// STRICT_DNS. Default is "STATIC".
 	Type string `json:"type,omitempty"`
-	// Protocol specifies the protocol to be used with the cluster, either UDP (default) or TCP
-	// (not implemented yet).
+	// Protocol specifies the protocol to be used with the cluster, either UDP (default) or
+	// TCP. TCP clusters can be reached via RFC 6062 TURN-TCP allocations on TURN-TCP and
+	// TURN-TLS listeners.
 	Protocol string `json:"protocol,omitempty"`
 	// Endpoints specifies the peers that can be reached via this cluster.
 	Endpoints []string `json:"endpoints,omitempty"`
+	// BandwidthLimit overrides the per-allocation bandwidth limit of the listeners for the
+	// traffic exchanged with the peers of the cluster, in bytes per second per direction. Zero
+	// means the listener's per-allocation limit applies.
+	BandwidthLimit int `json:"bandwidth_limit,omitempty"`
 }
 
 // Validate checks a configuration and injects defaults.
@@ -70,6 +75,10 @@ func (req *ClusterConfig) Validate() error {
 
 	sort.Strings(req.Endpoints)
 
+	if req.BandwidthLimit < 0 {
+		return fmt.Errorf("invalid bandwidth limit: %d", req.BandwidthLimit)
+	}
+
 	return nil
 }
 
@@ -111,6 +120,10 @@ func (req *ClusterConfig) String() string {
 	status = append(status, fmt.Sprintf("endpoints=[%s]",
 		strings.Join(req.Endpoints, ",")))
 
+	if req.BandwidthLimit > 0 {
+		status = append(status, fmt.Sprintf("bandwidth-limit=%d", req.BandwidthLimit))
+	}
+
 	return fmt.Sprintf("%q:{%s}", n, strings.Join(status, ","))
 }
 
@@ -15,6 +15,38 @@ const (
 	DefaultClusterType            = "STATIC"
 	DefaultAdminName              = "default-admin-config"
 	DefaultAuthName               = "default-auth-config"
+	DefaultDrainTimeout    int    = 3600
+	// DefaultSharedSecretVersion is the version of the shared secret specified in the
+	// credentials of the ephemeral authentication mode.
+	DefaultSharedSecretVersion = "default"
+	// DefaultCredentialTTL is the lifetime of ephemeral credentials in seconds assumed when
+	// computing the issue time of a credential for revocation.
+	DefaultCredentialTTL int = 86400
+)
+
+// auth lockout defaults
+const (
+	DefaultLockoutThreshold   int = 10
+	DefaultLockoutWindow      int = 60
+	DefaultLockoutDuration    int = 30
+	DefaultLockoutMaxDuration int = 3600
+)
+
+// auth webhook defaults
+const (
+	DefaultWebhookTimeout          int = 50
+	MaxWebhookTimeout              int = 100
+	DefaultWebhookCacheTTL         int = 60
+	DefaultWebhookNegativeCacheTTL int = 5
+	DefaultWebhookFailureThreshold int = 5
+	DefaultWebhookBreakerTimeout   int = 30
+)
+
+// telemetry defaults
+const (
+	DefaultOTLPMetricsInterval int = 60
+	DefaultAccessLogMaxSize    int = 100
+	DefaultAccessLogMaxBackups int = 5
 )
 
 // default ports
@@ -22,6 +54,7 @@ const (
 	DefaultMetricsPort     int = 8080
 	DefaultHealthCheckPort int = 8086
 	DefaultAuthServicePort int = 8088
+	DefaultDebugPort       int = 8089
 )
 
 // Label/annotation defaults
@@ -10,6 +10,7 @@ var (
 	ErrInvalidConf    = errors.New("Invalid configuration")
 	ErrNoSuchListener = errors.New("No such listener")
 	ErrNoSuchCluster  = errors.New("No such cluster")
+	ErrEmptyFilter    = errors.New("Empty allocation filter")
 	// ErrInvalidRoute   = errors.New("Invalid route")
 )
 
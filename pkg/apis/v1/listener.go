@@ -2,34 +2,81 @@ package v1
 
 import (
 	"fmt"
+	"net"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 )
 
+// TLS client certificate authentication modes
+const (
+	ClientAuthNone           = "none"
+	ClientAuthRequest        = "request"
+	ClientAuthRequire        = "require"
+	ClientCertUsernameNone   = "none"
+	ClientCertUsernameVerify = "verify"
+	ClientCertUsernameMap    = "map"
+)
+
 // ListenerConfig specifies a server socket on which STUN/TURN connections will be served.
 type ListenerConfig struct {
 	// Name of the listener.
 	Name string `json:"name,omitempty"`
-	// Protocol is the transport protocol ("UDP", "TCP", "TLS", "DTLS") or the complete L4/L7
-	// protocol stack ("TURN-UDP", "TURN-TCP", "TURN-TLS", "TURN-DTLS") used by the listener.
-	// The application-layer protocol on top of the transport protocol is always TURN, so "UDP"
-	// and "TURN-UDP" are equivalent (and so on for the other protocols). Default is
-	// "TURN-UDP".
+	// Protocol is the protocol stack used by the listener, either a TURN listener ("TURN-UDP",
+	// "TURN-TCP", "TURN-TLS", "TURN-DTLS") or a STUN-only listener ("UDP", "TCP", "TLS",
+	// "DTLS"). STUN-only listeners answer STUN Binding requests for server-reflexive address
+	// discovery but reject all TURN requests. Default is "TURN-UDP".
 	Protocol string `json:"protocol,omitempty"`
 	// PublicAddr is the Internet-facing public IP address for the listener (ignored by
 	// STUNner).
 	PublicAddr string `json:"public_address,omitempty"`
 	// PublicPort is the Internet-facing public port for the listener (ignored by STUNner).
 	PublicPort int `json:"public_port,omitempty"`
-	// Addr is the IP address for the listener. Default is localhost.
+	// Addr is the IP address the listener binds to, either an IPv4 or an IPv6 address. Use
+	// "0.0.0.0" or "::" to listen on all interfaces; the latter also enables IPv6 relay
+	// addresses. Default is localhost.
 	Addr string `json:"address,omitempty"`
 	// Port is the port for the listener. Default is the standard TURN port (3478).
 	Port int `json:"port,omitempty"`
-	// Cert is the base64-encoded TLS cert.
+	// MinRelayPort is the smallest relay port assigned for the relay connections spawned by the
+	// listener. Default is 1.
+	MinRelayPort int `json:"min_relay_port,omitempty"`
+	// MaxRelayPort is the highest relay port assigned for the relay connections spawned by the
+	// listener. Default is 65535.
+	MaxRelayPort int `json:"max_relay_port,omitempty"`
+	// Quota is the maximum number of concurrent allocations the listener can hold. Zero means
+	// no limit.
+	Quota int `json:"quota,omitempty"`
+	// BandwidthLimit is the maximum aggregate bandwidth of all the allocations of the listener,
+	// in bytes per second per direction. Packets exceeding the limit are dropped on UDP relays
+	// and delayed on TCP relays. Zero means no limit.
+	BandwidthLimit int `json:"bandwidth_limit,omitempty"`
+	// AllocationBandwidthLimit is the maximum bandwidth of a single allocation at the listener,
+	// in bytes per second per direction. Clusters may override the per-allocation limit for
+	// their peers. Zero means no limit.
+	AllocationBandwidthLimit int `json:"allocation_bandwidth_limit,omitempty"`
+	// Cert is the base64-encoded TLS cert. This is the default cert, served when no cert in
+	// Certificates matches the server name requested by the client.
 	Cert string `json:"cert,omitempty"`
 	// Key is the base64-encoded TLS key.
 	Key string `json:"key,omitempty"`
+	// Certificates is a list of additional TLS certs selected by the server name (SNI)
+	// requested by the client. If Cert/Key is empty then the first cert is the default.
+	Certificates []CertificateConfig `json:"certificates,omitempty"`
+	// ClientAuth is the TLS client certificate authentication mode of TLS/DTLS listeners:
+	// "none" does not request client certs, "request" verifies the client cert if the client
+	// sends one, "require" rejects clients without a valid client cert. Default is "none".
+	ClientAuth string `json:"client_auth,omitempty"`
+	// ClientCA is the base64-encoded PEM bundle of the CA certs used to verify client certs.
+	ClientCA string `json:"client_ca,omitempty"`
+	// ClientCertUsername specifies how the subject common name of a verified client cert is
+	// mapped to the TURN username: "none" ignores the client cert, "verify" rejects TURN
+	// requests with a username different from the cert subject but still checks the TURN
+	// credentials, "map" accepts the cert subject as the username with an empty password,
+	// i.e., authenticates the client solely by the client cert, and requires the client auth
+	// mode "require". Default is "none".
+	ClientCertUsername string `json:"client_cert_username,omitempty"`
 	// Routes specifies the list of Routes allowed via a listener.
 	Routes []string `json:"routes,omitempty"`
 }
@@ -61,14 +108,79 @@ func (req *ListenerConfig) Validate() error {
 		return fmt.Errorf("invalid port: %d", req.Port)
 	}
 
+	if req.MinRelayPort < 0 || req.MinRelayPort > 65535 {
+		return fmt.Errorf("invalid min relay port: %d", req.MinRelayPort)
+	}
+	if req.MaxRelayPort < 0 || req.MaxRelayPort > 65535 {
+		return fmt.Errorf("invalid max relay port: %d", req.MaxRelayPort)
+	}
+	if minPort, maxPort := req.GetRelayPortRange(); minPort > maxPort {
+		return fmt.Errorf("invalid relay port range: min relay port %d is larger than max "+
+			"relay port %d", minPort, maxPort)
+	}
+
+	if req.Quota < 0 {
+		return fmt.Errorf("invalid quota: %d", req.Quota)
+	}
+
+	if req.BandwidthLimit < 0 {
+		return fmt.Errorf("invalid bandwidth limit: %d", req.BandwidthLimit)
+	}
+	if req.AllocationBandwidthLimit < 0 {
+		return fmt.Errorf("invalid allocation bandwidth limit: %d",
+			req.AllocationBandwidthLimit)
+	}
+
 	if proto == ListenerProtocolTURNTLS || proto == ListenerProtocolTURNDTLS ||
 		proto == ListenerProtocolTLS || proto == ListenerProtocolDTLS {
-		if req.Cert == "" {
-			return fmt.Errorf("empty TLS cert for %s listener", proto.String())
+		if len(req.Certificates) == 0 || req.Cert != "" || req.Key != "" {
+			if req.Cert == "" {
+				return fmt.Errorf("empty TLS cert for %s listener", proto.String())
+			}
+			if req.Key == "" {
+				return fmt.Errorf("empty TLS key for %s listener", proto.String())
+			}
+		}
+		for i := range req.Certificates {
+			if err := req.Certificates[i].Validate(); err != nil {
+				return fmt.Errorf("invalid TLS cert #%d for %s listener: %w", i,
+					proto.String(), err)
+			}
+		}
+	}
+
+	req.ClientAuth = strings.ToLower(req.ClientAuth)
+	switch req.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthRequest, ClientAuthRequire:
+		if proto != ListenerProtocolTURNTLS && proto != ListenerProtocolTURNDTLS &&
+			proto != ListenerProtocolTLS && proto != ListenerProtocolDTLS {
+			return fmt.Errorf("client auth is not supported for %s listener", proto.String())
+		}
+		if req.ClientCA == "" {
+			return fmt.Errorf("empty client CA for %s listener with client auth %q",
+				proto.String(), req.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("invalid client auth mode: %q", req.ClientAuth)
+	}
+
+	req.ClientCertUsername = strings.ToLower(req.ClientCertUsername)
+	switch req.ClientCertUsername {
+	case "", ClientCertUsernameNone:
+	case ClientCertUsernameVerify, ClientCertUsernameMap:
+		if req.ClientAuth == "" || req.ClientAuth == ClientAuthNone {
+			return fmt.Errorf("client cert username mode %q requires client auth",
+				req.ClientCertUsername)
 		}
-		if req.Key == "" {
-			return fmt.Errorf("empty TLS key for %s listener", proto.String())
+		// the cert subject is accepted with an empty password in map mode: the listener
+		// must not admit clients without a client cert
+		if req.ClientCertUsername == ClientCertUsernameMap && req.ClientAuth != ClientAuthRequire {
+			return fmt.Errorf("client cert username mode %q requires client auth %q",
+				req.ClientCertUsername, ClientAuthRequire)
 		}
+	default:
+		return fmt.Errorf("invalid client cert username mode: %q", req.ClientCertUsername)
 	}
 
 	if req.Routes == nil {
@@ -95,6 +207,12 @@ func (req *ListenerConfig) DeepCopyInto(dst Config) {
 	*ret = *req
 	ret.Routes = make([]string, len(req.Routes))
 	copy(ret.Routes, req.Routes)
+	if req.Certificates != nil {
+		ret.Certificates = make([]CertificateConfig, len(req.Certificates))
+		for i := range req.Certificates {
+			req.Certificates[i].DeepCopyInto(&ret.Certificates[i])
+		}
+	}
 }
 
 // String stringifies the configuration.
@@ -111,7 +229,12 @@ func (req *ListenerConfig) String() string {
 		addr = req.Addr
 	}
 
-	status = append(status, fmt.Sprintf("turn://%s:%d", addr, req.Port))
+	scheme := "turn"
+	if proto, err := NewListenerProtocol(req.Protocol); err == nil && !proto.IsTURN() {
+		scheme = "stun"
+	}
+	status = append(status, fmt.Sprintf("%s://%s", scheme,
+		net.JoinHostPort(addr, strconv.Itoa(req.Port))))
 
 	a, p := "-", "-"
 	if req.PublicAddr != "" {
@@ -122,6 +245,20 @@ func (req *ListenerConfig) String() string {
 	}
 	status = append(status, fmt.Sprintf("public=%s:%s", a, p))
 
+	if req.MinRelayPort != 0 || req.MaxRelayPort != 0 {
+		status = append(status, fmt.Sprintf("relay-ports=<%d-%d>", req.MinRelayPort,
+			req.MaxRelayPort))
+	}
+
+	if req.Quota > 0 {
+		status = append(status, fmt.Sprintf("quota=%d", req.Quota))
+	}
+
+	if req.BandwidthLimit > 0 || req.AllocationBandwidthLimit > 0 {
+		status = append(status, fmt.Sprintf("bandwidth-limit=%d/%d", req.BandwidthLimit,
+			req.AllocationBandwidthLimit))
+	}
+
 	c, k := "-", "-"
 	if req.Cert != "" {
 		c = "<SECRET>"
@@ -130,11 +267,84 @@ func (req *ListenerConfig) String() string {
 		k = "<SECRET>"
 	}
 	status = append(status, fmt.Sprintf("cert/key=%s/%s", c, k))
+	if len(req.Certificates) > 0 {
+		certs := make([]string, len(req.Certificates))
+		for i := range req.Certificates {
+			certs[i] = req.Certificates[i].String()
+		}
+		status = append(status, fmt.Sprintf("sni-certs=[%s]", strings.Join(certs, ",")))
+	}
+	if req.ClientAuth != "" && req.ClientAuth != ClientAuthNone {
+		status = append(status, fmt.Sprintf("client-auth=%s", req.ClientAuth))
+	}
+	if req.ClientCertUsername != "" && req.ClientCertUsername != ClientCertUsernameNone {
+		status = append(status, fmt.Sprintf("client-cert-username=%s", req.ClientCertUsername))
+	}
 	status = append(status, fmt.Sprintf("routes=[%s]", strings.Join(req.Routes, ",")))
 
 	return fmt.Sprintf("%q:{%s}", n, strings.Join(status, ","))
 }
 
+// CertificateConfig specifies a TLS cert/key pair served to clients requesting one of the given
+// server names.
+type CertificateConfig struct {
+	// Hostnames is the list of server names the cert is served for. Wildcards are accepted in
+	// the leftmost label (e.g., "*.example.com"). Default is the DNS names in the cert.
+	Hostnames []string `json:"hostnames,omitempty"`
+	// Cert is the base64-encoded TLS cert.
+	Cert string `json:"cert"`
+	// Key is the base64-encoded TLS key.
+	Key string `json:"key"`
+}
+
+// Validate checks a cert configuration and normalizes the hostnames.
+func (req *CertificateConfig) Validate() error {
+	if req.Cert == "" {
+		return fmt.Errorf("empty TLS cert")
+	}
+	if req.Key == "" {
+		return fmt.Errorf("empty TLS key")
+	}
+	for i, h := range req.Hostnames {
+		h = strings.TrimSuffix(strings.ToLower(h), ".")
+		if h == "" {
+			return fmt.Errorf("empty hostname")
+		}
+		req.Hostnames[i] = h
+	}
+	return nil
+}
+
+// DeepCopyInto copies a cert configuration.
+func (req *CertificateConfig) DeepCopyInto(dst *CertificateConfig) {
+	*dst = *req
+	if req.Hostnames != nil {
+		dst.Hostnames = make([]string, len(req.Hostnames))
+		copy(dst.Hostnames, req.Hostnames)
+	}
+}
+
+// String stringifies the cert configuration, omitting the cert and the key.
+func (req *CertificateConfig) String() string {
+	if len(req.Hostnames) == 0 {
+		return "<SECRET>"
+	}
+	return fmt.Sprintf("%s:<SECRET>", strings.Join(req.Hostnames, "|"))
+}
+
+// GetRelayPortRange returns the relay port range of the listener, using the default for the unset
+// bounds.
+func (req *ListenerConfig) GetRelayPortRange() (int, int) {
+	minPort, maxPort := req.MinRelayPort, req.MaxRelayPort
+	if minPort == 0 {
+		minPort = DefaultMinRelayPort
+	}
+	if maxPort == 0 {
+		maxPort = DefaultMaxRelayPort
+	}
+	return minPort, maxPort
+}
+
 // GetListenerURI is a helper that can output two types of Listener URIs: one with "://" after the
 // scheme or one with only ":" (as per RFC7065).
 func (req *ListenerConfig) GetListenerURI(rfc7065 bool) (string, error) {
@@ -157,6 +367,18 @@ func (req *ListenerConfig) GetListenerURI(rfc7065 bool) (string, error) {
 	case ListenerProtocolTURNTLS:
 		service = "turns"
 		protocol = "tcp"
+	case ListenerProtocolUDP:
+		service = "stun"
+		protocol = "udp"
+	case ListenerProtocolTCP:
+		service = "stun"
+		protocol = "tcp"
+	case ListenerProtocolDTLS:
+		service = "stuns"
+		protocol = "udp"
+	case ListenerProtocolTLS:
+		service = "stuns"
+		protocol = "tcp"
 	}
 
 	addr := req.PublicAddr
@@ -171,11 +393,14 @@ func (req *ListenerConfig) GetListenerURI(rfc7065 bool) (string, error) {
 		port = req.Port
 	}
 
+	// IPv6 addresses must be enclosed in brackets
+	hostport := net.JoinHostPort(addr, strconv.Itoa(port))
+
 	var uri string
 	if rfc7065 {
-		uri = fmt.Sprintf("%s:%s:%d?transport=%s", service, addr, port, protocol)
+		uri = fmt.Sprintf("%s:%s?transport=%s", service, hostport, protocol)
 	} else {
-		uri = fmt.Sprintf("%s://%s:%d?transport=%s", service, addr, port, protocol)
+		uri = fmt.Sprintf("%s://%s?transport=%s", service, hostport, protocol)
 	}
 	return uri, nil
 }
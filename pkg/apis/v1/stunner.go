@@ -4,6 +4,7 @@ import (
 	"fmt"
 	// "sort"
 	"strings"
+	"time"
 )
 
 // StunnerConfig specifies the configuration for the STUnner daemon.
@@ -187,12 +188,43 @@ func (req *StunnerConfig) Summary() string {
 	}
 	status := fmt.Sprintf("Gateway: %s (loglevel: %q)\n", req.Admin.Name, req.Admin.LogLevel)
 	if t, err := NewAuthType(req.Auth.Type); err == nil {
-		if t == AuthTypeStatic {
-			status += fmt.Sprintf("Authentication type: static, username/password: %s/%s\n",
-				req.Auth.Credentials["username"], req.Auth.Credentials["password"])
-		} else {
-			status += fmt.Sprintf("Authentication type: ephemeral, shared-secret: %s\n",
-				req.Auth.Credentials["secret"])
+		switch t {
+		case AuthTypeStatic:
+			status += "Authentication type: static"
+			if u, ok := req.Auth.Credentials["username"]; ok {
+				status += fmt.Sprintf(", username/password: %s/<SECRET>", u)
+			}
+			if len(req.Auth.Users) > 0 {
+				status += fmt.Sprintf(", users: %d", len(req.Auth.Users))
+			}
+			if req.Auth.UsersFile != "" {
+				status += fmt.Sprintf(", users-file: %s", req.Auth.UsersFile)
+			}
+			status += "\n"
+		case AuthTypeWebhook:
+			status += "Authentication type: webhook"
+			if req.Auth.Webhook != nil {
+				status += fmt.Sprintf(", url: %s", req.Auth.Webhook.RedactedURL())
+			}
+			status += "\n"
+		case AuthTypeOAuth:
+			status += "Authentication type: oauth"
+			if req.Auth.OAuth != nil {
+				status += ", " + req.Auth.OAuth.String()
+			}
+			status += "\n"
+		default:
+			status += "Authentication type: ephemeral, shared-secret: <SECRET>"
+			if req.Auth.CredentialAlgorithm != "" {
+				status += fmt.Sprintf(", credential-algorithm: %s", req.Auth.CredentialAlgorithm)
+			}
+			if len(req.Auth.Secrets) > 0 {
+				status += fmt.Sprintf(", secrets: %d", len(req.Auth.Secrets))
+			}
+			if r := req.Auth.Revocations; r != nil && !r.IsEmpty() {
+				status += fmt.Sprintf(", revocations: %d", len(r.Usernames)+len(r.UserIDs))
+			}
+			status += "\n"
 		}
 	}
 
@@ -222,9 +254,45 @@ type StunnerStatus struct {
 	Listeners       []*ListenerStatus `json:"listeners"`
 	Clusters        []*ClusterStatus  `json:"clusters"`
 	AllocationCount int               `json:"allocationCount"`
+	ListenerUsage   []*ListenerUsage  `json:"listenerUsage,omitempty"`
+	Quota           *QuotaStatus      `json:"quota,omitempty"`
+	Drain           *DrainStatus      `json:"drain,omitempty"`
 	Status          string            `json:"status"`
 }
 
+// ListenerUsage represents the relay port and allocation usage of a listener.
+type ListenerUsage struct {
+	// Name is the name of the listener.
+	Name string `json:"name"`
+	// RelayPortsInUse is the number of relay ports currently allocated by the listener.
+	RelayPortsInUse int `json:"relayPortsInUse"`
+	// RelayPortsTotal is the size of the relay port range of the listener.
+	RelayPortsTotal int `json:"relayPortsTotal"`
+	// Allocations is the number of allocations currently held at the listener.
+	Allocations int `json:"allocations"`
+}
+
+// DrainStatus represents the progress of a graceful shutdown.
+type DrainStatus struct {
+	// Started is the time the graceful shutdown has started.
+	Started time.Time `json:"started"`
+	// Deadline is the time stunnerd exits even if there are active allocations left.
+	Deadline time.Time `json:"deadline"`
+	// InitialAllocations is the number of active allocations at the start of the graceful
+	// shutdown.
+	InitialAllocations int `json:"initialAllocations"`
+	// Progress is the ratio of the initial allocations terminated so far.
+	Progress float64 `json:"progress"`
+}
+
+// QuotaStatus represents the allocation quota usage of users and clients.
+type QuotaStatus struct {
+	// Users is the number of allocations held per username.
+	Users map[string]int `json:"users,omitempty"`
+	// Clients is the number of allocations held per client IP address.
+	Clients map[string]int `json:"clients,omitempty"`
+}
+
 // String stringifies the status.
 func (s *StunnerStatus) String() string {
 	ls := []string{}
@@ -236,13 +304,24 @@ func (s *StunnerStatus) String() string {
 		cs = append(cs, c.String())
 	}
 
+	status := s.Status
+	if s.Drain != nil {
+		status = fmt.Sprintf("%s(drain:%.0f%%,deadline=%s)", status, s.Drain.Progress*100,
+			s.Drain.Deadline.Format(time.RFC3339))
+	}
+
 	return fmt.Sprintf("%s/%s/%s/%s/allocs:%d/status=%s",
-		s.Admin.String(), s.Auth.String(), ls, cs, s.AllocationCount, s.Status)
+		s.Admin.String(), s.Auth.String(), ls, cs, s.AllocationCount, status)
 }
 
 // String summarizes the status.
 func (s *StunnerStatus) Summary() string {
+	status := s.Status
+	if s.Drain != nil {
+		status = fmt.Sprintf("%s(drain:%.0f%%)", status, s.Drain.Progress*100)
+	}
+
 	return fmt.Sprintf("%s\n\t%s\n\tlisteners:%d/clusters:%d\n\tallocs:%d/status=%s",
 		s.Admin.String(), s.Auth.String(), len(s.Listeners), len(s.Clusters),
-		s.AllocationCount, s.Status)
+		s.AllocationCount, status)
 }
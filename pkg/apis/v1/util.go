@@ -11,12 +11,16 @@ type AuthType int
 const (
 	AuthTypeStatic AuthType = iota + 1
 	AuthTypeEphemeral
+	AuthTypeOAuth
+	AuthTypeWebhook
 	AuthTypeUnknown
 )
 
 const (
 	authTypeStaticStr    = "static"
 	authTypeEphemeralStr = "ephemeral"
+	authTypeOAuthStr     = "oauth"
+	authTypeWebhookStr   = "webhook"
 	AuthTypePlainText    = AuthTypeStatic
 	AuthTypeLongTerm     = AuthTypeEphemeral
 	authTypePlainTextStr = "plaintext"
@@ -30,6 +34,10 @@ func NewAuthType(raw string) (AuthType, error) {
 		return AuthTypeStatic, nil
 	case authTypeEphemeralStr, authTypeLongTermStr:
 		return AuthTypeEphemeral, nil
+	case authTypeOAuthStr:
+		return AuthTypeOAuth, nil
+	case authTypeWebhookStr:
+		return AuthTypeWebhook, nil
 	default:
 		return AuthTypeUnknown, fmt.Errorf("unknown authentication type: \"%s\"", raw)
 	}
@@ -42,6 +50,10 @@ func (a AuthType) String() string {
 		return authTypeStaticStr
 	case AuthTypeEphemeral:
 		return authTypeEphemeralStr
+	case AuthTypeOAuth:
+		return authTypeOAuthStr
+	case AuthTypeWebhook:
+		return authTypeWebhookStr
 	default:
 		return "<unknown>"
 	}
@@ -122,6 +134,18 @@ func (l ListenerProtocol) String() string {
 	}
 }
 
+// IsTURN returns true if a listener runs the full TURN protocol and false for STUN-only listeners
+// (UDP, TCP, TLS and DTLS).
+func (l ListenerProtocol) IsTURN() bool {
+	switch l {
+	case ListenerProtocolTURNUDP, ListenerProtocolTURNTCP, ListenerProtocolTURNTLS,
+		ListenerProtocolTURNDTLS:
+		return true
+	default:
+		return false
+	}
+}
+
 // ClusterType specifies the cluster address resolution policy.
 type ClusterType int
 
@@ -4,13 +4,18 @@ package authentication
 import (
 	"crypto/hmac"
 	"crypto/sha1" //nolint:gosec,gci
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"fmt"
+	"hash"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/pion/turn/v4"
+
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 )
 
 // UsernameSeparator is the separator character used in time-windowed TURN authentication as
@@ -18,6 +23,11 @@ import (
 // (https://datatracker.ietf.org/doc/html/draft-uberti-behave-turn-rest-00).
 const UsernameSeparator = ":"
 
+// TenantPrefix is the prefix of the username component specifying the tenant of an ephemeral
+// credential, e.g., "1681490135:user-id:tenant=acme". The tenant is covered by the credential
+// signature so clients cannot change it.
+const TenantPrefix = "tenant="
+
 // AuthHandler specifies type of the TURN authentication handler used in Stunner. Re-exported from pion/turn for completeness.
 type AuthHandler = turn.AuthHandler
 
@@ -40,30 +50,73 @@ func GenerateTimeWindowedUsername(startTime time.Time, duration time.Duration, u
 // find the first thing that looks like a UNIX timestamp in the username and use that for checking
 // the time-windowed credential, and reject everything else.
 func CheckTimeWindowedUsername(username string) error {
-	var timestamp int = 0
-	for _, ts := range strings.Split(username, UsernameSeparator) {
-		t, err := strconv.Atoi(ts)
-		if err == nil {
-			timestamp = t
-			break
-		}
-	}
-
-	if timestamp == 0 {
+	expiry, ok := GetExpiry(username)
+	if !ok {
 		return fmt.Errorf("invalid time-windowed username %q", username)
 	}
 
-	if int64(timestamp) < time.Now().Unix() {
+	if expiry.Unix() < time.Now().Unix() {
 		return fmt.Errorf("expired time-windowed username %q", username)
 	}
 
 	return nil
 }
 
+// GetExpiry returns the expiry timestamp of a time-windowed username. Returns false if the
+// username contains no timestamp.
+func GetExpiry(username string) (time.Time, bool) {
+	for _, ts := range strings.Split(username, UsernameSeparator) {
+		if t, err := strconv.Atoi(ts); err == nil {
+			return time.Unix(int64(t), 0), t != 0
+		}
+	}
+	return time.Time{}, false
+}
+
+// GetUserID returns the user-id of a time-windowed username, i.e., the username without the
+// timestamp and the tenant, e.g., "user-id" for "1681490135:user-id:tenant=acme".
+func GetUserID(username string) string {
+	ts, ids := false, []string{}
+	for _, c := range strings.Split(username, UsernameSeparator) {
+		if _, err := strconv.Atoi(c); err == nil && !ts {
+			ts = true
+			continue
+		}
+		if strings.HasPrefix(c, TenantPrefix) {
+			continue
+		}
+		ids = append(ids, c)
+	}
+	return strings.Join(ids, UsernameSeparator)
+}
+
+// GetTenant returns the tenant specified in a time-windowed username, or an empty string if the
+// username specifies no tenant.
+func GetTenant(username string) string {
+	for _, c := range strings.Split(username, UsernameSeparator) {
+		if strings.HasPrefix(c, TenantPrefix) {
+			return strings.TrimPrefix(c, TenantPrefix)
+		}
+	}
+	return ""
+}
+
 // GetLongTermCredential creates a password given a username and a shared secret.
 func GetLongTermCredential(username string, sharedSecret string) (string, error) {
-	mac := hmac.New(sha1.New, []byte(sharedSecret))
-	_, err := mac.Write([]byte(username))
+	return GetLongTermCredentialWithAlgorithm(username, sharedSecret, stnrv1.CredentialAlgorithmHMACSHA1)
+}
+
+// GetLongTermCredentialWithAlgorithm creates a password given a username, a shared secret and the
+// credential algorithm ("HMAC-SHA1", "HMAC-SHA256" or "HMAC-SHA512") by computing
+// base64(HMAC(secret, username)). An empty algorithm means HMAC-SHA1.
+func GetLongTermCredentialWithAlgorithm(username, sharedSecret, algorithm string) (string, error) {
+	h, err := getCredentialHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(h, []byte(sharedSecret))
+	_, err = mac.Write([]byte(username))
 	if err != nil {
 		return "", err // Not sure if this will ever happen
 	}
@@ -71,8 +124,33 @@ func GetLongTermCredential(username string, sharedSecret string) (string, error)
 	return base64.StdEncoding.EncodeToString(password), nil
 }
 
+// GenerateEphemeralCredential creates a time-windowed username with a plain timestamp valid for
+// the given duration and the password for the username, given a shared secret and the credential
+// algorithm.
+func GenerateEphemeralCredential(sharedSecret, algorithm string, duration time.Duration) (string, string, error) {
+	username := strconv.FormatInt(time.Now().Add(duration).Unix(), 10)
+	password, err := GetLongTermCredentialWithAlgorithm(username, sharedSecret, algorithm)
+	return username, password, err
+}
+
+// getCredentialHash returns the hash function for a credential algorithm.
+func getCredentialHash(algorithm string) (func() hash.Hash, error) {
+	switch strings.ToUpper(algorithm) {
+	case "", stnrv1.CredentialAlgorithmHMACSHA1:
+		return sha1.New, nil
+	case stnrv1.CredentialAlgorithmHMACSHA256:
+		return sha256.New, nil
+	case stnrv1.CredentialAlgorithmHMACSHA512:
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unknown credential algorithm %q", algorithm)
+	}
+}
+
 // GenerateAuthKey is a convenience function to easily generate keys in the format used by
-// AuthHandler. Re-exported from `pion/turn` so that our callers will have a single import.
+// AuthHandler. Re-exported from `pion/turn` so that our callers will have a single import. The key
+// is always the RFC 5389 MD5 long-term key: the TURN stack checks only the MESSAGE-INTEGRITY
+// attribute, so the SHA-256 key of the RFC 8489 PASSWORD-ALGORITHMS negotiation is not supported.
 func GenerateAuthKey(username, realm, password string) []byte {
 	return turn.GenerateAuthKey(username, realm, password)
 }
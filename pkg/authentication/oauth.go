@@ -0,0 +1,161 @@
+package authentication
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pion/stun/v3"
+)
+
+// RFC 7635 third-party authorization.
+
+const (
+	// AttrAccessToken is the ACCESS-TOKEN attribute carrying the self-contained access token
+	// of the client (RFC 7635, Section 6.2).
+	AttrAccessToken stun.AttrType = 0x001B
+	// AttrThirdPartyAuthorization is the THIRD-PARTY-AUTHORIZATION attribute the server uses
+	// to signal that it supports third-party authorization (RFC 7635, Section 6.1).
+	AttrThirdPartyAuthorization stun.AttrType = 0x802E
+
+	// AccessTokenMaxClockSkew is the maximum time an access token timestamp may be ahead of
+	// the clock of the server.
+	AccessTokenMaxClockSkew = time.Minute
+
+	// accessTokenFractions is the number of timestamp fractions in a second.
+	accessTokenFractions = 64000
+)
+
+var (
+	errInvalidAccessToken = errors.New("invalid access token")
+	errExpiredAccessToken = errors.New("expired access token")
+)
+
+// AccessToken is the content of a self-contained access token (RFC 7635, Section 6.2).
+type AccessToken struct {
+	// MACKey is the session key the client uses to compute the MESSAGE-INTEGRITY of its
+	// requests.
+	MACKey []byte
+	// Timestamp is the time the token was issued.
+	Timestamp time.Time
+	// Lifetime is the validity period of the token.
+	Lifetime time.Duration
+}
+
+// Expiry returns the time the access token expires.
+func (t *AccessToken) Expiry() time.Time {
+	return t.Timestamp.Add(t.Lifetime)
+}
+
+// Check checks whether the access token is valid at the given time.
+func (t *AccessToken) Check(now time.Time) error {
+	if t.Timestamp.After(now.Add(AccessTokenMaxClockSkew)) {
+		return fmt.Errorf("%w: timestamp %s is in the future", errInvalidAccessToken,
+			t.Timestamp.Format(time.RFC3339))
+	}
+	if !now.Before(t.Expiry()) {
+		return fmt.Errorf("%w: expired at %s", errExpiredAccessToken,
+			t.Expiry().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// NewAccessToken encrypts an access token with the key shared between the authorization server and
+// STUNner using AES-GCM (AEAD_AES_128_GCM for a 16 byte key and AEAD_AES_256_GCM for a 32 byte
+// key), with the STUN server name as the associated data. The encoding is as per RFC 7635, Section
+// 6.2: a 2-byte nonce length, the nonce and the encrypted block containing the 2-byte MAC key
+// length, the MAC key, the 64-bit timestamp and the 32-bit lifetime.
+func NewAccessToken(key []byte, serverName string, token *AccessToken) ([]byte, error) {
+	aead, err := newTokenCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(token.MACKey) == 0 || len(token.MACKey) > 0xffff {
+		return nil, fmt.Errorf("invalid MAC key length %d", len(token.MACKey))
+	}
+	if token.Lifetime < 0 || token.Lifetime/time.Second > 0xffffffff {
+		return nil, fmt.Errorf("invalid lifetime %s", token.Lifetime)
+	}
+
+	plain := make([]byte, 2, 2+len(token.MACKey)+12)
+	binary.BigEndian.PutUint16(plain, uint16(len(token.MACKey)))
+	plain = append(plain, token.MACKey...)
+	ts := uint64(token.Timestamp.Unix())<<16 |
+		uint64(token.Timestamp.Nanosecond())*accessTokenFractions/uint64(time.Second)
+	plain = binary.BigEndian.AppendUint64(plain, ts)
+	plain = binary.BigEndian.AppendUint32(plain, uint32(token.Lifetime/time.Second))
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ret := make([]byte, 2, 2+len(nonce)+len(plain)+aead.Overhead())
+	binary.BigEndian.PutUint16(ret, uint16(len(nonce)))
+	ret = append(ret, nonce...)
+
+	return aead.Seal(ret, nonce, plain, []byte(serverName)), nil
+}
+
+// DecodeAccessToken decrypts an access token with the key shared between the authorization server
+// and STUNner. The validity of the token is not checked, use AccessToken.Check for that.
+func DecodeAccessToken(key []byte, serverName string, raw []byte) (*AccessToken, error) {
+	aead, err := newTokenCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) < 2 {
+		return nil, fmt.Errorf("%w: too short", errInvalidAccessToken)
+	}
+	nonceLen := int(binary.BigEndian.Uint16(raw[0:2]))
+	if nonceLen != aead.NonceSize() || len(raw) < 2+nonceLen {
+		return nil, fmt.Errorf("%w: invalid nonce length %d", errInvalidAccessToken, nonceLen)
+	}
+	nonce := raw[2 : 2+nonceLen]
+
+	plain, err := aead.Open(nil, nonce, raw[2+nonceLen:], []byte(serverName))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidAccessToken, err.Error())
+	}
+
+	if len(plain) < 2 {
+		return nil, fmt.Errorf("%w: too short", errInvalidAccessToken)
+	}
+	keyLen := int(binary.BigEndian.Uint16(plain[0:2]))
+	if keyLen == 0 || len(plain) != 2+keyLen+12 {
+		return nil, fmt.Errorf("%w: invalid MAC key length %d", errInvalidAccessToken, keyLen)
+	}
+
+	ts := binary.BigEndian.Uint64(plain[2+keyLen:])
+	sec, frac := int64(ts>>16), int64(ts&0xffff)
+	if frac >= accessTokenFractions {
+		return nil, fmt.Errorf("%w: invalid timestamp", errInvalidAccessToken)
+	}
+	lifetime := binary.BigEndian.Uint32(plain[2+keyLen+8:])
+
+	return &AccessToken{
+		MACKey:    plain[2 : 2+keyLen],
+		Timestamp: time.Unix(sec, frac*int64(time.Second)/accessTokenFractions),
+		Lifetime:  time.Duration(lifetime) * time.Second,
+	}, nil
+}
+
+// newTokenCipher creates the AES-GCM cipher for a token encryption key.
+func newTokenCipher(key []byte) (cipher.AEAD, error) {
+	if len(key) != 16 && len(key) != 32 {
+		return nil, fmt.Errorf("invalid token encryption key length %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
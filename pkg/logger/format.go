@@ -0,0 +1,248 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/logging"
+)
+
+const (
+	// FormatText is the default free-form text log format.
+	FormatText = "text"
+	// FormatJSON emits each log record as a JSON object on a separate line.
+	FormatJSON = "json"
+	// FormatLogfmt emits each log record as a line of logfmt-style key=value pairs.
+	FormatLogfmt = "logfmt"
+
+	recordTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+var textLevelNames = map[logging.LogLevel]string{
+	logging.LogLevelTrace: "TRACE",
+	logging.LogLevelDebug: "DEBUG",
+	logging.LogLevelInfo:  "INFO",
+	logging.LogLevelWarn:  "WARNING",
+	logging.LogLevelError: "ERROR",
+}
+
+var recordLevelNames = map[logging.LogLevel]string{
+	logging.LogLevelTrace: "trace",
+	logging.LogLevelDebug: "debug",
+	logging.LogLevelInfo:  "info",
+	logging.LogLevelWarn:  "warn",
+	logging.LogLevelError: "error",
+}
+
+func isValidFormat(format string) bool {
+	return format == FormatText || format == FormatJSON || format == FormatLogfmt
+}
+
+// WithFields returns a logger that attaches the given key-value pairs (e.g., "listener", "udp",
+// "username", "user1") to each log record. In the structured formats the pairs are emitted as
+// separate fields of the record, in the text format they are appended to the message as
+// key=value pairs. Loggers not created by a LeveledLoggerFactory are returned unchanged.
+func WithFields(log logging.LeveledLogger, keyvals ...any) logging.LeveledLogger {
+	switch l := log.(type) {
+	case *RateLimitedLogger:
+		return &fieldLogger{logger: l, fields: keyvals}
+	case *fieldLogger:
+		fields := make([]any, 0, len(l.fields)+len(keyvals))
+		fields = append(fields, l.fields...)
+		return &fieldLogger{logger: l.logger, fields: append(fields, keyvals...)}
+	default:
+		return log
+	}
+}
+
+// fieldLogger is a logger that attaches a set of key-value pairs to each log record.
+type fieldLogger struct {
+	logger *RateLimitedLogger
+	fields []any
+}
+
+func (l *fieldLogger) Trace(msg string) {
+	l.logger.output(logging.LogLevelTrace, msg, l.fields)
+}
+
+func (l *fieldLogger) Tracef(format string, args ...any) {
+	l.logger.output(logging.LogLevelTrace, fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *fieldLogger) Debug(msg string) {
+	l.logger.output(logging.LogLevelDebug, msg, l.fields)
+}
+
+func (l *fieldLogger) Debugf(format string, args ...any) {
+	l.logger.output(logging.LogLevelDebug, fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *fieldLogger) Info(msg string) {
+	l.logger.output(logging.LogLevelInfo, msg, l.fields)
+}
+
+func (l *fieldLogger) Infof(format string, args ...any) {
+	l.logger.output(logging.LogLevelInfo, fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *fieldLogger) Warn(msg string) {
+	l.logger.output(logging.LogLevelWarn, msg, l.fields)
+}
+
+func (l *fieldLogger) Warnf(format string, args ...any) {
+	l.logger.output(logging.LogLevelWarn, fmt.Sprintf(format, args...), l.fields)
+}
+
+func (l *fieldLogger) Error(msg string) {
+	l.logger.output(logging.LogLevelError, msg, l.fields)
+}
+
+func (l *fieldLogger) Errorf(format string, args ...any) {
+	l.logger.output(logging.LogLevelError, fmt.Sprintf(format, args...), l.fields)
+}
+
+// output emits a log message with a set of fields at the given level. Must be called directly from
+// the level-specific logger functions for the caller file name to be correct in the text format.
+func (l *RateLimitedLogger) output(level logging.LogLevel, msg string, fields []any) {
+	if l.level.Get() < level {
+		return
+	}
+
+	l.lock.Lock()
+	format := l.format
+	l.lock.Unlock()
+
+	if format != FormatText {
+		l.writeRecord(level, msg, fields)
+		return
+	}
+
+	if len(fields) > 0 {
+		msg = string(appendLogfmt(append([]byte(msg), ' '), fields))
+	}
+	l.loggers[level].Output(3, msg) //nolint:errcheck
+}
+
+// recordWriter is the output of the level-specific loggers in the structured formats.
+type recordWriter struct {
+	logger *RateLimitedLogger
+	level  logging.LogLevel
+}
+
+// Write fulfills io.Writer.
+func (w *recordWriter) Write(p []byte) (int, error) {
+	w.logger.writeRecord(w.level, string(bytes.TrimRight(p, "\r\n")), nil)
+	return len(p), nil
+}
+
+// writeRecord encodes a log record in the structured format of the logger and writes it to the
+// output, subject to rate-limiting.
+func (l *RateLimitedLogger) writeRecord(level logging.LogLevel, msg string, fields []any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	suppressed, ok := l.RateLimitedWriter.allow()
+	if !ok {
+		return
+	}
+
+	record := make([]any, 0, 8+len(fields)+2)
+	record = append(record,
+		"time", time.Now().Format(recordTimeFormat),
+		"level", recordLevelNames[level],
+		"scope", l.scope,
+		"msg", msg)
+	record = append(record, fields...)
+	if suppressed > 0 {
+		record = append(record, "suppressed", suppressed)
+	}
+
+	var buf []byte
+	if l.format == FormatJSON {
+		buf = appendJSON(nil, record)
+	} else {
+		buf = appendLogfmt(nil, record)
+	}
+
+	l.RateLimitedWriter.Writer.Write(append(buf, '\n')) //nolint:errcheck
+}
+
+// appendJSON encodes a list of key-value pairs as a JSON object.
+func appendJSON(buf []byte, keyvals []any) []byte {
+	buf = append(buf, '{')
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		key, val := fieldPair(keyvals, i)
+		buf = appendJSONValue(buf, key)
+		buf = append(buf, ':')
+		buf = appendJSONValue(buf, val)
+	}
+	return append(buf, '}')
+}
+
+func appendJSONValue(buf []byte, v any) []byte {
+	b := &bytes.Buffer{}
+	enc := json.NewEncoder(b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return strconv.AppendQuote(buf, fmt.Sprint(v))
+	}
+	return append(buf, bytes.TrimRight(b.Bytes(), "\n")...)
+}
+
+// appendLogfmt encodes a list of key-value pairs as space-separated key=value pairs.
+func appendLogfmt(buf []byte, keyvals []any) []byte {
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		key, val := fieldPair(keyvals, i)
+		buf = append(buf, strings.Map(func(r rune) rune {
+			if r <= ' ' || r == '=' || r == '"' {
+				return '_'
+			}
+			return r
+		}, key)...)
+		buf = append(buf, '=')
+
+		s := "null"
+		if val != nil {
+			s = fmt.Sprint(val)
+		}
+		if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, func(r rune) bool {
+			return r < ' ' || r == 0x7f
+		}) >= 0 {
+			buf = strconv.AppendQuote(buf, s)
+		} else {
+			buf = append(buf, s...)
+		}
+	}
+	return buf
+}
+
+// fieldPair returns the i-th key-value pair. Values are converted to a type that encodes in a
+// readable form: errors and Stringers (e.g., net.Addr) are converted to strings.
+func fieldPair(keyvals []any, i int) (string, any) {
+	key := fmt.Sprint(keyvals[i])
+	if i+1 >= len(keyvals) {
+		return key, "!MISSING"
+	}
+
+	switch v := keyvals[i+1].(type) {
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return key, v
+	case error:
+		return key, v.Error()
+	case fmt.Stringer:
+		return key, v.String()
+	default:
+		return key, fmt.Sprint(v)
+	}
+}
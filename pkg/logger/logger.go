@@ -6,7 +6,10 @@ import (
 	"io"
 	"log"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pion/logging"
 	"golang.org/x/time/rate"
@@ -34,6 +37,8 @@ type LoggerFactory interface {
 	SetLevel(levelSpec string)
 	// GetLevel gets the loglevel for the given scope.
 	GetLevel(scope string) string
+	// SetFormat sets the output format of all loggers.
+	SetFormat(format string) error
 }
 
 // LeveledLoggerFactory defines levels by scopes and creates new LeveledLoggers that can dynamically change their own loglevels.
@@ -42,6 +47,8 @@ type LeveledLoggerFactory struct {
 	DefaultLogLevel logging.LogLevel
 	ScopeLevels     map[string]logging.LogLevel
 	Loggers         map[string]*RateLimitedLogger
+	Format          string
+	lock            sync.RWMutex
 }
 
 // NewLoggerFactory sets up a scoped logger for STUNner.
@@ -51,6 +58,7 @@ func NewLoggerFactory(levelSpec string) *LeveledLoggerFactory {
 	logger.ScopeLevels = make(map[string]logging.LogLevel)
 	logger.Loggers = make(map[string]*RateLimitedLogger)
 	logger.Writer = os.Stdout
+	logger.Format = FormatText
 
 	// resets all child loggers
 	logger.SetLevel(levelSpec)
@@ -67,6 +75,9 @@ func (f *LeveledLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
 
 // SetLevel sets the loglevel.
 func (f *LeveledLoggerFactory) SetLevel(levelSpec string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
 	levels := strings.Split(levelSpec, ",")
 	for _, s := range levels {
 		scopedLevel := strings.SplitN(s, ":", 2)
@@ -100,22 +111,112 @@ func (f *LeveledLoggerFactory) SetLevel(levelSpec string) {
 
 		logger.SetLevel(l)
 
-		// disable rate-limiting at DEBUG and TRACE level
+		// disable rate-limiting at DEBUG and TRACE level, re-enable for rate-limited loggers
+		// otherwise
 		if l == logging.LogLevelDebug || l == logging.LogLevelTrace {
 			logger.DisableRateLimiter()
+		} else if logger.limited {
+			logger.EnableRateLimiter()
 		}
 	}
 }
 
 // GetLevel gets the loglevel for the given scope.
 func (f *LeveledLoggerFactory) GetLevel(scope string) string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	return f.getLevel(scope).String()
+}
+
+func (f *LeveledLoggerFactory) getLevel(scope string) logging.LogLevel {
 	logLevel := f.DefaultLogLevel
 	scopeLevel, found := f.ScopeLevels[scope]
 	if found {
 		logLevel = scopeLevel
 	}
 
-	return logLevel.String()
+	return logLevel
+}
+
+// GetLevels returns the loglevel of each known scope, plus the default loglevel for the scope
+// "all", in the format accepted by SetLevel.
+func (f *LeveledLoggerFactory) GetLevels() map[string]string {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	levels := map[string]string{"all": levelName(f.DefaultLogLevel)}
+	for scope := range f.Loggers {
+		levels[scope] = levelName(f.getLevel(scope))
+	}
+	for scope, l := range f.ScopeLevels {
+		levels[scope] = levelName(l)
+	}
+
+	return levels
+}
+
+// GetLevelSpec returns a level spec that restores the current loglevels when passed to SetLevel.
+func (f *LeveledLoggerFactory) GetLevelSpec() string {
+	levels := f.GetLevels()
+
+	spec := []string{"all:" + levels["all"]}
+	delete(levels, "all")
+	scopes := make([]string, 0, len(levels))
+	for scope := range levels {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	for _, scope := range scopes {
+		spec = append(spec, scope+":"+levels[scope])
+	}
+
+	return strings.Join(spec, ",")
+}
+
+// ValidateLevelSpec checks a level spec of the form "<scope>:<level>,<scope>:<level>,...".
+func ValidateLevelSpec(levelSpec string) error {
+	for _, s := range strings.Split(levelSpec, ",") {
+		scopedLevel := strings.SplitN(s, ":", 2)
+		if len(scopedLevel) != 2 || scopedLevel[0] == "" {
+			return fmt.Errorf("invalid loglevel %q: format must be <scope>:<level>", s)
+		}
+		if _, ok := logLevels[strings.ToUpper(scopedLevel[1])]; !ok {
+			return fmt.Errorf("invalid loglevel %q: unknown level %q", s, scopedLevel[1])
+		}
+	}
+
+	return nil
+}
+
+func levelName(l logging.LogLevel) string {
+	for name, level := range logLevels {
+		if level == l {
+			return name
+		}
+	}
+	return l.String()
+}
+
+// SetFormat sets the output format of all loggers, either "text" (the default), "json" or
+// "logfmt".
+func (f *LeveledLoggerFactory) SetFormat(format string) error {
+	if format == "" {
+		format = FormatText
+	}
+	if !isValidFormat(format) {
+		return fmt.Errorf("invalid log format %q", format)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.Format = format
+	for _, logger := range f.Loggers {
+		logger.SetFormat(format)
+	}
+
+	return nil
 }
 
 // RateLimitedLoggerFactory is a logger factory that can emit rate-limited loggers. Note that all
@@ -142,13 +243,12 @@ func (f *LeveledLoggerFactory) WithRateLimiter(limit rate.Limit, burst int) *Rat
 func (f *RateLimitedLoggerFactory) NewLogger(scope string) logging.LeveledLogger {
 	logger := f.LeveledLoggerFactory.newLogger(scope, f.Limit, f.Burst)
 
-	// disable rate-limiting logging at lower loglevels
-	l := f.DefaultLogLevel
+	f.lock.Lock()
+	defer f.lock.Unlock()
 
-	scopeLevel, found := f.ScopeLevels[scope]
-	if found {
-		l = scopeLevel
-	}
+	// disable rate-limiting logging at lower loglevels
+	l := f.getLevel(scope)
+	logger.limited = true
 
 	// disable rate-limiting at DEBUG and TRACE level
 	if l == logging.LogLevelDebug || l == logging.LogLevelTrace {
@@ -164,39 +264,85 @@ func (f *RateLimitedLoggerFactory) NewLogger(scope string) logging.LeveledLogger
 type RateLimitedLogger struct {
 	*logging.DefaultLeveledLogger
 	*RateLimitedWriter
+	scope   string
+	level   logging.LogLevel
+	limited bool
+	format  string
+	loggers map[logging.LogLevel]*log.Logger
+	lock    sync.Mutex
 }
 
 // NewRateLimitedLoggerForScope returns a LeveledLogger configured with a default rate limiter.
 func NewRateLimitedLoggerForScope(scope string, level logging.LogLevel, writer io.Writer, limit rate.Limit, burst int) *RateLimitedLogger {
 	// NewLogger will set the limit and burst
 	w := NewRateLimitedWriter(writer, limit, burst, true)
-	return &RateLimitedLogger{
+	l := &RateLimitedLogger{
 		DefaultLeveledLogger: logging.NewDefaultLeveledLoggerForScope(scope, level, writer),
 		RateLimitedWriter:    w,
+		scope:                scope,
+		level:                level,
+		loggers:              map[logging.LogLevel]*log.Logger{},
+	}
+
+	for _, lvl := range []logging.LogLevel{logging.LogLevelTrace, logging.LogLevelDebug,
+		logging.LogLevelInfo, logging.LogLevelWarn, logging.LogLevelError} {
+		l.loggers[lvl] = log.New(w, "", defaultFlags)
+	}
+	l.SetFormat(FormatText)
+
+	l.DefaultLeveledLogger.
+		WithTraceLogger(l.loggers[logging.LogLevelTrace]).
+		WithDebugLogger(l.loggers[logging.LogLevelDebug]).
+		WithInfoLogger(l.loggers[logging.LogLevelInfo]).
+		WithWarnLogger(l.loggers[logging.LogLevelWarn]).
+		WithErrorLogger(l.loggers[logging.LogLevelError])
+
+	return l
+}
+
+// SetLevel sets the loglevel of the logger.
+func (l *RateLimitedLogger) SetLevel(level logging.LogLevel) {
+	l.level.Set(level)
+	l.DefaultLeveledLogger.SetLevel(level)
+}
+
+// SetFormat sets the output format of the logger. Unknown formats fall back to text.
+func (l *RateLimitedLogger) SetFormat(format string) {
+	if !isValidFormat(format) {
+		format = FormatText
+	}
+
+	// do not hold the lock while reconfiguring the loggers: the record writer is called with the
+	// output lock of the loggers held
+	l.lock.Lock()
+	l.format = format
+	l.lock.Unlock()
+
+	for lvl, logger := range l.loggers {
+		if format == FormatText {
+			logger.SetOutput(l.RateLimitedWriter)
+			logger.SetPrefix(fmt.Sprintf("%s %s: ", l.scope, textLevelNames[lvl]))
+			logger.SetFlags(defaultFlags)
+		} else {
+			logger.SetOutput(&recordWriter{logger: l, level: lvl})
+			logger.SetPrefix("")
+			logger.SetFlags(0)
+		}
 	}
 }
 
 // newLogger knows how to emit rate-limited loggers.
 func (f *LeveledLoggerFactory) newLogger(scope string, limit rate.Limit, burst int) *RateLimitedLogger {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
 	logger, found := f.Loggers[scope]
 	if found {
 		return logger
 	}
 
-	logLevel := f.DefaultLogLevel
-	scopeLevel, found := f.ScopeLevels[scope]
-	if found {
-		logLevel = scopeLevel
-	}
-
-	l := NewRateLimitedLoggerForScope(scope, logLevel, f.Writer, limit, burst)
-
-	l.DefaultLeveledLogger.
-		WithTraceLogger(log.New(l.RateLimitedWriter, fmt.Sprintf("%s TRACE: ", scope), defaultFlags)).
-		WithDebugLogger(log.New(l.RateLimitedWriter, fmt.Sprintf("%s DEBUG: ", scope), defaultFlags)).
-		WithInfoLogger(log.New(l.RateLimitedWriter, fmt.Sprintf("%s INFO: ", scope), defaultFlags)).
-		WithWarnLogger(log.New(l.RateLimitedWriter, fmt.Sprintf("%s WARNING: ", scope), defaultFlags)).
-		WithErrorLogger(log.New(l.RateLimitedWriter, fmt.Sprintf("%s ERROR: ", scope), defaultFlags))
+	l := NewRateLimitedLoggerForScope(scope, f.getLevel(scope), f.Writer, limit, burst)
+	l.SetFormat(f.Format)
 
 	f.Loggers[scope] = l
 
@@ -225,44 +371,57 @@ func NewRateLimitedWriter(writer io.Writer, limit rate.Limit, burst int, addSupp
 
 // Write fulfills io.Writer.
 func (w *RateLimitedWriter) Write(p []byte) (int, error) {
-	if !w.RateLimiter.Allow() {
-		w.Counter++
+	suppressed, ok := w.allow()
+	if !ok {
 		return 0, nil
 	}
 
-	if w.AddSuppressed && w.Counter > 0 {
-		suffix := fmt.Sprintf(" (suppressed %d log events)\n", w.Counter)
+	if suppressed > 0 {
+		suffix := fmt.Sprintf(" (suppressed %d log events)\n", suppressed)
 		p = append(bytes.TrimRight(p, "\r\n"), suffix...)
 	}
-	n, err := w.Writer.Write(p)
+
+	return w.Writer.Write(p)
+}
+
+// allow consumes a token from the token bucket. If there is no token available the event is
+// counted as suppressed, otherwise the number of events suppressed since the last logged event is
+// returned (if AddSuppressed is set).
+func (w *RateLimitedWriter) allow() (int, bool) {
+	if !w.RateLimiter.Allow() {
+		w.Counter++
+		return 0, false
+	}
+
+	suppressed := 0
+	if w.AddSuppressed {
+		suppressed = w.Counter
+	}
 	w.Counter = 0
 
-	return n, err
+	return suppressed, true
 }
 
 // RateLimiter is a token bucket that can be disabled.
 type RateLimiter struct {
 	*rate.Limiter
-	EnableRateLimiterd bool
+	EnableRateLimiterd atomic.Bool
 }
 
 func NewRateLimiter(r rate.Limit, b int) *RateLimiter {
-	return &RateLimiter{
-		Limiter:            rate.NewLimiter(r, b),
-		EnableRateLimiterd: false,
-	}
+	return &RateLimiter{Limiter: rate.NewLimiter(r, b)}
 }
 
 func (l *RateLimiter) EnableRateLimiter() {
-	l.EnableRateLimiterd = true
+	l.EnableRateLimiterd.Store(true)
 }
 
 func (l *RateLimiter) DisableRateLimiter() {
-	l.EnableRateLimiterd = false
+	l.EnableRateLimiterd.Store(false)
 }
 
 func (l *RateLimiter) Allow() bool {
-	if !l.EnableRateLimiterd {
+	if !l.EnableRateLimiterd.Load() {
 		return true
 	}
 	return l.Limiter.Allow()
@@ -2,7 +2,10 @@ package logger
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
@@ -598,3 +601,136 @@ func logreadr() string {
 	logBuffer.Reset()
 	return ret
 }
+
+// structured log format tests
+
+func TestStructuredLogger(t *testing.T) {
+	loggerFactory := NewLoggerFactory("all:INFO")
+	loggerFactory.Writer = logBuffer
+	logreset()
+
+	assert.Error(t, loggerFactory.SetFormat("xml"), "invalid format")
+	assert.Equal(t, FormatText, loggerFactory.Format, "format unchanged")
+
+	log := loggerFactory.NewLogger(testScope)
+	flog := WithFields(log, "listener", "udp", "client", &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4),
+		Port: 5678}, "username", "user 1")
+
+	// text
+	flog.Infof("auth %s", "success")
+	line := logreadr()
+	assert.Contains(t, line, testScope+" INFO: auth success", "text: message")
+	assert.Contains(t, line, `listener=udp client=1.2.3.4:5678 username="user 1"`, "text: fields")
+	assert.Contains(t, line, "logger_test.go", "text: caller")
+
+	// json
+	assert.NoError(t, loggerFactory.SetFormat(FormatJSON), "set format")
+	log.Info("dummy")
+	rec := map[string]any{}
+	assert.NoError(t, json.Unmarshal([]byte(logreadr()), &rec), "json: record")
+	assert.Equal(t, "info", rec["level"], "json: level")
+	assert.Equal(t, testScope, rec["scope"], "json: scope")
+	assert.Equal(t, "dummy", rec["msg"], "json: message")
+	_, err := time.Parse(time.RFC3339Nano, rec["time"].(string))
+	assert.NoError(t, err, "json: timestamp")
+
+	flog.Warn(`quoted "msg"`)
+	rec = map[string]any{}
+	assert.NoError(t, json.Unmarshal([]byte(logreadr()), &rec), "json: record")
+	assert.Equal(t, "warn", rec["level"], "json: level")
+	assert.Equal(t, `quoted "msg"`, rec["msg"], "json: message")
+	assert.Equal(t, "udp", rec["listener"], "json: listener")
+	assert.Equal(t, "1.2.3.4:5678", rec["client"], "json: client")
+	assert.Equal(t, "user 1", rec["username"], "json: username")
+
+	// levels still apply
+	flog.Debug("dummy")
+	log.Debug("dummy")
+	assert.Zero(t, loglenr(), "json: debug suppressed")
+	loggerFactory.SetLevel(testScope + ":DEBUG")
+	WithFields(flog, "peer", "5.6.7.8").Debug("dummy")
+	rec = map[string]any{}
+	assert.NoError(t, json.Unmarshal([]byte(logreadr()), &rec), "json: record")
+	assert.Equal(t, "debug", rec["level"], "json: level")
+	assert.Equal(t, "udp", rec["listener"], "json: inherited field")
+	assert.Equal(t, "5.6.7.8", rec["peer"], "json: new field")
+
+	// logfmt
+	assert.NoError(t, loggerFactory.SetFormat(FormatLogfmt), "set format")
+	flog.Error("dummy error")
+	line = logreadr()
+	assert.Regexp(t, `^time=\S+ level=error scope=`+testScope+` msg="dummy error" listener=udp `+
+		`client=1.2.3.4:5678 username="user 1"\n$`, line, "logfmt: record")
+
+	// new loggers inherit the format
+	loggerFactory.NewLogger("other-scope").Error("dummy")
+	assert.Contains(t, logreadr(), "level=error scope=other-scope msg=dummy", "logfmt: new logger")
+}
+
+func TestStructuredRateLimitedLogger(t *testing.T) {
+	loggerFactory := NewLoggerFactory("all:INFO").WithRateLimiter(100.0, 1)
+	loggerFactory.Writer = logBuffer
+	assert.NoError(t, loggerFactory.SetFormat(FormatJSON), "set format")
+	logreset()
+
+	log := loggerFactory.NewLogger(testScope)
+	flog := WithFields(log, "listener", "udp")
+
+	log.Info("dummy")
+	assert.Contains(t, logreadr(), `"msg":"dummy"`)
+	log.Info("dummy")
+	assert.Zerof(t, loglenr(), "suppressed")
+	flog.Info("dummy")
+	assert.Zerof(t, loglenr(), "suppressed")
+
+	// wait until we get another token
+	time.Sleep(15 * time.Millisecond)
+
+	flog.Info("dummy")
+	rec := map[string]any{}
+	assert.NoError(t, json.Unmarshal([]byte(logreadr()), &rec), "json: record")
+	assert.Equal(t, "udp", rec["listener"], "json: listener")
+	assert.Equal(t, float64(2), rec["suppressed"], "json: suppressed count")
+}
+
+func TestLevelSpec(t *testing.T) {
+	loggerFactory := NewLoggerFactory("all:WARN,dummy:DEBUG")
+	loggerFactory.Writer = logBuffer
+	_ = loggerFactory.NewLogger("other")
+
+	assert.Equal(t, map[string]string{"all": "WARN", "dummy": "DEBUG", "other": "WARN"},
+		loggerFactory.GetLevels(), "levels")
+	spec := loggerFactory.GetLevelSpec()
+	assert.Equal(t, "all:WARN,dummy:DEBUG,other:WARN", spec, "level spec")
+
+	loggerFactory.SetLevel("all:TRACE,other:DISABLE")
+	assert.Equal(t, "Disabled", loggerFactory.GetLevel("other"), "other level")
+	loggerFactory.SetLevel(spec)
+	assert.Equal(t, "Warn", loggerFactory.GetLevel("other"), "other level restored")
+	assert.Equal(t, "Debug", loggerFactory.GetLevel("dummy"), "dummy level restored")
+	assert.Equal(t, "Warn", loggerFactory.GetLevel("all"), "default level restored")
+
+	assert.NoError(t, ValidateLevelSpec("all:INFO,turn:debug"), "valid spec")
+	assert.Error(t, ValidateLevelSpec("all:INFO,turn"), "no level")
+	assert.Error(t, ValidateLevelSpec(":INFO"), "no scope")
+	assert.Error(t, ValidateLevelSpec("all:VERBOSE"), "unknown level")
+}
+
+func TestRateLimiterRestoredAfterDebug(t *testing.T) {
+	loggerFactory := NewLoggerFactory("all:INFO").WithRateLimiter(1.0, 1)
+	loggerFactory.Writer = logBuffer
+	logreset()
+
+	log := loggerFactory.NewLogger(testScope)
+
+	// rate-limiting is disabled at DEBUG level and re-enabled at INFO level
+	loggerFactory.SetLevel("all:DEBUG")
+	log.Info("hello")
+	log.Info("hello")
+	assert.Equal(t, 2, strings.Count(logreadr(), "hello"), "not rate-limited")
+
+	loggerFactory.SetLevel("all:INFO")
+	log.Info("hello")
+	log.Info("hello")
+	assert.Equal(t, 1, strings.Count(logreadr(), "hello"), "rate-limited")
+}
@@ -110,7 +110,10 @@ func (s *Stunner) reconcileWithRollback(req *stnrv1.StunnerConfig, inRollback bo
 	toBeStarted = append(toBeStarted, adminState.ToBeStarted...)
 
 	s.log.Infof("Setting loglevel to %q", s.GetAdmin().LogLevel)
-	s.logger.SetLevel(s.GetAdmin().LogLevel)
+	s.logLevels.configure(s.GetAdmin().LogLevel)
+	if err := s.SetLogFormat(s.GetAdmin().LogFormat); err != nil {
+		s.log.Errorf("Could not set log format: %s", err.Error())
+	}
 
 	// auth
 	err = s.authManager.FinishReconciliation(authState)
@@ -168,6 +171,25 @@ func (s *Stunner) reconcileWithRollback(req *stnrv1.StunnerConfig, inRollback bo
 		}
 	}
 
+	// terminate the allocations of the credentials revoked in the new config
+	if !s.dryRun {
+		auth := s.GetAuth()
+		if auth != nil && auth.Revocations != nil && auth.Revocations.Terminate {
+			s.terminateRevoked(auth.RevocationMatcher(auth.Revocations))
+		}
+	}
+
+	// the allocation quota of a listener may change without a restart
+	if !s.dryRun {
+		for _, name := range s.listenerManager.Keys() {
+			if l := s.GetListener(name); l != nil {
+				if r := getRelayGen(l); r != nil {
+					r.updateQuotaUsage()
+				}
+			}
+		}
+	}
+
 	// we are "ready" unless we are being shut down
 	if !s.shutdown && !s.ready {
 		s.ready = true
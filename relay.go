@@ -3,31 +3,47 @@ package stunner
 // code adopted from github.com/livekit/pkg/telemetry
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/logging"
+	"github.com/pion/stun/v3"
 	"github.com/pion/transport/v3"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/utils/lru"
 
 	"github.com/l7mp/stunner/internal/object"
 	"github.com/l7mp/stunner/internal/telemetry"
+	"github.com/l7mp/stunner/internal/util"
+	stnrv1 "github.com/l7mp/stunner/pkg/apis/v1"
 	"github.com/l7mp/stunner/pkg/logger"
 )
 
 const ClusterCacheSize = 512
 
+// maxRelayPortRetries is the number of times the relay address generator tries to open a relay
+// socket on a port from the relay port range of a listener before giving up.
+const maxRelayPortRetries = 32
+
 var (
-	errNilConn = errors.New("Cannot allocate relay connection")
-	errTodo    = errors.New("Relay to Net.Conn not implemented")
+	errNilConn        = errors.New("Cannot allocate relay connection")
+	errConnNotInUse   = errors.New("TCP relays are allocated via AllocateListener")
+	errRelayPortInUse = errors.New("Relay port in use")
 )
 
 var (
 	ErrPortProhibited      = errors.New("Peer port administratively prohibited")
 	ErrInvalidPeerProtocol = errors.New("Unknown peer transport protocol")
+	ErrRelayPortsExhausted = errors.New("No relay port available in the relay port range")
 )
 
 type PortRangeChecker = func(addr net.Addr) (*object.Cluster, bool)
@@ -38,9 +54,14 @@ type RelayGen struct {
 	// Listener is the listener on behalf of which the relay address generator is created.
 	Listener *object.Listener
 
-	// RelayAddress is the IP returned to the user when the relay is created.
+	// RelayAddress is the IP returned to the user when an IPv4 relay is created, nil if the
+	// listener does not support IPv4 relays.
 	RelayAddress net.IP
 
+	// RelayAddress6 is the IP returned to the user when an IPv6 relay is created, nil if the
+	// listener does not support IPv6 relays.
+	RelayAddress6 net.IP
+
 	// Address is passed to Listen/ListenPacket when creating the Relay.
 	Address string
 
@@ -56,17 +77,66 @@ type RelayGen struct {
 
 	// Logger is a logger factory we can use to generate per-listener relay loggers.
 	Logger *logger.LeveledLoggerFactory
+
+	// userChecker returns the PortRangeChecker for the allocations of a user, restricted to
+	// the clusters allowed for the tenant of the user.
+	userChecker func(username string) PortRangeChecker
+
+	// the protocol, the transport address and the relay port range of the listener: changing
+	// these restarts the listener with a new relay address generator
+	protocol         string
+	serverAddr       net.Addr
+	minPort, maxPort int
+
+	ports     map[relayKey]bool
+	udpRelays map[int]*PortRangePacketConn
+	portLock  sync.Mutex
+	tcpPorts  *portSet
+	allocs    *allocationTable
+	drain     *drainState
+	tokens    *accessTokenTable
+	secrets   *sharedSecretTable
+	lockout   *authLockout
+	rxLimit   bandwidthLimiter
+	txLimit   bandwidthLimiter
+	log       logging.LeveledLogger
 }
 
 func NewRelayGen(l *object.Listener, logger *logger.LeveledLoggerFactory) *RelayGen {
-	return &RelayGen{
+	r := &RelayGen{
 		Listener:     l,
 		RelayAddress: l.Addr,
 		Address:      "0.0.0.0",
 		ClusterCache: lru.New(ClusterCacheSize),
 		Net:          l.Net,
 		Logger:       logger,
+		ports:        map[relayKey]bool{},
+		udpRelays:    map[int]*PortRangePacketConn{},
+		tcpPorts:     newPortSet(),
+		log:          logger.NewLogger(fmt.Sprintf("relay-%s", l.Name)),
+	}
+
+	// IPv6 listeners use dual-stack relays: a listener on "::" can relay both IPv4 and IPv6,
+	// otherwise only IPv6 relays are available
+	if l.Addr != nil && l.Addr.To4() == nil {
+		r.Address = "::"
+		r.RelayAddress6 = l.Addr
+		r.RelayAddress = nil
+		if l.Addr.IsUnspecified() {
+			r.RelayAddress = net.IPv4zero
+		}
 	}
+
+	// relays are bound to the listener address unless the listener is bound to all interfaces
+	if l.Addr != nil && !l.Addr.IsUnspecified() {
+		r.Address = l.Addr.String()
+	}
+
+	r.protocol = strings.TrimPrefix(l.Proto.String(), "TURN-")
+	r.serverAddr = r.listenerAddr()
+	r.minPort, r.maxPort = l.GetRelayPortRange()
+
+	return r
 }
 
 // Validate is called on server startup and confirms the RelayAddressGenerator is properly configured.
@@ -81,104 +151,588 @@ func (r *RelayGen) AllocatePacketConn(network string, requestedPort int) (net.Pa
 		requestedPort = 0
 	}
 
-	conn, err := r.Net.ListenPacket(network, fmt.Sprintf("%s:%d", r.Address, requestedPort))
+	// the TURN server always asks for an IPv4 relay, use a dual-stack socket instead so that
+	// the relay can be advertised with either address family
+	network = r.relayNetwork(network, "udp")
+
+	var conn net.PacketConn
+	port, err := r.allocatePort("udp", requestedPort, func(port int) (int, error) {
+		c, err := r.Net.ListenPacket(network, net.JoinHostPort(r.Address, strconv.Itoa(port)))
+		if err != nil {
+			return 0, err
+		}
+
+		addr, ok := c.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			c.Close()
+			return 0, errNilConn
+		}
+
+		conn = c
+		return addr.Port, nil
+	})
 	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
 		return nil, nil, err
 	}
 
+	conn = &relayPacketConn{PacketConn: conn, release: r.portReleaser("udp", port)}
 	conn = NewPortRangePacketConn(conn, r.PortRangeChecker,
 		r.Logger.NewLogger(fmt.Sprintf("relay-%s", r.Listener.Name)))
+	if c, ok := conn.(*PortRangePacketConn); ok {
+		c.listener = r.Listener.Name
+		c.rxLimit, c.txLimit = r.newRelayLimiters()
+		c.stats = r.allocs.addRelay(r.Listener.Name, "udp", port, func() { c.Close() })
+
+		r.portLock.Lock()
+		r.udpRelays[port] = c
+		r.portLock.Unlock()
+	}
 
-	relayAddr, ok := conn.LocalAddr().(*net.UDPAddr)
-	if !ok {
-		return nil, nil, errNilConn
+	return conn, &net.UDPAddr{IP: r.defaultRelayIP(), Port: port}, nil
+}
+
+// AllocateConn is required by the turn.RelayAddressGenerator interface but it is never called by
+// the TURN server: TCP relay allocations are handled by the TCPRelayListener, which uses
+// AllocateListener to obtain a relay address.
+func (r *RelayGen) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, errConnNotInUse
+}
+
+// AllocateListener creates a new TCP listener that will serve as the relayed transport address of
+// an RFC 6062 TCP allocation and returns the IP/Port to be returned to the client in the
+// allocation response. The listener socket is opened with SO_REUSEPORT set so that outgoing
+// connections to peers can be initiated from the same address. Note that TCP relays always use
+// the native network stack.
+func (r *RelayGen) AllocateListener(network string, requestedPort int) (net.Listener, net.Addr, error) {
+	if requestedPort <= 1 || requestedPort > 2<<16-1 {
+		requestedPort = 0
 	}
 
-	relayAddr.IP = r.RelayAddress
-	return conn, relayAddr, nil
+	network = r.relayNetwork(network, "tcp")
+
+	var l net.Listener
+	port, err := r.allocatePort("tcp", requestedPort, func(port int) (int, error) {
+		// the kernel does not detect port clashes between SO_REUSEPORT sockets
+		if port != 0 && !r.tcpPorts.reserve(port) {
+			return 0, errRelayPortInUse
+		}
+
+		listenerConf := &net.ListenConfig{Control: reuseAddrPort}
+		ln, err := listenerConf.Listen(context.Background(), network,
+			net.JoinHostPort(r.Address, strconv.Itoa(port)))
+		if err != nil {
+			r.tcpPorts.release(port)
+			return 0, err
+		}
+
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok {
+			ln.Close()
+			r.tcpPorts.release(port)
+			return 0, errNilConn
+		}
+
+		l = ln
+		return addr.Port, nil
+	})
+	if err != nil {
+		if l != nil {
+			l.Close()
+			r.tcpPorts.release(requestedPort)
+		}
+		return nil, nil, err
+	}
+
+	release := r.portReleaser("tcp", port)
+	l = &relayListener{Listener: l, release: func() {
+		release()
+		r.tcpPorts.release(port)
+	}}
+
+	return l, &net.TCPAddr{IP: r.defaultRelayIP(), Port: port}, nil
 }
 
-// AllocateConn generates a new Conn to receive traffic on and the IP/Port to populate the
-// allocation response with
-func (g *RelayGen) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
-	return nil, nil, errTodo
+// relayNetwork returns the network to open relay sockets on for the address family of the
+// listener: IPv6 listeners use IPv6 relays, dual-stack if the listener is bound to all interfaces.
+func (r *RelayGen) relayNetwork(network, transport string) string {
+	switch {
+	case r.RelayAddress6 == nil:
+		return network
+	case r.RelayAddress == nil:
+		return transport + "6"
+	default:
+		return transport
+	}
+}
+
+// PortsInUse returns the number of relay ports currently allocated.
+func (r *RelayGen) PortsInUse() int {
+	r.portLock.Lock()
+	defer r.portLock.Unlock()
+	return len(r.ports)
+}
+
+// hasPortRange returns true if the relay ports of the listener are restricted to a port range.
+func (r *RelayGen) hasPortRange() bool {
+	return r.minPort > stnrv1.DefaultMinRelayPort || r.maxPort < stnrv1.DefaultMaxRelayPort
+}
+
+// PortsTotal returns the size of the relay port range.
+func (r *RelayGen) PortsTotal() int {
+	return r.maxPort - r.minPort + 1
+}
+
+// allocatePort calls listen with candidate ports from the relay port range of the listener until
+// a relay socket of the given transport is successfully opened and returns the port of the relay.
+// Without a port range the port is chosen by the kernel and reserved once the socket is open: if
+// the port is still in use the caller must close the socket.
+func (r *RelayGen) allocatePort(transport string, requestedPort int, listen func(port int) (int, error)) (int, error) {
+	if !r.hasPortRange() {
+		port, err := listen(requestedPort)
+		if err != nil {
+			return 0, err
+		}
+		if !r.reservePort(transport, port) {
+			return 0, errRelayPortInUse
+		}
+		return port, nil
+	}
+
+	minPort, maxPort := r.minPort, r.maxPort
+	size := r.PortsTotal()
+
+	// try the requested port first, then scan the range from a random offset
+	offset := rand.Intn(size)
+	if requestedPort >= minPort && requestedPort <= maxPort {
+		offset = requestedPort - minPort
+	}
+
+	retries := 0
+	for i := 0; i < size && retries < maxRelayPortRetries; i++ {
+		port := minPort + (offset+i)%size
+		if !r.reservePort(transport, port) {
+			continue
+		}
+
+		p, err := listen(port)
+		if err == nil {
+			return p, nil
+		}
+
+		r.log.Tracef("cannot open relay socket on port %d: %s", port, err.Error())
+		r.releasePort(transport, port)
+		retries++
+	}
+
+	r.log.Infof("relay port range <%d-%d> exhausted after %d retries", minPort, maxPort,
+		retries)
+	telemetry.IncrementRelayPortExhausted(r.Listener.Name)
+
+	return 0, ErrRelayPortsExhausted
+}
+
+// reservePort marks a relay port of the given transport as used, returns false if the port is
+// already in use.
+func (r *RelayGen) reservePort(transport string, port int) bool {
+	key := relayKey{listener: r.Listener.Name, transport: transport, port: port}
+
+	r.portLock.Lock()
+	defer r.portLock.Unlock()
+
+	if r.ports[key] {
+		return false
+	}
+	r.ports[key] = true
+	telemetry.AddRelayPort(r.Listener.Name)
+
+	return true
+}
+
+// releasePort marks a relay port of the given transport as free.
+func (r *RelayGen) releasePort(transport string, port int) {
+	key := relayKey{listener: r.Listener.Name, transport: transport, port: port}
+
+	r.portLock.Lock()
+	defer r.portLock.Unlock()
+
+	if r.ports[key] {
+		delete(r.ports, key)
+		if transport == "udp" {
+			delete(r.udpRelays, port)
+		}
+		telemetry.SubRelayPort(r.Listener.Name)
+	}
+}
+
+// portRangeChecker returns the PortRangeChecker for the allocations of a user.
+func (r *RelayGen) portRangeChecker(username string) PortRangeChecker {
+	if r.userChecker == nil || username == "" {
+		return r.PortRangeChecker
+	}
+	return r.userChecker(username)
+}
+
+// bindRelay restricts the peers of a UDP relay to the clusters allowed for the user of the
+// allocation. The TURN server creates the relay before the allocation is registered, so the
+// checker of the user is set once the allocation is added.
+func (r *RelayGen) bindRelay(port int, username string) {
+	r.portLock.Lock()
+	c, ok := r.udpRelays[port]
+	r.portLock.Unlock()
+
+	if ok {
+		c.setChecker(r.portRangeChecker(username))
+	}
+}
+
+// portReleaser returns a function that releases a relay port at most once, removing the
+// allocation that uses the relay port.
+func (r *RelayGen) portReleaser(transport string, port int) func() {
+	return sync.OnceFunc(func() {
+		r.releasePort(transport, port)
+		if a := r.allocs.remove(r.Listener.Name, transport, port); a != nil {
+			telemetry.SubAllocation(r.Listener.Name)
+			r.updateQuotaUsage()
+			r.allocs.audit(accessLogEventDelete, a)
+			telemetry.TraceEvent(a.trace, "delete", nil,
+				telemetry.AttrListener.String(a.Listener),
+				telemetry.AttrUsername.String(a.Username),
+				telemetry.AttrClient.String(addrString(a.ClientAddr)),
+				telemetry.AttrRelay.String(addrString(a.RelayAddr)))
+		}
+	})
+}
+
+// addAllocation registers a new allocation with the given relay address. The allocation is
+// rejected if the user is blocked or the allocation would exceed any of the allocation quotas, in
+// which case the error code to reject the Allocate request with and false is returned.
+func (r *RelayGen) addAllocation(transport, username string, client, relay net.Addr) (stun.ErrorCode, bool) {
+	var port int
+	switch a := relay.(type) {
+	case *net.UDPAddr:
+		port = a.Port
+	case *net.TCPAddr:
+		port = a.Port
+	default:
+		return 0, true
+	}
+
+	if r.allocs.blocked(r.Listener.Name, username, client) {
+		r.log.Infof("rejecting allocation request from client %s (user %q): blocked", client,
+			username)
+		return stun.CodeForbidden, false
+	}
+
+	a := &Allocation{
+		Listener:   r.Listener.Name,
+		Protocol:   r.protocol,
+		Transport:  transport,
+		Username:   username,
+		ClientAddr: client,
+		ServerAddr: r.serverAddr,
+		RelayAddr:  relay,
+		Created:    time.Now(),
+	}
+
+	added, quota := r.allocs.add(a, port, r.Listener.GetQuota())
+	if quota != "" {
+		r.log.Infof("rejecting allocation request from client %s (user %q): %s allocation "+
+			"quota reached", client, username, quota)
+		telemetry.IncrementQuotaRejected(r.Listener.Name, quota)
+		return stun.CodeAllocQuotaReached, false
+	}
+
+	if added {
+		if transport == "udp" {
+			r.bindRelay(port, username)
+		}
+
+		// the trace of the allocation starts with the allocate span
+		r.allocs.setTrace(r.Listener.Name, transport, port,
+			telemetry.TraceEvent(trace.SpanContext{}, "allocate", nil,
+				telemetry.AttrListener.String(a.Listener),
+				telemetry.AttrUsername.String(username),
+				telemetry.AttrClient.String(client.String()),
+				telemetry.AttrRelay.String(relay.String())))
+		telemetry.AddAllocation(r.Listener.Name)
+		r.updateQuotaUsage()
+		r.allocs.audit(accessLogEventCreate, a)
+	}
+
+	return 0, true
+}
+
+// updateQuotaUsage exports the ratio of the allocation quota of the listener in use.
+func (r *RelayGen) updateQuotaUsage() {
+	telemetry.SetQuotaUsage(r.Listener.Name, r.allocs.count(r.Listener.Name),
+		r.Listener.GetQuota())
+}
+
+// traceRefresh records a successful Refresh request of a client as a trace span.
+func (r *RelayGen) traceRefresh(client net.Addr, lifetime time.Duration) {
+	telemetry.TraceEvent(r.allocs.traceContext(r.Listener.Name, client), "refresh", nil,
+		telemetry.AttrListener.String(r.Listener.Name),
+		telemetry.AttrClient.String(client.String()),
+		telemetry.AttrLifetime.Int64(int64(lifetime/time.Second)))
+}
+
+// listenerAddr returns the transport address of the listener.
+func (r *RelayGen) listenerAddr() net.Addr {
+	switch r.Listener.Proto {
+	case stnrv1.ListenerProtocolTURNUDP, stnrv1.ListenerProtocolTURNDTLS:
+		return &net.UDPAddr{IP: r.Listener.Addr, Port: r.Listener.Port}
+	default:
+		return &net.TCPAddr{IP: r.Listener.Addr, Port: r.Listener.Port}
+	}
+}
+
+// newRelayLimiters returns the bandwidth limiters for the traffic received from and sent to the
+// peers of a new allocation.
+func (r *RelayGen) newRelayLimiters() (*relayLimiter, *relayLimiter) {
+	return newRelayLimiter(r.Listener, &r.rxLimit), newRelayLimiter(r.Listener, &r.txLimit)
+}
+
+// relayIP returns the relay IP address advertised to clients for the given address family, or nil
+// if the listener cannot relay the address family.
+func (r *RelayGen) relayIP(family addrFamily) net.IP {
+	switch family {
+	case addrFamilyIPv4:
+		return r.RelayAddress
+	case addrFamilyIPv6:
+		return r.RelayAddress6
+	default:
+		return nil
+	}
+}
+
+// defaultRelayIP returns the relay IP advertised when the client does not request an address
+// family, IPv4 if available.
+func (r *RelayGen) defaultRelayIP() net.IP {
+	if r.RelayAddress != nil {
+		return r.RelayAddress
+	}
+	return r.RelayAddress6
 }
 
 // GenPortRangeChecker finds the cluster that is responsible for routing the packet and checks
-// whether the peer address is in the port range specified for the cluster. The RelayGen caches
+// whether the peer address is in the port range specified for the cluster. UDP peer addresses are
+// matched against UDP clusters and TCP peer addresses against TCP clusters. The RelayGen caches
 // recent hits for simplicity.
 func (s *Stunner) GenPortRangeChecker(g *RelayGen) PortRangeChecker {
+	return s.genPortRangeChecker(g, "")
+}
+
+// genPortRangeChecker returns a PortRangeChecker for the allocations of a user: the clusters are
+// restricted to the clusters allowed for the tenant of the user, if any. The tenant is resolved
+// once per allocation, while the clusters of the tenant are looked up on each call so that
+// configuration changes apply to existing allocations.
+func (s *Stunner) genPortRangeChecker(g *RelayGen, username string) PortRangeChecker {
+	tenant := ""
+	if auth := s.GetAuth(); auth != nil && username != "" {
+		tenant = auth.GetTenantName(username)
+	}
+
 	return func(addr net.Addr) (*object.Cluster, bool) {
-		u, ok := addr.(*net.UDPAddr)
-		if !ok {
+		var peerIP net.IP
+		var peerPort int
+		var proto stnrv1.ClusterProtocol
+		switch a := addr.(type) {
+		case *net.UDPAddr:
+			peerIP, peerPort, proto = a.IP, a.Port, stnrv1.ClusterProtocolUDP
+		case *net.TCPAddr:
+			peerIP, peerPort, proto = a.IP, a.Port, stnrv1.ClusterProtocolTCP
+		default:
 			return nil, false
 		}
 
-		ip := u.IP.String()
-		c, ok := g.ClusterCache.Get(ip)
+		allowed, restricted := []string(nil), tenant != ""
+		if auth := s.GetAuth(); auth != nil && restricted {
+			allowed = auth.GetTenantClusters(tenant)
+		}
+
+		key := proto.String() + ":" + peerIP.String()
+		c, ok := g.ClusterCache.Get(key)
 		var cluster *object.Cluster
-		if ok {
+		denied := ""
+		if ok && (!restricted || util.Member(allowed, c.(*object.Cluster).Name)) {
 			// cache hit
 			cluster = c.(*object.Cluster)
 		} else {
-			// route
+			// route: the cache holds the first matching cluster irrespective of the
+			// tenant so only unrestricted lookups are cached
 			for _, r := range g.Listener.Routes {
 				c := s.GetCluster(r)
-				if c != nil && c.Route(u.IP) {
+				if c != nil && c.Protocol == proto && c.Route(peerIP) {
+					if restricted && !util.Member(allowed, c.Name) {
+						denied = c.Name
+						continue
+					}
 					cluster = c
-					g.ClusterCache.Add(ip, c)
+					if !restricted {
+						g.ClusterCache.Add(key, c)
+					}
 					break
 				}
 			}
 		}
 
 		if cluster != nil {
-			return cluster, cluster.Match(u.IP, u.Port)
+			return cluster, cluster.Match(peerIP, peerPort)
+		}
+
+		if denied != "" {
+			g.log.Infof("peer %s denied for user %q (tenant %q): cluster %q not allowed "+
+				"for tenant", addr, username, tenant, denied)
 		}
 
 		return nil, false
 	}
 }
 
+// portSet is a set of ports safe for concurrent use.
+type portSet struct {
+	ports map[int]bool
+	lock  sync.Mutex
+}
+
+func newPortSet() *portSet {
+	return &portSet{ports: map[int]bool{}}
+}
+
+func (s *portSet) reserve(port int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ports[port] {
+		return false
+	}
+	s.ports[port] = true
+	return true
+}
+
+func (s *portSet) release(port int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.ports, port)
+}
+
+// relayPacketConn is a relay connection that releases its relay port when closed. The relay may be
+// closed both by the TURN server and administratively, closing the connection again is a no-op.
+type relayPacketConn struct {
+	net.PacketConn
+	release func()
+	closed  atomic.Bool
+}
+
+func (c *relayPacketConn) Close() error {
+	c.release()
+	if c.closed.Swap(true) {
+		return nil
+	}
+	return c.PacketConn.Close()
+}
+
+// relayListener is a TCP relay listener that releases its relay port when closed.
+type relayListener struct {
+	net.Listener
+	release func()
+}
+
+func (l *relayListener) Close() error {
+	l.release()
+	return l.Listener.Close()
+}
+
 // PortRangePacketConn is a net.PacketConn that filters on the target port range and also handles
-// telemetry.
+// telemetry and bandwidth limiting. Each peer the relay sends to is accounted as an upstream
+// connection to the cluster of the peer until the relay is closed. Peers are looked up without
+// locking so that only the first packet sent to a peer takes the lock.
 type PortRangePacketConn struct {
 	net.PacketConn
-	checker      PortRangeChecker
-	log          logging.LeveledLogger
-	readDeadline time.Time
-	lock         sync.Mutex
+	checker          atomic.Pointer[PortRangeChecker]
+	listener         string
+	rxLimit, txLimit *relayLimiter
+	stats            *allocationStats
+	peers            sync.Map // netip.AddrPort -> cluster name
+	closed           bool
+	log              logging.LeveledLogger
+	readDeadline     time.Time
+	lock             sync.Mutex
 }
 
 // NewPortRangePacketConn decorates a PacketConn with filtering on a target port range. Errors are reported per listener name.
 func NewPortRangePacketConn(c net.PacketConn, checker PortRangeChecker, log logging.LeveledLogger) net.PacketConn {
-	// cluster add/sub connection is not tracked
-	// AddConnection(n, t)
-	r := PortRangePacketConn{
+	r := &PortRangePacketConn{
 		PacketConn: c,
-		checker:    checker,
 		log:        log,
 	}
+	r.setChecker(checker)
 
-	return &r
+	return r
 }
 
 // WriteTo writes to the PacketConn.
 func (c *PortRangePacketConn) WriteTo(p []byte, peerAddr net.Addr) (int, error) {
-	cluster, ok := c.checker(peerAddr)
+	cluster, ok := (*c.checker.Load())(peerAddr)
 	if !ok {
 		return 0, ErrPortProhibited
 	}
 
+	// silently drop packets exceeding the bandwidth limit
+	if c.txLimit != nil && !c.txLimit.allow(cluster, len(p)) {
+		telemetry.IncrementShapedDrops(c.listener, telemetry.Outgoing, len(p))
+		return len(p), nil
+	}
+
 	n, err := c.PacketConn.WriteTo(p, peerAddr)
 	if n > 0 {
+		c.addPeer(peerAddr, cluster)
+		c.stats.tx(n)
 		telemetry.IncrementBytes(cluster.Name, telemetry.ClusterType, telemetry.Outgoing, uint64(n))
 		telemetry.IncrementPackets(cluster.Name, telemetry.ClusterType, telemetry.Outgoing, 1)
+		telemetry.IncrementRoute(c.listener, cluster.Name, telemetry.Outgoing, n)
 	}
 
 	return n, err
 }
 
+// setChecker replaces the checker used to filter the peers of the relay.
+func (c *PortRangePacketConn) setChecker(checker PortRangeChecker) {
+	c.checker.Store(&checker)
+}
+
+// addPeer accounts a new upstream connection to the cluster when a peer is first seen.
+func (c *PortRangePacketConn) addPeer(peerAddr net.Addr, cluster *object.Cluster) {
+	peer := peerAddrPort(peerAddr)
+	if _, ok := c.peers.Load(peer); ok {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	if _, ok := c.peers.LoadOrStore(peer, cluster.Name); !ok {
+		telemetry.AddConnection(cluster.Name, telemetry.ClusterType)
+	}
+}
+
+// peerAddrPort returns the transport address of a peer as a map key.
+func peerAddrPort(addr net.Addr) netip.AddrPort {
+	var ap netip.AddrPort
+	if a, ok := addr.(*net.UDPAddr); ok {
+		ap = a.AddrPort()
+	} else {
+		ap, _ = netip.ParseAddrPort(addr.String())
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
 // ReadFrom reads from the PortRangePacketConn. Blocks until a packet from the speciifed port range
 // is received and drops all other packets.
 func (c *PortRangePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
@@ -198,14 +752,21 @@ func (c *PortRangePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 			return n, peerAddr, err
 		}
 
-		cluster, ok := c.checker(peerAddr)
+		cluster, ok := (*c.checker.Load())(peerAddr)
 		if !ok {
 			continue
 		}
 
+		if c.rxLimit != nil && !c.rxLimit.allow(cluster, n) {
+			telemetry.IncrementShapedDrops(c.listener, telemetry.Incoming, n)
+			continue
+		}
+
 		if n > 0 {
+			c.stats.rx(n)
 			telemetry.IncrementBytes(cluster.Name, telemetry.ClusterType, telemetry.Incoming, uint64(n))
 			telemetry.IncrementPackets(cluster.Name, telemetry.ClusterType, telemetry.Incoming, 1)
+			telemetry.IncrementRoute(c.listener, cluster.Name, telemetry.Incoming, n)
 		}
 
 		return n, peerAddr, nil
@@ -220,7 +781,16 @@ func (c *PortRangePacketConn) SetReadDeadline(t time.Time) error {
 }
 
 func (c *PortRangePacketConn) Close() error {
-	// cluster add/sub connection is not tracked
-	// SubConnection(c.name, c.connType)
+	c.lock.Lock()
+	if !c.closed {
+		c.closed = true
+		c.peers.Range(func(peer, cluster any) bool {
+			telemetry.SubConnection(cluster.(string), telemetry.ClusterType)
+			c.peers.Delete(peer)
+			return true
+		})
+	}
+	c.lock.Unlock()
+
 	return c.PacketConn.Close()
 }
@@ -0,0 +1,1070 @@
+package stunner
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/stun/v3"
+
+	"github.com/l7mp/stunner/internal/object"
+	"github.com/l7mp/stunner/internal/telemetry"
+	"github.com/l7mp/stunner/internal/util"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
+)
+
+// Server side of RFC 6062 TCP relay allocations. pion/turn does not implement TCP allocations, so
+// the TCPRelayListener intercepts TURN requests that create and manage TCP allocations and passes
+// everything else to the TURN server.
+
+const (
+	// TCPConnectTimeout is the time limit for connecting to a peer and for the client to bind a
+	// new peer connection with a CONNECTION-BIND request, see RFC 6062, Section 5.
+	TCPConnectTimeout = 30 * time.Second
+
+	// protoTCP is the protocol number for TCP in the REQUESTED-TRANSPORT attribute.
+	protoTCP = 6
+
+	defaultAllocationLifetime = 10 * time.Minute
+	maxAllocationLifetime     = time.Hour
+	permissionLifetime        = 5 * time.Minute
+	channelBindingLifetime    = 10 * time.Minute
+)
+
+// TCPRelayListener is a net.Listener that wraps a TURN-TCP or TURN-TLS listener and implements
+// RFC 6062 TCP relay allocations. Requests related to TCP allocations (Allocate with
+// REQUESTED-TRANSPORT set to TCP, and Refresh, CreatePermission and Connect on connections that
+// own a TCP allocation) are handled by the TCPRelayListener, data connections (connections opened
+// with a CONNECTION-BIND request) are spliced to the peer, and all other connections and requests
+// are passed to the TURN server via Accept.
+type TCPRelayListener struct {
+	net.Listener
+
+	// Relay is the relay address generator of the listener.
+	Relay *RelayGen
+
+	realm             string
+	authHandler       a12n.AuthHandler
+	permissionHandler a12n.PermissionHandler
+	nonces            *nonceHash
+	interceptor       *allocInterceptor
+
+	conns     map[net.Conn]bool
+	allocs    map[*tcpAllocation]bool
+	pending   map[connectionID]*tcpPendingConn
+	acceptCh  chan net.Conn
+	done      chan struct{}
+	acceptErr error
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closed    bool
+	lock      sync.Mutex
+	wg        sync.WaitGroup
+	log       logging.LeveledLogger
+}
+
+// NewTCPRelayListener creates a listener that handles TCP relay allocations on top of a TURN-TCP
+// or TURN-TLS listener. The listener shares the allocation interceptor, and so the relay address
+// generator and the auth handler, with the TURN server of the listener. Permissions for TCP peers
+// are checked with the permission handler, and individual peer connections are also checked
+// against the PortRangeChecker of the relay.
+func NewTCPRelayListener(l net.Listener, interceptor *allocInterceptor, realm string, permissionHandler a12n.PermissionHandler, log logging.LeveledLogger) (*TCPRelayListener, error) {
+	nonces, err := newNonceHash()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &TCPRelayListener{
+		Listener:          l,
+		Relay:             interceptor.relay,
+		realm:             realm,
+		authHandler:       interceptor.authHandler,
+		permissionHandler: permissionHandler,
+		nonces:            nonces,
+		interceptor:       interceptor,
+		conns:             map[net.Conn]bool{},
+		allocs:            map[*tcpAllocation]bool{},
+		pending:           map[connectionID]*tcpPendingConn{},
+		acceptCh:          make(chan net.Conn),
+		done:              make(chan struct{}),
+		ctx:               ctx,
+		cancel:            cancel,
+		log:               log,
+	}
+
+	r.wg.Add(1)
+	go r.acceptLoop()
+
+	return r, nil
+}
+
+// Accept returns the next connection to be handled by the TURN server.
+func (l *TCPRelayListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	case <-l.done:
+		return nil, l.acceptErr
+	}
+}
+
+// Close closes the listener, all TCP allocations and all client connections.
+func (l *TCPRelayListener) Close() error {
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		return nil
+	}
+	l.closed = true
+
+	conns := make([]net.Conn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	allocs := make([]*tcpAllocation, 0, len(l.allocs))
+	for a := range l.allocs {
+		allocs = append(allocs, a)
+	}
+	l.lock.Unlock()
+
+	l.cancel()
+	err := l.Listener.Close()
+
+	for _, a := range allocs {
+		a.close()
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+
+	l.wg.Wait()
+
+	return err
+}
+
+// AllocationCount returns the number of active TCP allocations.
+func (l *TCPRelayListener) AllocationCount() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.allocs)
+}
+
+func (l *TCPRelayListener) acceptLoop() {
+	defer l.wg.Done()
+
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if !util.IsClosedErr(err) {
+				l.log.Debugf("failed to accept: %s", err.Error())
+			}
+			l.acceptErr = err
+			close(l.done)
+			return
+		}
+
+		if !l.track(conn) {
+			conn.Close()
+			continue
+		}
+
+		l.wg.Add(1)
+		go l.handshake(conn)
+	}
+}
+
+// handshake waits for the first TURN message on a new connection and decides whether this is a
+// control connection or a data connection.
+func (l *TCPRelayListener) handshake(conn net.Conn) {
+	defer l.wg.Done()
+
+	framer := &turnFramer{r: conn}
+	conn.SetReadDeadline(time.Now().Add(TCPConnectTimeout)) //nolint:errcheck
+	frame, err := framer.peek()
+	if err != nil {
+		l.log.Debugf("closing connection from %s: %s", conn.RemoteAddr(), err.Error())
+		l.untrack(conn)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+
+	if stun.IsMessage(frame) {
+		m := &stun.Message{Raw: append([]byte{}, frame...)}
+		if err := m.Decode(); err == nil && m.Type.Method == stun.MethodConnectionBind &&
+			m.Type.Class == stun.ClassRequest {
+			framer.consume(len(frame))
+			l.handleConnectionBind(conn, framer, m)
+			return
+		}
+	}
+
+	c := &tcpControlConn{Conn: conn, listener: l, framer: framer, inflight: map[[stun.TransactionIDSize]byte]bool{}}
+	l.untrack(conn)
+	if !l.track(c) {
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.acceptCh <- c:
+	case <-l.done:
+		l.untrack(c)
+		conn.Close()
+	}
+}
+
+// handleConnectionBind binds a data connection to a pending peer connection.
+func (l *TCPRelayListener) handleConnectionBind(conn net.Conn, framer *turnFramer, m *stun.Message) {
+	send := func(raw []byte) { conn.Write(raw) } //nolint:errcheck
+	fail := func() {
+		l.untrack(conn)
+		conn.Close()
+	}
+
+	id, err := getConnectionID(m)
+	if err != nil {
+		l.sendError(m, nil, send, stun.CodeBadRequest)
+		fail()
+		return
+	}
+
+	l.lock.Lock()
+	p, ok := l.pending[id]
+	l.lock.Unlock()
+	if !ok {
+		l.log.Debugf("connection-bind from %s: unknown connection id %d",
+			conn.RemoteAddr(), id)
+		l.sendError(m, nil, send, stun.CodeBadRequest)
+		fail()
+		return
+	}
+
+	username, key, ok := l.authenticate(m, conn.RemoteAddr(), send)
+	if !ok {
+		fail()
+		return
+	}
+	if username != p.alloc.username {
+		l.sendError(m, key, send, stun.CodeWrongCredentials)
+		fail()
+		return
+	}
+
+	if !l.removePending(p) {
+		// expired in the meantime
+		l.sendError(m, key, send, stun.CodeBadRequest)
+		fail()
+		return
+	}
+
+	l.sendResponse(m, key, stun.ClassSuccessResponse, send)
+	l.untrack(conn)
+
+	l.log.Debugf("connection-bind: connection id %d bound, client %s, peer %s", id,
+		conn.RemoteAddr(), p.peer)
+
+	p.alloc.splice(conn, framer.buf, p)
+}
+
+// authenticate checks the long-term credentials of a request. On failure it sends the error
+// response to the client and returns false.
+func (l *TCPRelayListener) authenticate(m *stun.Message, src net.Addr, send func([]byte)) (string, []byte, bool) {
+	if !m.Contains(stun.AttrMessageIntegrity) {
+		l.sendError(m, nil, send, stun.CodeUnauthorized, stun.NewRealm(l.realm),
+			stun.NewNonce(l.nonces.generate()))
+		return "", nil, false
+	}
+
+	var nonce stun.Nonce
+	var realm stun.Realm
+	var username stun.Username
+	if nonce.GetFrom(m) != nil || realm.GetFrom(m) != nil || username.GetFrom(m) != nil {
+		l.sendError(m, nil, send, stun.CodeBadRequest)
+		return "", nil, false
+	}
+
+	if err := l.nonces.validate(nonce.String()); err != nil {
+		l.sendError(m, nil, send, stun.CodeStaleNonce, stun.NewRealm(l.realm),
+			stun.NewNonce(l.nonces.generate()))
+		return "", nil, false
+	}
+
+	key, ok := l.authHandler(username.String(), realm.String(), src)
+	traceAuth(l.Relay.Listener.Name, username.String(), src, ok)
+	if !ok {
+		l.log.Debugf("%s request from %s: authentication failed for user %q", m.Type.Method,
+			src, username.String())
+		l.Relay.lockout.failure(l.Relay.Listener.Name, src, username.String())
+		l.sendError(m, nil, send, stun.CodeUnauthorized, stun.NewRealm(l.realm),
+			stun.NewNonce(l.nonces.generate()))
+		return "", nil, false
+	}
+
+	if err := stun.MessageIntegrity(key).Check(m); err != nil {
+		l.log.Debugf("%s request from %s: integrity check failed for user %q",
+			m.Type.Method, src, username.String())
+		l.Relay.lockout.failure(l.Relay.Listener.Name, src, username.String())
+		l.sendError(m, nil, send, stun.CodeUnauthorized, stun.NewRealm(l.realm),
+			stun.NewNonce(l.nonces.generate()))
+		return "", nil, false
+	}
+
+	return username.String(), key, true
+}
+
+// sendResponse builds and sends a response for a request. The response is signed with the key if
+// the key is non-nil.
+func (l *TCPRelayListener) sendResponse(m *stun.Message, key []byte, class stun.MessageClass, send func([]byte), setters ...stun.Setter) {
+	s := []stun.Setter{stun.NewTransactionIDSetter(m.TransactionID), stun.NewType(m.Type.Method, class)}
+	s = append(s, setters...)
+	if key != nil {
+		s = append(s, stun.MessageIntegrity(key))
+	}
+	s = append(s, stun.Fingerprint)
+
+	res, err := stun.Build(s...)
+	if err != nil {
+		l.log.Errorf("cannot build %s response: %s", m.Type.Method, err.Error())
+		return
+	}
+
+	send(res.Raw)
+}
+
+// sendError sends an error response for a request.
+func (l *TCPRelayListener) sendError(m *stun.Message, key []byte, send func([]byte), code stun.ErrorCode, setters ...stun.Setter) {
+	l.sendResponse(m, key, stun.ClassErrorResponse, send, append([]stun.Setter{code}, setters...)...)
+}
+
+func (l *TCPRelayListener) track(conn net.Conn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return false
+	}
+	l.conns[conn] = true
+	return true
+}
+
+func (l *TCPRelayListener) untrack(conn net.Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.conns, conn)
+}
+
+// addPending registers a peer connection waiting for the client to bind it and returns the new
+// connection id.
+func (l *TCPRelayListener) addPending(a *tcpAllocation, conn net.Conn, peer *net.TCPAddr, cluster *object.Cluster) (connectionID, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.closed {
+		return 0, false
+	}
+
+	var id connectionID
+	for {
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			return 0, false
+		}
+		id = connectionID(binary.BigEndian.Uint32(b))
+		if _, ok := l.pending[id]; !ok && id != 0 {
+			break
+		}
+	}
+
+	p := &tcpPendingConn{id: id, alloc: a, conn: conn, peer: peer, cluster: cluster}
+	p.timer = time.AfterFunc(TCPConnectTimeout, func() {
+		if l.removePending(p) {
+			l.log.Debugf("connection id %d to peer %s expired", p.id, p.peer)
+			p.conn.Close()
+			a.removePeer(p.peer)
+		}
+	})
+	l.pending[id] = p
+
+	return id, true
+}
+
+// removePending removes a pending peer connection, returns false if the connection has already
+// been removed.
+func (l *TCPRelayListener) removePending(p *tcpPendingConn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.pending[p.id]; !ok {
+		return false
+	}
+	p.timer.Stop()
+	delete(l.pending, p.id)
+
+	return true
+}
+
+// tcpPendingConn is a peer connection waiting to be bound by the client.
+type tcpPendingConn struct {
+	id      connectionID
+	alloc   *tcpAllocation
+	conn    net.Conn
+	peer    *net.TCPAddr
+	cluster *object.Cluster
+	timer   *time.Timer
+}
+
+// tcpControlConn is a client connection handed to the TURN server that intercepts the requests
+// related to TCP allocations.
+type tcpControlConn struct {
+	net.Conn
+	listener *TCPRelayListener
+	framer   *turnFramer
+	rbuf     []byte
+	alloc    *tcpAllocation
+	lastTx   [stun.TransactionIDSize]byte
+	lastRes  []byte
+	inflight map[[stun.TransactionIDSize]byte]bool
+	lock     sync.Mutex // protects alloc and the transaction cache
+	wlock    sync.Mutex // serializes writes
+}
+
+// Read reads the next TURN frame that is to be handled by the TURN server.
+func (c *tcpControlConn) Read(p []byte) (int, error) {
+	for len(c.rbuf) == 0 {
+		frame, err := c.framer.next()
+		if err != nil {
+			return 0, err
+		}
+
+		c.listener.interceptor.accessToken(frame, c.RemoteAddr())
+		c.listener.interceptor.sharedSecret(frame, c.RemoteAddr())
+		c.listener.interceptor.authRequest(frame, c.RemoteAddr())
+		if !c.handle(frame) {
+			if req, ok := c.listener.interceptor.refresh(frame, c.RemoteAddr()); ok {
+				frame = req
+			}
+			c.rbuf = frame
+		}
+	}
+
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+
+	return n, nil
+}
+
+// Write writes to the client.
+func (c *tcpControlConn) Write(p []byte) (int, error) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if _, err := c.Conn.Write(c.listener.interceptor.response(p, c.RemoteAddr())); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the connection and the TCP allocation of the client.
+func (c *tcpControlConn) Close() error {
+	c.listener.untrack(c)
+
+	c.lock.Lock()
+	a := c.alloc
+	c.alloc = nil
+	c.lock.Unlock()
+
+	if a != nil {
+		a.close()
+	}
+
+	return c.Conn.Close()
+}
+
+// send sends a response and caches it to answer retransmitted requests.
+func (c *tcpControlConn) send(raw []byte) {
+	var tx [stun.TransactionIDSize]byte
+	copy(tx[:], raw[8:stunHeaderSize])
+
+	c.lock.Lock()
+	c.lastTx, c.lastRes = tx, raw
+	delete(c.inflight, tx)
+	c.lock.Unlock()
+
+	c.Write(raw) //nolint:errcheck
+}
+
+func (c *tcpControlConn) getAlloc() *tcpAllocation {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.alloc != nil && c.alloc.isClosed() {
+		c.alloc = nil
+	}
+	return c.alloc
+}
+
+// handle processes a TURN frame, returns true if the frame was consumed and should not be passed
+// to the TURN server.
+func (c *tcpControlConn) handle(frame []byte) bool {
+	alloc := c.getAlloc()
+
+	if !stun.IsMessage(frame) {
+		// ChannelData: no channels on TCP allocations
+		return alloc != nil
+	}
+
+	m := &stun.Message{Raw: frame}
+	if err := m.Decode(); err != nil {
+		return false
+	}
+
+	if m.Type.Class != stun.ClassRequest {
+		// Send indications are not allowed on TCP allocations
+		return alloc != nil && m.Type.Method == stun.MethodSend
+	}
+
+	// answer retransmitted requests from the cache
+	c.lock.Lock()
+	if c.inflight[m.TransactionID] {
+		c.lock.Unlock()
+		return true
+	}
+	if c.lastRes != nil && c.lastTx == m.TransactionID {
+		res := c.lastRes
+		c.lock.Unlock()
+		c.Write(res) //nolint:errcheck
+		return true
+	}
+	c.lock.Unlock()
+
+	l := c.listener
+	switch m.Type.Method {
+	case stun.MethodAllocate:
+		if alloc != nil {
+			l.sendError(m, nil, c.send, stun.CodeAllocMismatch)
+			return true
+		}
+		if proto, err := getRequestedTransport(m); err != nil || proto != protoTCP {
+			// UDP allocations are handled by the TURN server
+			if res := l.interceptor.request(frame, c.RemoteAddr()); res != nil {
+				c.send(res)
+				return true
+			}
+			return false
+		}
+		c.handleAllocate(m)
+
+	case stun.MethodRefresh:
+		if alloc == nil {
+			return false
+		}
+		c.handleRefresh(m, alloc)
+
+	case stun.MethodCreatePermission:
+		if alloc == nil {
+			return false
+		}
+		c.handleCreatePermission(m, alloc)
+
+	case stun.MethodChannelBind:
+		if alloc == nil {
+			return false
+		}
+		l.sendError(m, nil, c.send, stun.CodeBadRequest)
+
+	case stun.MethodConnect:
+		if alloc == nil {
+			l.sendError(m, nil, c.send, stun.CodeAllocMismatch)
+			return true
+		}
+		c.handleConnect(m, alloc)
+
+	case stun.MethodConnectionBind:
+		// must be sent on a new connection
+		l.sendError(m, nil, c.send, stun.CodeBadRequest)
+
+	default:
+		return false
+	}
+
+	return true
+}
+
+func (c *tcpControlConn) handleAllocate(m *stun.Message) {
+	l := c.listener
+	username, key, ok := l.authenticate(m, c.RemoteAddr(), c.send)
+	if !ok {
+		return
+	}
+
+	if m.Contains(stun.AttrDontFragment) || m.Contains(stun.AttrEvenPort) ||
+		m.Contains(stun.AttrReservationToken) {
+		l.sendError(m, key, c.send, stun.CodeBadRequest)
+		return
+	}
+
+	family, err := getRequestedAddressFamily(m, c.RemoteAddr())
+	if err != nil {
+		l.sendError(m, key, c.send, stun.CodeBadRequest)
+		return
+	}
+	relayIP := l.Relay.relayIP(family)
+	if relayIP == nil {
+		l.log.Debugf("rejecting TCP allocation request from client %s: address family %s "+
+			"not supported", c.RemoteAddr(), family)
+		l.sendError(m, key, c.send, stun.CodeAddrFamilyNotSupported)
+		return
+	}
+
+	if l.Relay.drain.draining() {
+		l.log.Debugf("rejecting TCP allocation request from client %s: draining",
+			c.RemoteAddr())
+		l.sendError(m, key, c.send, stun.CodeInsufficientCapacity)
+		return
+	}
+
+	lt := requestedLifetime(m)
+	if lt == 0 {
+		lt = defaultAllocationLifetime
+	}
+
+	relayListener, addr, err := l.Relay.AllocateListener("tcp4", 0)
+	if err != nil {
+		l.log.Infof("cannot allocate TCP relay for client %s: %s", c.RemoteAddr(),
+			err.Error())
+		l.sendError(m, key, c.send, stun.CodeInsufficientCapacity)
+		return
+	}
+	relayAddr := addr.(*net.TCPAddr)
+	relayAddr.IP = relayIP
+
+	// the quotas are reserved along with the relay and released when the relay is closed
+	if code, ok := l.Relay.addAllocation("tcp", username, c.RemoteAddr(), relayAddr); !ok {
+		relayListener.Close()
+		l.sendError(m, key, c.send, code)
+		return
+	}
+
+	a := &tcpAllocation{
+		control:     c,
+		username:    username,
+		listener:    relayListener,
+		relayAddr:   relayAddr,
+		checker:     l.Relay.portRangeChecker(username),
+		permissions: map[string]time.Time{},
+		peers:       map[string]bool{},
+		dataConns:   map[net.Conn]bool{},
+	}
+	a.rxLimit, a.txLimit = l.Relay.newRelayLimiters()
+	a.stats = l.Relay.allocs.addRelay(l.Relay.Listener.Name, "tcp", relayAddr.Port, a.close)
+
+	a.timer = time.AfterFunc(lt, func() {
+		l.log.Debugf("TCP allocation %s expired", a.relayAddr)
+		a.close()
+	})
+
+	l.lock.Lock()
+	if l.closed {
+		l.lock.Unlock()
+		a.timer.Stop()
+		relayListener.Close()
+		l.sendError(m, key, c.send, stun.CodeInsufficientCapacity)
+		return
+	}
+	l.allocs[a] = true
+	l.lock.Unlock()
+
+	c.lock.Lock()
+	c.alloc = a
+	c.lock.Unlock()
+
+	l.wg.Add(1)
+	go a.acceptLoop()
+
+	l.log.Infof("TCP allocation created: client %s, user %q, relay address %s",
+		c.RemoteAddr(), username, relayAddr)
+
+	l.sendResponse(m, key, stun.ClassSuccessResponse, c.send,
+		xorAddress{attr: stun.AttrXORRelayedAddress, addr: relayAddr},
+		lifetime(lt),
+		xorAddress{attr: stun.AttrXORMappedAddress, addr: c.RemoteAddr()})
+}
+
+func (c *tcpControlConn) handleRefresh(m *stun.Message, a *tcpAllocation) {
+	l := c.listener
+	username, key, ok := l.authenticate(m, c.RemoteAddr(), c.send)
+	if !ok {
+		return
+	}
+	if username != a.username {
+		l.sendError(m, key, c.send, stun.CodeWrongCredentials)
+		return
+	}
+
+	lt := defaultAllocationLifetime
+	if m.Contains(stun.AttrLifetime) {
+		lt = requestedLifetime(m)
+	}
+
+	lt = l.Relay.drain.capLifetime(lt)
+
+	if lt == 0 {
+		c.lock.Lock()
+		c.alloc = nil
+		c.lock.Unlock()
+		a.close()
+	} else {
+		a.refresh(lt)
+		l.Relay.traceRefresh(c.RemoteAddr(), lt)
+	}
+
+	l.sendResponse(m, key, stun.ClassSuccessResponse, c.send, lifetime(lt))
+}
+
+func (c *tcpControlConn) handleCreatePermission(m *stun.Message, a *tcpAllocation) {
+	l := c.listener
+	username, key, ok := l.authenticate(m, c.RemoteAddr(), c.send)
+	if !ok {
+		return
+	}
+	if username != a.username {
+		l.sendError(m, key, c.send, stun.CodeWrongCredentials)
+		return
+	}
+
+	peers := getXORAddresses(m, stun.AttrXORPeerAddress)
+	if len(peers) == 0 {
+		l.sendError(m, key, c.send, stun.CodeBadRequest)
+		return
+	}
+
+	for _, p := range peers {
+		if getAddrFamily(&net.TCPAddr{IP: p.IP}) != getAddrFamily(a.relayAddr) {
+			l.sendError(m, key, c.send, stun.CodePeerAddrFamilyMismatch)
+			return
+		}
+		if !l.permissionHandler(c.RemoteAddr(), p.IP) {
+			l.sendError(m, key, c.send, stun.CodeForbidden)
+			return
+		}
+	}
+
+	for _, p := range peers {
+		a.addPermission(p.IP)
+	}
+
+	l.sendResponse(m, key, stun.ClassSuccessResponse, c.send)
+}
+
+func (c *tcpControlConn) handleConnect(m *stun.Message, a *tcpAllocation) {
+	l := c.listener
+	username, key, ok := l.authenticate(m, c.RemoteAddr(), c.send)
+	if !ok {
+		return
+	}
+	if username != a.username {
+		l.sendError(m, key, c.send, stun.CodeWrongCredentials)
+		return
+	}
+
+	peers := getXORAddresses(m, stun.AttrXORPeerAddress)
+	if len(peers) != 1 {
+		l.sendError(m, key, c.send, stun.CodeBadRequest)
+		return
+	}
+	peer := &net.TCPAddr{IP: peers[0].IP, Port: peers[0].Port}
+
+	if getAddrFamily(peer) != getAddrFamily(a.relayAddr) {
+		l.sendError(m, key, c.send, stun.CodePeerAddrFamilyMismatch)
+		return
+	}
+
+	if !a.hasPermission(peer.IP) {
+		l.log.Debugf("connect: no permission for peer %s on TCP allocation %s", peer,
+			a.relayAddr)
+		l.sendError(m, key, c.send, stun.CodeForbidden)
+		return
+	}
+
+	cluster, ok := a.checker(peer)
+	if !ok {
+		l.log.Debugf("connect: peer %s administratively prohibited on TCP allocation %s",
+			peer, a.relayAddr)
+		l.sendError(m, key, c.send, stun.CodeForbidden)
+		return
+	}
+
+	if !a.addPeer(peer) {
+		l.sendError(m, key, c.send, stun.CodeConnAlreadyExists)
+		return
+	}
+
+	c.lock.Lock()
+	c.inflight[m.TransactionID] = true
+	c.lock.Unlock()
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		dialer := &net.Dialer{
+			LocalAddr: a.listener.Addr(),
+			Control:   reuseAddrPort,
+			Timeout:   TCPConnectTimeout,
+		}
+		conn, err := dialer.DialContext(l.ctx, "tcp", peer.String())
+		if err != nil {
+			l.log.Debugf("connect: cannot connect to peer %s from TCP allocation %s: %s",
+				peer, a.relayAddr, err.Error())
+			a.removePeer(peer)
+			l.sendError(m, key, c.send, stun.CodeConnTimeoutOrFailure)
+			return
+		}
+
+		id, ok := l.addPending(a, conn, peer, cluster)
+		if !ok || a.isClosed() {
+			conn.Close()
+			a.removePeer(peer)
+			l.sendError(m, key, c.send, stun.CodeConnTimeoutOrFailure)
+			return
+		}
+
+		l.log.Debugf("connect: connected to peer %s from TCP allocation %s, connection id %d",
+			peer, a.relayAddr, id)
+
+		l.sendResponse(m, key, stun.ClassSuccessResponse, c.send, id)
+	}()
+}
+
+// requestedLifetime returns the lifetime requested by the client, capped at the maximum
+// allocation lifetime.
+func requestedLifetime(m *stun.Message) time.Duration {
+	lt, err := getLifetime(m)
+	if err != nil {
+		return 0
+	}
+	if lt > maxAllocationLifetime {
+		lt = maxAllocationLifetime
+	}
+	return lt
+}
+
+// tcpAllocation is an RFC 6062 TCP relay allocation.
+type tcpAllocation struct {
+	control     *tcpControlConn
+	username    string
+	listener    net.Listener
+	relayAddr   *net.TCPAddr
+	checker     PortRangeChecker
+	permissions map[string]time.Time
+	peers       map[string]bool
+	dataConns   map[net.Conn]bool
+	rxLimit     *relayLimiter
+	txLimit     *relayLimiter
+	stats       *allocationStats
+	timer       *time.Timer
+	closed      bool
+	lock        sync.Mutex
+}
+
+func (a *tcpAllocation) isClosed() bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.closed
+}
+
+func (a *tcpAllocation) refresh(lt time.Duration) {
+	a.timer.Reset(lt)
+}
+
+func (a *tcpAllocation) addPermission(ip net.IP) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.permissions[ip.String()] = time.Now().Add(permissionLifetime)
+}
+
+func (a *tcpAllocation) hasPermission(ip net.IP) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	exp, ok := a.permissions[ip.String()]
+	return ok && time.Now().Before(exp)
+}
+
+// addPeer registers a connection to a peer, returns false if a connection already exists.
+func (a *tcpAllocation) addPeer(peer *net.TCPAddr) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed || a.peers[peer.String()] {
+		return false
+	}
+	a.peers[peer.String()] = true
+	return true
+}
+
+func (a *tcpAllocation) removePeer(peer *net.TCPAddr) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.peers, peer.String())
+}
+
+// acceptLoop accepts connections from peers to the relayed transport address.
+func (a *tcpAllocation) acceptLoop() {
+	l := a.control.listener
+	defer l.wg.Done()
+
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		peer, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !a.hasPermission(peer.IP) {
+			conn.Close()
+			continue
+		}
+
+		cluster, ok := a.checker(peer)
+		if !ok {
+			l.log.Debugf("peer %s administratively prohibited on TCP allocation %s",
+				peer, a.relayAddr)
+			conn.Close()
+			continue
+		}
+
+		if !a.addPeer(peer) {
+			conn.Close()
+			continue
+		}
+
+		id, ok := l.addPending(a, conn, peer, cluster)
+		if !ok {
+			conn.Close()
+			a.removePeer(peer)
+			continue
+		}
+
+		msg, err := stun.Build(stun.TransactionID,
+			stun.NewType(stun.MethodConnectionAttempt, stun.ClassIndication),
+			xorAddress{attr: stun.AttrXORPeerAddress, addr: peer}, id, stun.Fingerprint)
+		if err != nil {
+			continue
+		}
+
+		l.log.Debugf("peer %s connected to TCP allocation %s, connection id %d", peer,
+			a.relayAddr, id)
+
+		a.control.Write(msg.Raw) //nolint:errcheck
+	}
+}
+
+// splice relays data between a client data connection and a peer connection.
+func (a *tcpAllocation) splice(conn net.Conn, buffered []byte, p *tcpPendingConn) {
+	l := a.control.listener
+	peer := telemetry.NewConn(p.conn, p.cluster.Name, telemetry.ClusterType)
+
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		conn.Close()
+		peer.Close()
+		return
+	}
+	a.dataConns[conn] = true
+	a.dataConns[peer] = true
+	a.lock.Unlock()
+
+	listener, cluster := l.Relay.Listener.Name, p.cluster.Name
+	countTx := func(n int) {
+		a.stats.tx(n)
+		telemetry.IncrementRoute(listener, cluster, telemetry.Outgoing, n)
+	}
+	countRx := func(n int) {
+		a.stats.rx(n)
+		telemetry.IncrementRoute(listener, cluster, telemetry.Incoming, n)
+	}
+
+	closeAll := func() {
+		conn.Close()
+		peer.Close()
+
+		a.lock.Lock()
+		delete(a.dataConns, conn)
+		delete(a.dataConns, peer)
+		delete(a.peers, p.peer.String())
+		a.lock.Unlock()
+	}
+
+	if len(buffered) > 0 {
+		if _, err := peer.Write(buffered); err != nil {
+			l.log.Debugf("cannot write to peer %s from TCP allocation %s: %s", p.peer,
+				a.relayAddr, err.Error())
+			closeAll()
+			return
+		}
+		countTx(len(buffered))
+	}
+
+	// TCP relays are shaped by delaying reads
+	tx := &limitedReader{r: conn, limiter: a.txLimit, cluster: p.cluster, ctx: l.ctx,
+		count: countTx}
+	rx := &limitedReader{r: peer, limiter: a.rxLimit, cluster: p.cluster, ctx: l.ctx,
+		count: countRx}
+
+	l.wg.Add(2)
+	go func() {
+		defer l.wg.Done()
+		io.Copy(peer, tx) //nolint:errcheck
+		closeAll()
+	}()
+	go func() {
+		defer l.wg.Done()
+		io.Copy(conn, rx) //nolint:errcheck
+		closeAll()
+	}()
+}
+
+// close deletes the allocation, closing the relay listener and all peer connections.
+func (a *tcpAllocation) close() {
+	a.lock.Lock()
+	if a.closed {
+		a.lock.Unlock()
+		return
+	}
+	a.closed = true
+	conns := make([]net.Conn, 0, len(a.dataConns))
+	for c := range a.dataConns {
+		conns = append(conns, c)
+	}
+	a.lock.Unlock()
+
+	l := a.control.listener
+	l.log.Infof("TCP allocation deleted: client %s, user %q, relay address %s",
+		a.control.RemoteAddr(), a.username, a.relayAddr)
+
+	a.timer.Stop()
+	a.listener.Close()
+	for _, c := range conns {
+		c.Close()
+	}
+
+	l.lock.Lock()
+	delete(l.allocs, a)
+	pending := []*tcpPendingConn{}
+	for _, p := range l.pending {
+		if p.alloc == a {
+			pending = append(pending, p)
+		}
+	}
+	l.lock.Unlock()
+
+	for _, p := range pending {
+		if l.removePending(p) {
+			p.conn.Close()
+		}
+	}
+}
@@ -1,12 +1,16 @@
 package stunner
 
 import (
+	"errors"
 	"net"
 	"testing"
 	"time"
 
+	"github.com/pion/stun/v3"
+	"github.com/pion/transport/v3/stdnet"
 	"github.com/pion/transport/v3/test"
 	"github.com/pion/transport/v3/vnet"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/l7mp/stunner/internal/object"
@@ -212,6 +216,241 @@ func BenchmarkPortRangePacketConn(b *testing.B) {
 	}
 }
 
+func TestRelayGenAddress(t *testing.T) {
+	telemetry.Init()
+	defer telemetry.Close()
+
+	loggerFactory := logger.NewLoggerFactory(connTestLoglevel)
+	stdnet, err := stdnet.NewNet()
+	assert.NoError(t, err, "stdnet")
+
+	for _, tc := range []struct {
+		addr, address, network string
+		relay, relay6          net.IP
+	}{
+		{"0.0.0.0", "0.0.0.0", "udp4", net.IPv4zero, nil},
+		{"127.0.0.1", "127.0.0.1", "udp4", net.ParseIP("127.0.0.1"), nil},
+		{"::", "::", "udp", net.IPv4zero, net.IPv6unspecified},
+		{"::1", "::1", "udp6", nil, net.IPv6loopback},
+	} {
+		l := &object.Listener{Name: "test", Addr: net.ParseIP(tc.addr), Net: stdnet}
+		r := NewRelayGen(l, loggerFactory)
+		assert.Equal(t, tc.address, r.Address, "relay bind address for listener %s", tc.addr)
+		assert.Equal(t, tc.network, r.relayNetwork("udp4", "udp"), "relay network for "+
+			"listener %s", tc.addr)
+		assert.True(t, tc.relay.Equal(r.RelayAddress), "IPv4 relay address for listener %s",
+			tc.addr)
+		assert.True(t, tc.relay6.Equal(r.RelayAddress6), "IPv6 relay address for listener %s",
+			tc.addr)
+	}
+
+	// relays are bound to the address of the listener
+	r := NewRelayGen(&object.Listener{Name: "test", Addr: net.ParseIP("127.0.0.1"), Net: stdnet},
+		loggerFactory)
+	conn, addr, err := r.AllocatePacketConn("udp4", 0)
+	assert.NoError(t, err, "allocate relay")
+	assert.Equal(t, "127.0.0.1", conn.LocalAddr().(*net.UDPAddr).IP.String(), "relay bound to "+
+		"listener address")
+	assert.Equal(t, "127.0.0.1", addr.(*net.UDPAddr).IP.String(), "relay address")
+	assert.NoError(t, conn.Close(), "close relay")
+}
+
+func TestRelayGenPorts(t *testing.T) {
+	telemetry.Init()
+	defer telemetry.Close()
+
+	loggerFactory := logger.NewLoggerFactory(connTestLoglevel)
+	stdnet, err := stdnet.NewNet()
+	assert.NoError(t, err, "stdnet")
+
+	// UDP and TCP relays on the same port number are tracked separately
+	r := NewRelayGen(&object.Listener{Name: "test", Addr: net.ParseIP("127.0.0.1"), Net: stdnet},
+		loggerFactory)
+	conn, addr, err := r.AllocatePacketConn("udp4", 0)
+	assert.NoError(t, err, "allocate UDP relay")
+	port := addr.(*net.UDPAddr).Port
+	l, addr, err := r.AllocateListener("tcp4", port)
+	assert.NoError(t, err, "allocate TCP relay")
+	assert.Equal(t, port, addr.(*net.TCPAddr).Port, "TCP relay port")
+	assert.Equal(t, 2, r.PortsInUse(), "ports in use")
+
+	assert.NoError(t, l.Close(), "close TCP relay")
+	assert.Equal(t, 1, r.PortsInUse(), "ports in use")
+	r.portLock.Lock()
+	_, ok := r.udpRelays[port]
+	r.portLock.Unlock()
+	assert.True(t, ok, "UDP relay kept")
+
+	assert.NoError(t, conn.Close(), "close UDP relay")
+	assert.Equal(t, 0, r.PortsInUse(), "ports in use")
+}
+
+func TestRelayGenPortsGauge(t *testing.T) {
+	telemetry.Init()
+	defer telemetry.Close()
+
+	loggerFactory := logger.NewLoggerFactory(connTestLoglevel)
+	stdnet, err := stdnet.NewNet()
+	assert.NoError(t, err, "stdnet")
+
+	// relay ports chosen by the kernel are accounted for without a port range
+	r := NewRelayGen(&object.Listener{Name: "test", Addr: net.ParseIP("127.0.0.1"), Net: stdnet},
+		loggerFactory)
+	gauge := func() float64 {
+		return testutil.ToFloat64(telemetry.ListenerRelayPortsActive.WithLabelValues("test"))
+	}
+	conn1, addr, err := r.AllocatePacketConn("udp4", 0)
+	assert.NoError(t, err, "allocate UDP relay")
+	port := addr.(*net.UDPAddr).Port
+	conn2, _, err := r.AllocatePacketConn("udp4", 0)
+	assert.NoError(t, err, "allocate UDP relay")
+	l, _, err := r.AllocateListener("tcp4", 0)
+	assert.NoError(t, err, "allocate TCP relay")
+	assert.Equal(t, 3, r.PortsInUse(), "ports in use")
+	assert.Equal(t, 3.0, gauge(), "relay ports gauge")
+
+	// a relay on a port that is still accounted for is closed
+	assert.NoError(t, conn1.Close(), "close UDP relay")
+	assert.True(t, r.reservePort("udp", port), "reserve port")
+	_, _, err = r.AllocatePacketConn("udp4", port)
+	assert.ErrorIs(t, err, errRelayPortInUse, "port in use")
+	assert.Equal(t, 3, r.PortsInUse(), "ports in use")
+	assert.Equal(t, 3.0, gauge(), "relay ports gauge")
+	r.releasePort("udp", port)
+	conn1, _, err = r.AllocatePacketConn("udp4", port)
+	assert.NoError(t, err, "relay socket closed")
+
+	assert.NoError(t, conn1.Close(), "close UDP relay")
+	assert.NoError(t, conn2.Close(), "close UDP relay")
+	assert.NoError(t, l.Close(), "close TCP relay")
+	assert.Equal(t, 0, r.PortsInUse(), "ports in use")
+	assert.Equal(t, 0.0, gauge(), "relay ports gauge")
+}
+
+func TestRelayGenAllocatePort(t *testing.T) {
+	telemetry.Init()
+	defer telemetry.Close()
+
+	loggerFactory := logger.NewLoggerFactory(connTestLoglevel)
+	fail := errors.New("port in use")
+	failAll := func(int) bool { return true }
+
+	for _, tc := range []struct {
+		name                  string
+		minPort, maxPort      int
+		requested             int
+		reserved, reservedTCP []int
+		failing               func(port int) bool
+		port, attempts        int
+		err                   error
+	}{
+		{name: "requested port", minPort: 10000, maxPort: 10009, requested: 10005,
+			port: 10005, attempts: 1},
+		{name: "retry on the next port", minPort: 10000, maxPort: 10009, requested: 10005,
+			failing: func(p int) bool { return p == 10005 }, port: 10006, attempts: 2},
+		{name: "wrap around", minPort: 10000, maxPort: 10009, requested: 10009,
+			failing: func(p int) bool { return p == 10009 }, port: 10000, attempts: 2},
+		{name: "reserved ports are skipped", minPort: 10000, maxPort: 10009, requested: 10005,
+			reserved: []int{10005, 10006}, port: 10007, attempts: 1},
+		{name: "ports of the other transport are not skipped", minPort: 10000, maxPort: 10009,
+			requested: 10005, reservedTCP: []int{10005}, port: 10005, attempts: 1},
+		{name: "small range exhausted", minPort: 10000, maxPort: 10009, requested: 10005,
+			failing: failAll, attempts: 10, err: ErrRelayPortsExhausted},
+		{name: "range fully reserved", minPort: 10000, maxPort: 10001, requested: 10000,
+			reserved: []int{10000, 10001}, attempts: 0, err: ErrRelayPortsExhausted},
+		{name: "retries are bounded", minPort: 10000, maxPort: 10999, requested: 10000,
+			failing: failAll, attempts: maxRelayPortRetries, err: ErrRelayPortsExhausted},
+		{name: "no port range", minPort: 0, maxPort: 0, requested: 0, port: 12345,
+			attempts: 1},
+		{name: "no port range: kernel-chosen port in use", minPort: 0, maxPort: 0,
+			requested: 0, reserved: []int{12345}, attempts: 1, err: errRelayPortInUse},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewRelayGen(&object.Listener{Name: "test", Addr: net.ParseIP("127.0.0.1"),
+				MinPort: tc.minPort, MaxPort: tc.maxPort}, loggerFactory)
+			for _, p := range tc.reserved {
+				assert.True(t, r.reservePort("udp", p), "reserve port")
+			}
+			for _, p := range tc.reservedTCP {
+				assert.True(t, r.reservePort("tcp", p), "reserve port")
+			}
+			inUse := r.PortsInUse()
+
+			attempts := 0
+			port, err := r.allocatePort("udp", tc.requested, func(p int) (int, error) {
+				attempts++
+				if tc.failing != nil && tc.failing(p) {
+					return 0, fail
+				}
+				if p == 0 {
+					// the kernel chooses the port
+					return 12345, nil
+				}
+				return p, nil
+			})
+
+			assert.Equal(t, tc.attempts, attempts, "attempts")
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err, "error")
+				assert.Equal(t, inUse, r.PortsInUse(), "failed ports released")
+				return
+			}
+			assert.NoError(t, err, "allocate port")
+			assert.Equal(t, tc.port, port, "port")
+			assert.Equal(t, inUse+1, r.PortsInUse(), "port reserved")
+			assert.False(t, r.reservePort("udp", port), "port reserved")
+		})
+	}
+}
+
+func TestAllocInterceptorUnknownTransaction(t *testing.T) {
+	telemetry.Init()
+	defer telemetry.Close()
+
+	loggerFactory := logger.NewLoggerFactory(connTestLoglevel)
+	stdnet, err := stdnet.NewNet()
+	assert.NoError(t, err, "stdnet")
+
+	r := NewRelayGen(&object.Listener{Name: "test", Addr: net.ParseIP("127.0.0.1"), Net: stdnet},
+		loggerFactory)
+	r.allocs = newAllocationTable(nil, nil)
+	i := newAllocInterceptor(r, nil, loggerFactory.NewLogger("test"))
+
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	relay := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5000}
+	closed := false
+	r.allocs.addRelay("test", "udp", relay.Port, func() { closed = true })
+
+	response := func() *stun.Message {
+		res, err := stun.Build(stun.TransactionID,
+			stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse))
+		assert.NoError(t, err, "build response")
+		assert.NoError(t, (&stun.XORMappedAddress{IP: relay.IP, Port: relay.Port}).AddToAs(res,
+			stun.AttrXORRelayedAddress), "relayed address")
+		m := &stun.Message{Raw: i.response(res.Raw, client)}
+		assert.NoError(t, m.Decode(), "decode response")
+		return m
+	}
+
+	// allocations that cannot be accounted for are deleted
+	m := response()
+	assert.Equal(t, stun.ClassErrorResponse, m.Type.Class, "error response")
+	var code stun.ErrorCodeAttribute
+	assert.NoError(t, code.GetFrom(m), "error code")
+	assert.Equal(t, stun.CodeServerError, code.Code, "server error")
+	assert.True(t, closed, "relay closed")
+	assert.Equal(t, 0, r.allocs.count("test"), "no allocation")
+
+	// responses to registered allocations pass
+	closed = false
+	_, ok := r.addAllocation("udp", "user1", client, relay)
+	assert.True(t, ok, "allocation admitted")
+	m = response()
+	assert.Equal(t, stun.ClassSuccessResponse, m.Type.Class, "success response")
+	assert.False(t, closed, "relay open")
+	assert.Equal(t, 1, r.allocs.count("test"), "allocation registered")
+}
+
 // CounterPacketConn is a net.PacketConn that filters on the target port range.
 type CounterPacketConn struct {
 	net.PacketConn
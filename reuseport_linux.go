@@ -0,0 +1,26 @@
+//go:build linux
+
+package stunner
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reuseAddrPort sets both SO_REUSEADDR and SO_REUSEPORT on a socket, which is needed to open
+// outgoing TCP connections from the address of a listening TCP relay.
+func reuseAddrPort(network, address string, conn syscall.RawConn) error {
+	var operr error
+	if err := conn.Control(func(fd uintptr) {
+		if operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_REUSEADDR, 1); operr != nil {
+			return
+		}
+		operr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+
+	return operr
+}
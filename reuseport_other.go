@@ -0,0 +1,10 @@
+//go:build !linux
+
+package stunner
+
+import "syscall"
+
+// reuseAddrPort falls back to SO_REUSEADDR on platforms where we do not support SO_REUSEPORT.
+func reuseAddrPort(network, address string, conn syscall.RawConn) error {
+	return reuseAddr(network, address, conn)
+}
@@ -0,0 +1,135 @@
+package stunner
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun/v3"
+
+	"github.com/l7mp/stunner/internal/object"
+	a12n "github.com/l7mp/stunner/pkg/authentication"
+)
+
+// sharedSecretMatchTimeout is the time we remember the shared secret that verified the last request
+// of a client.
+const sharedSecretMatchTimeout = time.Minute
+
+// sharedSecretMatch is the version of the shared secret that verified a request.
+type sharedSecretMatch struct {
+	version string
+	created time.Time
+}
+
+// sharedSecretTable finds the shared secret that was used to issue the ephemeral credential of a
+// client when multiple shared secrets are accepted during a secret rotation. The auth handler
+// receives only the username and cannot try the secrets one by one, so the requests are checked
+// against each accepted secret before they are passed to the TURN server and the version of the
+// secret whose key verifies the MESSAGE-INTEGRITY is stored for the auth handler, indexed by the
+// transport address of the client and the username.
+type sharedSecretTable struct {
+	auth    func() *object.Auth
+	matches map[string]sharedSecretMatch
+	lastGC  time.Time
+	lock    sync.Mutex
+}
+
+func newSharedSecretTable(auth func() *object.Auth) *sharedSecretTable {
+	return &sharedSecretTable{
+		auth:    auth,
+		matches: map[string]sharedSecretMatch{},
+		lastGC:  time.Now(),
+	}
+}
+
+func sharedSecretKey(addr net.Addr, username string) string {
+	return addr.Network() + "/" + addr.String() + "/" + username
+}
+
+// match checks an authenticated request against the accepted shared secrets and stores the version
+// of the secret that verifies the request. Does nothing unless more than one secret is accepted.
+// The shared secrets are a snapshot taken at reconciliation, only set in the ephemeral mode.
+func (t *sharedSecretTable) match(p []byte, src net.Addr) {
+	auth := t.auth()
+	if auth == nil {
+		return
+	}
+
+	now := time.Now()
+	secrets := auth.GetSharedSecrets(now)
+	if len(secrets) < 2 {
+		return
+	}
+
+	// work on a copy: checking the MESSAGE-INTEGRITY temporarily rewrites the message
+	m := &stun.Message{Raw: append([]byte{}, p...)}
+	if err := m.Decode(); err != nil || m.Type.Class != stun.ClassRequest ||
+		!m.Contains(stun.AttrMessageIntegrity) {
+		return
+	}
+
+	username, err := m.Get(stun.AttrUsername)
+	if err != nil {
+		return
+	}
+
+	k := sharedSecretKey(src, string(username))
+	for _, s := range secrets {
+		password, err := a12n.GetLongTermCredentialWithAlgorithm(string(username), s.Secret,
+			s.Algorithm)
+		if err != nil {
+			continue
+		}
+
+		key := a12n.GenerateAuthKey(string(username), auth.Realm, password)
+		if err := stun.MessageIntegrity(key).Check(m); err != nil {
+			continue
+		}
+
+		t.lock.Lock()
+		defer t.lock.Unlock()
+
+		if now.Sub(t.lastGC) > sharedSecretMatchTimeout {
+			for k, e := range t.matches {
+				if now.Sub(e.created) > sharedSecretMatchTimeout {
+					delete(t.matches, k)
+				}
+			}
+			t.lastGC = now
+		}
+
+		t.matches[k] = sharedSecretMatch{version: s.Version, created: now}
+		return
+	}
+
+	t.lock.Lock()
+	delete(t.matches, k)
+	t.lock.Unlock()
+}
+
+// get returns the shared secret for a client: the secret that verified the last request of the
+// client if it is still accepted, or the active secret otherwise. Returns false if no secret is
+// accepted.
+func (t *sharedSecretTable) get(src net.Addr, username string) (object.SharedSecret, bool) {
+	now := time.Now()
+	secrets := t.auth().GetSharedSecrets(now)
+	if len(secrets) == 0 {
+		return object.SharedSecret{}, false
+	}
+
+	if src != nil && len(secrets) > 1 {
+		t.lock.Lock()
+		e, ok := t.matches[sharedSecretKey(src, username)]
+		t.lock.Unlock()
+
+		if ok && now.Sub(e.created) <= sharedSecretMatchTimeout {
+			for _, s := range secrets {
+				if s.Version == e.version {
+					return s, true
+				}
+			}
+		}
+	}
+
+	return secrets[0], true
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/pion/dtls/v3"
 	"github.com/pion/turn/v4"
@@ -33,13 +34,38 @@ func (s *Stunner) StartServer(l *object.Listener) error {
 
 	relay := NewRelayGen(l, s.logger)
 	relay.PortRangeChecker = s.GenPortRangeChecker(relay)
-
+	relay.userChecker = func(username string) PortRangeChecker {
+		return s.genPortRangeChecker(relay, username)
+	}
+	relay.allocs = s.allocs
+	relay.drain = s.drain
+	relay.tokens = s.accessTokens
+	relay.secrets = s.sharedSecrets
+	relay.lockout = s.authLockout
+	// the kernel does not detect port clashes between the TCP relays of different listeners
+	relay.tcpPorts = s.tcpRelayPorts
+	telemetry.SetRelayPortCapacity(l.Name, relay.PortsTotal())
+
+	authHandler := s.newAuthHandler(l)
 	permissionHandler := s.NewPermissionHandler(l)
+	if !l.Proto.IsTURN() {
+		// STUN-only listeners answer Binding requests and reject everything else
+		authHandler = s.NewSTUNAuthHandler(l)
+		permissionHandler = func(net.Addr, net.IP) bool { return false }
+	}
+
+	// intercept Allocate and Refresh requests on TURN listeners to handle address family
+	// selection, allocation quotas and draining
+	var interceptor *allocInterceptor
+	if l.Proto.IsTURN() {
+		interceptor = newAllocInterceptor(relay, authHandler,
+			s.logger.NewLogger(fmt.Sprintf("relay-%s", l.Name)))
+	}
 
-	addr := fmt.Sprintf("0.0.0.0:%d", l.Port)
+	addr := net.JoinHostPort(l.Addr.String(), strconv.Itoa(l.Port))
 
 	switch l.Proto {
-	case stnrv1.ListenerProtocolTURNUDP:
+	case stnrv1.ListenerProtocolTURNUDP, stnrv1.ListenerProtocolUDP:
 		socketPool := util.NewPacketConnPool(l.Name, l.Net, s.udpThreadNum)
 
 		s.log.Infof("setting up UDP listener socket pool at %s with %d readloop threads",
@@ -50,6 +76,10 @@ func (s *Stunner) StartServer(l *object.Listener) error {
 		}
 
 		for _, c := range conns {
+			if interceptor != nil {
+				c = &interceptPacketConn{PacketConn: c, interceptor: interceptor}
+			}
+
 			conn := turn.PacketConnConfig{
 				PacketConn:            c,
 				RelayAddressGenerator: relay,
@@ -60,7 +90,7 @@ func (s *Stunner) StartServer(l *object.Listener) error {
 			pConns = append(pConns, conn)
 		}
 
-	case stnrv1.ListenerProtocolTURNTCP:
+	case stnrv1.ListenerProtocolTURNTCP, stnrv1.ListenerProtocolTCP:
 		s.log.Debugf("setting up TCP listener at %s", addr)
 
 		tcpListener, err := net.Listen("tcp", addr)
@@ -70,6 +100,15 @@ func (s *Stunner) StartServer(l *object.Listener) error {
 
 		tcpListener = telemetry.NewListener(tcpListener, l.Name, telemetry.ListenerType)
 
+		if l.Proto.IsTURN() {
+			relayListener, err := s.NewTCPRelayListener(tcpListener, l, interceptor)
+			if err != nil {
+				tcpListener.Close()
+				return fmt.Errorf("failed to create TCP relay listener at %s: %s", addr, err)
+			}
+			tcpListener = relayListener
+		}
+
 		conn := turn.ListenerConfig{
 			Listener:              tcpListener,
 			RelayAddressGenerator: relay,
@@ -80,24 +119,52 @@ func (s *Stunner) StartServer(l *object.Listener) error {
 		l.Conns = append(l.Conns, conn)
 
 		// cannot test this on vnet, no TLS in vnet.Net
-	case stnrv1.ListenerProtocolTURNTLS:
+	case stnrv1.ListenerProtocolTURNTLS, stnrv1.ListenerProtocolTLS:
 		s.log.Debugf("setting up TLS/TCP listener at %s", addr)
 
-		cer, err := tls.X509KeyPair(l.Cert, l.Key)
-		if err != nil {
+		if _, err := l.GetCertificate(""); err != nil {
 			return fmt.Errorf("cannot load cert/key pair for creating TLS listener at %s: %s",
 				addr, err)
 		}
-		tlsListener, err := tls.Listen("tcp", addr, &tls.Config{
-			MinVersion:   tls.VersionTLS12,
-			Certificates: []tls.Certificate{cer},
-		})
+		// serve the cert via a callback for SNI and so that cert updates do not require a restart
+		tlsConfig := &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return l.GetCertificate(hello.ServerName)
+			},
+		}
+		if clientCertEnabled(l) {
+			if _, err := l.GetClientCAs(); err != nil {
+				return fmt.Errorf("cannot load client CA for creating TLS listener at %s: %s",
+					addr, err)
+			}
+			// verify client certs ourselves so that rejections can be counted and the
+			// client CA can be updated without a restart
+			tlsConfig.ClientAuth = tls.RequestClientCert
+			tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+				return verifyClientCert(l, cs.PeerCertificates, s.log)
+			}
+		}
+		tlsListener, err := tls.Listen("tcp", addr, tlsConfig)
 		if err != nil {
 			return fmt.Errorf("failed to create TLS listener at %s: %s", addr, err)
 		}
 
+		if clientCertEnabled(l) {
+			tlsListener = newClientCertListener(tlsListener, l, s.clientCerts, s.log)
+		}
+
 		tlsListener = telemetry.NewListener(tlsListener, l.Name, telemetry.ListenerType)
 
+		if l.Proto.IsTURN() {
+			relayListener, err := s.NewTCPRelayListener(tlsListener, l, interceptor)
+			if err != nil {
+				tlsListener.Close()
+				return fmt.Errorf("failed to create TCP relay listener at %s: %s", addr, err)
+			}
+			tlsListener = relayListener
+		}
+
 		conn := turn.ListenerConfig{
 			Listener:              tlsListener,
 			RelayAddressGenerator: relay,
@@ -107,11 +174,10 @@ func (s *Stunner) StartServer(l *object.Listener) error {
 		lConns = append(lConns, conn)
 		l.Conns = append(l.Conns, conn)
 
-	case stnrv1.ListenerProtocolTURNDTLS:
+	case stnrv1.ListenerProtocolTURNDTLS, stnrv1.ListenerProtocolDTLS:
 		s.log.Debugf("setting up DTLS/UDP listener at %s", addr)
 
-		cer, err := tls.X509KeyPair(l.Cert, l.Key)
-		if err != nil {
+		if _, err := l.GetCertificate(""); err != nil {
 			return fmt.Errorf("cannot load cert/key pair for creating DTLS listener at %s: %s",
 				addr, err)
 		}
@@ -121,16 +187,37 @@ func (s *Stunner) StartServer(l *object.Listener) error {
 		if err != nil {
 			return fmt.Errorf("failed to parse DTLS listener address %s: %s", addr, err)
 		}
-		dtlsListener, err := dtls.Listen("udp", udpAddr, &dtls.Config{
-			Certificates: []tls.Certificate{cer},
+		dtlsConfig := &dtls.Config{
+			GetCertificate: func(hello *dtls.ClientHelloInfo) (*tls.Certificate, error) {
+				return l.GetCertificate(hello.ServerName)
+			},
 			// ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
-		})
+		}
+		if clientCertEnabled(l) {
+			if _, err := l.GetClientCAs(); err != nil {
+				return fmt.Errorf("cannot load client CA for creating DTLS listener at %s: %s",
+					addr, err)
+			}
+			dtlsConfig.ClientAuth = dtls.RequestClientCert
+			dtlsConfig.VerifyConnection = func(state *dtls.State) error {
+				return verifyDTLSClientCert(l, state.PeerCertificates, s.log)
+			}
+		}
+		dtlsListener, err := dtls.Listen("udp", udpAddr, dtlsConfig)
 		if err != nil {
 			return fmt.Errorf("failed to create DTLS listener at %s: %s", addr, err)
 		}
 
+		if clientCertEnabled(l) {
+			dtlsListener = newClientCertListener(dtlsListener, l, s.clientCerts, s.log)
+		}
+
 		dtlsListener = telemetry.NewListener(dtlsListener, l.Name, telemetry.ListenerType)
 
+		if interceptor != nil {
+			dtlsListener = &interceptListener{Listener: dtlsListener, interceptor: interceptor}
+		}
+
 		conn := turn.ListenerConfig{
 			Listener:              dtlsListener,
 			RelayAddressGenerator: relay,
@@ -152,7 +239,7 @@ func (s *Stunner) StartServer(l *object.Listener) error {
 
 	t, err := turn.NewServer(turn.ServerConfig{
 		Realm:             s.GetRealm(),
-		AuthHandler:       s.NewAuthHandler(),
+		AuthHandler:       s.newTracedAuthHandler(l, authHandler),
 		PacketConnConfigs: pConns,
 		ListenerConfigs:   lConns,
 		LoggerFactory:     s.logger.WithRateLimiter(LogRateLimit, LogBurst),
@@ -163,7 +250,20 @@ func (s *Stunner) StartServer(l *object.Listener) error {
 	}
 	l.Server = t
 
-	s.log.Infof("listener %s: TURN server running", l.Name)
+	if l.Proto.IsTURN() {
+		s.log.Infof("listener %s: TURN server running", l.Name)
+	} else {
+		s.log.Infof("listener %s: STUN server running", l.Name)
+	}
 
 	return nil
 }
+
+// NewTCPRelayListener wraps a TURN-TCP or TURN-TLS listener with support for RFC 6062 TCP relay
+// allocations, using the allocation interceptor of the listener. TCP peers are admitted only via
+// TCP clusters.
+func (s *Stunner) NewTCPRelayListener(tcpListener net.Listener, l *object.Listener, interceptor *allocInterceptor) (*TCPRelayListener, error) {
+	return NewTCPRelayListener(tcpListener, interceptor, s.GetRealm(),
+		s.newPermissionHandler(l, stnrv1.ClusterProtocolTCP),
+		s.logger.NewLogger(fmt.Sprintf("relay-tcp-%s", l.Name)))
+}
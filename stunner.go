@@ -2,13 +2,16 @@
 package stunner
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/pion/logging"
 	"github.com/pion/transport/v3"
 	"github.com/pion/transport/v3/stdnet"
+	"github.com/pion/turn/v4"
 
 	"github.com/l7mp/stunner/internal/manager"
 	"github.com/l7mp/stunner/internal/object"
@@ -30,8 +33,17 @@ type Stunner struct {
 	resolver                                                   resolver.DnsResolver
 	udpThreadNum                                               int
 	logger                                                     *logger.LeveledLoggerFactory
+	logFormat                                                  string
+	logLevels                                                  *logLevelState
 	log                                                        logging.LeveledLogger
 	net                                                        transport.Net
+	allocs                                                     *allocationTable
+	drain                                                      *drainState
+	clientCerts                                                *clientCertTable
+	accessTokens                                               *accessTokenTable
+	sharedSecrets                                              *sharedSecretTable
+	authLockout                                                *authLockout
+	tcpRelayPorts                                              *portSet
 	ready, shutdown                                            bool
 }
 
@@ -46,7 +58,11 @@ func NewStunner(options Options) *Stunner {
 	if options.LogLevel != "" {
 		logger.SetLevel(options.LogLevel)
 	}
+	logFormatErr := logger.SetFormat(options.LogFormat)
 	log := logger.NewLogger("stunner")
+	if logFormatErr != nil {
+		log.Errorf("Could not set log format: %s", logFormatErr.Error())
+	}
 
 	r := options.Resolver
 	if r == nil {
@@ -84,16 +100,45 @@ func NewStunner(options Options) *Stunner {
 		name:             id,
 		version:          stnrv1.ApiVersion,
 		logger:           logger,
+		logFormat:        logger.Format,
+		logLevels:        newLogLevelState(logger),
 		log:              log,
 		suppressRollback: options.SuppressRollback,
 		dryRun:           options.DryRun,
 		resolver:         r,
 		udpThreadNum:     udpThreadNum,
 		net:              vnet,
+		drain:            &drainState{},
+		clientCerts:      newClientCertTable(),
+		tcpRelayPorts:    newPortSet(),
 	}
 
+	s.accessTokens = newAccessTokenTable(s.GetAuth)
+	s.sharedSecrets = newSharedSecretTable(s.GetAuth)
+	s.authLockout = newAuthLockout(s.GetAuth)
+
+	s.allocs = newAllocationTable(func() (int, int) {
+		if auth := s.GetAuth(); auth != nil {
+			return auth.GetQuotas()
+		}
+		return 0, 0
+	}, func() *telemetry.AccessLog {
+		if len(s.adminManager.Keys()) == 0 {
+			return nil
+		}
+		return s.GetAdmin().GetAccessLog()
+	})
+
 	s.adminManager = manager.NewManager("admin-manager",
-		object.NewAdminFactory(options.DryRun, s.NewReadinessHandler(), s.NewStatusHandler(), logger), logger)
+		object.NewAdminFactory(options.DryRun, object.AdminHandlers{
+			Readiness:   s.NewReadinessHandler(),
+			Status:      s.NewStatusHandler(),
+			Allocations: s.NewAllocationHandler(),
+			Termination: s.NewTerminationHandler(),
+			Revocation:  s.NewRevocationHandler(),
+			Lockout:     s.NewLockoutHandler(),
+			LogLevel:    s.NewLogLevelHandler(),
+		}, logger), logger)
 	s.authManager = manager.NewManager("auth-manager",
 		object.NewAuthFactory(logger), logger)
 	s.listenerManager = manager.NewManager("listener-manager",
@@ -105,6 +150,9 @@ func NewStunner(options Options) *Stunner {
 		s.resolver.Start()
 		telemetry.Init()
 		telemetry.RegisterAllocationMetric(s.log, s.GetActiveConnections)
+		telemetry.RegisterDrainMetrics(s.log,
+			func() float64 { return s.drain.remaining().Seconds() },
+			func() float64 { return s.drain.progress(s.AllocationCount()) })
 	}
 
 	// TODO: remove this when STUNner gains self-managed dataplanes
@@ -128,11 +176,27 @@ func (s *Stunner) IsReady() bool {
 	return s.ready
 }
 
-// Shutdown causes STUNner to fail the readiness check. Manwhile, it will keep on serving
-// connections. This function should be called after the main program catches a SIGTERM.
+// Shutdown causes STUNner to fail the readiness check and start draining. Manwhile, it will keep
+// on serving existing allocations, but new allocations are rejected and allocation refreshes are
+// capped at the drain timeout. This function should be called after the main program catches a
+// SIGTERM.
 func (s *Stunner) Shutdown() {
 	s.shutdown = true
 	s.ready = false
+
+	timeout := stnrv1.DefaultDrainTimeout
+	if len(s.adminManager.Keys()) > 0 {
+		if t := s.GetAdmin().DrainTimeout; t > 0 {
+			timeout = t
+		}
+	}
+	s.drain.start(time.Duration(timeout)*time.Second, s.AllocationCount())
+}
+
+// IsDrained returns true if a graceful shutdown can complete, i.e., there are no active
+// allocations left or the drain timeout has expired.
+func (s *Stunner) IsDrained() bool {
+	return s.shutdown && (s.AllocationCount() == 0 || s.drain.expired())
 }
 
 // GetAdmin returns the admin object underlying STUNner.
@@ -190,7 +254,16 @@ func (s *Stunner) SetLogLevel(levelSpec string) {
 	s.logger.SetLevel(levelSpec)
 }
 
-// GetAllocations returns the number of active allocations summed over all listeners.  It can be
+// SetLogFormat sets the log format, either "text", "json" or "logfmt". An empty format resets the
+// format set in the options.
+func (s *Stunner) SetLogFormat(format string) error {
+	if format == "" {
+		format = s.logFormat
+	}
+	return s.logger.SetFormat(format)
+}
+
+// AllocationCount returns the number of active allocations summed over all listeners.  It can be
 // used to drain the server before closing.
 func (s *Stunner) AllocationCount() int {
 	n := 0
@@ -200,10 +273,129 @@ func (s *Stunner) AllocationCount() int {
 		if l.Server != nil {
 			n += l.Server.AllocationCount()
 		}
+		// TCP allocations are not tracked by the TURN server
+		for _, c := range l.Conns {
+			if lc, ok := c.(turn.ListenerConfig); ok {
+				if r, ok := lc.Listener.(*TCPRelayListener); ok {
+					n += r.AllocationCount()
+				}
+			}
+		}
 	}
 	return n
 }
 
+// GetAllocations returns the active allocations matching a filter, including the client and the
+// relayed transport address, the username, the permissions and channels installed by the client,
+// and the traffic relayed by the allocation. Use an empty filter to list all allocations.
+func (s *Stunner) GetAllocations(filter stnrv1.AllocationFilter) []*stnrv1.AllocationStatus {
+	return s.allocs.list(filter)
+}
+
+// TerminateAllocations forcibly closes the active allocations matching a filter at all listeners
+// and returns the status of the terminated allocations. If block is positive then new allocations
+// matching the filter are rejected with a 403 (Forbidden) error for the given cool-down period.
+// The filter must not be empty.
+func (s *Stunner) TerminateAllocations(filter stnrv1.AllocationFilter, block time.Duration) ([]*stnrv1.AllocationStatus, error) {
+	if filter.IsEmpty() {
+		return nil, stnrv1.ErrEmptyFilter
+	}
+
+	// block first so that terminated clients cannot reallocate
+	if block > 0 {
+		s.allocs.block(filter, block)
+		s.log.Infof("blocking new allocations matching %s for %s", filter.String(), block)
+	}
+
+	allocs := s.allocs.terminate(filter)
+	s.log.Infof("terminated %d allocation(s) matching %s", len(allocs), filter.String())
+
+	return allocs, nil
+}
+
+// RevokeCredentials adds ephemeral credentials to the revocation list at runtime, or removes them
+// from the list if remove is set, and returns the resultant revocation list. Revoked credentials
+// are rejected from the next authentication request on. If the Terminate flag of the request is
+// set then the active allocations of the revoked credentials are terminated as well. A nil
+// request returns the revocation list.
+func (s *Stunner) RevokeCredentials(req *stnrv1.RevocationConfig, remove bool) (*stnrv1.RevocationStatus, error) {
+	auth := s.GetAuth()
+	if auth == nil {
+		return nil, errors.New("no authenticator")
+	}
+
+	ret := &stnrv1.RevocationStatus{}
+	if req != nil {
+		if err := auth.Revoke(req, remove); err != nil {
+			return nil, err
+		}
+
+		op := "revoked"
+		if remove {
+			op = "unrevoked"
+		}
+		s.log.Infof("%s ephemeral credentials: %s", op, req.String())
+
+		if !remove && req.Terminate {
+			ret.Terminated = s.terminateRevoked(auth.RevocationMatcher(req))
+		}
+	}
+
+	ret.Revocations = auth.GetRevocations()
+
+	return ret, nil
+}
+
+// terminateRevoked closes the active allocations of the ephemeral credentials revoked by a
+// revocation matcher and returns the status of the terminated allocations.
+func (s *Stunner) terminateRevoked(revoked func(username string) bool) []*stnrv1.AllocationStatus {
+	allocs := s.allocs.terminateIf(func(a *stnrv1.AllocationStatus) bool {
+		return revoked(a.Username)
+	})
+	if len(allocs) > 0 {
+		s.log.Infof("terminated %d allocation(s) of revoked credentials", len(allocs))
+	}
+
+	return allocs
+}
+
+// GetLockouts returns the source IP addresses and the usernames with failed authentication attempts
+// or recent lockouts, including the number of failed attempts within the failure window, the
+// number of consecutive lockouts and the end of the current lockout. A non-empty client IP or
+// username lists only the matching entry.
+func (s *Stunner) GetLockouts(clientIP, username string) []*stnrv1.LockoutStatus {
+	return s.authLockout.status(clientIP, username, false)
+}
+
+// ResetLockouts unlocks the source IP addresses and the usernames matching a client IP and a
+// username (empty strings match all) and forgets their failed authentication attempts. Returns the
+// status of the entries before the reset.
+func (s *Stunner) ResetLockouts(clientIP, username string) []*stnrv1.LockoutStatus {
+	list := s.authLockout.status(clientIP, username, true)
+	if len(list) > 0 {
+		s.log.Infof("reset %d lockout(s) (client-ip=%q, username=%q)", len(list), clientIP,
+			username)
+	}
+	return list
+}
+
+// getRelayGen returns the relay address generator of a running listener.
+func getRelayGen(l *object.Listener) *RelayGen {
+	for _, c := range l.Conns {
+		switch conn := c.(type) {
+		case turn.PacketConnConfig:
+			if r, ok := conn.RelayAddressGenerator.(*RelayGen); ok {
+				return r
+			}
+		case turn.ListenerConfig:
+			if r, ok := conn.RelayAddressGenerator.(*RelayGen); ok {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
 // Status returns the status for the running STUNner instance.
 func (s *Stunner) Status() stnrv1.Status {
 	status := stnrv1.StunnerStatus{ApiVersion: s.version}
@@ -216,9 +408,18 @@ func (s *Stunner) Status() stnrv1.Status {
 
 	ls := s.listenerManager.Keys()
 	status.Listeners = make([]*stnrv1.ListenerStatus, len(ls))
+	status.ListenerUsage = make([]*stnrv1.ListenerUsage, len(ls))
 	for i, lName := range ls {
 		if l := s.GetListener(lName); l != nil {
 			status.Listeners[i] = l.Status().(*stnrv1.ListenerStatus)
+			status.ListenerUsage[i] = &stnrv1.ListenerUsage{
+				Name:        lName,
+				Allocations: s.allocs.count(lName),
+			}
+			if r := getRelayGen(l); r != nil {
+				status.ListenerUsage[i].RelayPortsInUse = r.PortsInUse()
+				status.ListenerUsage[i].RelayPortsTotal = r.PortsTotal()
+			}
 		}
 	}
 
@@ -231,6 +432,12 @@ func (s *Stunner) Status() stnrv1.Status {
 	}
 
 	status.AllocationCount = s.AllocationCount()
+	if users, clients := s.allocs.usage(); len(users) > 0 || len(clients) > 0 {
+		status.Quota = &stnrv1.QuotaStatus{Users: users, Clients: clients}
+	}
+	if s.drain.draining() {
+		status.Drain = s.drain.status(status.AllocationCount)
+	}
 	stat := "READY"
 	if !s.ready {
 		stat = "NOT-READY"
@@ -248,15 +455,14 @@ func (s *Stunner) Status() stnrv1.Status {
 func (s *Stunner) Close() {
 	s.log.Info("closing STUNner")
 
-	// ignore restart-required errors
-	if len(s.adminManager.Keys()) > 0 {
-		_ = s.GetAdmin().Close()
-	}
-
 	if len(s.authManager.Keys()) > 0 {
 		_ = s.GetAuth().Close()
 	}
 
+	// the TURN servers delete their allocations in the background once the listeners are
+	// closed, so close the relays first to have the allocations deleted before Close returns
+	s.allocs.closeAll()
+
 	listeners := s.listenerManager.Keys()
 	for _, name := range listeners {
 		l := s.GetListener(name)
@@ -275,7 +481,16 @@ func (s *Stunner) Close() {
 		}
 	}
 
+	// close the admin last so that the access log and the telemetry exporters record the
+	// allocations deleted when closing the listeners; ignore restart-required errors
+	if len(s.adminManager.Keys()) > 0 {
+		_ = s.GetAdmin().Close()
+	}
+
+	s.logLevels.close()
+
 	telemetry.UnregisterAllocationMetric(s.log)
+	telemetry.UnregisterDrainMetrics(s.log)
 	if !s.dryRun {
 		telemetry.Close()
 	}
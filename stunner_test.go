@@ -1,19 +1,34 @@
 package stunner
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/pion/dtls/v3"
 	"github.com/pion/logging"
+	"github.com/pion/stun/v3"
 	"github.com/pion/transport/v3"
 	"github.com/pion/transport/v3/stdnet"
 	"github.com/pion/transport/v3/test"
@@ -21,7 +36,12 @@ import (
 	"github.com/pion/turn/v4"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
 
+	"github.com/l7mp/stunner/internal/object"
 	"github.com/l7mp/stunner/internal/resolver"
 	"github.com/l7mp/stunner/internal/telemetry"
 	"github.com/l7mp/stunner/pkg/logger"
@@ -641,6 +661,3396 @@ func testStunnerLocalhost(t *testing.T, udpThreadNum int, tests []TestStunnerCon
 	}
 }
 
+/********************************************
+ *
+ *  STUN-only listener tests over localhost
+ *
+ *********************************************/
+
+func TestStunnerSTUNListenerLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	// the DTLS listener releases its UDP socket asynchronously, run it last
+	for _, tc := range []struct{ proto, uri string }{
+		{"udp", "stun:127.0.0.1:23478?transport=udp"},
+		{"tcp", "stun:127.0.0.1:23478?transport=tcp"},
+		{"tls", "stuns:127.0.0.1:23478?transport=tcp"},
+		{"dtls", "stuns:127.0.0.1:23478?transport=udp"},
+	} {
+		proto, uri := tc.proto, tc.uri
+		testName := fmt.Sprintf("TestStunner_STUNListener_Localhost_client:%s", proto)
+		t.Run(testName, func(t *testing.T) {
+			log.Debugf("-------------- Running test: %s -------------", testName)
+
+			c := stnrv1.StunnerConfig{
+				ApiVersion: stnrv1.ApiVersion,
+				Admin: stnrv1.AdminConfig{
+					LogLevel: stunnerTestLoglevel,
+				},
+				Auth: stnrv1.AuthConfig{
+					Type: "static",
+					Credentials: map[string]string{
+						"username": "user1",
+						"password": "passwd1",
+					},
+				},
+				Listeners: []stnrv1.ListenerConfig{{
+					Name:     "stun",
+					Protocol: proto,
+					Addr:     "127.0.0.1",
+					Port:     23478,
+					Cert:     certPem64,
+					Key:      keyPem64,
+					Routes:   []string{"allow-any"},
+				}},
+				Clusters: []stnrv1.ClusterConfig{{
+					Name:      "allow-any",
+					Endpoints: []string{"0.0.0.0/0"},
+				}},
+			}
+
+			log.Debug("testing STUN URI")
+			u, err := GetUriFromListener(&c.Listeners[0])
+			assert.NoError(t, err, "GetUriFromListener")
+			assert.Equal(t, uri, u, "listener uri")
+
+			log.Debug("creating a stunnerd")
+			stunner := NewStunner(Options{
+				LogLevel:         stunnerTestLoglevel,
+				SuppressRollback: true,
+			})
+
+			log.Debug("starting stunnerd")
+			assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+			stunnerAddr := "127.0.0.1:23478"
+
+			log.Debug("creating a client")
+			var lconn net.PacketConn
+			switch proto {
+			case "udp":
+				lconn, err = net.ListenPacket("udp", "0.0.0.0:0")
+				assert.NoError(t, err, "cannot create UDP client socket")
+			case "tcp":
+				conn, cErr := net.Dial("tcp", stunnerAddr)
+				assert.NoError(t, cErr, "cannot create TCP client socket")
+				lconn = turn.NewSTUNConn(conn)
+			case "tls":
+				conn, err := tls.Dial("tcp", stunnerAddr, &tls.Config{
+					MinVersion:         tls.VersionTLS12,
+					InsecureSkipVerify: true,
+				})
+				assert.NoError(t, err, "cannot create TLS client socket")
+				lconn = turn.NewSTUNConn(conn)
+			case "dtls":
+				udpAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23478}
+				conn, err := dtls.Dial("udp", udpAddr, &dtls.Config{
+					InsecureSkipVerify: true,
+				})
+				assert.NoError(t, err, "cannot create DTLS client socket")
+				lconn = turn.NewSTUNConn(conn)
+			}
+
+			// binding requests succeed but allocations fail
+			stdnet, _ := stdnet.NewNet()
+			testConfig := echoTestConfig{t, stdnet, stdnet, stunner,
+				stunnerAddr, lconn, "user1", "passwd1", net.IPv4(127, 0, 0, 1),
+				"127.0.0.1:25678", false, true, false, loggerFactory}
+			stunnerEchoTest(testConfig)
+
+			assert.Equal(t, 0, stunner.AllocationCount(), "allocation count")
+			assert.NoError(t, lconn.Close(), "cannot close STUN client connection")
+
+			stunner.Close()
+		})
+	}
+}
+
+/********************************************
+ *
+ *  TCP relay tests over localhost (RFC 6062)
+ *  *****************
+ *  Topology:
+ *                 /----- STUNner (tcp:23478)
+ *      client--- lo
+ *                 \----- echo-server (tcp:25678)
+ *
+ *********************************************/
+
+type StunnerTestTCPRelayConfig struct {
+	testName    string
+	config      stnrv1.StunnerConfig
+	echoSuccess bool
+}
+
+var testTCPRelayConfigs = []StunnerTestTCPRelayConfig{
+	{
+		testName: "TCP cluster: allow",
+		config: stnrv1.StunnerConfig{
+			ApiVersion: stnrv1.ApiVersion,
+			Admin: stnrv1.AdminConfig{
+				LogLevel: stunnerTestLoglevel,
+			},
+			Auth: stnrv1.AuthConfig{
+				Type: "static",
+				Credentials: map[string]string{
+					"username": "user1",
+					"password": "passwd1",
+				},
+			},
+			Listeners: []stnrv1.ListenerConfig{{
+				Name:     "tcp",
+				Protocol: "turn-tcp",
+				Addr:     "127.0.0.1",
+				Port:     23478,
+				Routes:   []string{"echo-server-cluster"},
+			}},
+			Clusters: []stnrv1.ClusterConfig{{
+				Name:      "echo-server-cluster",
+				Protocol:  "tcp",
+				Endpoints: []string{"127.0.0.1"},
+			}},
+		},
+		echoSuccess: true,
+	},
+	{
+		testName: "TCP cluster: port mismatch",
+		config: stnrv1.StunnerConfig{
+			ApiVersion: stnrv1.ApiVersion,
+			Admin: stnrv1.AdminConfig{
+				LogLevel: stunnerTestLoglevel,
+			},
+			Auth: stnrv1.AuthConfig{
+				Type: "static",
+				Credentials: map[string]string{
+					"username": "user1",
+					"password": "passwd1",
+				},
+			},
+			Listeners: []stnrv1.ListenerConfig{{
+				Name:     "tcp",
+				Protocol: "turn-tcp",
+				Addr:     "127.0.0.1",
+				Port:     23478,
+				Routes:   []string{"echo-server-cluster"},
+			}},
+			Clusters: []stnrv1.ClusterConfig{{
+				Name:      "echo-server-cluster",
+				Protocol:  "tcp",
+				Endpoints: []string{"127.0.0.1:<1-1000>"},
+			}},
+		},
+		echoSuccess: false,
+	},
+	{
+		testName: "UDP cluster: deny",
+		config: stnrv1.StunnerConfig{
+			ApiVersion: stnrv1.ApiVersion,
+			Admin: stnrv1.AdminConfig{
+				LogLevel: stunnerTestLoglevel,
+			},
+			Auth: stnrv1.AuthConfig{
+				Type: "static",
+				Credentials: map[string]string{
+					"username": "user1",
+					"password": "passwd1",
+				},
+			},
+			Listeners: []stnrv1.ListenerConfig{{
+				Name:     "tcp",
+				Protocol: "turn-tcp",
+				Addr:     "127.0.0.1",
+				Port:     23478,
+				Routes:   []string{"echo-server-cluster"},
+			}},
+			Clusters: []stnrv1.ClusterConfig{{
+				Name:      "echo-server-cluster",
+				Endpoints: []string{"127.0.0.1"},
+			}},
+		},
+		echoSuccess: false,
+	},
+}
+
+func TestStunnerTCPRelayLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 60)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	for _, c := range testTCPRelayConfigs {
+		t.Run(c.testName, func(t *testing.T) {
+			log.Debugf("-------------- Running test: %s -------------", c.testName)
+
+			stunner := NewStunner(Options{
+				LogLevel:         stunnerTestLoglevel,
+				SuppressRollback: true,
+			})
+
+			log.Debug("starting stunnerd")
+			assert.NoError(t, stunner.Reconcile(&c.config), "starting server")
+
+			log.Debug("creating a TCP echo server")
+			echoListener, err := net.Listen("tcp4", "127.0.0.1:25678")
+			assert.NoError(t, err, "cannot create echo server")
+			echoPeers := make(chan net.Addr, 4)
+			go func() {
+				for {
+					conn, err := echoListener.Accept()
+					if err != nil {
+						return
+					}
+					echoPeers <- conn.RemoteAddr()
+					go func() {
+						defer conn.Close()
+						buf := make([]byte, 1600)
+						for {
+							n, err := conn.Read(buf)
+							if err != nil {
+								return
+							}
+							if _, err := conn.Write(buf[:n]); err != nil {
+								return
+							}
+						}
+					}()
+				}
+			}()
+
+			log.Debug("creating a client")
+			stunnerAddr := "127.0.0.1:23478"
+			conn, err := net.Dial("tcp", stunnerAddr)
+			assert.NoError(t, err, "cannot create TCP client socket")
+			stdnet, _ := stdnet.NewNet()
+			client, err := turn.NewClient(&turn.ClientConfig{
+				STUNServerAddr: stunnerAddr,
+				TURNServerAddr: stunnerAddr,
+				Username:       "user1",
+				Password:       "passwd1",
+				Conn:           turn.NewSTUNConn(conn),
+				Net:            stdnet,
+				LoggerFactory:  loggerFactory,
+			})
+			assert.NoError(t, err, "cannot create TURN client")
+			assert.NoError(t, client.Listen(), "cannot listen on TURN client")
+
+			log.Debug("sending a TCP allocate request")
+			alloc, err := client.AllocateTCP()
+			assert.NoError(t, err, "TCP allocation")
+			assert.Equal(t, 1, stunner.AllocationCount(), "allocation count")
+
+			relayAddr, ok := alloc.Addr().(*net.TCPAddr)
+			assert.True(t, ok, "relay address type")
+
+			clusterConns := telemetry.ClusterConnsActive.WithLabelValues("echo-server-cluster")
+			conns := testutil.ToFloat64(clusterConns)
+
+			log.Debug("connecting to the echo server")
+			peerConn, err := alloc.Dial("tcp", "127.0.0.1:25678")
+			if c.echoSuccess {
+				assert.NoError(t, err, "connect")
+
+				// the echo server should see the relay address
+				peer := <-echoPeers
+				assert.Equal(t, relayAddr.Port, peer.(*net.TCPAddr).Port, "peer port")
+
+				buf := make([]byte, 1600)
+				for i := 0; i < 4; i++ {
+					_, err = peerConn.Write([]byte("Hello"))
+					assert.NoError(t, err, "write")
+					n, err := peerConn.Read(buf)
+					assert.NoError(t, err, "read")
+					assert.Equal(t, "Hello", string(buf[:n]), "echo")
+				}
+
+				log.Debug("connecting to the relay address from the peer")
+				go func() {
+					conn, err := net.Dial("tcp4", relayAddr.String())
+					if !assert.NoError(t, err, "peer connect") {
+						return
+					}
+					defer conn.Close()
+					buf := make([]byte, 16)
+					n, err := conn.Read(buf)
+					assert.NoError(t, err, "peer read")
+					_, err = conn.Write(buf[:n])
+					assert.NoError(t, err, "peer write")
+					// wait until the client closes
+					_, _ = conn.Read(buf)
+				}()
+
+				acceptConn, err := alloc.Accept()
+				assert.NoError(t, err, "accept")
+				_, err = acceptConn.Write([]byte("World"))
+				assert.NoError(t, err, "write")
+				n, err := acceptConn.Read(buf)
+				assert.NoError(t, err, "read")
+				assert.Equal(t, "World", string(buf[:n]), "echo")
+
+				assert.NoError(t, acceptConn.Close(), "close accepted connection")
+				assert.NoError(t, peerConn.Close(), "close peer connection")
+			} else {
+				assert.Error(t, err, "connect")
+			}
+
+			assert.NoError(t, alloc.Close(), "close allocation")
+			time.Sleep(100 * time.Millisecond)
+			assert.Equal(t, 0, stunner.AllocationCount(), "allocation count")
+			assert.Equal(t, conns, testutil.ToFloat64(clusterConns), "cluster connections")
+
+			client.Close()
+			assert.NoError(t, conn.Close(), "cannot close TURN client connection")
+			assert.NoError(t, echoListener.Close(), "cannot close echo server")
+
+			stunner.Close()
+		})
+	}
+}
+
+/********************************************
+ *
+ *  IPv6 tests over localhost
+ *  *****************
+ *  Topology:
+ *                 /----- STUNner (udp/tcp:[::1]:23478)
+ *      client--- lo
+ *                 \----- echo-server ([::1]:25678)
+ *
+ *********************************************/
+
+type StunnerTestIPv6Config struct {
+	testName      string
+	protocol      string
+	listenerAddr  string
+	clientAddr    string
+	relayIP       net.IP
+	tcpAllocation bool
+	echoSuccess   bool
+}
+
+var testIPv6Configs = []StunnerTestIPv6Config{
+	{
+		testName:     "TURN-UDP: IPv6 listener, IPv6 client",
+		protocol:     "turn-udp",
+		listenerAddr: "::1",
+		clientAddr:   "::1",
+		relayIP:      net.ParseIP("::1"),
+		echoSuccess:  true,
+	},
+	{
+		testName:     "TURN-TCP: IPv6 listener, IPv6 client",
+		protocol:     "turn-tcp",
+		listenerAddr: "::1",
+		clientAddr:   "::1",
+		relayIP:      net.ParseIP("::1"),
+		echoSuccess:  true,
+	},
+	{
+		testName:      "TURN-TCP: IPv6 listener, IPv6 client, TCP allocation",
+		protocol:      "turn-tcp",
+		listenerAddr:  "::1",
+		clientAddr:    "::1",
+		relayIP:       net.ParseIP("::1"),
+		tcpAllocation: true,
+	},
+	{
+		testName:     "TURN-UDP: dual-stack listener, IPv4 client",
+		protocol:     "turn-udp",
+		listenerAddr: "::",
+		clientAddr:   "127.0.0.1",
+		relayIP:      net.IPv4zero,
+	},
+	{
+		testName:     "TURN-UDP: dual-stack listener, IPv6 client",
+		protocol:     "turn-udp",
+		listenerAddr: "::",
+		clientAddr:   "::1",
+		relayIP:      net.IPv6unspecified,
+	},
+	{
+		testName:     "TURN-TCP: dual-stack listener, IPv6 client",
+		protocol:     "turn-tcp",
+		listenerAddr: "::",
+		clientAddr:   "::1",
+		relayIP:      net.IPv6unspecified,
+	},
+}
+
+// dualStackNet lets the TURN client, which resolves server addresses as IPv4 only, connect to IPv6
+// servers.
+type dualStackNet struct {
+	*stdnet.Net
+}
+
+func (n *dualStackNet) ResolveUDPAddr(_, address string) (*net.UDPAddr, error) {
+	return n.Net.ResolveUDPAddr("udp", address)
+}
+
+func newIPv6TestConfig(proto, addr string) *stnrv1.StunnerConfig {
+	return &stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel: stunnerTestLoglevel,
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "ipv6",
+			Protocol: proto,
+			Addr:     addr,
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Protocol:  "udp",
+			Endpoints: []string{"0.0.0.0/0", "::/0"},
+		}, {
+			Name:      "allow-any-tcp",
+			Protocol:  "tcp",
+			Endpoints: []string{"0.0.0.0/0", "::/0"},
+		}},
+	}
+}
+
+func TestStunnerIPv6Localhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 60)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	if conn, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 is not available on localhost")
+	} else {
+		conn.Close()
+	}
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	for _, c := range testIPv6Configs {
+		t.Run(c.testName, func(t *testing.T) {
+			log.Debugf("-------------- Running test: %s -------------", c.testName)
+
+			config := newIPv6TestConfig(c.protocol, c.listenerAddr)
+			config.Listeners[0].Routes = []string{"allow-any", "allow-any-tcp"}
+
+			stunner := NewStunner(Options{
+				LogLevel:         stunnerTestLoglevel,
+				SuppressRollback: true,
+			})
+
+			log.Debug("starting stunnerd")
+			assert.NoError(t, stunner.Reconcile(config), "starting server")
+
+			log.Debug("creating a client")
+			stunnerAddr := net.JoinHostPort(c.clientAddr, "23478")
+			var lconn net.PacketConn
+			var err error
+			switch c.protocol {
+			case "turn-udp":
+				lconn, err = net.ListenPacket("udp", net.JoinHostPort(c.clientAddr, "0"))
+				assert.NoError(t, err, "cannot create UDP client socket")
+			case "turn-tcp":
+				conn, err := net.Dial("tcp", stunnerAddr)
+				assert.NoError(t, err, "cannot create TCP client socket")
+				lconn = turn.NewSTUNConn(conn)
+			}
+
+			stdnet, _ := stdnet.NewNet()
+			client, err := turn.NewClient(&turn.ClientConfig{
+				STUNServerAddr: stunnerAddr,
+				TURNServerAddr: stunnerAddr,
+				Username:       "user1",
+				Password:       "passwd1",
+				Conn:           lconn,
+				Net:            &dualStackNet{Net: stdnet},
+				LoggerFactory:  loggerFactory,
+			})
+			assert.NoError(t, err, "cannot create TURN client")
+			assert.NoError(t, client.Listen(), "cannot listen on TURN client")
+
+			log.Debug("sending a binding request")
+			reflAddr, err := client.SendBindingRequest()
+			assert.NoError(t, err, "binding request")
+			assert.True(t, reflAddr.(*net.UDPAddr).IP.Equal(net.ParseIP(c.clientAddr)),
+				"srflx address")
+
+			if c.tcpAllocation {
+				// the TURN client cannot open IPv6 data connections, only check the
+				// relay address
+				log.Debug("sending a TCP allocate request")
+				alloc, err := client.AllocateTCP()
+				assert.NoError(t, err, "TCP allocation")
+				relayAddr := alloc.Addr().(*net.TCPAddr)
+				assert.True(t, relayAddr.IP.Equal(c.relayIP), "relay address")
+				assert.Equal(t, 1, stunner.AllocationCount(), "allocation count")
+				assert.NoError(t, alloc.Close(), "close allocation")
+			} else {
+				log.Debug("sending an allocate request")
+				conn, err := client.Allocate()
+				assert.NoError(t, err, "allocation")
+				relayAddr := conn.LocalAddr().(*net.UDPAddr)
+				assert.True(t, relayAddr.IP.Equal(c.relayIP), "relay address")
+
+				if c.echoSuccess {
+					log.Debug("creating a UDP echo server")
+					echoConn, err := net.ListenPacket("udp6", "[::1]:25678")
+					assert.NoError(t, err, "cannot create echo server")
+					go func() {
+						buf := make([]byte, 1600)
+						for {
+							n, from, err := echoConn.ReadFrom(buf)
+							if err != nil {
+								return
+							}
+							assert.Equal(t, relayAddr.String(), from.String(), "peer address")
+							echoConn.WriteTo(buf[:n], from) //nolint:errcheck
+						}
+					}()
+
+					buf := make([]byte, 1600)
+					for i := 0; i < 4; i++ {
+						_, err = conn.WriteTo([]byte("Hello"), echoConn.LocalAddr())
+						assert.NoError(t, err, "write")
+						n, from, err := conn.ReadFrom(buf)
+						assert.NoError(t, err, "read")
+						assert.Equal(t, "Hello", string(buf[:n]), "echo")
+						assert.Equal(t, echoConn.LocalAddr().String(), from.String(),
+							"echo address")
+					}
+
+					assert.NoError(t, echoConn.Close(), "cannot close echo server")
+				}
+
+				assert.NoError(t, conn.Close(), "cannot close relay connection")
+			}
+
+			time.Sleep(150 * time.Millisecond)
+			client.Close()
+			assert.NoError(t, lconn.Close(), "cannot close TURN client connection")
+
+			stunner.Close()
+		})
+	}
+
+	for _, c := range []struct {
+		testName, listenerAddr, clientAddr string
+		family                             byte
+	}{
+		{"IPv4 listener, IPv6 relay requested", "127.0.0.1", "127.0.0.1", 0x02},
+		{"IPv6 listener, IPv4 relay requested", "::1", "::1", 0x01},
+	} {
+		t.Run("TURN-UDP: "+c.testName, func(t *testing.T) {
+			log.Debugf("-------------- Running test: %s -------------", c.testName)
+
+			stunner := NewStunner(Options{
+				LogLevel:         stunnerTestLoglevel,
+				SuppressRollback: true,
+			})
+			assert.NoError(t, stunner.Reconcile(newIPv6TestConfig("turn-udp", c.listenerAddr)),
+				"starting server")
+
+			conn, err := net.Dial("udp", net.JoinHostPort(c.clientAddr, "23478"))
+			assert.NoError(t, err, "cannot create UDP client socket")
+
+			req, err := stun.Build(stun.TransactionID,
+				stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+				stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}},
+				stun.RawAttribute{Type: stun.AttrRequestedAddressFamily,
+					Value: []byte{c.family, 0, 0, 0}},
+				stun.Fingerprint)
+			assert.NoError(t, err, "build allocate request")
+			_, err = conn.Write(req.Raw)
+			assert.NoError(t, err, "send allocate request")
+
+			buf := make([]byte, 1600)
+			assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			n, err := conn.Read(buf)
+			assert.NoError(t, err, "read allocate response")
+
+			res := &stun.Message{Raw: buf[:n]}
+			assert.NoError(t, res.Decode(), "decode allocate response")
+			assert.Equal(t, stun.ClassErrorResponse, res.Type.Class, "error response")
+			var code stun.ErrorCodeAttribute
+			assert.NoError(t, code.GetFrom(res), "error code")
+			assert.Equal(t, stun.CodeAddrFamilyNotSupported, code.Code, "error code")
+
+			assert.NoError(t, conn.Close(), "cannot close client connection")
+			stunner.Close()
+		})
+	}
+}
+
+/********************************************
+ *
+ *  Relay port range tests over localhost
+ *
+ *********************************************/
+
+func TestStunnerRelayPortRangeLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	minPort, maxPort := 29000, 29001
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel: stunnerTestLoglevel,
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:         "udp",
+			Protocol:     "turn-udp",
+			Addr:         "127.0.0.1",
+			Port:         23478,
+			MinRelayPort: minPort,
+			MaxRelayPort: maxPort,
+			Routes:       []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	relayPortStatus := func() (int, int) {
+		status := stunner.Status().(*stnrv1.StunnerStatus)
+		assert.Len(t, status.Listeners, 1, "listener status")
+		return status.ListenerUsage[0].RelayPortsInUse, status.ListenerUsage[0].RelayPortsTotal
+	}
+
+	clients := []*testTURNClient{}
+	newClient := func() *testTURNClient {
+		client := newTestTURNClient(t, "udp", "user1", "passwd1", loggerFactory)
+		clients = append(clients, client)
+		return client
+	}
+
+	log.Debug("allocating the entire relay port range")
+	relays := []net.PacketConn{}
+	for i := 0; i <= maxPort-minPort; i++ {
+		client := newClient()
+
+		relay, err := client.Allocate()
+		assert.NoError(t, err, "allocation")
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		assert.True(t, port >= minPort && port <= maxPort, "relay port in range")
+		relays = append(relays, relay)
+	}
+
+	inUse, total := relayPortStatus()
+	assert.Equal(t, 2, inUse, "relay ports in use")
+	assert.Equal(t, 2, total, "relay ports total")
+
+	log.Debug("port range exhausted")
+	_, err := newClient().Allocate()
+	assert.Error(t, err, "allocation fails")
+	assert.Contains(t, err.Error(), "508", "insufficient capacity")
+
+	log.Debug("freeing a relay port")
+	port := relays[0].LocalAddr().(*net.UDPAddr).Port
+	assert.NoError(t, relays[0].Close(), "close relay")
+	time.Sleep(100 * time.Millisecond)
+	inUse, _ = relayPortStatus()
+	assert.Equal(t, 1, inUse, "relay ports in use")
+
+	relay, err := newClient().Allocate()
+	assert.NoError(t, err, "allocation")
+	assert.Equal(t, port, relay.LocalAddr().(*net.UDPAddr).Port, "relay port reused")
+	relays[0] = relay
+
+	for _, r := range relays {
+		assert.NoError(t, r.Close(), "close relay")
+	}
+	time.Sleep(100 * time.Millisecond)
+	inUse, _ = relayPortStatus()
+	assert.Equal(t, 0, inUse, "relay ports in use")
+
+	for _, client := range clients {
+		client.Close()
+	}
+}
+
+func TestStunnerAllocationQuotaLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel: stunnerTestLoglevel,
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+			UserQuota: 2,
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	clients := []*testTURNClient{}
+	allocate := func() (net.PacketConn, error) {
+		client := newTestTURNClient(t, "udp", "user1", "passwd1", loggerFactory)
+		clients = append(clients, client)
+		return client.Allocate()
+	}
+
+	log.Debug("user quota")
+	relays := []net.PacketConn{}
+	for i := 0; i < 2; i++ {
+		relay, err := allocate()
+		assert.NoError(t, err, "allocation")
+		relays = append(relays, relay)
+	}
+
+	_, err := allocate()
+	assert.Error(t, err, "allocation fails")
+	assert.Contains(t, err.Error(), "486", "allocation quota reached")
+
+	status := stunner.Status().(*stnrv1.StunnerStatus)
+	assert.Len(t, status.Listeners, 1, "listener status")
+	assert.Equal(t, 2, status.ListenerUsage[0].Allocations, "listener allocations")
+	assert.NotNil(t, status.Quota, "quota status")
+	assert.Equal(t, map[string]int{"user1": 2}, status.Quota.Users, "user allocations")
+	assert.Equal(t, map[string]int{"127.0.0.1": 2}, status.Quota.Clients, "client allocations")
+
+	log.Debug("deleting an allocation frees quota")
+	assert.NoError(t, relays[0].Close(), "close relay")
+	time.Sleep(100 * time.Millisecond)
+	status = stunner.Status().(*stnrv1.StunnerStatus)
+	assert.Equal(t, 1, status.ListenerUsage[0].Allocations, "listener allocations")
+
+	relay, err := allocate()
+	assert.NoError(t, err, "allocation")
+	relays[0] = relay
+
+	log.Debug("listener quota")
+	quotaUsage := func() float64 {
+		return testutil.ToFloat64(telemetry.ListenerQuotaUsage.WithLabelValues("udp"))
+	}
+	assert.Equal(t, 0.0, quotaUsage(), "no listener quota")
+	c.Auth.UserQuota = 0
+	c.Listeners[0].Quota = 3
+	assert.NoError(t, stunner.Reconcile(&c), "reconcile")
+	assert.InDelta(t, 2.0/3, quotaUsage(), 0.001, "listener quota usage")
+
+	relay, err = allocate()
+	assert.NoError(t, err, "allocation")
+	relays = append(relays, relay)
+	assert.Equal(t, 1.0, quotaUsage(), "listener quota usage")
+
+	_, err = allocate()
+	assert.Error(t, err, "allocation fails")
+	assert.Contains(t, err.Error(), "486", "allocation quota reached")
+
+	log.Debug("client quota")
+	c.Auth.ClientQuota = 3
+	c.Listeners[0].Quota = 0
+	assert.NoError(t, stunner.Reconcile(&c), "reconcile")
+	assert.Equal(t, 0.0, quotaUsage(), "no listener quota")
+
+	_, err = allocate()
+	assert.Error(t, err, "allocation fails")
+	assert.Contains(t, err.Error(), "486", "allocation quota reached")
+
+	for _, r := range relays {
+		assert.NoError(t, r.Close(), "close relay")
+	}
+	time.Sleep(100 * time.Millisecond)
+	status = stunner.Status().(*stnrv1.StunnerStatus)
+	assert.Equal(t, 0, status.ListenerUsage[0].Allocations, "listener allocations")
+	assert.Nil(t, status.Quota, "quota status")
+
+	for _, client := range clients {
+		client.Close()
+	}
+}
+
+func TestStunnerAllocationQuotaConcurrent(t *testing.T) {
+	table := newAllocationTable(func() (int, int) { return 2, 0 }, nil)
+
+	add := func(port int) bool {
+		added, _ := table.add(&Allocation{
+			Listener:   "udp",
+			Transport:  "udp",
+			Username:   "user1",
+			ClientAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port},
+		}, port, 0)
+		return added
+	}
+
+	// concurrent allocations cannot exceed the quota
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	ports := []int{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			if add(port) {
+				lock.Lock()
+				ports = append(ports, port)
+				lock.Unlock()
+			}
+		}(20000 + i)
+	}
+	wg.Wait()
+	assert.Len(t, ports, 2, "allocations admitted")
+
+	added, quota := table.add(&Allocation{Listener: "udp", Transport: "udp", Username: "user1",
+		ClientAddr: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: ports[0]}}, ports[0], 0)
+	assert.False(t, added, "allocation already registered")
+	assert.Equal(t, "", quota, "registered allocations are not rejected")
+
+	// deleting an allocation releases the quota
+	assert.NotNil(t, table.remove("udp", "udp", ports[0]), "remove")
+	assert.True(t, add(30000), "quota released")
+	assert.False(t, add(30001), "quota reached")
+}
+
+func TestStunnerBandwidthLimitLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel: stunnerTestLoglevel,
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:                     "udp",
+			Protocol:                 "turn-udp",
+			Addr:                     "127.0.0.1",
+			Port:                     23478,
+			AllocationBandwidthLimit: 10000,
+			Routes:                   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err, "cannot create peer socket")
+	defer peer.Close()
+
+	// sendBurst sends 200 1000-byte packets to the peer via a new allocation and returns the
+	// number of packets received by the peer
+	sendBurst := func() int {
+		client := newTestTURNClient(t, "udp", "user1", "passwd1", loggerFactory)
+		defer client.Close()
+
+		relay, err := client.Allocate()
+		assert.NoError(t, err, "allocation")
+		defer relay.Close()
+
+		// create the permission
+		_, err = relay.WriteTo([]byte("hello"), peer.LocalAddr())
+		assert.NoError(t, err, "write to peer")
+		buf := make([]byte, 1500)
+		assert.NoError(t, peer.SetReadDeadline(time.Now().Add(time.Second)), "deadline")
+		_, _, err = peer.ReadFrom(buf)
+		assert.NoError(t, err, "read from peer")
+
+		// read concurrently so that the peer socket buffer does not overflow
+		done := make(chan int)
+		go func() {
+			n := 0
+			for {
+				peer.SetReadDeadline(time.Now().Add(500 * time.Millisecond)) //nolint:errcheck
+				if _, _, err := peer.ReadFrom(buf); err != nil {
+					done <- n
+					return
+				}
+				n++
+			}
+		}()
+
+		data := make([]byte, 1000)
+		for i := 0; i < 200; i++ {
+			_, err = relay.WriteTo(data, peer.LocalAddr())
+			assert.NoError(t, err, "write to peer")
+			time.Sleep(100 * time.Microsecond)
+		}
+
+		return <-done
+	}
+
+	log.Debug("per-allocation bandwidth limit")
+	n := sendBurst()
+	assert.True(t, n > 0, "some packets are relayed")
+	assert.True(t, n < 100, "packets above the bandwidth limit are dropped")
+	assert.True(t, testutil.ToFloat64(telemetry.ListenerShapedPackets.WithLabelValues("udp",
+		telemetry.Outgoing.String())) > 0, "drops counted")
+
+	log.Debug("cluster override")
+	c.Clusters[0].BandwidthLimit = 100000000
+	assert.NoError(t, stunner.Reconcile(&c), "reconcile")
+	n = sendBurst()
+	assert.True(t, n > 150, "cluster limit overrides the allocation limit")
+}
+
+func TestStunnerBandwidthLimitAggregate(t *testing.T) {
+	o, err := object.NewListener(&stnrv1.ListenerConfig{
+		Name:                     "udp",
+		Protocol:                 "turn-udp",
+		Addr:                     "127.0.0.1",
+		BandwidthLimit:           70000,
+		AllocationBandwidthLimit: 200000,
+	}, nil, func() string { return stnrv1.DefaultRealm },
+		logger.NewLoggerFactory(stunnerTestLoglevel))
+	assert.ErrorIs(t, err, object.ErrRestartRequired, "new listener")
+	l := o.(*object.Listener)
+	aggregate := &bandwidthLimiter{}
+	r1 := newRelayLimiter(l, aggregate)
+	r2 := newRelayLimiter(l, aggregate)
+
+	assert.True(t, r1.allow(nil, 60000), "within limits")
+	assert.False(t, r2.allow(nil, 60000), "aggregate limit reached")
+
+	// the per-allocation tokens are given back when the aggregate limit rejects the traffic
+	tokens := r2.alloc.get(l.AllocBandwidthLimit).Tokens()
+	assert.True(t, tokens > 190000, "per-allocation tokens not spent: %f", tokens)
+}
+
+// turnTransaction sends a STUN request on a connection and returns the response.
+func turnTransaction(t *testing.T, conn net.Conn, setters ...stun.Setter) *stun.Message {
+	t.Helper()
+
+	req, err := stun.Build(append([]stun.Setter{stun.TransactionID}, setters...)...)
+	assert.NoError(t, err, "build request")
+	_, err = conn.Write(req.Raw)
+	assert.NoError(t, err, "send request")
+
+	buf := make([]byte, 1600)
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buf)
+	assert.NoError(t, err, "read response")
+
+	res := &stun.Message{Raw: buf[:n]}
+	assert.NoError(t, res.Decode(), "decode response")
+	return res
+}
+
+// testTURNClient is a TURN client connected to the test listener at 127.0.0.1:23478.
+type testTURNClient struct {
+	*turn.Client
+	conn net.PacketConn
+}
+
+// newTestTURNClient creates a TURN client over UDP or, if proto is "tcp", over TCP.
+func newTestTURNClient(t *testing.T, proto, username, password string, loggerFactory logging.LoggerFactory) *testTURNClient {
+	t.Helper()
+
+	var conn net.PacketConn
+	if proto == "tcp" {
+		c, err := net.Dial("tcp", "127.0.0.1:23478")
+		assert.NoError(t, err, "cannot create TCP client socket")
+		conn = turn.NewSTUNConn(c)
+	} else {
+		c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		assert.NoError(t, err, "cannot create UDP client socket")
+		conn = c
+	}
+
+	nw, err := stdnet.NewNet()
+	assert.NoError(t, err, "net")
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: "127.0.0.1:23478",
+		TURNServerAddr: "127.0.0.1:23478",
+		Username:       username,
+		Password:       password,
+		Conn:           conn,
+		Net:            nw,
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err, "cannot create TURN client")
+	assert.NoError(t, client.Listen(), "cannot listen on TURN client")
+
+	return &testTURNClient{Client: client, conn: conn}
+}
+
+// Close closes the client and the client connection.
+func (c *testTURNClient) Close() {
+	c.Client.Close()
+	c.conn.Close() //nolint:errcheck
+}
+
+// testAllocate creates an allocation at the test listener, the returned function closes the
+// allocation and the client.
+func testAllocate(t *testing.T, proto, username, password string, loggerFactory logging.LoggerFactory) (func(), error) {
+	t.Helper()
+
+	client := newTestTURNClient(t, proto, username, password, loggerFactory)
+	relay, err := client.Allocate()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return func() {
+		relay.Close() //nolint:errcheck
+		client.Close()
+	}, nil
+}
+
+func TestStunnerDrainLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:     stunnerTestLoglevel,
+			DrainTimeout: 3,
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	transport := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}
+	errorCode := func(m *stun.Message) stun.ErrorCode {
+		var code stun.ErrorCodeAttribute
+		assert.NoError(t, code.GetFrom(m), "error code")
+		return code.Code
+	}
+
+	log.Debug("creating an allocation")
+	conn, err := net.Dial("udp", "127.0.0.1:23478")
+	assert.NoError(t, err, "cannot create UDP client socket")
+	defer conn.Close()
+
+	res := turnTransaction(t, conn, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		transport, stun.Fingerprint)
+	assert.Equal(t, stun.CodeUnauthorized, errorCode(res), "unauthorized")
+	var nonce stun.Nonce
+	assert.NoError(t, nonce.GetFrom(res), "nonce")
+	var realm stun.Realm
+	assert.NoError(t, realm.GetFrom(res), "realm")
+	auth := []stun.Setter{stun.NewUsername("user1"), realm, nonce,
+		stun.NewLongTermIntegrity("user1", realm.String(), "passwd1"), stun.Fingerprint}
+
+	res = turnTransaction(t, conn, append([]stun.Setter{
+		stun.NewType(stun.MethodAllocate, stun.ClassRequest), transport}, auth...)...)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class, "allocation")
+	assert.Equal(t, 1, stunner.AllocationCount(), "allocation count")
+	assert.False(t, stunner.IsDrained(), "not draining")
+
+	log.Debug("draining")
+	stunner.Shutdown()
+	drainStart := time.Now()
+	status := stunner.Status().(*stnrv1.StunnerStatus)
+	assert.Equal(t, "TERMINATING", status.Status, "status")
+	assert.NotNil(t, status.Drain, "drain status")
+	assert.Equal(t, 1, status.Drain.InitialAllocations, "initial allocations")
+	assert.Equal(t, 0.0, status.Drain.Progress, "drain progress")
+	assert.False(t, stunner.IsDrained(), "draining")
+
+	log.Debug("new allocations are rejected")
+	conn2, err := net.Dial("udp", "127.0.0.1:23478")
+	assert.NoError(t, err, "cannot create UDP client socket")
+	defer conn2.Close()
+	res = turnTransaction(t, conn2, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		transport, stun.Fingerprint)
+	assert.Equal(t, stun.CodeInsufficientCapacity, errorCode(res), "insufficient capacity")
+
+	log.Debug("refreshes with a wrong password are not re-signed")
+	forged := []stun.Setter{stun.NewUsername("user1"), realm, nonce,
+		stun.NewLongTermIntegrity("user1", realm.String(), "dummy"), stun.Fingerprint}
+	res = turnTransaction(t, conn, append([]stun.Setter{
+		stun.NewType(stun.MethodRefresh, stun.ClassRequest), lifetime(10 * time.Minute)},
+		forged...)...)
+	assert.Equal(t, stun.ClassErrorResponse, res.Type.Class, "forged refresh")
+	assert.Equal(t, stun.CodeBadRequest, errorCode(res), "integrity check failed")
+
+	// the capped lifetime is rounded up to whole seconds: refresh well after the drain has
+	// started so that the allocation outlives the drain timeout
+	log.Debug("refreshes are capped")
+	time.Sleep(time.Until(drainStart.Add(500 * time.Millisecond)))
+	res = turnTransaction(t, conn, append([]stun.Setter{
+		stun.NewType(stun.MethodRefresh, stun.ClassRequest), lifetime(10 * time.Minute)},
+		auth...)...)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class, "refresh")
+	lt, err := getLifetime(res)
+	assert.NoError(t, err, "lifetime")
+	assert.True(t, lt > 0 && lt <= 3*time.Second, "lifetime capped")
+
+	log.Debug("drain timeout expires")
+	time.Sleep(time.Until(drainStart.Add(3*time.Second + 100*time.Millisecond)))
+	assert.Equal(t, 1, stunner.AllocationCount(), "allocation count")
+	assert.True(t, stunner.IsDrained(), "drain timeout expired")
+
+	res = turnTransaction(t, conn, append([]stun.Setter{
+		stun.NewType(stun.MethodRefresh, stun.ClassRequest), lifetime(0)}, auth...)...)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class, "delete allocation")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, stunner.AllocationCount(), "allocation count")
+	status = stunner.Status().(*stnrv1.StunnerStatus)
+	assert.Equal(t, 1.0, status.Drain.Progress, "drain progress")
+}
+
+func TestStunnerCertReloadLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 60)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	newCertPem, newKeyPem, err := GenerateSelfSignedKey()
+	assert.NoError(t, err, "cannot generate SSL cert/key")
+	oldCert, err := tls.X509KeyPair(certPem, keyPem)
+	assert.NoError(t, err, "cannot parse SSL cert/key")
+	newCert, err := tls.X509KeyPair(newCertPem, newKeyPem)
+	assert.NoError(t, err, "cannot parse SSL cert/key")
+
+	stunnerAddr := "127.0.0.1:23478"
+
+	// dial returns a client connection to the listener and the cert served by the listener
+	dial := func(proto string) (net.Conn, []byte) {
+		switch proto {
+		case "turn-tls":
+			conn, err := tls.Dial("tcp", stunnerAddr, &tls.Config{
+				MinVersion:         tls.VersionTLS12,
+				InsecureSkipVerify: true,
+			})
+			assert.NoError(t, err, "cannot create TLS client socket")
+			return conn, conn.ConnectionState().PeerCertificates[0].Raw
+		case "turn-dtls":
+			udpAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23478}
+			conn, err := dtls.Dial("udp", udpAddr, &dtls.Config{
+				InsecureSkipVerify: true,
+			})
+			assert.NoError(t, err, "cannot create DTLS client socket")
+			assert.NoError(t, conn.HandshakeContext(context.Background()), "DTLS handshake")
+			state, ok := conn.ConnectionState()
+			assert.True(t, ok, "DTLS connection state")
+			return conn, state.PeerCertificates[0]
+		}
+		return nil, nil
+	}
+
+	// run the DTLS listener last, it releases its UDP socket asynchronously
+	for _, proto := range []string{"turn-tls", "turn-dtls"} {
+		testName := fmt.Sprintf("TestStunnerCertReload_Localhost_client:%s", proto)
+		t.Run(testName, func(t *testing.T) {
+			log.Debugf("-------------- Running test: %s -------------", testName)
+
+			c := stnrv1.StunnerConfig{
+				ApiVersion: stnrv1.ApiVersion,
+				Admin: stnrv1.AdminConfig{
+					LogLevel: stunnerTestLoglevel,
+				},
+				Auth: stnrv1.AuthConfig{
+					Type: "static",
+					Credentials: map[string]string{
+						"username": "user1",
+						"password": "passwd1",
+					},
+				},
+				Listeners: []stnrv1.ListenerConfig{{
+					Name:     "tls",
+					Protocol: proto,
+					Addr:     "127.0.0.1",
+					Port:     23478,
+					Cert:     certPem64,
+					Key:      keyPem64,
+					Routes:   []string{"allow-any"},
+				}},
+				Clusters: []stnrv1.ClusterConfig{{
+					Name:      "allow-any",
+					Endpoints: []string{"0.0.0.0/0"},
+				}},
+			}
+
+			stunner := NewStunner(Options{
+				LogLevel:         stunnerTestLoglevel,
+				SuppressRollback: true,
+			})
+			defer stunner.Close()
+
+			log.Debug("starting stunnerd")
+			assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+			log.Debug("creating an allocation with the old cert")
+			conn, cert := dial(proto)
+			defer conn.Close()
+			assert.Equal(t, oldCert.Certificate[0], cert, "old cert served")
+
+			stdnet, _ := stdnet.NewNet()
+			client, err := turn.NewClient(&turn.ClientConfig{
+				STUNServerAddr: stunnerAddr,
+				TURNServerAddr: stunnerAddr,
+				Username:       "user1",
+				Password:       "passwd1",
+				Conn:           turn.NewSTUNConn(conn),
+				Net:            stdnet,
+				LoggerFactory:  loggerFactory,
+			})
+			assert.NoError(t, err, "cannot create TURN client")
+			defer client.Close()
+			assert.NoError(t, client.Listen(), "cannot listen on TURN client")
+
+			relay, err := client.Allocate()
+			assert.NoError(t, err, "allocation")
+			defer relay.Close()
+			assert.Equal(t, 1, stunner.AllocationCount(), "allocation count")
+
+			log.Debug("updating the cert")
+			c.Listeners[0].Cert = base64.StdEncoding.EncodeToString(newCertPem)
+			c.Listeners[0].Key = base64.StdEncoding.EncodeToString(newKeyPem)
+			assert.NoError(t, stunner.Reconcile(&c), "cert update does not restart the listener")
+
+			l := stunner.GetListener("tls")
+			assert.NotNil(t, l, "listener found")
+			assert.Equal(t, newCertPem, l.Cert, "listener cert updated")
+
+			log.Debug("new handshakes pick up the new cert")
+			newConn, cert := dial(proto)
+			assert.Equal(t, newCert.Certificate[0], cert, "new cert served")
+			assert.NoError(t, newConn.Close(), "close")
+
+			log.Debug("existing sessions survive")
+			_, err = client.SendBindingRequest()
+			assert.NoError(t, err, "binding request on the old session")
+			assert.Equal(t, 1, stunner.AllocationCount(), "allocation count")
+
+			log.Debug("an invalid cert restarts the listener")
+			c.Listeners[0].Cert = "ZHVtbXkK" // base64: dummy
+			err = stunner.Reconcile(&c)
+			assert.Error(t, err, "invalid cert")
+		})
+	}
+}
+
+func TestStunnerSNILocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 60)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	// all certs are issued for "localhost"
+	defCert, err := tls.X509KeyPair(certPem, keyPem)
+	assert.NoError(t, err, "cannot parse SSL cert/key")
+	certPemA, keyPemA, err := GenerateSelfSignedKey()
+	assert.NoError(t, err, "cannot generate SSL cert/key")
+	certA, err := tls.X509KeyPair(certPemA, keyPemA)
+	assert.NoError(t, err, "cannot parse SSL cert/key")
+	certPemB, keyPemB, err := GenerateSelfSignedKey()
+	assert.NoError(t, err, "cannot generate SSL cert/key")
+	certB, err := tls.X509KeyPair(certPemB, keyPemB)
+	assert.NoError(t, err, "cannot parse SSL cert/key")
+
+	// getCert returns the cert served by the listener for a server name
+	getCert := func(proto, serverName string) []byte {
+		switch proto {
+		case "turn-tls":
+			conn, err := tls.Dial("tcp", "127.0.0.1:23478", &tls.Config{
+				MinVersion:         tls.VersionTLS12,
+				ServerName:         serverName,
+				InsecureSkipVerify: true,
+			})
+			assert.NoError(t, err, "cannot create TLS client socket")
+			defer conn.Close()
+			return conn.ConnectionState().PeerCertificates[0].Raw
+		case "turn-dtls":
+			udpAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23478}
+			conn, err := dtls.Dial("udp", udpAddr, &dtls.Config{
+				ServerName:         serverName,
+				InsecureSkipVerify: true,
+			})
+			assert.NoError(t, err, "cannot create DTLS client socket")
+			defer conn.Close()
+			assert.NoError(t, conn.HandshakeContext(context.Background()), "DTLS handshake")
+			state, ok := conn.ConnectionState()
+			assert.True(t, ok, "DTLS connection state")
+			return state.PeerCertificates[0]
+		}
+		return nil
+	}
+
+	// run the DTLS listener last, it releases its UDP socket asynchronously
+	for _, proto := range []string{"turn-tls", "turn-dtls"} {
+		testName := fmt.Sprintf("TestStunnerSNI_Localhost_client:%s", proto)
+		t.Run(testName, func(t *testing.T) {
+			log.Debugf("-------------- Running test: %s -------------", testName)
+
+			c := stnrv1.StunnerConfig{
+				ApiVersion: stnrv1.ApiVersion,
+				Admin: stnrv1.AdminConfig{
+					LogLevel: stunnerTestLoglevel,
+				},
+				Auth: stnrv1.AuthConfig{
+					Type: "static",
+					Credentials: map[string]string{
+						"username": "user1",
+						"password": "passwd1",
+					},
+				},
+				Listeners: []stnrv1.ListenerConfig{{
+					Name:     "tls",
+					Protocol: proto,
+					Addr:     "127.0.0.1",
+					Port:     23478,
+					Cert:     certPem64,
+					Key:      keyPem64,
+					Certificates: []stnrv1.CertificateConfig{{
+						Hostnames: []string{"a.example.com"},
+						Cert:      base64.StdEncoding.EncodeToString(certPemA),
+						Key:       base64.StdEncoding.EncodeToString(keyPemA),
+					}, {
+						Hostnames: []string{"*.b.example.com"},
+						Cert:      base64.StdEncoding.EncodeToString(certPemB),
+						Key:       base64.StdEncoding.EncodeToString(keyPemB),
+					}},
+					Routes: []string{"allow-any"},
+				}},
+				Clusters: []stnrv1.ClusterConfig{{
+					Name:      "allow-any",
+					Endpoints: []string{"0.0.0.0/0"},
+				}},
+			}
+
+			stunner := NewStunner(Options{
+				LogLevel:         stunnerTestLoglevel,
+				SuppressRollback: true,
+			})
+			defer stunner.Close()
+
+			log.Debug("starting stunnerd")
+			assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+			// the cert selection rules are tested in internal/object
+			assert.Equal(t, certA.Certificate[0], getCert(proto, "a.example.com"), "exact match")
+			assert.Equal(t, certB.Certificate[0], getCert(proto, "x.b.example.com"), "wildcard match")
+			assert.Equal(t, defCert.Certificate[0], getCert(proto, "c.example.com"), "default cert")
+
+			log.Debug("the first cert is the default if there is no default cert")
+			c.Listeners[0].Cert, c.Listeners[0].Key = "", ""
+			assert.NoError(t, stunner.Reconcile(&c), "cert update does not restart the listener")
+			assert.Equal(t, certA.Certificate[0], getCert(proto, "c.example.com"), "default cert")
+		})
+	}
+}
+
+// generateTestCert generates an ECDSA cert with the given subject common name, signed by the
+// given CA or self-signed if the CA is nil.
+func generateTestCert(t *testing.T, cn string, isCA bool, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err, "generate key")
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	parent, signer := template, any(key)
+	if ca != nil {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	assert.NoError(t, err, "create cert")
+	leaf, err := x509.ParseCertificate(der)
+	assert.NoError(t, err, "parse cert")
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestStunnerClientCertLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 60)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	ca := generateTestCert(t, "test-ca", true, nil)
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+	otherCA := generateTestCert(t, "other-ca", true, nil)
+
+	userCert := generateTestCert(t, "user1", false, &ca)
+	deviceCert := generateTestCert(t, "device-1", false, &ca)
+	invalidCert := generateTestCert(t, "user1", false, &otherCA)
+
+	stunnerAddr := "127.0.0.1:23478"
+
+	// dial returns a connection to the listener presenting the given client cert
+	dial := func(proto string, cert *tls.Certificate) (net.Conn, error) {
+		certs := []tls.Certificate{}
+		if cert != nil {
+			certs = append(certs, *cert)
+		}
+		switch proto {
+		case "turn-tls":
+			conn, err := tls.Dial("tcp", stunnerAddr, &tls.Config{
+				MinVersion:         tls.VersionTLS12,
+				Certificates:       certs,
+				InsecureSkipVerify: true,
+			})
+			if err != nil {
+				return nil, err
+			}
+			// with TLS 1.3 the client learns that the server rejected the client cert on
+			// the first read
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)) //nolint:errcheck
+			if _, err := conn.Read(make([]byte, 1)); err != nil {
+				if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+					conn.Close()
+					return nil, err
+				}
+			}
+			conn.SetReadDeadline(time.Time{}) //nolint:errcheck
+			return conn, nil
+		case "turn-dtls":
+			udpAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 23478}
+			conn, err := dtls.Dial("udp", udpAddr, &dtls.Config{
+				Certificates:       certs,
+				InsecureSkipVerify: true,
+			})
+			if err != nil {
+				return nil, err
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := conn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+		return nil, fmt.Errorf("unknown protocol %q", proto)
+	}
+
+	// allocate tries to create an allocation over a connection
+	allocate := func(conn net.Conn, user, passwd string) error {
+		stdnet, _ := stdnet.NewNet()
+		client, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: stunnerAddr,
+			TURNServerAddr: stunnerAddr,
+			Username:       user,
+			Password:       passwd,
+			Conn:           turn.NewSTUNConn(conn),
+			Net:            stdnet,
+			LoggerFactory:  loggerFactory,
+		})
+		assert.NoError(t, err, "cannot create TURN client")
+		defer client.Close()
+		assert.NoError(t, client.Listen(), "cannot listen on TURN client")
+
+		relay, err := client.Allocate()
+		if err != nil {
+			return err
+		}
+		return relay.Close()
+	}
+
+	rejected := func(reason string) float64 {
+		return testutil.ToFloat64(telemetry.ListenerClientCertRejected.WithLabelValues("tls", reason))
+	}
+
+	// run the DTLS listener last, it releases its UDP socket asynchronously
+	for _, proto := range []string{"turn-tls", "turn-dtls"} {
+		testName := fmt.Sprintf("TestStunnerClientCert_Localhost_client:%s", proto)
+		t.Run(testName, func(t *testing.T) {
+			log.Debugf("-------------- Running test: %s -------------", testName)
+
+			c := stnrv1.StunnerConfig{
+				ApiVersion: stnrv1.ApiVersion,
+				Admin: stnrv1.AdminConfig{
+					LogLevel: stunnerTestLoglevel,
+				},
+				Auth: stnrv1.AuthConfig{
+					Type: "static",
+					Credentials: map[string]string{
+						"username": "user1",
+						"password": "passwd1",
+					},
+				},
+				Listeners: []stnrv1.ListenerConfig{{
+					Name:               "tls",
+					Protocol:           proto,
+					Addr:               "127.0.0.1",
+					Port:               23478,
+					Cert:               certPem64,
+					Key:                keyPem64,
+					ClientAuth:         "require",
+					ClientCA:           base64.StdEncoding.EncodeToString(caPem),
+					ClientCertUsername: "verify",
+					Routes:             []string{"allow-any"},
+				}},
+				Clusters: []stnrv1.ClusterConfig{{
+					Name:      "allow-any",
+					Endpoints: []string{"0.0.0.0/0"},
+				}},
+			}
+
+			stunner := NewStunner(Options{
+				LogLevel:         stunnerTestLoglevel,
+				SuppressRollback: true,
+			})
+			defer stunner.Close()
+
+			log.Debug("starting stunnerd")
+			assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+			log.Debug("clients without a client cert are rejected")
+			missing := rejected("missing")
+			_, err := dial(proto, nil)
+			assert.Error(t, err, "no client cert")
+			assert.Equal(t, missing+1, rejected("missing"), "rejection counted")
+
+			log.Debug("clients with an invalid client cert are rejected")
+			invalid := rejected("invalid")
+			_, err = dial(proto, &invalidCert)
+			assert.Error(t, err, "invalid client cert")
+			assert.Equal(t, invalid+1, rejected("invalid"), "rejection counted")
+
+			log.Debug("the username must match the client cert")
+			conn, err := dial(proto, &userCert)
+			assert.NoError(t, err, "valid client cert")
+			assert.NoError(t, allocate(conn, "user1", "passwd1"), "allocate")
+			assert.NoError(t, conn.Close(), "close")
+
+			username := rejected("username")
+			conn, err = dial(proto, &deviceCert)
+			assert.NoError(t, err, "valid client cert")
+			assert.Error(t, allocate(conn, "user1", "passwd1"), "username mismatch")
+			assert.NoError(t, conn.Close(), "close")
+			assert.True(t, rejected("username") > username, "rejection counted")
+
+			log.Debug("the client cert subject is mapped to the username")
+			c.Listeners[0].ClientCertUsername = "map"
+			assert.NoError(t, stunner.Reconcile(&c), "no restart")
+			conn, err = dial(proto, &deviceCert)
+			assert.NoError(t, err, "valid client cert")
+			assert.NoError(t, allocate(conn, "device-1", ""), "allocate")
+			assert.NoError(t, conn.Close(), "close")
+		})
+	}
+}
+
+func TestStunnerClientCertHandshakeTimeout(t *testing.T) {
+	timeout := clientCertHandshakeTimeout
+	clientCertHandshakeTimeout = 100 * time.Millisecond
+	defer func() { clientCertHandshakeTimeout = timeout }()
+
+	server, client := net.Pipe()
+	defer client.Close() //nolint:errcheck
+
+	l := &clientCertListener{
+		listener: &object.Listener{Name: "tls"},
+		table:    newClientCertTable(),
+		log:      logger.NewLoggerFactory(stunnerTestLoglevel).NewLogger("test"),
+	}
+	conn := &clientCertConn{Conn: tls.Server(server, &tls.Config{MinVersion: tls.VersionTLS12}),
+		listener: l}
+	defer conn.Close() //nolint:errcheck
+
+	// the client never sends a ClientHello
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	assert.Error(t, err, "handshake timed out")
+	assert.True(t, time.Since(start) < 5*time.Second, "handshake bounded")
+}
+
+func TestStunnerAllocationListLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	hc := "http://127.0.0.1:8087"
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:            stunnerTestLoglevel,
+			HealthCheckEndpoint: &hc,
+			AdminToken:          "secret-token",
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+	assert.Len(t, stunner.GetAllocations(stnrv1.AllocationFilter{}), 0, "no allocations")
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err, "cannot create peer socket")
+	defer peer.Close()
+
+	lconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err, "cannot create UDP client socket")
+	defer lconn.Close()
+
+	stdnet, _ := stdnet.NewNet()
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: "127.0.0.1:23478",
+		TURNServerAddr: "127.0.0.1:23478",
+		Username:       "user1",
+		Password:       "passwd1",
+		Conn:           lconn,
+		Net:            stdnet,
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err, "cannot create TURN client")
+	defer client.Close()
+	assert.NoError(t, client.Listen(), "cannot listen on TURN client")
+
+	relay, err := client.Allocate()
+	assert.NoError(t, err, "allocation")
+	defer relay.Close()
+
+	routeTx := telemetry.RouteBytesTotal.WithLabelValues("udp", "allow-any", "tx")
+	routeRx := telemetry.RouteBytesTotal.WithLabelValues("udp", "allow-any", "rx")
+	clusterConns := telemetry.ClusterConnsActive.WithLabelValues("allow-any")
+	tx, rx, conns := testutil.ToFloat64(routeTx), testutil.ToFloat64(routeRx),
+		testutil.ToFloat64(clusterConns)
+
+	log.Debug("relaying traffic")
+	buf := make([]byte, 1500)
+	for i := 0; i < 3; i++ {
+		// the client binds a channel after the first packet
+		_, err = relay.WriteTo([]byte("hello"), peer.LocalAddr())
+		assert.NoError(t, err, "write to peer")
+		assert.NoError(t, peer.SetReadDeadline(time.Now().Add(time.Second)), "deadline")
+		_, addr, err := peer.ReadFrom(buf)
+		assert.NoError(t, err, "read from peer")
+		_, err = peer.WriteTo([]byte("world!"), addr)
+		assert.NoError(t, err, "write to client")
+		assert.NoError(t, relay.SetReadDeadline(time.Now().Add(time.Second)), "deadline")
+		_, _, err = relay.ReadFrom(buf)
+		assert.NoError(t, err, "read from relay")
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	allocs := stunner.GetAllocations(stnrv1.AllocationFilter{})
+	assert.Len(t, allocs, 1, "allocation listed")
+	a := allocs[0]
+	assert.Equal(t, "udp", a.Listener, "listener")
+	assert.Equal(t, "UDP", a.Protocol, "protocol")
+	assert.Equal(t, lconn.LocalAddr().String(), a.ClientAddr, "client address")
+	assert.Equal(t, "127.0.0.1:23478", a.ServerAddr, "server address")
+	assert.Equal(t, "udp", a.RelayProtocol, "relay protocol")
+	assert.Equal(t, relay.LocalAddr().String(), a.RelayAddr, "relay address")
+	assert.Equal(t, "user1", a.Username, "username")
+	assert.Equal(t, []string{"127.0.0.1"}, a.Permissions, "permissions")
+	assert.Len(t, a.Channels, 1, "channels")
+	if len(a.Channels) == 1 {
+		assert.Equal(t, peer.LocalAddr().String(), a.Channels[0].Peer, "channel peer")
+		assert.True(t, a.Channels[0].Number >= 0x4000, "channel number")
+	}
+	assert.Equal(t, uint64(3), a.TxPackets, "tx packets")
+	assert.Equal(t, uint64(15), a.TxBytes, "tx bytes")
+	assert.Equal(t, uint64(3), a.RxPackets, "rx packets")
+	assert.Equal(t, uint64(18), a.RxBytes, "rx bytes")
+
+	log.Debug("route and cluster metrics")
+	assert.Equal(t, tx+15, testutil.ToFloat64(routeTx), "route tx bytes")
+	assert.Equal(t, rx+18, testutil.ToFloat64(routeRx), "route rx bytes")
+	assert.Equal(t, conns+1, testutil.ToFloat64(clusterConns), "cluster connections")
+
+	log.Debug("filtering")
+	assert.Len(t, stunner.GetAllocations(stnrv1.AllocationFilter{Listener: "udp",
+		Username: "user1", ClientIP: "127.0.0.1"}), 1, "filter match")
+	assert.Len(t, stunner.GetAllocations(stnrv1.AllocationFilter{Listener: "dummy"}), 0,
+		"listener mismatch")
+	assert.Len(t, stunner.GetAllocations(stnrv1.AllocationFilter{Username: "user2"}), 0,
+		"username mismatch")
+	assert.Len(t, stunner.GetAllocations(stnrv1.AllocationFilter{ClientIP: "10.0.0.1"}), 0,
+		"client IP mismatch")
+
+	log.Debug("querying the allocations endpoint")
+	get := func(token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, hc+"/allocations?username=user1", nil)
+		assert.NoError(t, err, "request")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "GET /allocations")
+		return res
+	}
+
+	res := get("")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "no token")
+	res.Body.Close()
+	res = get("dummy")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "invalid token")
+	res.Body.Close()
+
+	res = get("secret-token")
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode, "status code")
+	list := []stnrv1.AllocationStatus{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&list), "decode allocation list")
+	assert.Len(t, list, 1, "allocation listed")
+	if len(list) == 1 {
+		assert.Equal(t, a.RelayAddr, list[0].RelayAddr, "relay address")
+	}
+
+	log.Debug("the debug server token is not accepted without an admin token")
+	c.Admin.AdminToken = ""
+	c.Admin.Debug = &stnrv1.DebugConfig{Endpoint: "http://127.0.0.1:8089", Token: "secret-token"}
+	assert.NoError(t, stunner.Reconcile(&c), "reconcile")
+	res = get("secret-token")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "admin endpoints disabled")
+	res.Body.Close()
+
+	relay.Close()
+	assert.Eventually(t, func() bool {
+		return len(stunner.GetAllocations(stnrv1.AllocationFilter{})) == 0
+	}, 5*time.Second, 50*time.Millisecond, "allocation removed")
+	assert.Equal(t, conns, testutil.ToFloat64(clusterConns), "cluster connection closed")
+}
+
+func TestStunnerAllocationTerminateLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	hc := "http://127.0.0.1:8087"
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:            stunnerTestLoglevel,
+			HealthCheckEndpoint: &hc,
+			AdminToken:          "secret-token",
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}, {
+			Name:     "tcp",
+			Protocol: "turn-tcp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	allocate := func(proto string) (func(), error) {
+		return testAllocate(t, proto, "user1", "passwd1", loggerFactory)
+	}
+
+	log.Debug("creating allocations")
+	for _, proto := range []string{"udp", "udp", "tcp"} {
+		close, err := allocate(proto)
+		assert.NoError(t, err, "allocation")
+		defer close()
+	}
+	assert.Len(t, stunner.GetAllocations(stnrv1.AllocationFilter{}), 3, "allocations listed")
+	assert.Equal(t, 3, stunner.AllocationCount(), "allocation count")
+
+	log.Debug("empty filter")
+	_, err := stunner.TerminateAllocations(stnrv1.AllocationFilter{}, 0)
+	assert.ErrorIs(t, err, stnrv1.ErrEmptyFilter, "empty filter rejected")
+
+	log.Debug("terminating the allocations at the UDP listener")
+	allocs, err := stunner.TerminateAllocations(stnrv1.AllocationFilter{Listener: "udp"},
+		time.Second)
+	assert.NoError(t, err, "terminate")
+	assert.Len(t, allocs, 2, "terminated allocations")
+	assert.Eventually(t, func() bool { return stunner.AllocationCount() == 1 },
+		5*time.Second, 50*time.Millisecond, "TURN server allocations removed")
+	allocs = stunner.GetAllocations(stnrv1.AllocationFilter{})
+	assert.Len(t, allocs, 1, "allocation listed")
+	if len(allocs) == 1 {
+		assert.Equal(t, "tcp", allocs[0].Listener, "listener")
+	}
+
+	log.Debug("new allocations are blocked")
+	_, err = allocate("udp")
+	assert.Error(t, err, "blocked")
+	close, err := allocate("tcp")
+	assert.NoError(t, err, "not blocked")
+	defer close()
+
+	log.Debug("the block expires")
+	time.Sleep(1100 * time.Millisecond)
+	close, err = allocate("udp")
+	assert.NoError(t, err, "block expired")
+	defer close()
+	assert.Equal(t, 3, stunner.AllocationCount(), "allocation count")
+
+	log.Debug("terminating allocations via the allocations endpoint")
+	delWithToken := func(query, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodDelete, hc+"/allocations"+query, nil)
+		assert.NoError(t, err, "request")
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "DELETE /allocations")
+		return res
+	}
+	del := func(query string) *http.Response { return delWithToken(query, "secret-token") }
+
+	res := delWithToken("?listener=tcp", "dummy")
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "invalid token")
+	res.Body.Close()
+	assert.Equal(t, 3, stunner.AllocationCount(), "no allocation terminated")
+
+	res = del("")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "empty filter rejected")
+	res.Body.Close()
+
+	res = del("?listener=tcp&block=-1")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "invalid block period")
+	res.Body.Close()
+
+	res = del("?listener=tcp&username=user1")
+	assert.Equal(t, http.StatusOK, res.StatusCode, "status code")
+	list := []stnrv1.AllocationStatus{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&list), "decode allocation list")
+	res.Body.Close()
+	assert.Len(t, list, 2, "terminated allocations")
+	assert.Eventually(t, func() bool { return stunner.AllocationCount() == 1 },
+		5*time.Second, 50*time.Millisecond, "TURN server allocations removed")
+
+	log.Debug("no block set")
+	close, err = allocate("tcp")
+	assert.NoError(t, err, "not blocked")
+	defer close()
+}
+
+// otlpCollector is a stand-in for an OTLP/HTTP collector that records the names of the received
+// metrics and the received spans.
+type otlpCollector struct {
+	metrics map[string]bool
+	spans   []*tracepb.Span
+	lock    sync.Mutex
+}
+
+func (c *otlpCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var res proto.Message
+	switch r.URL.Path {
+	case "/v1/metrics":
+		req := &colmetricpb.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for _, m := range sm.Metrics {
+					c.metrics[m.Name] = true
+				}
+			}
+		}
+		res = &colmetricpb.ExportMetricsServiceResponse{}
+	case "/v1/traces":
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+		res = &coltracepb.ExportTraceServiceResponse{}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	raw, _ := proto.Marshal(res)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(raw) //nolint:errcheck
+}
+
+func (c *otlpCollector) hasMetric(name string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.metrics[name]
+}
+
+// getSpans returns the spans with the given name.
+func (c *otlpCollector) getSpans(name string) []*tracepb.Span {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ret := []*tracepb.Span{}
+	for _, s := range c.spans {
+		if s.Name == name {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func spanAttr(s *tracepb.Span, key string) string {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value.GetStringValue()
+		}
+	}
+	return ""
+}
+
+func TestStunnerOTLPLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	collector := &otlpCollector{metrics: map[string]bool{}}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel: stunnerTestLoglevel,
+			OTLP: &stnrv1.OTLPConfig{
+				Endpoint:        "http://" + srv.Listener.Addr().String(),
+				MetricsInterval: 1,
+			},
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+	assert.Equal(t, "http://"+srv.Listener.Addr().String(),
+		stunner.GetAdmin().Status().(*stnrv1.AdminStatus).OTLPEndpoint, "OTLP status")
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err, "cannot create peer socket")
+	defer peer.Close()
+
+	lconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err, "cannot create UDP client socket")
+	defer lconn.Close()
+
+	stdnet, _ := stdnet.NewNet()
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: "127.0.0.1:23478",
+		TURNServerAddr: "127.0.0.1:23478",
+		Username:       "user1",
+		Password:       "passwd1",
+		Conn:           lconn,
+		Net:            stdnet,
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err, "cannot create TURN client")
+	assert.NoError(t, client.Listen(), "cannot listen on TURN client")
+
+	relay, err := client.Allocate()
+	assert.NoError(t, err, "allocation")
+
+	_, err = relay.WriteTo([]byte("hello"), peer.LocalAddr())
+	assert.NoError(t, err, "write to peer")
+	buf := make([]byte, 1500)
+	assert.NoError(t, peer.SetReadDeadline(time.Now().Add(time.Second)), "deadline")
+	_, _, err = peer.ReadFrom(buf)
+	assert.NoError(t, err, "read from peer")
+
+	log.Debug("metrics are pushed")
+	assert.Eventually(t, func() bool {
+		return collector.hasMetric("stunner_listener_allocations")
+	}, 10*time.Second, 100*time.Millisecond, "listener metrics exported")
+	assert.True(t, collector.hasMetric("stunner_cluster_bytes_total"), "cluster metrics exported")
+
+	assert.NoError(t, relay.Close(), "close relay")
+	client.Close()
+	assert.Eventually(t, func() bool { return stunner.AllocationCount() == 0 },
+		5*time.Second, 50*time.Millisecond, "allocation deleted")
+
+	log.Debug("closing stunnerd flushes the traces")
+	stunner.Close()
+
+	assert.True(t, len(collector.getSpans("auth")) > 0, "auth spans")
+	for _, s := range collector.getSpans("auth") {
+		assert.Equal(t, "udp", spanAttr(s, "stunner.listener"), "auth listener")
+		assert.Equal(t, "user1", spanAttr(s, "stunner.username"), "auth username")
+	}
+
+	allocs := collector.getSpans("allocate")
+	assert.Len(t, allocs, 1, "allocate span")
+	perms := collector.getSpans("permission")
+	assert.True(t, len(perms) > 0, "permission spans")
+	deletes := collector.getSpans("delete")
+	assert.Len(t, deletes, 1, "delete span")
+	if len(allocs) == 1 && len(perms) > 0 && len(deletes) == 1 {
+		assert.Equal(t, relay.LocalAddr().String(), spanAttr(allocs[0], "stunner.relay.address"),
+			"relay address")
+		assert.Equal(t, "allow-any", spanAttr(perms[0], "stunner.cluster"), "cluster")
+		assert.Equal(t, allocs[0].TraceId, perms[0].TraceId, "permission in allocation trace")
+		assert.Equal(t, allocs[0].TraceId, deletes[0].TraceId, "delete in allocation trace")
+	}
+}
+
+func TestStunnerAccessLogLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:  stunnerTestLoglevel,
+			AccessLog: &stnrv1.AccessLogConfig{Path: path},
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+	assert.Equal(t, path, stunner.GetAdmin().Status().(*stnrv1.AdminStatus).AccessLog,
+		"access log status")
+	conf := stunner.GetAdmin().GetConfig().(*stnrv1.AdminConfig)
+	assert.NotNil(t, conf.AccessLog, "access log config")
+	assert.Equal(t, stnrv1.DefaultAccessLogMaxSize, conf.AccessLog.MaxSize, "default max size")
+	assert.Equal(t, stnrv1.DefaultAccessLogMaxBackups, conf.AccessLog.MaxBackups,
+		"default max backups")
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err, "cannot create peer socket")
+	defer peer.Close()
+
+	lconn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	assert.NoError(t, err, "cannot create UDP client socket")
+	defer lconn.Close()
+
+	stdnet, _ := stdnet.NewNet()
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: "127.0.0.1:23478",
+		TURNServerAddr: "127.0.0.1:23478",
+		Username:       "user1",
+		Password:       "passwd1",
+		Conn:           lconn,
+		Net:            stdnet,
+		LoggerFactory:  loggerFactory,
+	})
+	assert.NoError(t, err, "cannot create TURN client")
+	assert.NoError(t, client.Listen(), "cannot listen on TURN client")
+
+	relay, err := client.Allocate()
+	assert.NoError(t, err, "allocation")
+	relayAddr := relay.LocalAddr().String()
+
+	log.Debug("relaying traffic")
+	buf := make([]byte, 1500)
+	_, err = relay.WriteTo([]byte("hello"), peer.LocalAddr())
+	assert.NoError(t, err, "write to peer")
+	assert.NoError(t, peer.SetReadDeadline(time.Now().Add(time.Second)), "deadline")
+	_, addr, err := peer.ReadFrom(buf)
+	assert.NoError(t, err, "read from peer")
+	_, err = peer.WriteTo([]byte("world!"), addr)
+	assert.NoError(t, err, "write to client")
+	assert.NoError(t, relay.SetReadDeadline(time.Now().Add(time.Second)), "deadline")
+	_, _, err = relay.ReadFrom(buf)
+	assert.NoError(t, err, "read from relay")
+
+	assert.NoError(t, relay.Close(), "close relay")
+	client.Close()
+	assert.Eventually(t, func() bool { return stunner.AllocationCount() == 0 },
+		5*time.Second, 50*time.Millisecond, "allocation deleted")
+
+	stunner.Close()
+
+	log.Debug("checking the access log")
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err, "read access log")
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	assert.Len(t, lines, 2, "access log records")
+	if len(lines) != 2 {
+		return
+	}
+
+	recs := make([]map[string]any, 2)
+	for i, l := range lines {
+		assert.NoError(t, json.Unmarshal([]byte(l), &recs[i]), "access log record")
+	}
+
+	for i, event := range []string{"create", "delete"} {
+		r := recs[i]
+		assert.Equal(t, event, r["event"], "event")
+		assert.Equal(t, "udp", r["listener"], "listener")
+		assert.Equal(t, "UDP", r["protocol"], "protocol")
+		assert.Equal(t, lconn.LocalAddr().String(), r["client_address"], "client address")
+		assert.Equal(t, "127.0.0.1:23478", r["server_address"], "server address")
+		assert.Equal(t, "udp", r["relay_protocol"], "relay protocol")
+		assert.Equal(t, relayAddr, r["relay_address"], "relay address")
+		assert.Equal(t, "user1", r["username"], "username")
+		assert.Equal(t, recs[0]["created"], r["created"], "created")
+	}
+
+	r := recs[1]
+	assert.Equal(t, []any{"127.0.0.1"}, r["peers"], "peers")
+	assert.Greater(t, r["duration"], float64(0), "duration")
+	assert.Equal(t, float64(5), r["tx_bytes"], "tx bytes")
+	assert.Equal(t, float64(1), r["tx_packets"], "tx packets")
+	assert.Equal(t, float64(6), r["rx_bytes"], "rx bytes")
+	assert.Equal(t, float64(1), r["rx_packets"], "rx packets")
+
+	log.Debug("checking access log rotation")
+	rotated := filepath.Join(t.TempDir(), "rotated.log")
+	l, err := telemetry.NewAccessLog(telemetry.AccessLogOptions{Path: rotated, MaxSize: 30,
+		MaxBackups: 2}, log)
+	assert.NoError(t, err, "open access log")
+	for i := 0; i < 4; i++ {
+		l.Write(map[string]int{"record": i}) // 13 bytes per record
+	}
+	assert.NoError(t, l.Close(), "close access log")
+	l.Write(map[string]int{"record": 4}) // dropped
+
+	for file, content := range map[string]string{
+		rotated:        "{\"record\":2}\n{\"record\":3}\n",
+		rotated + ".1": "{\"record\":0}\n{\"record\":1}\n",
+	} {
+		raw, err := os.ReadFile(file)
+		assert.NoError(t, err, "read access log")
+		assert.Equal(t, content, string(raw), "access log content")
+	}
+	_, err = os.Stat(rotated + ".2")
+	assert.True(t, os.IsNotExist(err), "no second backup")
+}
+
+func TestStunnerDebugServerLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	hc := ""
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:            stunnerTestLoglevel,
+			HealthCheckEndpoint: &hc,
+			Debug: &stnrv1.DebugConfig{
+				Endpoint:    "http://127.0.0.1:8089",
+				Token:       "secret-token",
+				EnablePprof: true,
+			},
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Credentials: map[string]string{
+				"username": "user1",
+				"password": "passwd1",
+			},
+		},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+	assert.Equal(t, "http://127.0.0.1:8089",
+		stunner.GetAdmin().Status().(*stnrv1.AdminStatus).DebugEndpoint, "debug status")
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	do := func(method, path, token string) (int, *stnrv1.LogLevelStatus) {
+		req, err := http.NewRequest(method, "http://127.0.0.1:8089"+path, nil)
+		assert.NoError(t, err, "request")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := client.Do(req)
+		if !assert.NoError(t, err, "debug server request") {
+			return 0, nil
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		assert.NoError(t, err, "read response")
+		status := &stnrv1.LogLevelStatus{}
+		if res.StatusCode != http.StatusOK || !strings.HasPrefix(path, "/loglevel") {
+			return res.StatusCode, nil
+		}
+		assert.NoError(t, json.Unmarshal(body, status), "unmarshal loglevels")
+		return res.StatusCode, status
+	}
+
+	orig := stunner.logger.GetLevel("stunner")
+
+	log.Debug("requests are authenticated")
+	code, _ := do(http.MethodGet, "/loglevel", "")
+	assert.Equal(t, http.StatusUnauthorized, code, "no token")
+	code, _ = do(http.MethodGet, "/loglevel", "dummy")
+	assert.Equal(t, http.StatusUnauthorized, code, "wrong token")
+	code, _ = do(http.MethodGet, "/debug/pprof/", "")
+	assert.Equal(t, http.StatusUnauthorized, code, "pprof: no token")
+
+	log.Debug("querying loglevels")
+	code, status := do(http.MethodGet, "/loglevel", "secret-token")
+	assert.Equal(t, http.StatusOK, code, "get loglevels")
+	if assert.NotNil(t, status) {
+		assert.Equal(t, strings.ToUpper(orig), status.Levels["stunner"], "stunner loglevel")
+		assert.Zero(t, status.RevertIn, "no revert")
+	}
+
+	log.Debug("invalid loglevels are rejected")
+	code, _ = do(http.MethodPut, "/loglevel?level=stunner:dummy", "secret-token")
+	assert.Equal(t, http.StatusBadRequest, code, "invalid level")
+	code, _ = do(http.MethodPut, "/loglevel?level=stunner:DEBUG&revert=-1", "secret-token")
+	assert.Equal(t, http.StatusBadRequest, code, "invalid revert")
+	code, _ = do(http.MethodDelete, "/loglevel", "secret-token")
+	assert.Equal(t, http.StatusMethodNotAllowed, code, "invalid method")
+	assert.Equal(t, orig, stunner.logger.GetLevel("stunner"), "loglevel unchanged")
+
+	log.Debug("temporary loglevel override")
+	code, status = do(http.MethodPut, "/loglevel?level=stunner:DEBUG&revert=1", "secret-token")
+	assert.Equal(t, http.StatusOK, code, "set loglevel")
+	if assert.NotNil(t, status) {
+		assert.Equal(t, "DEBUG", status.Levels["stunner"], "stunner loglevel")
+		assert.Equal(t, int64(1), status.RevertIn, "revert pending")
+	}
+	assert.Equal(t, "Debug", stunner.logger.GetLevel("stunner"), "loglevel overridden")
+
+	// reconciling an unchanged loglevel keeps the override
+	assert.NoError(t, stunner.Reconcile(&c), "reconcile")
+	assert.Equal(t, "Debug", stunner.logger.GetLevel("stunner"), "override kept")
+
+	assert.Eventually(t, func() bool { return stunner.logger.GetLevel("stunner") == orig },
+		3*time.Second, 50*time.Millisecond, "loglevel reverted")
+	_, status = do(http.MethodGet, "/loglevel", "secret-token")
+	if assert.NotNil(t, status) {
+		assert.Zero(t, status.RevertIn, "no revert")
+	}
+
+	log.Debug("permanent loglevel override is reset by a config change")
+	code, _ = do(http.MethodPost, "/loglevel?level=stunner:TRACE", "secret-token")
+	assert.Equal(t, http.StatusOK, code, "set loglevel")
+	assert.Equal(t, "Trace", stunner.logger.GetLevel("stunner"), "loglevel overridden")
+	assert.NoError(t, stunner.Reconcile(&c), "reconcile")
+	assert.Equal(t, "Trace", stunner.logger.GetLevel("stunner"), "override kept")
+	c.Admin.LogLevel = "all:ERROR,stunner:WARN"
+	assert.NoError(t, stunner.Reconcile(&c), "reconcile")
+	assert.Equal(t, "Warn", stunner.logger.GetLevel("stunner"), "config loglevel")
+
+	log.Debug("pprof")
+	code, _ = do(http.MethodGet, "/debug/pprof/", "secret-token")
+	assert.Equal(t, http.StatusOK, code, "pprof index")
+	code, _ = do(http.MethodGet, "/debug/pprof/goroutine?debug=1", "secret-token")
+	assert.Equal(t, http.StatusOK, code, "pprof goroutine profile")
+
+	log.Debug("a debug server that fails to start is retried")
+	l, err := net.Listen("tcp", "127.0.0.1:8090")
+	assert.NoError(t, err, "occupy debug port")
+	c.Admin.Debug = &stnrv1.DebugConfig{Endpoint: "http://127.0.0.1:8090", Token: "new-token"}
+	assert.NoError(t, stunner.Reconcile(&c), "debug server errors are not fatal")
+	assert.Empty(t, stunner.GetAdmin().Status().(*stnrv1.AdminStatus).DebugEndpoint, "debug status")
+	_, err = client.Get("http://127.0.0.1:8089/loglevel")
+	assert.Error(t, err, "old debug server closed")
+	assert.NoError(t, l.Close(), "release debug port")
+	assert.NoError(t, stunner.Reconcile(&c), "reconcile")
+	assert.Equal(t, "http://127.0.0.1:8090",
+		stunner.GetAdmin().Status().(*stnrv1.AdminStatus).DebugEndpoint, "debug status")
+	res, err := client.Get("http://127.0.0.1:8090/loglevel")
+	if assert.NoError(t, err, "debug server restarted") {
+		res.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "no token")
+	}
+
+	log.Debug("disabling the debug server")
+	c.Admin.Debug = nil
+	assert.NoError(t, stunner.Reconcile(&c), "reconcile")
+	_, err = client.Get("http://127.0.0.1:8090/loglevel")
+	assert.Error(t, err, "debug server closed")
+
+	stunner.Close()
+}
+
+func TestStunnerOAuthLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	assert.NoError(t, err, "key")
+
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin:      stnrv1.AdminConfig{LogLevel: stunnerTestLoglevel},
+		Auth: stnrv1.AuthConfig{
+			Type:  "oauth",
+			Realm: "example.com",
+			OAuth: &stnrv1.OAuthConfig{
+				ServerName: "turn.example.com",
+				Keys: []stnrv1.OAuthKey{{
+					ID:  "key1",
+					Key: base64.StdEncoding.EncodeToString(key),
+				}},
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	log.Debug("status is redacted")
+	status, err := json.Marshal(stunner.Status())
+	assert.NoError(t, err, "status")
+	assert.NotContains(t, string(status), base64.StdEncoding.EncodeToString(key), "key hidden")
+	assert.Contains(t, string(status), `"kid":"key1"`, "key id")
+	assert.Equal(t, c.Auth.OAuth.Keys[0].Key,
+		stunner.GetAuth().GetConfig().(*stnrv1.AuthConfig).OAuth.Keys[0].Key, "config intact")
+
+	log.Debug("token codec")
+	macKey := make([]byte, 20)
+	_, err = rand.Read(macKey)
+	assert.NoError(t, err, "MAC key")
+	now := time.Now()
+	raw, err := a12n.NewAccessToken(key, "turn.example.com", &a12n.AccessToken{
+		MACKey:    macKey,
+		Timestamp: now,
+		Lifetime:  time.Hour,
+	})
+	assert.NoError(t, err, "encode token")
+	token, err := a12n.DecodeAccessToken(key, "turn.example.com", raw)
+	assert.NoError(t, err, "decode token")
+	assert.Equal(t, macKey, token.MACKey, "MAC key")
+	assert.Equal(t, now.Unix(), token.Timestamp.Unix(), "timestamp")
+	assert.True(t, now.Sub(token.Timestamp).Abs() < time.Millisecond, "timestamp precision")
+	assert.Equal(t, time.Hour, token.Lifetime, "lifetime")
+	assert.NoError(t, token.Check(now), "valid")
+	assert.Error(t, token.Check(now.Add(2*time.Hour)), "expired")
+	_, err = a12n.DecodeAccessToken(key, "other.example.com", raw)
+	assert.Error(t, err, "associated data mismatch")
+
+	transport := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}
+	errorCode := func(m *stun.Message) stun.ErrorCode {
+		var code stun.ErrorCodeAttribute
+		assert.NoError(t, code.GetFrom(m), "error code")
+		return code.Code
+	}
+
+	// allocate sends an Allocate request with an access token and returns the response
+	allocate := func(conn net.Conn, kid string, token []byte) *stun.Message {
+		res := turnTransaction(t, conn, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			transport, stun.Fingerprint)
+		assert.Equal(t, stun.CodeUnauthorized, errorCode(res), "unauthorized")
+		serverName, err := res.Get(a12n.AttrThirdPartyAuthorization)
+		assert.NoError(t, err, "third-party authorization")
+		assert.Equal(t, "turn.example.com", string(serverName), "server name")
+		var nonce stun.Nonce
+		assert.NoError(t, nonce.GetFrom(res), "nonce")
+		var realm stun.Realm
+		assert.NoError(t, realm.GetFrom(res), "realm")
+
+		return turnTransaction(t, conn, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+			transport, stun.NewUsername(kid), realm, nonce,
+			stun.RawAttribute{Type: a12n.AttrAccessToken, Value: token},
+			stun.MessageIntegrity(macKey), stun.Fingerprint)
+	}
+
+	log.Debug("creating an allocation with a valid token")
+	conn, err := net.Dial("udp", "127.0.0.1:23478")
+	assert.NoError(t, err, "cannot create UDP client socket")
+	defer conn.Close()
+	res := allocate(conn, "key1", raw)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class, "allocation")
+	assert.NoError(t, stun.MessageIntegrity(macKey).Check(res), "response signed with MAC key")
+	assert.Equal(t, 1, stunner.AllocationCount(), "allocation count")
+
+	log.Debug("invalid tokens are rejected")
+	expired, err := a12n.NewAccessToken(key, "turn.example.com", &a12n.AccessToken{
+		MACKey:    macKey,
+		Timestamp: now.Add(-2 * time.Hour),
+		Lifetime:  time.Hour,
+	})
+	assert.NoError(t, err, "encode token")
+	otherKey := make([]byte, 16)
+	forged, err := a12n.NewAccessToken(otherKey, "turn.example.com", &a12n.AccessToken{
+		MACKey:    macKey,
+		Timestamp: now,
+		Lifetime:  time.Hour,
+	})
+	assert.NoError(t, err, "encode token")
+	for _, tc := range []struct {
+		name, kid string
+		token     []byte
+	}{
+		{"expired token", "key1", expired},
+		{"invalid key", "key1", forged},
+		{"unknown key id", "key2", raw},
+	} {
+		conn2, err := net.Dial("udp", "127.0.0.1:23478")
+		assert.NoError(t, err, "cannot create UDP client socket")
+		res := allocate(conn2, tc.kid, tc.token)
+		assert.Equal(t, stun.ClassErrorResponse, res.Type.Class, tc.name)
+		conn2.Close()
+	}
+	assert.Equal(t, 1, stunner.AllocationCount(), "allocation count")
+
+	log.Debug("deleting the allocation")
+	var nonce stun.Nonce
+	var realm stun.Realm
+	res = turnTransaction(t, conn, stun.NewType(stun.MethodRefresh, stun.ClassRequest),
+		lifetime(0), stun.Fingerprint)
+	assert.Equal(t, stun.CodeUnauthorized, errorCode(res), "unauthorized")
+	assert.NoError(t, nonce.GetFrom(res), "nonce")
+	assert.NoError(t, realm.GetFrom(res), "realm")
+	res = turnTransaction(t, conn, stun.NewType(stun.MethodRefresh, stun.ClassRequest),
+		lifetime(0), stun.NewUsername("key1"), realm, nonce, stun.MessageIntegrity(macKey),
+		stun.Fingerprint)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class, "delete allocation")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, stunner.AllocationCount(), "allocation count")
+}
+
+func TestStunnerSharedSecretRotationLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin:      stnrv1.AdminConfig{LogLevel: stunnerTestLoglevel},
+		Auth: stnrv1.AuthConfig{
+			Type:        "ephemeral",
+			Credentials: map[string]string{"secret": "new-secret"},
+			Secrets: []stnrv1.SharedSecret{
+				{Version: "v1", Secret: "old-secret",
+					Expiry: time.Now().Add(time.Hour).Format(time.RFC3339)},
+				{Version: "v0", Secret: "expired-secret",
+					Expiry: time.Now().Add(-time.Minute).Format(time.RFC3339)},
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	allocate := func(secret string) error {
+		t.Helper()
+		username, password, err := turn.GenerateLongTermCredentials(secret, time.Hour)
+		assert.NoError(t, err, "credentials")
+
+		client := newTestTURNClient(t, "udp", username, password, loggerFactory)
+		defer client.Close()
+
+		relay, err := client.Allocate()
+		if err != nil {
+			return err
+		}
+
+		// refresh and permission requests must also be verified with the same secret
+		assert.NoError(t, client.CreatePermission(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4),
+			Port: 1234}), "create permission")
+
+		return relay.Close()
+	}
+
+	log.Debug("credentials issued with the active and the previous secrets are accepted")
+	assert.NoError(t, allocate("new-secret"), "active secret")
+	assert.NoError(t, allocate("old-secret"), "previous secret")
+	assert.Error(t, allocate("expired-secret"), "expired secret")
+	assert.Error(t, allocate("unknown-secret"), "unknown secret")
+
+	assert.True(t, testutil.ToFloat64(telemetry.AuthSharedSecretRequests.WithLabelValues("default")) > 0,
+		"active secret requests")
+	assert.True(t, testutil.ToFloat64(telemetry.AuthSharedSecretRequests.WithLabelValues("v1")) > 0,
+		"previous secret requests")
+	assert.Equal(t, 1.0, testutil.ToFloat64(telemetry.AuthSharedSecretActive.WithLabelValues("default")),
+		"active secret")
+	assert.Equal(t, 0.0, testutil.ToFloat64(telemetry.AuthSharedSecretActive.WithLabelValues("v1")),
+		"previous secret")
+
+	log.Debug("summary and status are redacted")
+	assert.NotContains(t, c.Summary(), "old-secret", "summary redacted")
+	assert.Contains(t, c.Summary(), "secrets: 2", "summary")
+	s := stunner.GetAuth().Status().String()
+	assert.NotContains(t, s, "old-secret", "status redacted")
+	assert.Contains(t, s, "secrets=[v1,v0]", "status")
+	status, err := json.Marshal(stunner.GetAuth().Status())
+	assert.NoError(t, err, "status")
+	assert.NotContains(t, string(status), "old-secret", "secrets hidden")
+	assert.Contains(t, string(status), `"version":"v1"`, "secret versions")
+
+	log.Debug("removing the previous secret without restarting the listeners")
+	l := stunner.GetListener("udp")
+	c2 := stnrv1.StunnerConfig{}
+	c.DeepCopyInto(&c2)
+	c2.Auth.Secrets = nil
+	assert.NoError(t, stunner.Reconcile(&c2), "reconcile")
+	assert.True(t, l == stunner.GetListener("udp"), "listener not restarted")
+	assert.NoError(t, allocate("new-secret"), "active secret")
+	assert.Error(t, allocate("old-secret"), "removed secret")
+
+	log.Debug("rotating the active secret")
+	c3 := stnrv1.StunnerConfig{}
+	c.DeepCopyInto(&c3)
+	c3.Auth.Credentials = map[string]string{}
+	c3.Auth.Secrets = []stnrv1.SharedSecret{
+		{Version: "v2", Secret: "newer-secret"},
+		{Version: "v1", Secret: "new-secret",
+			Expiry: time.Now().Add(time.Hour).Format(time.RFC3339)},
+	}
+	assert.NoError(t, stunner.Reconcile(&c3), "reconcile")
+	assert.NoError(t, allocate("newer-secret"), "active secret")
+	assert.NoError(t, allocate("new-secret"), "previous secret")
+	assert.Equal(t, 1.0, testutil.ToFloat64(telemetry.AuthSharedSecretActive.WithLabelValues("v2")),
+		"active secret")
+
+	log.Debug("invalid configs are rejected")
+	c4 := stnrv1.StunnerConfig{}
+	c3.DeepCopyInto(&c4)
+	c4.Auth.Secrets[0].Expiry = time.Now().Add(time.Hour).Format(time.RFC3339)
+	assert.Error(t, c4.Validate(), "active secret expires")
+	c3.DeepCopyInto(&c4)
+	c4.Auth.Secrets[1].Version = "v2"
+	assert.Error(t, c4.Validate(), "duplicate version")
+	c3.DeepCopyInto(&c4)
+	c4.Auth.Secrets[1].Expiry = "tomorrow"
+	assert.Error(t, c4.Validate(), "invalid expiry")
+	c3.DeepCopyInto(&c4)
+	c4.Auth.Secrets[1].Algorithm = "HMAC-MD5"
+	assert.Error(t, c4.Validate(), "invalid secret algorithm")
+	c3.DeepCopyInto(&c4)
+	c4.Auth.CredentialAlgorithm = "SHA256"
+	assert.Error(t, c4.Validate(), "invalid credential algorithm")
+}
+
+func TestStunnerTenantsLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin:      stnrv1.AdminConfig{LogLevel: stunnerTestLoglevel},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Users: []stnrv1.StaticUser{
+				{Username: "user-any", Password: "passwd"},
+				{Username: "user-a", Password: "passwd", Tenant: "tenant-a"},
+				{Username: "user-none", Password: "passwd", Tenant: "tenant-none"},
+			},
+			Tenants: map[string][]string{
+				"tenant-a":    {"cluster-b"},
+				"tenant-none": {},
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"cluster-a", "cluster-b"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "cluster-a",
+			Endpoints: []string{"10.0.0.2", "10.0.0.3"},
+		}, {
+			Name:      "cluster-b",
+			Endpoints: []string{"10.0.0.0/8"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	permit := func(username, password string, peer net.IP) error {
+		t.Helper()
+		client := newTestTURNClient(t, "udp", username, password, loggerFactory)
+		defer client.Close()
+
+		relay, err := client.Allocate()
+		assert.NoError(t, err, "allocate")
+		defer relay.Close() //nolint:errcheck
+
+		return client.CreatePermission(&net.UDPAddr{IP: peer, Port: 1234})
+	}
+
+	log.Debug("users without a tenant may reach all clusters")
+	assert.NoError(t, permit("user-any", "passwd", net.ParseIP("10.0.0.1")), "cluster-b")
+	assert.NoError(t, permit("user-any", "passwd", net.ParseIP("10.0.0.2")), "cluster-a")
+
+	log.Debug("users of a tenant may reach only the clusters of the tenant")
+	assert.NoError(t, permit("user-a", "passwd", net.ParseIP("10.0.0.1")), "cluster-b")
+	// the peer is routed by both clusters: cluster-a comes first but only cluster-b is allowed
+	assert.NoError(t, permit("user-a", "passwd", net.ParseIP("10.0.0.2")), "cluster-b")
+	assert.Error(t, permit("user-none", "passwd", net.ParseIP("10.0.0.1")), "no clusters")
+
+	log.Debug("permissions are denied to unknown allocations")
+	handler := stunner.NewPermissionHandler(stunner.GetListener("udp"))
+	assert.False(t, handler(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234},
+		net.ParseIP("10.0.0.1")), "unknown allocation")
+
+	log.Debug("the relay enforces the tenant of the user")
+	relay := NewRelayGen(stunner.GetListener("udp"), stunner.logger)
+	checker := func(addr net.Addr, username string) (*object.Cluster, bool) {
+		return stunner.genPortRangeChecker(relay, username)(addr)
+	}
+	peer := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1234}
+	cluster, ok := checker(peer, "user-any")
+	assert.True(t, ok, "user without tenant")
+	assert.Equal(t, "cluster-a", cluster.Name, "first matching cluster")
+	cluster, ok = checker(peer, "user-a")
+	assert.True(t, ok, "tenant")
+	assert.Equal(t, "cluster-b", cluster.Name, "tenant cluster")
+	_, ok = checker(peer, "user-none")
+	assert.False(t, ok, "tenant without clusters")
+
+	log.Debug("the tenant is bound to the relay when the allocation is registered")
+	relay.PortRangeChecker = stunner.GenPortRangeChecker(relay)
+	relay.userChecker = func(username string) PortRangeChecker {
+		return stunner.genPortRangeChecker(relay, username)
+	}
+	conn, relayAddr, err := relay.AllocatePacketConn("udp4", 0)
+	assert.NoError(t, err, "relay")
+	relay.bindRelay(relayAddr.(*net.UDPAddr).Port, "user-none")
+	_, err = conn.WriteTo([]byte("hello"), peer)
+	assert.ErrorIs(t, err, ErrPortProhibited, "tenant without clusters")
+	assert.NoError(t, conn.Close(), "close relay")
+
+	log.Debug("ephemeral credentials specify the tenant in the username")
+	c2 := stnrv1.StunnerConfig{}
+	c.DeepCopyInto(&c2)
+	c2.Auth = stnrv1.AuthConfig{
+		Type:        "ephemeral",
+		Credentials: map[string]string{"secret": "my-secret"},
+		Tenants:     map[string][]string{"tenant-b": {"cluster-a"}},
+	}
+	assert.NoError(t, stunner.Reconcile(&c2), "reconcile")
+
+	ts := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	ephemeral := func(username string) (string, string) {
+		password, err := a12n.GetLongTermCredential(username, "my-secret")
+		assert.NoError(t, err, "credential")
+		return username, password
+	}
+	u, p := ephemeral(ts + ":user1:" + a12n.TenantPrefix + "tenant-b")
+	assert.NoError(t, permit(u, p, net.ParseIP("10.0.0.2")), "cluster-a")
+	assert.Error(t, permit(u, p, net.ParseIP("10.0.0.1")), "cluster-b")
+	u, p = ephemeral(ts + ":user1:" + a12n.TenantPrefix + "unknown")
+	assert.Error(t, permit(u, p, net.ParseIP("10.0.0.2")), "unknown tenant")
+	u, p = ephemeral(ts + ":user1")
+	assert.NoError(t, permit(u, p, net.ParseIP("10.0.0.1")), "no tenant")
+
+	_, ok = checker(peer, ts+":user1:"+a12n.TenantPrefix+"tenant-b")
+	assert.True(t, ok, "tenant")
+	_, ok = checker(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234},
+		ts+":user1:"+a12n.TenantPrefix+"tenant-b")
+	assert.False(t, ok, "cluster not allowed")
+
+	log.Debug("invalid configs are rejected")
+	c3 := stnrv1.StunnerConfig{}
+	c.DeepCopyInto(&c3)
+	c3.Auth.Users[1].Tenant = "unknown"
+	assert.Error(t, c3.Validate(), "unknown tenant")
+	c.DeepCopyInto(&c3)
+	c3.Auth.Tenants["a:b"] = []string{"cluster-b"}
+	assert.Error(t, c3.Validate(), "invalid tenant name")
+}
+
+func TestStunnerRevocationLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	hc := "http://127.0.0.1:8087"
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:            stunnerTestLoglevel,
+			HealthCheckEndpoint: &hc,
+			AdminToken:          "secret-token",
+		},
+		Auth: stnrv1.AuthConfig{
+			Type:        "ephemeral",
+			Credentials: map[string]string{"secret": "my-secret"},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	// allocate creates an allocation with an ephemeral credential, the returned function closes
+	// the client
+	allocate := func(username string) (func(), error) {
+		password, err := a12n.GetLongTermCredential(username, "my-secret")
+		assert.NoError(t, err, "credential")
+		return testAllocate(t, "udp", username, password, loggerFactory)
+	}
+
+	ts := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	user1, user2 := ts+":user1", ts+":user2"
+
+	log.Debug("creating allocations")
+	for _, u := range []string{user1, user2, user2} {
+		close, err := allocate(u)
+		assert.NoError(t, err, "allocation")
+		defer close()
+	}
+	assert.Equal(t, 3, stunner.AllocationCount(), "allocation count")
+
+	log.Debug("revoking a username")
+	status, err := stunner.RevokeCredentials(&stnrv1.RevocationConfig{Usernames: []string{user1}},
+		false)
+	assert.NoError(t, err, "revoke")
+	assert.Equal(t, []string{user1}, status.Revocations.Usernames, "revoked usernames")
+	assert.Empty(t, status.Terminated, "no allocations terminated")
+	assert.Equal(t, 3, stunner.AllocationCount(), "allocation count")
+	_, err = allocate(user1)
+	assert.Error(t, err, "revoked username rejected")
+	close, err := allocate(ts + ":user3")
+	assert.NoError(t, err, "other usernames accepted")
+	defer close()
+
+	log.Debug("revoking a user-id via the revocation endpoint")
+	token := "secret-token"
+	do := func(method, query string) (*stnrv1.RevocationStatus, int) {
+		req, err := http.NewRequest(method, hc+"/revocations"+query, nil)
+		assert.NoError(t, err, "request")
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "revocation request")
+		defer res.Body.Close()
+		status := stnrv1.RevocationStatus{}
+		if res.StatusCode == http.StatusOK {
+			assert.NoError(t, json.NewDecoder(res.Body).Decode(&status), "decode status")
+		}
+		return &status, res.StatusCode
+	}
+
+	token = "dummy"
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodDelete} {
+		_, code := do(method, "?user_id=user2&terminate=true")
+		assert.Equal(t, http.StatusUnauthorized, code, "invalid token")
+	}
+	assert.Equal(t, 4, stunner.AllocationCount(), "no allocation terminated")
+	token = "secret-token"
+
+	_, code := do(http.MethodPost, "")
+	assert.Equal(t, http.StatusBadRequest, code, "empty revocation rejected")
+	_, code = do(http.MethodPost, "?issued_before=yesterday")
+	assert.Equal(t, http.StatusBadRequest, code, "invalid cutoff rejected")
+	_, code = do(http.MethodPost, "?user_id=user2&terminate=maybe")
+	assert.Equal(t, http.StatusBadRequest, code, "invalid terminate flag rejected")
+
+	status, code = do(http.MethodPost, "?user_id=user2&terminate=true")
+	assert.Equal(t, http.StatusOK, code, "status code")
+	assert.Equal(t, []string{"user2"}, status.Revocations.UserIDs, "revoked user-ids")
+	assert.Len(t, status.Terminated, 2, "terminated allocations")
+	assert.Eventually(t, func() bool { return stunner.AllocationCount() == 2 },
+		5*time.Second, 50*time.Millisecond, "TURN server allocations removed")
+	_, err = allocate(strconv.FormatInt(time.Now().Add(2*time.Hour).Unix(), 10) + ":user2")
+	assert.Error(t, err, "revoked user-id rejected")
+
+	status, code = do(http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, code, "status code")
+	assert.Equal(t, []string{user1}, status.Revocations.Usernames, "revoked usernames")
+	assert.Equal(t, []string{"user2"}, status.Revocations.UserIDs, "revoked user-ids")
+
+	log.Debug("removing a revocation")
+	status, code = do(http.MethodDelete, "?user_id=user2")
+	assert.Equal(t, http.StatusOK, code, "status code")
+	assert.Empty(t, status.Revocations.UserIDs, "revoked user-ids")
+	close, err = allocate(user2)
+	assert.NoError(t, err, "unrevoked user-id accepted")
+	defer close()
+	assert.Equal(t, 3, stunner.AllocationCount(), "allocation count")
+
+	log.Debug("revoking credentials issued before a cutoff in the config")
+	c2 := stnrv1.StunnerConfig{}
+	c.DeepCopyInto(&c2)
+	c2.Auth.Revocations = &stnrv1.RevocationConfig{
+		IssuedBefore:  time.Now().Format(time.RFC3339),
+		CredentialTTL: 7200,
+		Terminate:     true,
+	}
+	assert.NoError(t, stunner.Reconcile(&c2), "reconcile")
+	assert.Eventually(t, func() bool { return stunner.AllocationCount() == 0 },
+		5*time.Second, 50*time.Millisecond, "TURN server allocations removed")
+	_, err = allocate(ts + ":user4")
+	assert.Error(t, err, "credential issued before the cutoff rejected")
+	close, err = allocate(strconv.FormatInt(time.Now().Add(2*time.Hour+time.Minute).Unix(), 10) +
+		":user4")
+	assert.NoError(t, err, "credential issued after the cutoff accepted")
+	defer close()
+
+	log.Debug("runtime revocations survive reconciliation")
+	status, err = stunner.RevokeCredentials(nil, false)
+	assert.NoError(t, err, "list")
+	assert.Equal(t, []string{user1}, status.Revocations.Usernames, "revoked usernames")
+	assert.Equal(t, c2.Auth.Revocations.IssuedBefore, status.Revocations.IssuedBefore, "cutoff")
+
+	log.Debug("clearing the runtime revocations")
+	status, code = do(http.MethodDelete, "")
+	assert.Equal(t, http.StatusOK, code, "status code")
+	assert.Empty(t, status.Revocations.Usernames, "revoked usernames")
+	assert.Equal(t, c2.Auth.Revocations.IssuedBefore, status.Revocations.IssuedBefore,
+		"config cutoff kept")
+
+	log.Debug("revocation requires ephemeral authentication")
+	c3 := stnrv1.StunnerConfig{}
+	c.DeepCopyInto(&c3)
+	c3.Auth = stnrv1.AuthConfig{
+		Type:        "static",
+		Credentials: map[string]string{"username": "user1", "password": "passwd1"},
+	}
+	assert.NoError(t, stunner.Reconcile(&c3), "reconcile")
+	_, code = do(http.MethodPost, "?username=user1")
+	assert.Equal(t, http.StatusBadRequest, code, "revocation rejected")
+
+	c.DeepCopyInto(&c3)
+	c3.Auth.Revocations = &stnrv1.RevocationConfig{UserIDs: []string{""}}
+	assert.Error(t, c3.Validate(), "empty user-id")
+	c3.Auth.Revocations = &stnrv1.RevocationConfig{IssuedBefore: "2024-13-01"}
+	assert.Error(t, c3.Validate(), "invalid cutoff")
+}
+
+func TestStunnerLockoutLocalhost(t *testing.T) {
+	lim := test.TimeOut(time.Second * 30)
+	defer lim.Stop()
+
+	report := test.CheckRoutines(t)
+	defer report()
+
+	loggerFactory := logger.NewLoggerFactory(stunnerTestLoglevel)
+	log := loggerFactory.NewLogger("test")
+
+	hc := "http://127.0.0.1:8087"
+	c := stnrv1.StunnerConfig{
+		ApiVersion: stnrv1.ApiVersion,
+		Admin: stnrv1.AdminConfig{
+			LogLevel:            stunnerTestLoglevel,
+			HealthCheckEndpoint: &hc,
+			AdminToken:          "secret-token",
+		},
+		Auth: stnrv1.AuthConfig{
+			Type: "static",
+			Users: []stnrv1.StaticUser{
+				{Username: "user1", Password: "passwd1"},
+				{Username: "user2", Password: "passwd2"},
+			},
+			Lockout: &stnrv1.LockoutConfig{
+				ClientThreshold: 100,
+				UserThreshold:   2,
+				Duration:        60,
+				MaxDuration:     300,
+			},
+		},
+		Listeners: []stnrv1.ListenerConfig{{
+			Name:     "udp",
+			Protocol: "turn-udp",
+			Addr:     "127.0.0.1",
+			Port:     23478,
+			Routes:   []string{"allow-any"},
+		}},
+		Clusters: []stnrv1.ClusterConfig{{
+			Name:      "allow-any",
+			Endpoints: []string{"0.0.0.0/0"},
+		}},
+	}
+
+	stunner := NewStunner(Options{
+		LogLevel:         stunnerTestLoglevel,
+		SuppressRollback: true,
+	})
+	defer stunner.Close()
+
+	log.Debug("starting stunnerd")
+	assert.NoError(t, stunner.Reconcile(&c), "starting server")
+
+	// allocate creates and closes an allocation
+	allocate := func(username, password string) error {
+		close, err := testAllocate(t, "udp", username, password, loggerFactory)
+		if err != nil {
+			return err
+		}
+		close()
+		return nil
+	}
+
+	failures := func(reason string) float64 {
+		return testutil.ToFloat64(telemetry.AuthFailures.WithLabelValues("udp", reason))
+	}
+	invalidCredential, invalidUsername := failures("invalid_credential"), failures("invalid_username")
+	lockedOut := failures("locked_out")
+
+	token := "secret-token"
+	lockouts := func(method, query string) []*stnrv1.LockoutStatus {
+		req, err := http.NewRequest(method, hc+"/lockouts"+query, nil)
+		assert.NoError(t, err, "request")
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err, "lockout request")
+		defer res.Body.Close()
+		if token != "secret-token" {
+			assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "status code")
+			return nil
+		}
+		assert.Equal(t, http.StatusOK, res.StatusCode, "status code")
+		list := []*stnrv1.LockoutStatus{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&list), "decode lockout list")
+		return list
+	}
+
+	log.Debug("locking out a username")
+	assert.Error(t, allocate("user1", "wrong"), "invalid password")
+	list := lockouts(http.MethodGet, "?username=user1")
+	assert.Len(t, list, 1, "lockout list")
+	if len(list) == 1 {
+		assert.Equal(t, 1, list[0].Failures, "failures")
+		assert.Nil(t, list[0].LockedUntil, "not locked out")
+	}
+	assert.Error(t, allocate("user1", "wrong"), "invalid password")
+	assert.Error(t, allocate("user1", "passwd1"), "locked out")
+	assert.NoError(t, allocate("user2", "passwd2"), "other users are not locked out")
+	assert.Equal(t, invalidCredential+2, failures("invalid_credential"), "failures counted")
+	assert.Equal(t, lockedOut+1, failures("locked_out"), "lockouts counted")
+
+	list = lockouts(http.MethodGet, "?username=user1")
+	assert.Len(t, list, 1, "lockout list")
+	if len(list) == 1 {
+		assert.Equal(t, "user1", list[0].Username, "username")
+		assert.Equal(t, 1, list[0].Lockouts, "lockouts")
+		assert.NotNil(t, list[0].LockedUntil, "locked out")
+	}
+	assert.Len(t, lockouts(http.MethodGet, "?client_ip=127.0.0.1"), 1, "client tracked")
+
+	log.Debug("unlocking requires the admin token")
+	token = "dummy"
+	assert.Nil(t, lockouts(http.MethodGet, "?username=user1"), "unauthorized")
+	assert.Nil(t, lockouts(http.MethodDelete, "?username=user1"), "unauthorized")
+	assert.Len(t, stunner.GetLockouts("", "user1"), 1, "still locked out")
+	token = "secret-token"
+
+	log.Debug("unlocking a username")
+	list = lockouts(http.MethodDelete, "?username=user1")
+	assert.Len(t, list, 1, "unlocked")
+	assert.NoError(t, allocate("user1", "passwd1"), "unlocked")
+	assert.Empty(t, stunner.GetLockouts("", "user1"), "lockout removed")
+
+	log.Debug("error responses to authenticated requests are not failed attempts")
+	conn, err := net.Dial("udp", "127.0.0.1:23478")
+	assert.NoError(t, err, "cannot create UDP client socket")
+	defer conn.Close() //nolint:errcheck
+	transport := stun.RawAttribute{Type: stun.AttrRequestedTransport, Value: []byte{17, 0, 0, 0}}
+	res := turnTransaction(t, conn, stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		transport, stun.Fingerprint)
+	var nonce stun.Nonce
+	assert.NoError(t, nonce.GetFrom(res), "nonce")
+	var realm stun.Realm
+	assert.NoError(t, realm.GetFrom(res), "realm")
+	auth := []stun.Setter{stun.NewUsername("user1"), realm, nonce,
+		stun.NewLongTermIntegrity("user1", realm.String(), "passwd1"), stun.Fingerprint}
+	res = turnTransaction(t, conn, append([]stun.Setter{
+		stun.NewType(stun.MethodAllocate, stun.ClassRequest), transport}, auth...)...)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class, "allocation")
+	for i := 0; i < 3; i++ {
+		// invalid channel number and no peer address
+		res = turnTransaction(t, conn, append([]stun.Setter{
+			stun.NewType(stun.MethodChannelBind, stun.ClassRequest),
+			stun.RawAttribute{Type: stun.AttrChannelNumber, Value: []byte{0, 1, 0, 0}}},
+			auth...)...)
+		assert.Equal(t, stun.ClassErrorResponse, res.Type.Class, "invalid channel bind")
+	}
+	assert.Empty(t, stunner.GetLockouts("", "user1"), "no failed attempts")
+	assert.NoError(t, allocate("user1", "passwd1"), "not locked out")
+
+	log.Debug("the username lockout does not apply to existing allocations")
+	assert.Error(t, allocate("user1", "wrong"), "invalid password")
+	assert.Error(t, allocate("user1", "wrong"), "invalid password")
+	assert.Error(t, allocate("user1", "passwd1"), "locked out")
+	res = turnTransaction(t, conn, append([]stun.Setter{
+		stun.NewType(stun.MethodRefresh, stun.ClassRequest), lifetime(10 * time.Minute)},
+		auth...)...)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class, "refresh")
+	res = turnTransaction(t, conn, append([]stun.Setter{
+		stun.NewType(stun.MethodRefresh, stun.ClassRequest), lifetime(0)}, auth...)...)
+	assert.Equal(t, stun.ClassSuccessResponse, res.Type.Class, "delete allocation")
+	assert.NotEmpty(t, stunner.ResetLockouts("", "user1"), "unlock")
+
+	log.Debug("the username lockout is disabled by default")
+	c2 := stnrv1.StunnerConfig{}
+	c.DeepCopyInto(&c2)
+	c2.Auth.Lockout = &stnrv1.LockoutConfig{}
+	assert.NoError(t, stunner.Reconcile(&c2), "reconcile")
+	assert.Equal(t, 0, stunner.GetAuth().Lockout.UserThreshold, "user threshold")
+	for i := 0; i < 3; i++ {
+		assert.Error(t, allocate("user1", "wrong"), "invalid password")
+	}
+	assert.NoError(t, allocate("user1", "passwd1"), "not locked out")
+	assert.Empty(t, stunner.GetLockouts("", "user1"), "username not tracked")
+
+	log.Debug("locking out a client")
+	c.DeepCopyInto(&c2)
+	c2.Auth.Lockout = &stnrv1.LockoutConfig{ClientThreshold: 3, UserThreshold: 100}
+	assert.NoError(t, stunner.Reconcile(&c2), "reconcile")
+	assert.NotEmpty(t, stunner.ResetLockouts("", ""), "reset")
+	for _, u := range []string{"unknown1", "unknown2", "unknown3"} {
+		assert.Error(t, allocate(u, "passwd"), "invalid username")
+	}
+	assert.Equal(t, invalidUsername+3, failures("invalid_username"), "failures counted")
+	assert.Error(t, allocate("user2", "passwd2"), "client locked out")
+	list = lockouts(http.MethodGet, "?client_ip=127.0.0.1")
+	assert.Len(t, list, 1, "lockout list")
+	if len(list) == 1 {
+		assert.Equal(t, "127.0.0.1", list[0].ClientIP, "client IP")
+		assert.NotNil(t, list[0].LockedUntil, "locked out")
+	}
+
+	log.Debug("allowlisted clients are not locked out")
+	c2.Auth.Lockout.Allowlist = []string{"127.0.0.0/8"}
+	assert.NoError(t, stunner.Reconcile(&c2), "reconcile")
+	assert.NoError(t, allocate("user2", "passwd2"), "allowlisted")
+	assert.Error(t, allocate("user2", "wrong"), "invalid password")
+	list = stunner.GetLockouts("", "user2")
+	assert.Empty(t, list, "failures from allowlisted clients are not tracked")
+
+	log.Debug("lockout can be disabled")
+	c2.Auth.Lockout = nil
+	assert.NoError(t, stunner.Reconcile(&c2), "reconcile")
+	assert.Len(t, stunner.ResetLockouts("", ""), 4, "reset") // the client and 3 usernames
+	for i := 0; i < 4; i++ {
+		assert.Error(t, allocate("user2", "wrong"), "invalid password")
+	}
+	assert.NoError(t, allocate("user2", "passwd2"), "not locked out")
+
+	log.Debug("invalid configs are rejected")
+	for _, l := range []stnrv1.LockoutConfig{
+		{ClientThreshold: -1},
+		{Duration: 60, MaxDuration: 30},
+		{Allowlist: []string{"not-an-ip"}},
+	} {
+		c.DeepCopyInto(&c2)
+		c2.Auth.Lockout = &l
+		assert.Error(t, c2.Validate(), "invalid lockout config")
+	}
+}
+
 // *****************
 // Cluster tests with VNet
 // *****************
@@ -2150,7 +5560,7 @@ var testConfigsV1Alpha1 = []TestConfigV1Alpha1{
 	},
 	{
 		testName:       "longterm endpoint with multiple routes ok",
-		config:         []byte(`{"version":"v1alpha1","admin":{"loglevel":"all:ERROR"},"auth":{"type":"longterm","credentials":{"secret":"my-secret"}},"listeners":[{"name":"udp","protocol":"turn-udp","public_address":"1.2.3.4","public_port":3478,"address":"127.0.0.1","port":3478,"routes":["allow-any"]}],"clusters":[{"name":"allow-any","endpoints":["0.0.0.0/0"]}]}`),
+		config:         []byte(`{"version":"v1alpha1","admin":{"loglevel":"all:ERROR"},"auth":{"type":"longterm","credentials":{"secret":"my-secret"}},"listeners":[{"name":"udp","protocol":"turn-udp","public_address":"1.2.3.4","public_port":3478,"address":"1.2.3.4","port":3478,"routes":["allow-any"]}],"clusters":[{"name":"allow-any","endpoints":["0.0.0.0/0"]}]}`),
 		echoServerAddr: "1.2.3.5:5678",
 		result:         true,
 	},